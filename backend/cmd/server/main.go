@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db"
+	"github.com/securechat/backend/internal/server"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/version"
+)
+
+func main() {
+	cfg := config.Load()
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger.Printf("starting secure-chat backend (commit %s, built %s, %s)", version.Commit, version.BuildTime, version.GoVersion)
+
+	gormDB, err := db.Connect(cfg.DatabaseDSN, cfg.DBLogLevel, cfg.DBAutoMigrate)
+	if err != nil {
+		logger.Fatal("db connect:", err)
+	}
+	if err := gormDB.Use(db.NewSlowQueryLogger(time.Duration(cfg.DBSlowQueryMs) * time.Millisecond)); err != nil {
+		logger.Fatal("db slow query logger:", err)
+	}
+
+	// initialize services
+	otpSvc := services.NewOTPService(gormDB, cfg, services.NewNotifier(cfg))
+	prekeySvc := services.NewPreKeyService(gormDB, cfg)
+	hub := services.NewHub()
+	hub.DuplicatePolicy = cfg.WSDuplicatePolicy
+	matchmaker := services.NewMatchmaker(gormDB, hub)
+	matchmaker.Fairness = cfg.MatchFairness
+	matchmaker.WhileMatched = cfg.MatchWhileMatched
+	matchmaker.RematchCooldown = time.Duration(cfg.MatchRematchCooldownSec) * time.Second
+	matchmaker.MinOverlap = cfg.MatchMinOverlap
+	matchmaker.OverlapFallback = time.Duration(cfg.MatchOverlapFallbackSec) * time.Second
+	matchmaker.FallbackAfter = time.Duration(cfg.MatchFallbackPoolSec) * time.Second
+	matchmaker.WaitTimeout = time.Duration(cfg.MatchWaitTimeoutSec) * time.Second
+	matchmaker.TickInterval = time.Duration(cfg.MatchTickMs) * time.Millisecond
+	matchmaker.AnonIDMaxLifetime = time.Duration(cfg.MatchAnonIDMaxLifetimeSec) * time.Second
+	if cfg.MatchAnalytics {
+		matchmaker.Analytics = services.NewMatchAnalytics(gormDB)
+	}
+
+	srv := server.NewServer(cfg, gormDB, otpSvc, prekeySvc, matchmaker, hub)
+
+	// start matchmaker runner
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	matchmakerDone := make(chan struct{})
+	go func() {
+		matchmaker.Run(ctx)
+		close(matchmakerDone)
+	}()
+	go prekeySvc.RunCleanup(ctx)
+	go otpSvc.RunCleanup(ctx)
+	accountCleanup := services.NewAccountCleanup(gormDB, hub, time.Duration(cfg.IncompleteAccountTTLHours)*time.Hour)
+	accountCleanup.Audit = srv.API.Audit
+	go accountCleanup.Run(ctx)
+	if cfg.HubBus == "postgres" {
+		if err := hub.EnableBus(ctx, services.NewPostgresBus(gormDB, cfg.DatabaseDSN), cfg.InstanceID); err != nil {
+			logger.Fatal("hub bus:", err)
+		}
+		logger.Printf("hub bus enabled (instance %s)", cfg.InstanceID)
+	}
+	presence := services.NewPresenceReconciler(gormDB, hub, time.Duration(cfg.PresenceFlushSec)*time.Second)
+	presenceDone := make(chan struct{})
+	go func() {
+		presence.Run(ctx)
+		close(presenceDone)
+	}()
+
+	// run server
+	go func() {
+		if err := srv.Start(); err != nil {
+			logger.Fatal("server start:", err)
+		}
+	}()
+
+	// graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	drainWait := time.Duration(cfg.ShutdownDrainSec) * time.Second
+wait:
+	for {
+		select {
+		case <-drain:
+			logger.Printf("drain signal received; notified %d queued users", srv.API.Drain())
+		case <-stop:
+			break wait
+		}
+	}
+
+	logger.Println("shutdown signal received")
+	// Drain first so readiness fails and the load balancer moves new traffic
+	// elsewhere while the current connections finish
+	if drainWait > 0 {
+		srv.API.Drain()
+		logger.Printf("draining for %s", drainWait)
+		time.Sleep(drainWait)
+	}
+	// Stop the workers first so queued users are told to re-enqueue, and
+	// presence is flushed, while their sockets are still open
+	stopWorkers()
+	<-matchmakerDone
+	<-presenceDone
+
+	ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctxShutdown); err != nil {
+		logger.Fatal("shutdown error:", err)
+	}
+	logger.Println("server stopped")
+}
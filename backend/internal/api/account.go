@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/utils"
+)
+
+// accountExport is the data-export bundle. It only carries the caller's own
+// non-content data; OTP hashes, registration sessions and anything belonging to
+// other users are deliberately left out.
+type accountExport struct {
+	ExportedAt     time.Time            `json:"exported_at"`
+	UserID         string               `json:"user_id"`
+	Identifier     string               `json:"identifier"`
+	CreatedAt      time.Time            `json:"created_at"`
+	IdentityPubKey Base64Bytes          `json:"identity_pub"`
+	Devices        []exportDevice       `json:"devices"`
+	SignedPreKeys  []exportSignedPreKey `json:"signed_prekeys"`
+	OneTimePreKeys int64                `json:"one_time_prekeys_available"`
+	MatchProfiles  []exportMatchProfile `json:"match_profiles"`
+}
+
+type exportDevice struct {
+	DeviceID     string      `json:"device_id"`
+	DevicePubKey Base64Bytes `json:"device_pubkey"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+type exportSignedPreKey struct {
+	DeviceID  string      `json:"device_id"`
+	KeyID     string      `json:"key_id"`
+	PreKey    Base64Bytes `json:"prekey"`
+	Signature Base64Bytes `json:"signature"`
+	ExpiresAt time.Time   `json:"expires_at"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type exportMatchProfile struct {
+	TagHash   string    `json:"tag_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// POST /api/account/export
+func (a *App) AccountExportHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req AccountExportRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return invalidBody(c, err)
+		}
+	}
+
+	var user models.User
+	if err := a.dbFor(c).Where("id = ?", userID).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	var devices []models.Device
+	if err := a.dbFor(c).Where("user_id = ?", userID).Order("created_at asc").Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	var prekeys []models.PreKey
+	if err := a.dbFor(c).Where("user_id = ?", userID).Order("created_at asc").Find(&prekeys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	var oneTimeCount int64
+	if err := a.dbFor(c).Model(&models.OneTimePreKey{}).Where("user_id = ? AND used = false", userID).Count(&oneTimeCount).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	var profiles []models.MatchProfile
+	if err := a.dbFor(c).Where("user_id = ?", userID).Order("created_at asc").Find(&profiles).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	export := accountExport{
+		ExportedAt:     a.Clock.Now().UTC(),
+		UserID:         user.ID.String(),
+		Identifier:     user.Identifier,
+		CreatedAt:      user.CreatedAt,
+		IdentityPubKey: user.IdentityPubKey,
+		Devices:        make([]exportDevice, len(devices)),
+		SignedPreKeys:  make([]exportSignedPreKey, len(prekeys)),
+		OneTimePreKeys: oneTimeCount,
+		MatchProfiles:  make([]exportMatchProfile, len(profiles)),
+	}
+	for i, d := range devices {
+		export.Devices[i] = exportDevice{
+			DeviceID:     d.DeviceID,
+			DevicePubKey: d.DevicePubKey,
+			CreatedAt:    d.CreatedAt,
+		}
+	}
+	for i, p := range prekeys {
+		export.SignedPreKeys[i] = exportSignedPreKey{
+			DeviceID:  p.DeviceID,
+			KeyID:     p.KeyID,
+			PreKey:    p.PreKey,
+			Signature: p.Signature,
+			ExpiresAt: p.ExpiresAt,
+			CreatedAt: p.CreatedAt,
+		}
+	}
+	for i, p := range profiles {
+		export.MatchProfiles[i] = exportMatchProfile{TagHash: p.TagHash, CreatedAt: p.CreatedAt}
+	}
+
+	if req.PublicKey == "" {
+		return c.JSON(fiber.Map{"encrypted": false, "data": export})
+	}
+
+	pub, err := utils.ParseRSAPublicKey([]byte(req.PublicKey))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid public_key"})
+	}
+	plaintext, err := json.Marshal(export)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to build export"})
+	}
+	env, err := utils.SealForRSAPublicKey(pub, plaintext)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to encrypt export"})
+	}
+
+	return c.JSON(AccountExportResponse{
+		Encrypted:  true,
+		WrappedKey: env.WrappedKey,
+		Nonce:      env.Nonce,
+		Ciphertext: env.Ciphertext,
+	})
+}
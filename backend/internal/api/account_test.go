@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+// exportFixture seeds alice, whose export is taken, and bob, whose data must
+// never appear in it. It returns the strings the export must not contain.
+func exportFixture(t *testing.T, a *App) (alice models.User, forbidden []string) {
+	t.Helper()
+	alice = dbtest.SeedUser(t, a.DB, "alice@example.com")
+	dbtest.SeedKeys(t, a.DB, alice, 2)
+	bob := dbtest.SeedUser(t, a.DB, "bob@example.com")
+	dbtest.SeedKeys(t, a.DB, bob, 2)
+
+	if err := a.DB.Model(&models.Device{}).Where("user_id = ?", alice.ID).
+		Updates(map[string]interface{}{"push_token": "alice-push-token", "push_platform": "fcm"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	a.OTPService.Notifier = &capturingNotifier{}
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), alice.Identifier); err != nil {
+		t.Fatal(err)
+	}
+	var sess models.RegistrationSession
+	a.DB.Where("identifier = ?", alice.Identifier).First(&sess)
+	if err := a.Convos.QueueMessage(alice.ID, bob.ID, nil, []byte("ciphertext-from-bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.StdEncoding.EncodeToString
+	forbidden = []string{
+		bob.ID.String(), bob.Identifier, enc(bob.IdentityPubKey),
+		"alice-push-token", enc(sess.OTPHash), hex.EncodeToString(sess.OTPHash),
+		"ciphertext-from-bob", enc([]byte("ciphertext-from-bob")),
+	}
+	var bobKeys []models.OneTimePreKey
+	a.DB.Where("user_id = ?", bob.ID).Find(&bobKeys)
+	for _, k := range bobKeys {
+		forbidden = append(forbidden, enc(k.PreKey))
+	}
+	var bobDevices []models.Device
+	a.DB.Where("user_id = ?", bob.ID).Find(&bobDevices)
+	for _, d := range bobDevices {
+		forbidden = append(forbidden, enc(d.DevicePubKey), enc(d.SigningPubKey))
+	}
+	return alice, forbidden
+}
+
+// assertExport checks that data is alice's export and leaks nothing forbidden
+func assertExport(t *testing.T, data []byte, alice models.User, forbidden []string) {
+	t.Helper()
+	for _, s := range forbidden {
+		if strings.Contains(string(data), s) {
+			t.Fatalf("export contains %q: %s", s, data)
+		}
+	}
+	var export accountExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.UserID != alice.ID.String() || export.Identifier != alice.Identifier ||
+		len(export.Devices) != 1 || len(export.SignedPreKeys) != 1 || export.OneTimePreKeys != 2 {
+		t.Fatalf("export = %+v", export)
+	}
+}
+
+func TestAccountExportOmitsSecretsAndOtherUsers(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice, forbidden := exportFixture(t, a)
+	export := serve(fiber.MethodPost, "/export", alice.ID, a.AccountExportHandler)
+
+	status, body := do(t, export, fiber.MethodPost, "/export", nil)
+	if status != fiber.StatusOK || body["encrypted"] != false {
+		t.Fatalf("export: %d %v", status, body)
+	}
+	data, _ := json.Marshal(body["data"])
+	assertExport(t, data, alice, forbidden)
+}
+
+func TestAccountExportEncryptsToClientKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice, forbidden := exportFixture(t, a)
+	export := serve(fiber.MethodPost, "/export", alice.ID, a.AccountExportHandler)
+	priv := testServerKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	status, body := do(t, export, fiber.MethodPost, "/export", map[string]string{"public_key": string(pubPEM)})
+	if status != fiber.StatusOK || body["encrypted"] != true || body["data"] != nil {
+		t.Fatalf("export: %d %v", status, body)
+	}
+	field := func(name string) []byte {
+		b, err := base64.StdEncoding.DecodeString(body[name].(string))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return b
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, field("wrapped_key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	data, err := gcm.Open(nil, field("nonce"), field("ciphertext"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertExport(t, data, alice, forbidden)
+
+	if status, _ := do(t, export, fiber.MethodPost, "/export", map[string]string{"public_key": "not a key"}); status != fiber.StatusBadRequest {
+		t.Fatalf("bad public_key: %d", status)
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/db"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// POST /api/admin/users/:id/disconnect
+func (a *App) AdminDisconnectUserHandler(c *fiber.Ctx) error {
+	adminID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	targetID, err := parseUUIDField("id", c.Params("id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+
+	var req AdminDisconnectRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return invalidBody(c, err)
+		}
+	}
+
+	// Revoke first so the kicked client can't reconnect with its current token
+	if req.RevokeSessions {
+		res := a.dbFor(c).Model(&models.User{}).Where("id = ?", targetID).Update("sessions_revoked_at", a.Clock.Now())
+		if res.Error != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+		if res.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+		}
+	}
+
+	closed := a.Hub.Disconnect(targetID, services.CloseKicked)
+	log.Printf("admin %s disconnected user %s (connections=%d, revoked=%t)", adminID, targetID, closed, req.RevokeSessions)
+
+	return c.JSON(fiber.Map{
+		"status":             "ok",
+		"connections_closed": closed,
+		"sessions_revoked":   req.RevokeSessions,
+	})
+}
+
+// POST /api/admin/drain
+// One-way: a draining instance is expected to be restarted.
+func (a *App) AdminDrainHandler(c *fiber.Ctx) error {
+	adminID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	notified := a.Drain()
+	log.Printf("admin %s started drain (queued users notified=%d)", adminID, notified)
+	return c.JSON(AdminDrainResponse{Status: "draining", QueuedNotified: notified})
+}
+
+// Drain stops the instance taking new WebSocket connections and match
+// requests, and tells queued users the service is restarting. Connected
+// sockets and existing pairings carry on until shutdown. It returns how many
+// queued users were notified.
+func (a *App) Drain() int {
+	a.Hub.Drain()
+	return a.Matchmaker.Drain()
+}
+
+// GET /api/admin/metrics
+func (a *App) AdminMetricsHandler(c *fiber.Ctx) error {
+	sqlDB, err := a.DB.DB()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	st := sqlDB.Stats()
+	return c.JSON(MetricsResponse{
+		DB: DBPoolStats{
+			MaxOpen:           st.MaxOpenConnections,
+			Open:              st.OpenConnections,
+			InUse:             st.InUse,
+			Idle:              st.Idle,
+			WaitCount:         st.WaitCount,
+			WaitDurationMs:    st.WaitDuration.Milliseconds(),
+			MaxIdleClosed:     st.MaxIdleClosed,
+			MaxLifetimeClosed: st.MaxLifetimeClosed,
+		},
+		SlowQueries: db.SlowQueries(a.DB),
+	})
+}
+
+// GET /api/admin/matchmaker
+func (a *App) AdminMatchmakerHandler(c *fiber.Ctx) error {
+	st := a.Matchmaker.Stats()
+	return c.JSON(MatchmakerStatsResponse{
+		Waiting:           st.Waiting,
+		ActivePairings:    st.ActivePairings,
+		OldestWaitSeconds: int(st.OldestWait.Seconds()),
+		WaitAges:          st.WaitAges,
+		Buckets:           st.Buckets,
+	})
+}
+
+// keyHealthSoonWindow is how close to expiry a device's newest signed prekey
+// counts as expiring soon
+const keyHealthSoonWindow = 7 * 24 * time.Hour
+
+// GET /api/admin/keys/health
+func (a *App) AdminKeyHealthHandler(c *fiber.Ctx) error {
+	h, err := a.PreKeySvc.WithDB(a.dbFor(c)).Health(keyHealthSoonWindow)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(KeyHealthResponse{
+		UsersWithoutIdentityKey:   h.UsersWithoutIdentityKey,
+		OneTimePreKeyBuckets:      h.OneTimePreKeyBuckets,
+		SignedPreKeysExpired:      h.SignedPreKeysExpired,
+		SignedPreKeysExpiringSoon: h.SignedPreKeysExpiringSoon,
+	})
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// GET /api/admin/audit
+// Filters by event, user_id and time; since and until are Unix seconds.
+func (a *App) AdminAuditLogHandler(c *fiber.Ctx) error {
+	f := services.AuditFilter{Event: c.Query("event")}
+	if s := c.Query("user_id"); s != "" {
+		userID, err := parseUUIDField("user_id", s)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		f.UserID = userID
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		s := c.Query(p.name)
+		if s == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || sec < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid timestamp", "field": p.name})
+		}
+		*p.dst = time.Unix(sec, 0)
+	}
+
+	limit := c.QueryInt("limit", defaultAuditLimit)
+	if limit < 1 || limit > maxAuditLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid limit", "field": "limit"})
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid offset", "field": "offset"})
+	}
+
+	// One extra row tells us whether another page exists
+	events, err := a.Audit.Query(f, limit+1, offset)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	resp := AuditLogResponse{Events: make([]AuditEventResponse, 0, len(events))}
+	if len(events) > limit {
+		events = events[:limit]
+		resp.NextOffset = offset + limit
+	}
+	for _, ev := range events {
+		item := AuditEventResponse{
+			Seq:       ev.Seq,
+			Event:     ev.Event,
+			IP:        ev.IP,
+			Detail:    ev.Detail,
+			CreatedAt: ev.CreatedAt.Unix(),
+			PrevHash:  ev.PrevHash,
+			Hash:      ev.Hash,
+		}
+		if ev.UserID != nil {
+			item.UserID = ev.UserID.String()
+		}
+		resp.Events = append(resp.Events, item)
+	}
+	return c.JSON(resp)
+}
+
+// GET /api/admin/audit/verify
+// Walks the whole chain, so it gets slower as the log grows.
+func (a *App) AdminAuditVerifyHandler(c *fiber.Ctx) error {
+	brokenAt, checked, err := a.Audit.Verify()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(AuditVerifyResponse{Intact: brokenAt == 0, Checked: checked, BrokenAt: brokenAt})
+}
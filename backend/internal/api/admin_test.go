@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/services"
+)
+
+func TestAdminDisconnectClosesEverySocket(t *testing.T) {
+	a := newSocketTestApp(t)
+	admin := dbtest.SeedUser(t, a.DB, "admin")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	a.Cfg.AdminUserIDs = []string{admin.ID.String()}
+	url := listenWS(t, a)
+	var sockets []*websocket.Conn
+	for _, device := range []string{"phone", "laptop"} {
+		ws, err := dialWS(t, a, url, bob.ID, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaitSession(t, ws)
+		sockets = append(sockets, ws)
+	}
+
+	disconnect := serve(fiber.MethodPost, "/users/:id/disconnect", admin.ID, a.AdminMiddleware, a.AdminDisconnectUserHandler)
+	status, body := do(t, disconnect, fiber.MethodPost, "/users/"+bob.ID.String()+"/disconnect", nil)
+	if status != fiber.StatusOK || body["connections_closed"] != float64(2) || body["sessions_revoked"] != false {
+		t.Fatalf("disconnect: %d %v", status, body)
+	}
+	for _, ws := range sockets {
+		assertClosedWith(t, ws, services.CloseKicked, "kicked")
+	}
+	waitFor(t, func() bool { return !a.Hub.IsOnline(bob.ID) })
+
+	// Without revocation the client may come straight back
+	if _, err := dialWS(t, a, url, bob.ID, "phone"); err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+}
+
+func TestAdminDisconnectCanRevokeSessions(t *testing.T) {
+	a := newSocketTestApp(t)
+	admin := dbtest.SeedUser(t, a.DB, "admin")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	a.Cfg.AdminUserIDs = []string{admin.ID.String()}
+	url := listenWS(t, a)
+	token, _ := a.issueJWT(bob.ID)
+	ws, err := dialWS(t, a, url, bob.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return a.Hub.IsOnline(bob.ID) })
+
+	disconnect := serve(fiber.MethodPost, "/users/:id/disconnect", admin.ID, a.AdminMiddleware, a.AdminDisconnectUserHandler)
+	status, body := do(t, disconnect, fiber.MethodPost, "/users/"+bob.ID.String()+"/disconnect", map[string]bool{"revoke_sessions": true})
+	if status != fiber.StatusOK || body["connections_closed"] != float64(1) || body["sessions_revoked"] != true {
+		t.Fatalf("disconnect: %d %v", status, body)
+	}
+	assertClosedWith(t, ws, services.CloseKicked, "kicked")
+
+	// Tokens issued up to the revocation no longer authenticate
+	if _, _, err := a.verifyToken(token); err == nil {
+		t.Fatal("revoked token still accepted")
+	}
+	if _, err := dialWS(t, a, url, bob.ID, "phone"); err == nil {
+		t.Fatal("reconnected with a token from before the revocation")
+	}
+	a.Clock.(*services.ManualClock).Advance(time.Second)
+	if _, err := dialWS(t, a, url, bob.ID, "phone"); err != nil {
+		t.Fatalf("reconnect after signing in again: %v", err)
+	}
+}
+
+func TestAdminDisconnectRequiresAdmin(t *testing.T) {
+	a, _ := newTestApp(t)
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	connect(t, a, bob.ID, false)
+	disconnect := serve(fiber.MethodPost, "/users/:id/disconnect", bob.ID, a.AdminMiddleware, a.AdminDisconnectUserHandler)
+	if status, _ := do(t, disconnect, fiber.MethodPost, "/users/"+bob.ID.String()+"/disconnect", nil); status != fiber.StatusForbidden {
+		t.Fatalf("non-admin: %d", status)
+	}
+	if !a.Hub.IsOnline(bob.ID) {
+		t.Fatal("non-admin request disconnected the user")
+	}
+}
+
+func TestAdminMatchmakerReflectsQueueAndPairings(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := services.NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	a.Matchmaker.Clock = clock
+	admin := dbtest.SeedUser(t, a.DB, "admin")
+	a.Cfg.AdminUserIDs = []string{admin.ID.String()}
+	var users []uuid.UUID
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		u := dbtest.SeedUser(t, a.DB, name)
+		connect(t, a, u.ID, false)
+		users = append(users, u.ID)
+	}
+	pair(t, a, users[0], users[1])
+
+	// No shared tag, so these two stay queued
+	if err := a.Matchmaker.Enqueue(context.Background(), users[2], []string{"golang"}, false); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(45 * time.Second)
+	if err := a.Matchmaker.Enqueue(context.Background(), users[3], []string{"rustlang"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := serve(fiber.MethodGet, "/matchmaker", admin.ID, a.AdminMiddleware, a.AdminMatchmakerHandler)
+	req := httptest.NewRequest(fiber.MethodGet, "/matchmaker", nil)
+	resp, err := stats.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var body MatchmakerStatsResponse
+	if err := json.Unmarshal(raw, &body); err != nil || resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("stats: %d %s", resp.StatusCode, raw)
+	}
+	if body.Waiting != 2 || body.ActivePairings != 1 || body.OldestWaitSeconds != 45 {
+		t.Fatalf("stats = %+v", body)
+	}
+	if body.WaitAges["<10s"] != 1 || body.WaitAges["30-60s"] != 1 {
+		t.Fatalf("wait ages = %v", body.WaitAges)
+	}
+	if len(body.Buckets) != 2 {
+		t.Fatalf("buckets = %v", body.Buckets)
+	}
+	for label, n := range body.Buckets {
+		if n != 1 {
+			t.Fatalf("bucket %s has %d users", label, n)
+		}
+	}
+	// Neither user IDs nor tags appear in the output
+	for _, s := range []string{users[0].String(), users[1].String(), users[2].String(), users[3].String(), "golang", "rustlang"} {
+		if strings.Contains(string(raw), s) {
+			t.Fatalf("stats expose %q: %s", s, raw)
+		}
+	}
+
+	nonAdmin := serve(fiber.MethodGet, "/matchmaker", users[0], a.AdminMiddleware, a.AdminMatchmakerHandler)
+	if status, _ := do(t, nonAdmin, fiber.MethodGet, "/matchmaker", nil); status != fiber.StatusForbidden {
+		t.Fatalf("non-admin: %d", status)
+	}
+}
+
+func TestSecurityEventsAreAuditedWithIntactChain(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Audit.Clock = a.Clock
+	a.OTPService.Clock = a.Clock
+	notifier := &capturingNotifier{}
+	a.OTPService.Notifier = notifier
+	admin := dbtest.SeedUser(t, a.DB, "admin")
+	alice := dbtest.SeedUser(t, a.DB, "alice@example.com")
+	a.Cfg.AdminUserIDs = []string{admin.ID.String()}
+
+	// A wrong code, then the right one
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), alice.Identifier); err != nil {
+		t.Fatal(err)
+	}
+	verify := serve(fiber.MethodPost, "/verify", uuid.Nil, a.Verify2FAHandler)
+	if status, _ := do(t, verify, fiber.MethodPost, "/verify", map[string]string{"identifier": alice.Identifier, "otp": "not-a-code"}); status != fiber.StatusUnauthorized {
+		t.Fatalf("wrong code: %d", status)
+	}
+	if status, body := do(t, verify, fiber.MethodPost, "/verify", map[string]string{"identifier": alice.Identifier, "otp": notifier.code}); status != fiber.StatusOK {
+		t.Fatalf("verify: %d %v", status, body)
+	}
+
+	// A first upload from a new device with a new identity key
+	_, signingPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := uploadBody(t, signingPriv)
+	body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+	upload := serve(fiber.MethodPost, "/upload", alice.ID, a.PreKeysUploadHandler)
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+
+	list := serve(fiber.MethodGet, "/audit", admin.ID, a.AdminMiddleware, a.AdminAuditLogHandler)
+	status, resp := do(t, list, fiber.MethodGet, "/audit?user_id="+alice.ID.String(), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("audit: %d %v", status, resp)
+	}
+	var got []string
+	for _, e := range resp["events"].([]interface{}) {
+		ev := e.(map[string]interface{})
+		if ev["user_id"] != alice.ID.String() || ev["ip"] == "" {
+			t.Fatalf("entry %v", ev)
+		}
+		// Identifiers and key material stay out of the log
+		detail, _ := ev["detail"].(string)
+		if strings.Contains(detail, alice.Identifier) || strings.Contains(detail, body["identity_pub"].(string)) {
+			t.Fatalf("entry leaks secrets: %v", ev)
+		}
+		got = append(got, ev["event"].(string))
+	}
+	want := []string{services.AuditIdentityChanged, services.AuditDeviceAdded, services.AuditKeyUpload, services.AuditLogin, services.AuditOTPFailed}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("events newest first = %v, want %v", got, want)
+	}
+	if status, resp := do(t, list, fiber.MethodGet, "/audit?event="+services.AuditLogin, nil); status != fiber.StatusOK || len(resp["events"].([]interface{})) != 1 {
+		t.Fatalf("login events: %d %v", status, resp)
+	}
+
+	check := serve(fiber.MethodGet, "/audit/verify", admin.ID, a.AdminMiddleware, a.AdminAuditVerifyHandler)
+	if status, resp := do(t, check, fiber.MethodGet, "/audit/verify", nil); status != fiber.StatusOK || resp["intact"] != true || resp["checked"] != float64(len(want)) {
+		t.Fatalf("verify: %d %v", status, resp)
+	}
+
+	nonAdmin := serve(fiber.MethodGet, "/audit", alice.ID, a.AdminMiddleware, a.AdminAuditLogHandler)
+	if status, _ := do(t, nonAdmin, fiber.MethodGet, "/audit", nil); status != fiber.StatusForbidden {
+		t.Fatalf("non-admin: %d", status)
+	}
+}
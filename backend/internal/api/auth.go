@@ -1,68 +1,140 @@
 package api
 
 import (
+	"errors"
+	mrand "math/rand"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofrs/uuid"
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/securechat/backend/internal/models"
 )
 
-// generateJWT creates a JWT token for the user
-func generateJWT(userID uuid.UUID, secret string) (string, error) {
+// generateJWT creates a JWT token for the user, issued at now and signed
+// with the key named kid
+func generateJWT(userID uuid.UUID, kid, secret string, now time.Time) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id": userID.String(),
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-		"iat":     time.Now().Unix(),
+		"exp":     now.Add(24 * time.Hour).Unix(),
+		"iat":     now.Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
 	return token.SignedString([]byte(secret))
 }
 
-// AuthMiddleware validates JWT tokens
-func (a *App) AuthMiddleware(c *fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing authorization header"})
-	}
+// issueJWT signs a token for userID with the current key
+func (a *App) issueJWT(userID uuid.UUID) (string, error) {
+	return generateJWT(userID, a.Cfg.JWTSigningKeyID, a.Cfg.JWTSigningKey, a.Clock.Now())
+}
 
-	// Extract token from "Bearer <token>"
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization format"})
+// verificationKeys returns the keys that may have signed a token with this
+// kid: the current key and, until it expires, the previous one. Tokens from
+// before key IDs were added carry none and are tried against both.
+func (a *App) verificationKeys(kid string) [][]byte {
+	var keys [][]byte
+	if kid == "" || kid == a.Cfg.JWTSigningKeyID {
+		keys = append(keys, []byte(a.Cfg.JWTSigningKey))
 	}
+	if a.Cfg.JWTPreviousSigningKey != "" && a.Clock.Now().Before(a.Cfg.JWTPreviousKeyValidUntil) &&
+		(kid == "" || kid == a.Cfg.JWTPreviousSigningKeyID) {
+		keys = append(keys, []byte(a.Cfg.JWTPreviousSigningKey))
+	}
+	return keys
+}
 
-	tokenString := parts[1]
+// authenticateToken validates a JWT and returns the user it was issued to.
+// Error messages are safe to return to the client.
+func (a *App) authenticateToken(tokenString string) (uuid.UUID, error) {
+	userID, _, err := a.verifyToken(tokenString)
+	return userID, err
+}
+
+// verifyToken is authenticateToken that also returns the token's expiry, or
+// the zero time if it has none
+func (a *App) verifyToken(tokenString string) (uuid.UUID, time.Time, error) {
+	// The kid header picks the key; it is only trusted to choose among our
+	// own keys, and the signature check below is what authenticates
+	unverified, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return uuid.Nil, time.Time{}, errors.New("invalid token")
+	}
+	kid, _ := unverified.Header["kid"].(string)
 
 	// Parse and validate token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.ErrUnauthorized
+	var token *jwt.Token
+	for _, key := range a.verificationKeys(kid) {
+		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			// Validate signing method
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fiber.ErrUnauthorized
+			}
+			return key, nil
+		}, jwt.WithTimeFunc(a.Clock.Now))
+		if err == nil && token.Valid {
+			break
 		}
-		return []byte(a.Cfg.JWTSigningKey), nil
-	})
-
-	if err != nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
+	}
+	if token == nil || err != nil || !token.Valid {
+		return uuid.Nil, time.Time{}, errors.New("invalid token")
 	}
 
 	// Extract claims
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token claims"})
+		return uuid.Nil, time.Time{}, errors.New("invalid token claims")
 	}
 
 	// Extract user_id
 	userIDStr, ok := claims["user_id"].(string)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid user_id in token"})
+		return uuid.Nil, time.Time{}, errors.New("invalid user_id in token")
 	}
 
 	userID, err := uuid.FromString(userIDStr)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid user_id format"})
+		return uuid.Nil, time.Time{}, errors.New("invalid user_id format")
+	}
+
+	// Reject tokens issued before the user's sessions were revoked
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil {
+		return uuid.Nil, time.Time{}, errors.New("invalid token claims")
+	}
+	var user models.User
+	if err := a.DB.Select("id", "sessions_revoked_at").Where("id = ?", userID).First(&user).Error; err != nil {
+		return uuid.Nil, time.Time{}, errors.New("invalid token")
+	}
+	if user.SessionsRevokedAt != nil && issuedAt.Unix() <= user.SessionsRevokedAt.Unix() {
+		return uuid.Nil, time.Time{}, errors.New("session revoked")
+	}
+
+	var expiresAt time.Time
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	return userID, expiresAt, nil
+}
+
+// AuthMiddleware validates JWT tokens
+func (a *App) AuthMiddleware(c *fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing authorization header"})
+	}
+
+	// Extract token from "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization format"})
+	}
+
+	userID, err := a.authenticateToken(parts[1])
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	// Store user_id in context
@@ -71,6 +143,63 @@ func (a *App) AuthMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// AdminMiddleware restricts a route to the configured admin users. It must
+// run after AuthMiddleware.
+func (a *App) AdminMiddleware(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	for _, id := range a.Cfg.AdminUserIDs {
+		if id == userID.String() {
+			return c.Next()
+		}
+	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "admin only"})
+}
+
+// AuthJitter delays the response by a random 0-AuthJitterMs milliseconds so
+// the timing of OTP and identifier checks carries less signal. The handlers
+// already do equal bcrypt work on every path; this blurs what remains (query
+// plans, cache hits) rather than hiding gross differences.
+func (a *App) AuthJitter(c *fiber.Ctx) error {
+	err := c.Next()
+	if a.Cfg.AuthJitterMs > 0 {
+		time.Sleep(time.Duration(mrand.Int63n(int64(a.Cfg.AuthJitterMs) * int64(time.Millisecond))))
+	}
+	return err
+}
+
+// RequireHTTPS rejects requests that reached the server over plain HTTP,
+// for routes that carry credentials or keys. Behind a proxy the scheme comes
+// from X-Forwarded-Proto, which is only believed from TRUSTED_PROXIES.
+func (a *App) RequireHTTPS(c *fiber.Ctx) error {
+	if !a.Cfg.RequireHTTPS || c.Protocol() == "https" {
+		return c.Next()
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "https_required"})
+}
+
+// RequireIdentityKey rejects users who haven't uploaded an identity key yet,
+// for routes that are meaningless without one. It must run after
+// AuthMiddleware.
+func (a *App) RequireIdentityKey(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	var n int64
+	if err := a.dbFor(c).Model(&models.User{}).
+		Where("id = ? AND length(identity_pub_key) > 0", userID).
+		Count(&n).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if n == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "keys_not_ready"})
+	}
+	return c.Next()
+}
+
 // GetUserID extracts user ID from context (set by AuthMiddleware)
 func GetUserID(c *fiber.Ctx) (uuid.UUID, error) {
 	userID, ok := c.Locals("user_id").(uuid.UUID)
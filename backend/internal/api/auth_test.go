@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/services"
+)
+
+func TestPreviousJWTKeyValidatesOnlyDuringOverlap(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+
+	oldToken, err := a.issueJWT(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token from before key IDs, signed with what becomes the previous key
+	legacyToken, err := generateJWT(alice.ID, "", a.Cfg.JWTSigningKey, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A kid naming the new key doesn't make the old key's signature count
+	forgedKid, err := generateJWT(alice.ID, "new", a.Cfg.JWTSigningKey, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate: the old key stays valid for an hour
+	a.Cfg.JWTPreviousSigningKey, a.Cfg.JWTPreviousSigningKeyID = a.Cfg.JWTSigningKey, a.Cfg.JWTSigningKeyID
+	a.Cfg.JWTPreviousKeyValidUntil = clock.Now().Add(time.Hour)
+	a.Cfg.JWTSigningKey, a.Cfg.JWTSigningKeyID = "rotated-secret", "new"
+	newToken, err := a.issueJWT(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/", a.AuthMiddleware, func(c *fiber.Ctx) error {
+		userID, err := GetUserID(c)
+		if err != nil {
+			return err
+		}
+		return c.SendString(userID.String())
+	})
+	status := func(token string) int {
+		t.Helper()
+		req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	clock.Advance(59 * time.Minute)
+	for name, tc := range map[string]struct {
+		token string
+		want  int
+	}{
+		"new key":             {newToken, fiber.StatusOK},
+		"previous key":        {oldToken, fiber.StatusOK},
+		"previous key no kid": {legacyToken, fiber.StatusOK},
+		"kid of the new key":  {forgedKid, fiber.StatusUnauthorized},
+	} {
+		if got := status(tc.token); got != tc.want {
+			t.Errorf("during overlap, %s: %d, want %d", name, got, tc.want)
+		}
+	}
+
+	// Past the window only the new key is accepted, though none of the
+	// tokens has itself expired
+	clock.Advance(time.Minute + time.Second)
+	for name, tc := range map[string]struct {
+		token string
+		want  int
+	}{
+		"new key":             {newToken, fiber.StatusOK},
+		"previous key":        {oldToken, fiber.StatusUnauthorized},
+		"previous key no kid": {legacyToken, fiber.StatusUnauthorized},
+	} {
+		if got := status(tc.token); got != tc.want {
+			t.Errorf("after overlap, %s: %d, want %d", name, got, tc.want)
+		}
+	}
+}
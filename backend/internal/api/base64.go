@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+)
+
+// Base64Bytes is raw bytes that cross the HTTP edge as a standard base64
+// string. Keys and signatures are stored and handled as raw bytes; request
+// and response types use Base64Bytes so the encoding happens once, in
+// (un)marshalling, and can't be applied twice.
+type Base64Bytes []byte
+
+var base64BytesType = reflect.TypeOf(Base64Bytes(nil))
+
+// MarshalJSON encodes b as a base64 string, or null when b is nil
+func (b Base64Bytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes a base64 string; null leaves b nil. Anything else is
+// reported as a *json.UnmarshalTypeError, which invalidBody names the field of.
+func (b *Base64Bytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*b = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &json.UnmarshalTypeError{Value: "non-string", Type: base64BytesType}
+	}
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return &json.UnmarshalTypeError{Value: "string", Type: base64BytesType}
+	}
+	*b = raw
+	return nil
+}
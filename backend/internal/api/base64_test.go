@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestBase64BytesRoundTrip(t *testing.T) {
+	type body struct {
+		Key Base64Bytes `json:"key"`
+	}
+	in := body{Key: Base64Bytes{0x00, 0xff, 0x10, 0x80}}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"key":"AP8QgA=="}` {
+		t.Fatalf("marshal = %s", data)
+	}
+	var out body
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Key) != string(in.Key) {
+		t.Fatalf("round trip = %x, want %x", out.Key, in.Key)
+	}
+}
+
+func TestBase64BytesEmptyValues(t *testing.T) {
+	type body struct {
+		Key Base64Bytes `json:"key"`
+	}
+	cases := []struct {
+		json    string
+		wantNil bool
+	}{
+		{`{}`, true},
+		{`{"key":null}`, true},
+		{`{"key":""}`, false},
+	}
+	for _, tc := range cases {
+		var out body
+		if err := json.Unmarshal([]byte(tc.json), &out); err != nil {
+			t.Fatalf("%s: %v", tc.json, err)
+		}
+		if (out.Key == nil) != tc.wantNil || len(out.Key) != 0 {
+			t.Fatalf("%s: key = %#v", tc.json, out.Key)
+		}
+	}
+
+	data, _ := json.Marshal(body{})
+	if string(data) != `{"key":null}` {
+		t.Fatalf("nil marshals as %s", data)
+	}
+	data, _ = json.Marshal(body{Key: Base64Bytes{}})
+	if string(data) != `{"key":""}` {
+		t.Fatalf("empty marshals as %s", data)
+	}
+}
+
+func TestBase64BytesRejectsBadInput(t *testing.T) {
+	for _, in := range []string{`{"key":"not base64!"}`, `{"key":42}`} {
+		var out struct {
+			Key Base64Bytes `json:"key"`
+		}
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal([]byte(in), &out); !errors.As(err, &typeErr) || typeErr.Type != base64BytesType {
+			t.Fatalf("%s: err = %v", in, err)
+		}
+	}
+}
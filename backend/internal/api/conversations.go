@@ -0,0 +1,332 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// POST /api/conversations
+func (a *App) CreateConversationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req CreateConversationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if len(req.MemberIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "member_ids required"})
+	}
+	if len(req.MemberIDs)+1 > a.Cfg.MaxGroupMembers {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "too many members"})
+	}
+
+	memberIDs := make([]uuid.UUID, 0, len(req.MemberIDs))
+	for _, s := range req.MemberIDs {
+		id, err := parseUUIDField("member_ids", s)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		memberIDs = append(memberIDs, id)
+	}
+
+	var found int64
+	if err := a.dbFor(c).Model(&models.User{}).Where("id IN ?", memberIDs).Count(&found).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if int(found) != len(uniqueUUIDs(memberIDs)) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown member"})
+	}
+
+	conv, err := a.Convos.Create(userID, memberIDs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create conversation"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(conversationJSON(*conv, userID, a.Clock.Now()))
+}
+
+// GET /api/conversations
+func (a *App) ListConversationsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	convs, err := a.Convos.ListForUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	now := a.Clock.Now()
+	out := make([]ConversationResponse, len(convs))
+	for i, conv := range convs {
+		out[i] = conversationJSON(conv, userID, now)
+	}
+	return c.JSON(ConversationListResponse{Conversations: out})
+}
+
+// DELETE /api/conversations/:id
+// Ends the conversation for every member: queued ciphertext and membership
+// are deleted, the others are told, and a match with a member of a two-person
+// conversation is ended too.
+func (a *App) DeleteConversationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	convID, err := parseUUIDField("id", c.Params("id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+
+	isMember, err := a.Convos.IsMember(convID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if !isMember {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_member"})
+	}
+
+	members, err := a.Convos.Purge(convID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete conversation"})
+	}
+
+	notice, _ := json.Marshal(map[string]string{"type": "conversation_deleted", "conversation_id": convID.String()})
+	for _, id := range members {
+		if id == userID {
+			continue
+		}
+		a.Hub.SendTo(id, notice)
+		if peer, ok := a.Matchmaker.GetPair(userID); ok && peer == id && len(members) == 2 {
+			a.Matchmaker.EndMatch(userID)
+		}
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// POST /api/conversations/:id/mute
+// Suppresses push wake-ups for the caller only; messages are still queued
+// and delivered.
+func (a *App) MuteConversationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	convID, err := parseUUIDField("id", c.Params("id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+
+	var req ConversationMuteRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return invalidBody(c, err)
+		}
+	}
+	if req.DurationSeconds < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "duration_seconds must not be negative", "field": "duration_seconds"})
+	}
+	var until *time.Time
+	if req.DurationSeconds > 0 {
+		t := a.Clock.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+		until = &t
+	}
+
+	if err := a.Convos.SetMute(convID, userID, until); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_member"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	resp := ConversationMuteResponse{Status: "muted"}
+	if until != nil {
+		resp.MutedUntil = until.Unix()
+	}
+	return c.JSON(resp)
+}
+
+// DELETE /api/conversations/:id/mute
+func (a *App) UnmuteConversationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	convID, err := parseUUIDField("id", c.Params("id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+	if err := a.Convos.Unmute(convID, userID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_member"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(ConversationMuteResponse{Status: "unmuted"})
+}
+
+// conversationJSON renders conv for viewer as of now, including viewer's own
+// mute state but never another member's
+func conversationJSON(conv models.Conversation, viewer uuid.UUID, now time.Time) ConversationResponse {
+	members := make([]string, len(conv.Members))
+	resp := ConversationResponse{
+		ConversationID: conv.ID.String(),
+		CreatedBy:      conv.CreatedBy.String(),
+		CreatedAt:      conv.CreatedAt.Unix(),
+		Members:        members,
+	}
+	for i, m := range conv.Members {
+		members[i] = m.UserID.String()
+		if m.UserID == viewer && m.MutedAt(now) {
+			resp.Muted = true
+			if m.MutedUntil != nil {
+				resp.MutedUntil = m.MutedUntil.Unix()
+			}
+		}
+	}
+	return resp
+}
+
+func uniqueUUIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool, len(ids))
+	var out []uuid.UUID
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// forwardToConversation delivers a sender's per-recipient ciphertexts to the
+// other members, queueing each for members who are offline. Non-members are
+// refused, as is a send whose recipients aren't exactly the current other
+// members, so a client with a stale member list re-encrypts rather than
+// leaving someone out.
+func (a *App) forwardToConversation(conn *services.Connection, convID uuid.UUID, payloads map[uuid.UUID][]byte) {
+	isMember, err := a.Convos.IsMember(convID, conn.UserID)
+	if err != nil {
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	if !isMember {
+		sendWSError(conn, "not_a_member", "conversation_id")
+		return
+	}
+
+	members, err := a.Convos.MemberIDs(convID)
+	if err != nil {
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	recipients := make([]uuid.UUID, 0, len(members))
+	for _, id := range members {
+		if id == conn.UserID {
+			continue
+		}
+		if _, ok := payloads[id]; !ok {
+			sendWSError(conn, "recipients_mismatch", "payloads")
+			return
+		}
+		recipients = append(recipients, id)
+	}
+	if len(payloads) != len(recipients) {
+		sendWSError(conn, "recipients_mismatch", "payloads")
+		return
+	}
+
+	now := a.Clock.Now().Unix()
+	for _, id := range recipients {
+		payload := payloads[id]
+		if a.Hub.SendEnvelope(id, &services.Envelope{
+			Type:           services.EnvelopeTypeMessage,
+			Peer:           conn.UserID,
+			ConversationID: convID,
+			Timestamp:      now,
+			Payload:        payload,
+		}) {
+			continue
+		}
+		if err := a.Convos.QueueMessage(id, conn.UserID, &convID, payload); err != nil {
+			log.Printf("queue message for %s: %v", id, err)
+			continue
+		}
+		go a.Push.NotifyQueued(id, &convID)
+	}
+}
+
+// flushQueued sends the device the messages queued for its user that it
+// hasn't been sent yet. Each is marked delivered to the device only once the
+// write pump has written it, so messages cut off by a disconnect are sent
+// again on the next connection.
+func (a *App) flushQueued(conn *services.Connection, done <-chan struct{}) {
+	msgs, err := a.Convos.Pending(conn.UserID, conn.DeviceID)
+	if err != nil {
+		log.Printf("load queued messages for %s: %v", conn.UserID, err)
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	written := make(chan uuid.UUID, len(msgs))
+	go a.ackQueued(conn, written, len(msgs), done)
+	for _, m := range msgs {
+		env := &services.Envelope{
+			Type:      services.EnvelopeTypeMessage,
+			Peer:      m.SenderID,
+			Timestamp: m.CreatedAt.Unix(),
+			Queued:    true,
+			Payload:   m.Payload,
+		}
+		if m.ConversationID != nil {
+			env.ConversationID = *m.ConversationID
+		}
+		frame := conn.Encode(env)
+		id := m.ID
+		frame.Written = func() { written <- id }
+		select {
+		case conn.Send <- frame:
+		case <-done:
+			return
+		}
+	}
+}
+
+// ackQueued marks queued messages delivered to conn's device as the write
+// pump reports them written, until n have been or the connection closes
+func (a *App) ackQueued(conn *services.Connection, written <-chan uuid.UUID, n int, done <-chan struct{}) {
+	ack := func(id uuid.UUID) {
+		if err := a.Convos.MarkDelivered(conn.UserID, id, conn.DeviceID, a.Clock.Now()); err != nil {
+			log.Printf("mark queued message %s delivered to %s: %v", id, conn.UserID, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case id := <-written:
+			ack(id)
+		case <-done:
+			// Frames written just before the close still count
+			for {
+				select {
+				case id := <-written:
+					ack(id)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+func TestTimedMuteLapsesOnAppClock(t *testing.T) {
+	a, push := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	a.DB.Model(&models.Device{}).Where("user_id = ?", bob.ID).Updates(map[string]interface{}{"push_token": "tok", "push_platform": "fcm"})
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mute := serve(fiber.MethodPost, "/conversations/:id/mute", bob.ID, a.MuteConversationHandler)
+	if status, body := do(t, mute, fiber.MethodPost, "/conversations/"+conv.ID.String()+"/mute", map[string]int{"duration_seconds": 3600}); status != fiber.StatusOK {
+		t.Fatalf("mute: %d %v", status, body)
+	}
+	list := serve(fiber.MethodGet, "/conversations", bob.ID, a.ListConversationsHandler)
+	muted := func() bool {
+		status, body := do(t, list, fiber.MethodGet, "/conversations", nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("list: %d %v", status, body)
+		}
+		return body["conversations"].([]interface{})[0].(map[string]interface{})["muted"] == true
+	}
+
+	if !muted() {
+		t.Fatal("not muted within the hour")
+	}
+	a.Push.NotifyQueued(bob.ID, &conv.ID)
+	if push.count() != 0 {
+		t.Fatal("pushed while muted")
+	}
+
+	clock.Advance(time.Hour + time.Second)
+	if muted() {
+		t.Fatal("still muted after the hour")
+	}
+	a.Push.NotifyQueued(bob.ID, &conv.ID)
+	if push.count() != 1 {
+		t.Fatal("no push once the mute lapsed")
+	}
+}
+
+func TestMutedConversationSuppressesPushButStillDelivers(t *testing.T) {
+	a, push := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	mallory := dbtest.SeedUser(t, a.DB, "mallory")
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	a.DB.Model(&models.Device{}).Where("user_id = ?", bob.ID).Updates(map[string]interface{}{"push_token": "tok", "push_platform": "fcm"})
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/conversations/" + conv.ID.String() + "/mute"
+	fromAlice := connect(t, a, alice.ID, false)
+
+	// Only members can mute
+	if status, body := do(t, serve(fiber.MethodPost, "/conversations/:id/mute", mallory.ID, a.MuteConversationHandler), fiber.MethodPost, target, nil); status != fiber.StatusForbidden {
+		t.Fatalf("non-member mute: %d %v", status, body)
+	}
+	if status, body := do(t, serve(fiber.MethodPost, "/conversations/:id/mute", bob.ID, a.MuteConversationHandler), fiber.MethodPost, target, nil); status != fiber.StatusOK || body["muted_until"] != nil {
+		t.Fatalf("mute: %d %v", status, body)
+	}
+
+	// Offline: queued without a push
+	sendMessage(t, a, fromAlice, "conversation_id", conv.ID.String())
+	if queued, err := a.Convos.Pending(bob.ID, "device-1"); err != nil || len(queued) != 1 {
+		t.Fatalf("queued while muted: %v, %v", queued, err)
+	}
+
+	// Online: delivered live as usual
+	bobConn := connect(t, a, bob.ID, false)
+	sendMessage(t, a, fromAlice, "conversation_id", conv.ID.String())
+	var got map[string]interface{}
+	if err := json.Unmarshal(nextFrame(t, bobConn).Data, &got); err != nil || got["conversation_id"] != conv.ID.String() {
+		t.Fatalf("live delivery while muted: %v, %v", got, err)
+	}
+	a.Hub.Unregister(bobConn)
+	// Pushes go out on their own goroutine; give a leaked one time to land
+	time.Sleep(50 * time.Millisecond)
+	if push.count() != 0 {
+		t.Fatal("pushed while muted")
+	}
+
+	// Unmuted, the next offline message pushes again
+	if status, body := do(t, serve(fiber.MethodDelete, "/conversations/:id/mute", bob.ID, a.UnmuteConversationHandler), fiber.MethodDelete, target, nil); status != fiber.StatusOK {
+		t.Fatalf("unmute: %d %v", status, body)
+	}
+	sendMessage(t, a, fromAlice, "conversation_id", conv.ID.String())
+	waitFor(t, func() bool { return push.count() == 1 })
+}
+
+func TestGroupMessageFansOutToMembers(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	create := serve(fiber.MethodPost, "/conversations", alice.ID, a.CreateConversationHandler)
+	status, body := do(t, create, fiber.MethodPost, "/conversations", map[string][]string{"member_ids": {bob.ID.String(), carol.ID.String()}})
+	if status != fiber.StatusCreated || len(body["members"].([]interface{})) != 3 {
+		t.Fatalf("create: %d %v", status, body)
+	}
+	convID := body["conversation_id"].(string)
+
+	fromAlice := connect(t, a, alice.ID, false)
+	bobConn := connect(t, a, bob.ID, false)
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":            "message",
+		"conversation_id": convID,
+		"payloads":        map[string]string{bob.ID.String(): "ct-bob", carol.ID.String(): "ct-carol"},
+	})
+	a.dispatchText(&wsSession{conn: fromAlice}, frame)
+
+	// Each member gets the ciphertext encrypted for them: online members
+	// live, offline ones from the queue. The sender isn't echoed.
+	var got map[string]interface{}
+	if err := json.Unmarshal(nextFrame(t, bobConn).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "message" || got["conversation_id"] != convID || got["from"] != alice.ID.String() || got["payload"] != "ct-bob" {
+		t.Fatalf("bob got %v", got)
+	}
+	noFrame(t, fromAlice)
+	queued, err := a.Convos.Pending(carol.ID, "device-1")
+	if err != nil || len(queued) != 1 || queued[0].ConversationID == nil || queued[0].ConversationID.String() != convID || string(queued[0].Payload) != "ct-carol" {
+		t.Fatalf("carol's queue = %v, %v", queued, err)
+	}
+	if queued, _ := a.Convos.Pending(bob.ID, "device-1"); len(queued) != 0 {
+		t.Fatalf("delivered message also queued for bob: %v", queued)
+	}
+}
+
+func TestGroupMessageRecipientsMustMatchMembers(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	mallory := dbtest.SeedUser(t, a.DB, "mallory")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID, carol.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromAlice := connect(t, a, alice.ID, false)
+	bobConn := connect(t, a, bob.ID, false)
+
+	for name, recipients := range map[string][]uuid.UUID{
+		"missing member": {bob.ID},
+		"non-member":     {bob.ID, carol.ID, mallory.ID},
+		"sender":         {alice.ID, bob.ID, carol.ID},
+	} {
+		payloads := make(map[string]string)
+		for _, id := range recipients {
+			payloads[id.String()] = "ct"
+		}
+		frame, _ := json.Marshal(map[string]interface{}{"type": "message", "conversation_id": conv.ID.String(), "payloads": payloads})
+		a.dispatchText(&wsSession{conn: fromAlice}, frame)
+		var got map[string]string
+		if err := json.Unmarshal(nextFrame(t, fromAlice).Data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["type"] != "error" || got["error"] != "recipients_mismatch" || got["field"] != "payloads" {
+			t.Fatalf("%s: alice got %v", name, got)
+		}
+		// Nobody gets part of a rejected send
+		noFrame(t, bobConn)
+		var n int64
+		a.DB.Model(&models.QueuedMessage{}).Count(&n)
+		if n != 0 {
+			t.Fatalf("%s: %d messages queued", name, n)
+		}
+	}
+}
+
+func TestGroupMessageRequiresMembership(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	mallory := dbtest.SeedUser(t, a.DB, "mallory")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobConn := connect(t, a, bob.ID, false)
+	fromMallory := connect(t, a, mallory.ID, false)
+
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":            "message",
+		"conversation_id": conv.ID.String(),
+		"payloads":        map[string]string{alice.ID.String(): "ct", bob.ID.String(): "ct"},
+	})
+	a.dispatchText(&wsSession{conn: fromMallory}, frame)
+	var got map[string]string
+	if err := json.Unmarshal(nextFrame(t, fromMallory).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "error" || got["error"] != "not_a_member" || got["field"] != "conversation_id" {
+		t.Fatalf("mallory got %v", got)
+	}
+	noFrame(t, bobConn)
+	if queued, _ := a.Convos.Pending(alice.ID, "device-1"); len(queued) != 0 {
+		t.Fatalf("non-member's message queued: %v", queued)
+	}
+
+	// Nor can a group be created with someone who doesn't exist
+	create := serve(fiber.MethodPost, "/conversations", alice.ID, a.CreateConversationHandler)
+	if status, body := do(t, create, fiber.MethodPost, "/conversations", map[string][]string{"member_ids": {uuid.Must(uuid.NewV4()).String()}}); status != fiber.StatusBadRequest || body["error"] != "unknown member" {
+		t.Fatalf("unknown member: %d %v", status, body)
+	}
+}
+
+func TestDeleteConversationPurgesItsData(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	mallory := dbtest.SeedUser(t, a.DB, "mallory")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := a.Convos.Create(alice.ID, []uuid.UUID{carol.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob and carol are offline, so both conversations leave ciphertext queued
+	fromAlice := connect(t, a, alice.ID, false)
+	sendMessage(t, a, fromAlice, "conversation_id", conv.ID.String())
+	sendMessage(t, a, fromAlice, "conversation_id", conv.ID.String())
+	sendMessage(t, a, fromAlice, "conversation_id", other.ID.String())
+	bobConn := connect(t, a, bob.ID, false)
+	pair(t, a, alice.ID, bob.ID)
+
+	var records int64
+	a.DB.Model(&models.QueuedMessage{}).Where("conversation_id = ?", conv.ID).Count(&records)
+	if records != 2 {
+		t.Fatalf("%d queued messages before the purge, want 2", records)
+	}
+
+	target := "/conversations/" + conv.ID.String()
+	remove := func(userID uuid.UUID) (int, map[string]interface{}) {
+		return do(t, serve(fiber.MethodDelete, "/conversations/:id", userID, a.DeleteConversationHandler), fiber.MethodDelete, target, nil)
+	}
+	if status, body := remove(mallory.ID); status != fiber.StatusForbidden || body["error"] != "not_a_member" {
+		t.Fatalf("non-participant: %d %v", status, body)
+	}
+	if status, body := remove(alice.ID); status != fiber.StatusOK {
+		t.Fatalf("delete: %d %v", status, body)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(nextFrame(t, bobConn).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "conversation_deleted" || got["conversation_id"] != conv.ID.String() {
+		t.Fatalf("bob got %v", got)
+	}
+	if _, ok := a.Matchmaker.GetPair(alice.ID); ok {
+		t.Fatal("pairing survived the conversation")
+	}
+
+	// Nothing of the conversation is left to read
+	if queued, err := a.Convos.Pending(bob.ID, "device-1"); err != nil || len(queued) != 0 {
+		t.Fatalf("bob's queue = %v, %v", queued, err)
+	}
+	for _, model := range []interface{}{&models.QueuedMessage{}, &models.ConversationMember{}} {
+		var n int64
+		a.DB.Model(model).Where("conversation_id = ?", conv.ID).Count(&n)
+		if n != 0 {
+			t.Fatalf("%d %T rows left", n, model)
+		}
+	}
+	if ok, _ := a.Convos.IsMember(conv.ID, bob.ID); ok {
+		t.Fatal("bob is still a member")
+	}
+	if status, _ := remove(bob.ID); status != fiber.StatusForbidden {
+		t.Fatalf("delete again: %d", status)
+	}
+
+	// Other conversations are untouched
+	if queued, _ := a.Convos.Pending(carol.ID, "device-1"); len(queued) != 1 {
+		t.Fatalf("carol's queue has %d messages, want 1", len(queued))
+	}
+}
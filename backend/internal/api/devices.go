@@ -0,0 +1,94 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// maxPushTokenLength is well above APNs (64 hex) and FCM (~160) tokens
+const maxPushTokenLength = 4096
+
+const (
+	defaultDeviceLimit = 20
+	maxDeviceLimit     = 100
+)
+
+// GET /api/me/devices
+// Most recently seen first, a page at a time, so accounts with many devices
+// don't have to load them all.
+func (a *App) ListDevicesHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	limit := c.QueryInt("limit", defaultDeviceLimit)
+	if limit < 1 || limit > maxDeviceLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid limit", "field": "limit"})
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid offset", "field": "offset"})
+	}
+
+	// One extra row tells us whether another page exists
+	var devices []models.Device
+	if err := a.dbFor(c).Where("user_id = ?", userID).
+		Order("last_seen_at desc").Order("device_id").
+		Limit(limit + 1).Offset(offset).
+		Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	resp := DeviceListResponse{Devices: make([]DeviceSummary, 0, len(devices))}
+	if len(devices) > limit {
+		devices = devices[:limit]
+		resp.NextOffset = offset + limit
+	}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, DeviceSummary{
+			DeviceID:       d.DeviceID,
+			RegistrationID: d.RegistrationID,
+			PushPlatform:   d.PushPlatform,
+			LastSeenAt:     d.LastSeenAt.Unix(),
+			CreatedAt:      d.CreatedAt.Unix(),
+		})
+	}
+	return c.JSON(resp)
+}
+
+// PUT /api/me/devices/:device_id/push-token
+// An empty token clears it, so the device stops receiving pushes.
+func (a *App) UpdatePushTokenHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req PushTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if len(req.Token) > maxPushTokenLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "token too long", "field": "token"})
+	}
+	if req.Token != "" && req.Platform != services.PushPlatformAPNs && req.Platform != services.PushPlatformFCM {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "platform must be apns or fcm", "field": "platform"})
+	}
+	if req.Token == "" {
+		req.Platform = ""
+	}
+
+	res := a.dbFor(c).Model(&models.Device{}).
+		Where("user_id = ? AND device_id = ?", userID, c.Params("device_id")).
+		Updates(map[string]interface{}{"push_token": req.Token, "push_platform": req.Platform})
+	if res.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if res.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "device not found"})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
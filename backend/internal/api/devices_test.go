@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func TestDeviceListIsCappedAndMostRecentFirst(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	base := time.Unix(1700000000, 0)
+	const total = defaultDeviceLimit + 5
+	for i := 0; i < total; i++ {
+		// Seen in shuffled order, so insertion order can't pass for recency
+		seen := (i * 7) % total
+		d := models.Device{
+			ID:           uuid.Must(uuid.NewV4()),
+			UserID:       alice.ID,
+			DeviceID:     fmt.Sprintf("device-%02d", seen),
+			DevicePubKey: []byte{1},
+			LastSeenAt:   base.Add(time.Duration(seen) * time.Minute),
+		}
+		if err := a.DB.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := serve(fiber.MethodGet, "/me/devices", alice.ID, a.ListDevicesHandler)
+	var seen []string
+	target := "/me/devices"
+	for pages := 0; ; pages++ {
+		status, body := do(t, list, fiber.MethodGet, target, nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: %d %v", target, status, body)
+		}
+		devices := body["devices"].([]interface{})
+		if pages == 0 && len(devices) != defaultDeviceLimit {
+			t.Fatalf("first page has %d devices, want the cap of %d", len(devices), defaultDeviceLimit)
+		}
+		for _, d := range devices {
+			seen = append(seen, d.(map[string]interface{})["device_id"].(string))
+		}
+		next, ok := body["next_offset"]
+		if !ok {
+			break
+		}
+		target = fmt.Sprintf("/me/devices?offset=%v", next)
+	}
+	if len(seen) != total {
+		t.Fatalf("paged through %d devices, want %d", len(seen), total)
+	}
+	for i, id := range seen {
+		if want := fmt.Sprintf("device-%02d", total-1-i); id != want {
+			t.Fatalf("device %d = %s, want %s (most recent first)", i, id, want)
+		}
+	}
+
+	for _, q := range []string{"limit=0", fmt.Sprintf("limit=%d", maxDeviceLimit+1), "offset=-1"} {
+		if status, body := do(t, list, fiber.MethodGet, "/me/devices?"+q, nil); status != fiber.StatusBadRequest {
+			t.Fatalf("%s: %d %v", q, status, body)
+		}
+	}
+}
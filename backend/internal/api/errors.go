@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/services"
+)
+
+// InvalidUUIDError reports a request field that should hold a UUID but doesn't
+type InvalidUUIDError struct {
+	Field string
+}
+
+func (e *InvalidUUIDError) Error() string {
+	return "invalid_uuid: " + e.Field
+}
+
+// parseUUIDField parses s as a UUID, returning an *InvalidUUIDError naming
+// field when it is malformed
+func parseUUIDField(field, s string) (uuid.UUID, error) {
+	id, err := uuid.FromString(s)
+	if err != nil {
+		return uuid.Nil, &InvalidUUIDError{Field: field}
+	}
+	return id, nil
+}
+
+// invalidUUID writes the uniform 400 response for a malformed UUID
+func invalidUUID(c *fiber.Ctx, err error) error {
+	resp := fiber.Map{"error": "invalid_uuid"}
+	var e *InvalidUUIDError
+	if errors.As(err, &e) {
+		resp["field"] = e.Field
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(resp)
+}
+
+// invalidBody writes the 400 for a body BodyParser rejected, telling an
+// empty body apart from malformed JSON
+func invalidBody(c *fiber.Ctx, err error) error {
+	if len(c.Body()) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "body required"})
+	}
+	resp := fiber.Map{"error": "invalid request"}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		resp["detail"] = fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Type == base64BytesType:
+		// Not every Go release attaches the field to errors from UnmarshalJSON
+		resp["detail"] = "keys and signatures must be base64"
+		if typeErr.Field != "" {
+			resp["detail"] = typeErr.Field + " must be base64"
+			resp["field"] = typeErr.Field
+		}
+	case errors.As(err, &typeErr):
+		resp["detail"] = fmt.Sprintf("%s must be %s", typeErr.Field, typeErr.Type)
+		resp["field"] = typeErr.Field
+	case errors.Is(err, fiber.ErrUnprocessableEntity):
+		resp["detail"] = "Content-Type must be application/json"
+	default:
+		resp["detail"] = "malformed JSON"
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(resp)
+}
+
+// sendWSError queues an error frame to the client so bad input isn't silently dropped
+func sendWSError(conn *services.Connection, code, field string) {
+	frame := map[string]string{"type": "error", "error": code}
+	if field != "" {
+		frame["field"] = field
+	}
+	b, _ := json.Marshal(frame)
+	select {
+	case conn.Send <- services.TextFrame(b):
+	default:
+	}
+}
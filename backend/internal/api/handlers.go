@@ -1,17 +1,23 @@
 package api
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofrs/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db"
 	"github.com/securechat/backend/internal/models"
 	"github.com/securechat/backend/internal/services"
 	"github.com/securechat/backend/internal/utils"
@@ -23,34 +29,53 @@ type App struct {
 	PreKeySvc  *services.PreKeyService
 	Matchmaker *services.Matchmaker
 	Hub        *services.Hub
+	Convos     *services.ConversationService
+	Sessions   *services.SessionService
+	Push       *services.PushService
+	Lookups    *LookupCache
+	Audit      *services.AuditLog
 	ServerPriv *rsa.PrivateKey
 	Cfg        *config.Config
+	// Clock issues and checks token times
+	Clock services.Clock
 }
 
 // GET /auth/check-username?username=xxx
+// Deliberately reports availability; the OTP verification path is the one
+// that must not reveal whether an identifier is known.
 func (a *App) CheckUsernameHandler(c *fiber.Ctx) error {
 	username := c.Query("username")
 	if username == "" || len(username) < 3 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username must be at least 3 characters"})
 	}
 
-	var user models.User
-	if err := a.DB.Where("identifier = ?", username).First(&user).Error; err == nil {
-		return c.JSON(fiber.Map{"available": false, "message": "Username already taken"})
-	} else if err != gorm.ErrRecordNotFound {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	available, cached := a.Lookups.Get(username)
+	if !cached {
+		var user models.User
+		err := a.dbFor(c).Where("identifier = ?", username).First(&user).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+		available = err == gorm.ErrRecordNotFound
+		a.Lookups.Put(username, available)
 	}
 
+	if !available {
+		return c.JSON(fiber.Map{"available": false, "message": "Username already taken"})
+	}
 	return c.JSON(fiber.Map{"available": true, "message": "Username is available"})
 }
 
+// dbFor scopes a query to the request, so slow-query logs carry its route
+func (a *App) dbFor(c *fiber.Ctx) *gorm.DB {
+	return a.DB.WithContext(c.UserContext())
+}
+
 // POST /auth/register
 func (a *App) RegisterHandler(c *fiber.Ctx) error {
-	var req struct {
-		Identifier string `json:"identifier"`
-	}
+	var req RegisterRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+		return invalidBody(c, err)
 	}
 	if req.Identifier == "" || len(req.Identifier) < 3 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "identifier must be at least 3 characters"})
@@ -58,49 +83,66 @@ func (a *App) RegisterHandler(c *fiber.Ctx) error {
 
 	// Check if user already exists
 	var existingUser models.User
-	if err := a.DB.Where("identifier = ?", req.Identifier).First(&existingUser).Error; err == nil {
+	if err := a.dbFor(c).Where("identifier = ?", req.Identifier).First(&existingUser).Error; err == nil {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "username already taken"})
 	} else if err != gorm.ErrRecordNotFound {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 	}
 
-	otp, err := a.OTPService.CreateRegistrationSession(req.Identifier)
+	otp, err := a.OTPService.CreateRegistrationSession(c.UserContext(), req.Identifier)
+	var throttled *services.OTPThrottledError
+	if errors.As(err, &throttled) {
+		retry := int(throttled.RetryAfter.Round(time.Second).Seconds())
+		if retry < 1 {
+			retry = 1
+		}
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retry))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "otp_throttled", "retry_after": retry})
+	}
 	if err != nil {
+		log.Printf("registration session for %s: %v", req.Identifier, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create session"})
 	}
-	// In dev return OTP; in prod send via SMS/email
-	return c.JSON(fiber.Map{"status": "ok", "otp": otp})
+	if a.Cfg.OTPReturnInResponse {
+		return c.JSON(fiber.Map{"status": "ok", "otp": otp})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
 }
 
 // POST /auth/verify-2fa
 func (a *App) Verify2FAHandler(c *fiber.Ctx) error {
-	var req struct {
-		Identifier     string `json:"identifier"`
-		OTP            string `json:"otp"`
-		IdentityPubKey string `json:"identity_pubkey"` // Required for new users
-	}
+	var req Verify2FARequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+		return invalidBody(c, err)
 	}
 
 	ok, err := a.OTPService.VerifyRegistrationSession(req.Identifier, req.OTP)
+	if errors.Is(err, services.ErrOTPConsumed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "otp_already_used"})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "verification failed"})
 	}
 	if !ok {
+		// Attribute the failure when the identifier has an account; the
+		// identifier itself stays out of the log
+		var target models.User
+		a.dbFor(c).Select("id").Where("identifier = ?", req.Identifier).Limit(1).Find(&target)
+		a.Audit.Record(services.AuditEntry{Event: services.AuditOTPFailed, UserID: target.ID, IP: c.IP()})
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid otp"})
 	}
 
+	registered := false
 	var user models.User
-	if err := a.DB.Where("identifier = ?", req.Identifier).First(&user).Error; err != nil {
+	if err := a.dbFor(c).Where("identifier = ?", req.Identifier).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			// New user - require identity public key
-			if req.IdentityPubKey == "" {
+			if len(req.IdentityPubKey) == 0 {
 				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "identity_pubkey required for new users"})
 			}
-			identityPub, err := base64.StdEncoding.DecodeString(req.IdentityPubKey)
-			if err != nil || len(identityPub) != 32 {
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pubkey format"})
+			identityPub := []byte(req.IdentityPubKey)
+			if err := utils.ValidateX25519PublicKey(identityPub); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pubkey", "reason": err.Error()})
 			}
 
 			id, err := uuid.NewV4()
@@ -112,19 +154,35 @@ func (a *App) Verify2FAHandler(c *fiber.Ctx) error {
 				Identifier:     req.Identifier,
 				IdentityPubKey: identityPub,
 			}
-			if err := a.DB.Create(&user).Error; err != nil {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create user"})
+			if err := a.dbFor(c).Create(&user).Error; err != nil {
+				// Another verification for this identifier (a different live
+				// code) may have created the account first; the caller has
+				// proven control of the identifier, so sign in to that one.
+				// A fresh struct, since First would also match on user's new ID
+				var existing models.User
+				if lookupErr := a.dbFor(c).Where("identifier = ?", req.Identifier).First(&existing).Error; lookupErr != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create user"})
+				}
+				user = existing
+			} else {
+				registered = true
 			}
+			a.Lookups.Forget(user.Identifier)
 		} else {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 		}
 	}
 
 	// Generate JWT token
-	token, err := generateJWT(user.ID, a.Cfg.JWTSigningKey)
+	token, err := a.issueJWT(user.ID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate token"})
 	}
+	login := services.AuditEntry{Event: services.AuditLogin, UserID: user.ID, IP: c.IP()}
+	if registered {
+		login.Detail = "registered"
+	}
+	a.Audit.Record(login)
 
 	return c.JSON(fiber.Map{
 		"status":  "ok",
@@ -133,6 +191,26 @@ func (a *App) Verify2FAHandler(c *fiber.Ctx) error {
 	})
 }
 
+// GET /auth/pending?identifier=xxx
+// Responses have the same shape whether or not the identifier exists so the
+// endpoint can't be used to enumerate accounts.
+func (a *App) PendingVerificationHandler(c *fiber.Ctx) error {
+	identifier := c.Query("identifier")
+	if identifier == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "identifier required"})
+	}
+
+	remaining, pending, err := a.OTPService.PendingRegistrationSession(identifier)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	return c.JSON(fiber.Map{
+		"pending":    pending,
+		"expires_in": int(remaining.Seconds()),
+	})
+}
+
 // POST /api/keys/prekeys/upload
 func (a *App) PreKeysUploadHandler(c *fiber.Ctx) error {
 	userID, err := GetUserID(c)
@@ -140,64 +218,80 @@ func (a *App) PreKeysUploadHandler(c *fiber.Ctx) error {
 		return err
 	}
 
-	var payload struct {
-		IdentityPub     string   `json:"identity_pub"`
-		SigningPub      string   `json:"signing_pub"`
-		SignedPreKey    string   `json:"signed_prekey"`
-		SignedPreKeySig string   `json:"signed_prekey_signature"`
-		OneTimePreKeys  []string `json:"one_time_prekeys"`
-		DeviceID        string   `json:"device_id"`
-		DevicePubKey    string   `json:"device_pubkey"`
-	}
+	var payload PreKeyUploadRequest
 	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+		return invalidBody(c, err)
 	}
 
-	identityPub, err := base64.StdEncoding.DecodeString(payload.IdentityPub)
-	if err != nil || len(identityPub) != 32 {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pub"})
+	identityPub := []byte(payload.IdentityPub)
+	if err := utils.ValidateX25519PublicKey(identityPub); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pub", "reason": err.Error()})
 	}
 
-	signingPub, err := base64.StdEncoding.DecodeString(payload.SigningPub)
-	if err != nil || len(signingPub) != 32 {
+	signingPub := []byte(payload.SigningPub)
+	if len(signingPub) != 32 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signing_pub"})
 	}
 
-	a.DB.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{"identity_pub_key": identityPub})
+	sigBytes := []byte(payload.SignedPreKeySig)
+	spkBytes := []byte(payload.SignedPreKey)
 
-	sigBytes, err := base64.StdEncoding.DecodeString(payload.SignedPreKeySig)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signature"})
-	}
-
-	spkBytes, err := base64.StdEncoding.DecodeString(payload.SignedPreKey)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey"})
+	spkID, ok := signedPreKeyID(payload.SignedPreKeyID)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey_id", "field": "signed_prekey_id"})
 	}
-
-	if !utils.VerifyEd25519(signingPub, spkBytes, sigBytes) {
+	if !a.verifySignedPreKey(userID, signingPub, spkID, spkBytes, sigBytes) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "signature verification failed"})
 	}
 
-	if err := a.PreKeySvc.StoreSignedPreKey(userID, "signed-prekey-v1", spkBytes, sigBytes, time.Now().Add(30*24*time.Hour)); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to store signed prekey"})
-	}
-
+	// Undecodable one-time prekeys are skipped rather than failing the whole
+	// upload, but the response reports how many were stored so the client
+	// can tell and re-upload
 	var otps [][]byte
-	for _, s := range payload.OneTimePreKeys {
+	var otpIndex []int
+	for i, s := range payload.OneTimePreKeys {
 		b, err := base64.StdEncoding.DecodeString(s)
-		if err != nil {
+		if err != nil || len(b) == 0 {
+			log.Printf("prekey upload for %s: skipping one-time prekey %d: invalid base64", userID, i)
 			continue
 		}
 		otps = append(otps, b)
+		otpIndex = append(otpIndex, i)
 	}
-	if err := a.PreKeySvc.AddOneTimePreKeys(userID, otps); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to store one-time prekeys"})
+
+	if payload.RegistrationID != nil && !utils.ValidRegistrationID(*payload.RegistrationID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "registration_id must be between 1 and 16383", "field": "registration_id"})
+	}
+	if payload.AssignRegistrationID && payload.RegistrationID == nil && !a.Cfg.RegistrationIDAssignment {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "server-assigned registration IDs are disabled", "field": "assign_registration_id"})
 	}
 
-	devPub, err := base64.StdEncoding.DecodeString(payload.DevicePubKey)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid device_pubkey"})
+	// Device info is optional: with device_pubkey the device is registered or
+	// refreshed; without it the keys go to an existing device, named by
+	// device_id or implied when the account has exactly one
+	devPub := []byte(payload.DevicePubKey)
+	if len(devPub) > 0 {
+		if payload.DeviceID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "device_id required with device_pubkey", "field": "device_id"})
+		}
+	} else {
+		q := a.dbFor(c).Where("user_id = ?", userID)
+		if payload.DeviceID != "" {
+			q = q.Where("device_id = ?", payload.DeviceID)
+		}
+		var devices []models.Device
+		if err := q.Limit(2).Find(&devices).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+		switch {
+		case len(devices) == 0 && payload.DeviceID != "":
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown device_id; include device_pubkey to register it", "field": "device_id"})
+		case len(devices) == 0:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "device_id and device_pubkey required for the first device", "field": "device_pubkey"})
+		case len(devices) > 1:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "device_id required", "field": "device_id"})
+		}
+		payload.DeviceID = devices[0].DeviceID
 	}
 
 	did, err := uuid.NewV4()
@@ -205,20 +299,273 @@ func (a *App) PreKeysUploadHandler(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate device id"})
 	}
 
-	device := models.Device{
-		ID:           did,
-		UserID:       userID,
-		DeviceID:     payload.DeviceID,
-		DevicePubKey: devPub,
+	var current models.User
+	if err := a.dbFor(c).Select("id", "identity_pub_key").Where("id = ?", userID).First(&current).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 	}
-	if err := a.DB.Create(&device).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create device"})
+	var knownDevices int64
+	if len(devPub) > 0 {
+		if err := a.dbFor(c).Model(&models.Device{}).Where("user_id = ? AND device_id = ?", userID, payload.DeviceID).Count(&knownDevices).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
 	}
 
-	return c.JSON(fiber.Map{"status": "ok"})
+	// Identity, keys and device are written atomically so a failure part-way
+	// through never leaves the account half-initialized
+	now := a.Clock.Now()
+	var failure string
+	var regID int
+	var otpIDs []uuid.UUID
+	err = db.WithTx(c.UserContext(), a.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{"identity_pub_key": identityPub}).Error; err != nil {
+			failure = "failed to update identity key"
+			return err
+		}
+
+		prekeys := a.PreKeySvc.WithDB(tx)
+		if err := prekeys.StoreSignedPreKey(userID, payload.DeviceID, spkID, spkBytes, sigBytes); err != nil {
+			failure = "failed to store signed prekey"
+			return err
+		}
+		if otpIDs, err = prekeys.AddOneTimePreKeys(userID, payload.DeviceID, otps); err != nil {
+			failure = "failed to store one-time prekeys"
+			return err
+		}
+		if regID, err = registrationIDFor(tx, userID, payload.DeviceID, payload.RegistrationID, payload.AssignRegistrationID); err != nil {
+			failure = "failed to assign registration id"
+			return err
+		}
+
+		if len(devPub) == 0 {
+			updates := map[string]interface{}{"last_seen_at": now, "signing_pub_key": signingPub}
+			if regID > 0 {
+				updates["registration_id"] = regID
+			}
+			if err := tx.Model(&models.Device{}).Where("user_id = ? AND device_id = ?", userID, payload.DeviceID).Updates(updates).Error; err != nil {
+				if regID > 0 && db.IsUniqueViolation(tx, err) {
+					return errRegistrationIDTaken
+				}
+				failure = "failed to update device"
+				return err
+			}
+			return nil
+		}
+		device := models.Device{
+			ID:            did,
+			UserID:        userID,
+			DeviceID:      payload.DeviceID,
+			DevicePubKey:  devPub,
+			SigningPubKey: signingPub,
+			LastSeenAt:    now,
+		}
+		refresh := []string{"device_pub_key", "signing_pub_key", "last_seen_at"}
+		if regID > 0 {
+			device.RegistrationID = regID
+			refresh = append(refresh, "registration_id")
+		}
+		// A re-upload from a known device refreshes its row instead of
+		// adding another entry to the bundle's device list
+		upsert := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "device_id"}},
+			DoUpdates: clause.AssignmentColumns(refresh),
+		}
+		if err := tx.Clauses(upsert).Create(&device).Error; err != nil {
+			// Another upload took the ID after registrationIDFor checked it;
+			// the upsert only absorbs (user_id, device_id) conflicts
+			if regID > 0 && db.IsUniqueViolation(tx, err) {
+				return errRegistrationIDTaken
+			}
+			failure = "failed to create device"
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, errRegistrationIDTaken) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "registration_id_taken", "field": "registration_id"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": failure})
+	}
+	device := "device_id=" + payload.DeviceID
+	a.Audit.Record(services.AuditEntry{Event: services.AuditKeyUpload, UserID: userID, IP: c.IP(), Detail: device})
+	if len(devPub) > 0 && knownDevices == 0 {
+		a.Audit.Record(services.AuditEntry{Event: services.AuditDeviceAdded, UserID: userID, IP: c.IP(), Detail: device})
+	}
+	if len(current.IdentityPubKey) > 0 && !bytes.Equal(current.IdentityPubKey, identityPub) {
+		a.Audit.Record(services.AuditEntry{Event: services.AuditIdentityChanged, UserID: userID, IP: c.IP(), Detail: device})
+		a.notifyIdentityChanged(userID, identityPub)
+	}
+
+	ids := make([]string, len(payload.OneTimePreKeys))
+	for i, id := range otpIDs {
+		ids[otpIndex[i]] = id.String()
+	}
+	resp := fiber.Map{
+		"status":                     "ok",
+		"one_time_prekeys_requested": len(payload.OneTimePreKeys),
+		"one_time_prekeys_stored":    len(otps),
+		"one_time_prekey_ids":        ids,
+		"device_id":                  payload.DeviceID,
+	}
+	if regID > 0 {
+		resp["registration_id"] = regID
+	}
+	return c.JSON(resp)
+}
+
+var errRegistrationIDTaken = errors.New("registration id taken")
+
+// registrationIDFor returns the registration ID to store for the device, or 0
+// to leave the stored one alone. A requested ID must not belong to another of
+// the user's devices; with assign and no request, the device keeps the ID it
+// has or gets a free one.
+func registrationIDFor(tx *gorm.DB, userID uuid.UUID, deviceID string, requested *int, assign bool) (int, error) {
+	var devices []models.Device
+	if err := tx.Select("device_id", "registration_id").Where("user_id = ? AND registration_id > 0", userID).Find(&devices).Error; err != nil {
+		return 0, err
+	}
+	used := make(map[int]bool, len(devices))
+	current := 0
+	for _, d := range devices {
+		if d.DeviceID == deviceID {
+			current = d.RegistrationID
+			continue
+		}
+		used[d.RegistrationID] = true
+	}
+
+	switch {
+	case requested != nil:
+		if used[*requested] {
+			return 0, errRegistrationIDTaken
+		}
+		return *requested, nil
+	case !assign:
+		return 0, nil
+	case current > 0:
+		return current, nil
+	}
+	id, ok := utils.FreeRegistrationID(used)
+	if !ok {
+		return 0, errors.New("no free registration id")
+	}
+	return id, nil
+}
+
+// POST /api/keys/signed-prekey
+// Rotates a device's signed prekey without touching the device row, identity
+// key or one-time prekeys. The signature is checked against the signing key
+// stored by the device's last full upload.
+func (a *App) RotateSignedPreKeyHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req SignedPreKeyRotateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	spkBytes, sigBytes := []byte(req.SignedPreKey), []byte(req.SignedPreKeySig)
+	if len(spkBytes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey", "field": "signed_prekey"})
+	}
+	spkID, ok := signedPreKeyID(req.SignedPreKeyID)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey_id", "field": "signed_prekey_id"})
+	}
+
+	q := a.dbFor(c).Where("user_id = ?", userID)
+	if req.DeviceID != "" {
+		q = q.Where("device_id = ?", req.DeviceID)
+	}
+	var devices []models.Device
+	if err := q.Limit(2).Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	switch {
+	case len(devices) == 0:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "device not found", "field": "device_id"})
+	case len(devices) > 1:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "device_id required", "field": "device_id"})
+	}
+	device := devices[0]
+	if len(device.SigningPubKey) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "signing key unknown; upload keys to register it"})
+	}
+
+	if !a.verifySignedPreKey(userID, device.SigningPubKey, spkID, spkBytes, sigBytes) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "signature verification failed"})
+	}
+	if err := a.PreKeySvc.WithDB(a.dbFor(c)).StoreSignedPreKey(userID, device.DeviceID, spkID, spkBytes, sigBytes); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to store signed prekey"})
+	}
+	a.Audit.Record(services.AuditEntry{Event: services.AuditKeyUpload, UserID: userID, IP: c.IP(), Detail: "device_id=" + device.DeviceID + " signed_prekey"})
+	return c.JSON(fiber.Map{"status": "ok", "device_id": device.DeviceID, "signed_prekey_id": spkID})
+}
+
+// maxSignedPreKeyIDLength bounds client-chosen signed prekey IDs
+const maxSignedPreKeyIDLength = 64
+
+// signedPreKeyID returns the key ID a signed prekey is stored and verified
+// under: the client's, or utils.SignedPreKeyID for clients that don't send
+// one. IDs must be printable ASCII.
+func signedPreKeyID(id string) (string, bool) {
+	if id == "" {
+		return utils.SignedPreKeyID, true
+	}
+	if len(id) > maxSignedPreKeyIDLength {
+		return "", false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+// DELETE /api/keys/prekeys/onetime/:key_id
+// Revokes a single one-time prekey the owner believes was leaked, without
+// rotating anything else.
+func (a *App) RevokeOneTimePreKeyHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	keyID, err := parseUUIDField("key_id", c.Params("key_id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+
+	if err := a.PreKeySvc.WithDB(a.dbFor(c)).RevokeOneTimePreKey(userID, keyID); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "one-time prekey not found"})
+		case errors.Is(err, services.ErrPreKeyConsumed):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "already_consumed"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(fiber.Map{"status": "revoked"})
+}
+
+// verifySignedPreKey checks sig over the domain-separated signed-prekey
+// message for keyID, falling back to the bare key only when
+// SPKDomainSeparation is off
+func (a *App) verifySignedPreKey(userID uuid.UUID, signingPub []byte, keyID string, spk, sig []byte) bool {
+	if utils.VerifyEd25519(signingPub, utils.SignedPreKeyMessage(keyID, spk), sig) {
+		return true
+	}
+	if a.Cfg.SPKDomainSeparation || !utils.VerifyEd25519(signingPub, spk, sig) {
+		return false
+	}
+	log.Printf("signed prekey for %s: accepted signature over the bare key", userID)
+	return true
 }
 
 // GET /auth/server-pubkey
+// The same key verifies bundle_signature on key bundles (RSA-PSS SHA256).
 func (a *App) ServerPublicKeyHandler(c *fiber.Ctx) error {
 	// Export in PKIX/SPKI format for Web Crypto API
 	pubBytes, err := x509.MarshalPKIXPublicKey(&a.ServerPriv.PublicKey)
@@ -0,0 +1,764 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/utils"
+)
+
+// uploadBody builds a valid prekey upload signed with signingPriv
+func uploadBody(t *testing.T, signingPriv ed25519.PrivateKey) map[string]interface{} {
+	t.Helper()
+	spk := x25519Key(t)
+	enc := base64.StdEncoding.EncodeToString
+	return map[string]interface{}{
+		"identity_pub":            enc(x25519Key(t)),
+		"signing_pub":             enc(signingPriv.Public().(ed25519.PublicKey)),
+		"signed_prekey":           enc(spk),
+		"signed_prekey_signature": enc(ed25519.Sign(signingPriv, utils.SignedPreKeyMessage(utils.SignedPreKeyID, spk))),
+		"one_time_prekeys":        []string{enc(x25519Key(t))},
+		"device_id":               "device-1",
+	}
+}
+
+func TestUploadEmptyDevicePubKeyKeepsDeviceKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	var before models.Device
+	a.DB.Where("user_id = ?", user.ID).First(&before)
+
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	for _, devPub := range []interface{}{nil, ""} {
+		body := uploadBody(t, signingPriv)
+		body["device_pubkey"] = devPub
+		if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK {
+			t.Fatalf("device_pubkey=%q: %d %v", devPub, status, resp)
+		}
+		var after models.Device
+		a.DB.Where("user_id = ?", user.ID).First(&after)
+		if !bytes.Equal(after.DevicePubKey, before.DevicePubKey) {
+			t.Fatalf("device_pubkey=%q replaced the device key with %x", devPub, after.DevicePubKey)
+		}
+	}
+}
+
+func TestUploadStampsDeviceWithAppClock(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", uploadBody(t, signingPriv)); status != fiber.StatusOK {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+	var device models.Device
+	a.DB.Where("user_id = ?", user.ID).First(&device)
+	if !device.LastSeenAt.Equal(a.Clock.Now()) {
+		t.Fatalf("last_seen_at = %v, want %v", device.LastSeenAt, a.Clock.Now())
+	}
+}
+
+func TestRepeatedDeviceUploadUpdatesInPlace(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	_, signingPriv, _ := ed25519.GenerateKey(rand.Reader)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+
+	var pubkeys [][]byte
+	for i := 0; i < 2; i++ {
+		pub := x25519Key(t)
+		pubkeys = append(pubkeys, pub)
+		body := uploadBody(t, signingPriv)
+		body["device_pubkey"] = base64.StdEncoding.EncodeToString(pub)
+		if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK {
+			t.Fatalf("upload %d: %d %v", i, status, resp)
+		}
+		clock.Advance(time.Hour)
+	}
+
+	var devices []models.Device
+	a.DB.Where("user_id = ?", user.ID).Find(&devices)
+	if len(devices) != 1 {
+		t.Fatalf("%d device rows after re-registering one device", len(devices))
+	}
+	if !bytes.Equal(devices[0].DevicePubKey, pubkeys[1]) || !devices[0].LastSeenAt.Equal(clock.Now().Add(-time.Hour)) {
+		t.Fatalf("device not updated: %+v", devices[0])
+	}
+
+	// The unique index backs the upsert
+	dup := devices[0]
+	dup.ID = uuid.Must(uuid.NewV4())
+	if err := a.DB.Create(&dup).Error; err == nil {
+		t.Fatal("duplicate (user_id, device_id) row inserted")
+	}
+}
+
+func TestUploadDeviceInfoIsOptional(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	countOTKs := func(device string) int64 {
+		n, _ := a.PreKeySvc.CountOneTimePreKeys(user.ID, device)
+		return n
+	}
+
+	// Keys only: with a single device, device_id may be left out too
+	body := uploadBody(t, signingPriv)
+	delete(body, "device_id")
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK || resp["device_id"] != "device-1" {
+		t.Fatalf("keys only: %d %v", status, resp)
+	}
+	if n := countOTKs("device-1"); n != 1 {
+		t.Fatalf("keys-only upload stored %d one-time prekeys on device-1", n)
+	}
+
+	// Keys and device: a new device is registered alongside the first
+	body = uploadBody(t, signingPriv)
+	body["device_id"] = "device-2"
+	body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK || resp["device_id"] != "device-2" {
+		t.Fatalf("keys and device: %d %v", status, resp)
+	}
+	var devices int64
+	a.DB.Model(&models.Device{}).Where("user_id = ?", user.ID).Count(&devices)
+	if devices != 2 || countOTKs("device-2") != 1 {
+		t.Fatalf("%d devices, %d keys on device-2", devices, countOTKs("device-2"))
+	}
+
+	// Partial or ambiguous device info is rejected before anything is written
+	for name, tc := range map[string]struct {
+		deviceID, devicePub interface{}
+		field               string
+	}{
+		"pubkey without id":          {nil, base64.StdEncoding.EncodeToString(x25519Key(t)), "device_id"},
+		"unknown id without pubkey":  {"device-3", nil, "device_id"},
+		"no id with several devices": {nil, nil, "device_id"},
+	} {
+		body := uploadBody(t, signingPriv)
+		body["device_id"], body["device_pubkey"] = tc.deviceID, tc.devicePub
+		if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusBadRequest || resp["field"] != tc.field {
+			t.Errorf("%s: %d %v", name, status, resp)
+		}
+	}
+	if countOTKs("device-1") != 1 || countOTKs("device-2") != 1 {
+		t.Fatal("a rejected upload stored one-time prekeys")
+	}
+
+	// The first upload of an account must describe its device
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	first := serve(fiber.MethodPost, "/upload", bob.ID, a.PreKeysUploadHandler)
+	if status, resp := do(t, first, fiber.MethodPost, "/upload", uploadBody(t, signingPriv)); status != fiber.StatusBadRequest || resp["field"] != "device_id" {
+		t.Fatalf("first upload with unknown device_id: %d %v", status, resp)
+	}
+	body = uploadBody(t, signingPriv)
+	delete(body, "device_id")
+	if status, resp := do(t, first, fiber.MethodPost, "/upload", body); status != fiber.StatusBadRequest || resp["field"] != "device_pubkey" {
+		t.Fatalf("first upload without device info: %d %v", status, resp)
+	}
+}
+
+// capturingNotifier records the last code it was asked to deliver
+type capturingNotifier struct {
+	identifier, channel, code string
+}
+
+func (n *capturingNotifier) SendOTP(_ context.Context, identifier, channel, code string) error {
+	n.identifier, n.channel, n.code = identifier, channel, code
+	return nil
+}
+
+func TestUploadReportsStoredOneTimePreKeys(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	_, signingPriv, _ := ed25519.GenerateKey(rand.Reader)
+	body := uploadBody(t, signingPriv)
+	body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+	good := base64.StdEncoding.EncodeToString(x25519Key(t))
+	body["one_time_prekeys"] = []string{good, "not base64!", good, ""}
+
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	status, resp := do(t, upload, fiber.MethodPost, "/upload", body)
+	if status != fiber.StatusOK || resp["one_time_prekeys_requested"] != float64(4) || resp["one_time_prekeys_stored"] != float64(2) {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+	var stored []models.OneTimePreKey
+	a.DB.Where("user_id = ?", user.ID).Find(&stored)
+	if len(stored) != 2 {
+		t.Fatalf("%d rows stored, response said 2", len(stored))
+	}
+	// IDs line up with the request, empty where a key was skipped
+	ids := resp["one_time_prekey_ids"].([]interface{})
+	if len(ids) != 4 || ids[1] != "" || ids[3] != "" {
+		t.Fatalf("ids = %v", ids)
+	}
+	for _, i := range []int{0, 2} {
+		var k models.OneTimePreKey
+		if err := a.DB.First(&k, "id = ? AND user_id = ?", ids[i], user.ID).Error; err != nil {
+			t.Fatalf("id %d (%v): %v", i, ids[i], err)
+		}
+	}
+}
+
+func TestRegisterDeliversCodeWithoutEchoingIt(t *testing.T) {
+	a, _ := newTestApp(t)
+	notifier := &capturingNotifier{}
+	a.OTPService.Notifier = notifier
+	register := serve(fiber.MethodPost, "/register", uuid.Nil, a.RegisterHandler)
+
+	status, body := do(t, register, fiber.MethodPost, "/register", map[string]string{"identifier": "frank@example.com"})
+	if status != fiber.StatusOK || body["otp"] != nil {
+		t.Fatalf("register: %d %v", status, body)
+	}
+	if notifier.identifier != "frank@example.com" || notifier.channel != services.ChannelEmail || notifier.code == "" {
+		t.Fatalf("notifier got %+v", notifier)
+	}
+
+	// Development builds may echo the delivered code
+	a.Cfg.OTPReturnInResponse = true
+	status, body = do(t, register, fiber.MethodPost, "/register", map[string]string{"identifier": "+15550103"})
+	if status != fiber.StatusOK || body["otp"] != notifier.code || notifier.channel != services.ChannelSMS {
+		t.Fatalf("register with echo: %d %v, notifier %+v", status, body, notifier)
+	}
+}
+
+func TestRegisterTooSoonIsThrottled(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.OTPResendIntervalSec = 60
+	a.OTPService.Clock = a.Clock
+	a.OTPService.Notifier = &capturingNotifier{}
+	register := serve(fiber.MethodPost, "/register", uuid.Nil, a.RegisterHandler)
+
+	if status, body := do(t, register, fiber.MethodPost, "/register", map[string]string{"identifier": "heidi@example.com"}); status != fiber.StatusOK {
+		t.Fatalf("first: %d %v", status, body)
+	}
+	a.Clock.(*services.ManualClock).Advance(15 * time.Second)
+	status, body := do(t, register, fiber.MethodPost, "/register", map[string]string{"identifier": "heidi@example.com"})
+	if status != fiber.StatusTooManyRequests || body["error"] != "otp_throttled" || body["retry_after"] != float64(45) {
+		t.Fatalf("second: %d %v", status, body)
+	}
+	var n int64
+	a.DB.Model(&models.RegistrationSession{}).Where("identifier = ?", "heidi@example.com").Count(&n)
+	if n != 1 {
+		t.Fatalf("%d sessions after a throttled request", n)
+	}
+}
+
+func TestPendingVerificationStates(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	a.OTPService.Clock = clock
+	a.OTPService.Notifier = &capturingNotifier{}
+	pending := serve(fiber.MethodGet, "/pending", uuid.Nil, a.PendingVerificationHandler)
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "grace@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(4 * time.Minute)
+	status, body := do(t, pending, fiber.MethodGet, "/pending?identifier=grace@example.com", nil)
+	if status != fiber.StatusOK || body["pending"] != true || body["expires_in"] != float64(6*60) {
+		t.Fatalf("pending: %d %v", status, body)
+	}
+	if _, ok := body["otp"]; ok || len(body) != 2 {
+		t.Fatalf("pending response has extra fields: %v", body)
+	}
+
+	// Expired and unknown identifiers look the same
+	clock.Advance(7 * time.Minute)
+	for _, identifier := range []string{"grace@example.com", "nobody@example.com"} {
+		status, body := do(t, pending, fiber.MethodGet, "/pending?identifier="+identifier, nil)
+		if status != fiber.StatusOK || body["pending"] != false || body["expires_in"] != float64(0) || len(body) != 2 {
+			t.Fatalf("%s: %d %v", identifier, status, body)
+		}
+	}
+
+	if status, _ := do(t, pending, fiber.MethodGet, "/pending", nil); status != fiber.StatusBadRequest {
+		t.Fatalf("missing identifier: %d", status)
+	}
+}
+
+func TestVerify2FAFailuresLookAlike(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	a.OTPService.Clock = clock
+	a.OTPService.Notifier = &capturingNotifier{}
+	dbtest.SeedUser(t, a.DB, "known@example.com")
+	verify := serve(fiber.MethodPost, "/verify", uuid.Nil, a.Verify2FAHandler)
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "expired@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(11 * time.Minute)
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "known@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong code for an account, an expired session and an identifier
+	// never seen all get the same answer
+	for _, identifier := range []string{"known@example.com", "expired@example.com", "nobody@example.com"} {
+		status, body := do(t, verify, fiber.MethodPost, "/verify", map[string]string{"identifier": identifier, "otp": "not-a-code"})
+		if status != fiber.StatusUnauthorized || len(body) != 1 || body["error"] != "invalid otp" {
+			t.Fatalf("%s: %d %v", identifier, status, body)
+		}
+	}
+}
+
+// rendezvous returns a query callback that holds the first n queries on
+// table until all n have run, forcing concurrent requests to interleave
+func rendezvous(t *testing.T, table string, n int) func(*gorm.DB) {
+	var mu sync.Mutex
+	arrived := 0
+	release := make(chan struct{})
+	return func(tx *gorm.DB) {
+		if tx.Statement.Table != table {
+			return
+		}
+		mu.Lock()
+		if arrived == n {
+			mu.Unlock()
+			return
+		}
+		if arrived++; arrived == n {
+			close(release)
+		}
+		mu.Unlock()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			mu.Lock()
+			t.Errorf("only %d of %d queries on %s arrived", arrived, n, table)
+			mu.Unlock()
+		}
+	}
+}
+
+type verifyResult struct {
+	status int
+	body   map[string]interface{}
+	err    error
+}
+
+func TestConcurrentVerifyConsumesCodeOnce(t *testing.T) {
+	a, _ := newTestApp(t)
+	notifier := &capturingNotifier{}
+	a.OTPService.Notifier = notifier
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Both requests read the session before either consumes it
+	a.DB.Callback().Query().After("gorm:query").Register("test:rendezvous", rendezvous(t, "registration_sessions", 2))
+	verify := serve(fiber.MethodPost, "/verify", uuid.Nil, a.Verify2FAHandler)
+	body := map[string]string{
+		"identifier":      "alice@example.com",
+		"otp":             notifier.code,
+		"identity_pubkey": base64.StdEncoding.EncodeToString(x25519Key(t)),
+	}
+
+	results := make(chan verifyResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			status, resp, err := tryDo(verify, fiber.MethodPost, "/verify", body)
+			results <- verifyResult{status, resp, err}
+		}()
+	}
+	byStatus := map[int]map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		byStatus[r.status] = r.body
+	}
+	if ok := byStatus[fiber.StatusOK]; ok == nil || ok["token"] == nil {
+		t.Fatalf("no verification succeeded: %v", byStatus)
+	}
+	if conflict := byStatus[fiber.StatusConflict]; conflict == nil || conflict["error"] != "otp_already_used" {
+		t.Fatalf("second verification: %v", byStatus)
+	}
+	var users int64
+	a.DB.Model(&models.User{}).Where("identifier = ?", "alice@example.com").Count(&users)
+	if users != 1 {
+		t.Fatalf("%d accounts created", users)
+	}
+}
+
+func TestConcurrentSignUpSharesOneAccount(t *testing.T) {
+	a, _ := newTestApp(t)
+	notifier := &capturingNotifier{}
+	a.OTPService.Notifier = notifier
+	var codes []string
+	for i := 0; i < 2; i++ {
+		if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, notifier.code)
+	}
+	// Both requests find no account before either creates one
+	a.DB.Callback().Query().After("gorm:query").Register("test:rendezvous", rendezvous(t, "users", 2))
+	verify := serve(fiber.MethodPost, "/verify", uuid.Nil, a.Verify2FAHandler)
+	send := func(code string, identityPub []byte, results chan<- verifyResult) {
+		status, resp, err := tryDo(verify, fiber.MethodPost, "/verify", map[string]string{
+			"identifier":      "alice@example.com",
+			"otp":             code,
+			"identity_pubkey": base64.StdEncoding.EncodeToString(identityPub),
+		})
+		results <- verifyResult{status, resp, err}
+	}
+
+	// The newest code has to be consumed before the older one is checked
+	results := make(chan verifyResult, 2)
+	go send(codes[1], x25519Key(t), results)
+	waitFor(t, func() bool {
+		var n int64
+		a.DB.Model(&models.RegistrationSession{}).Count(&n)
+		return n == 1
+	})
+	go send(codes[0], x25519Key(t), results)
+
+	var userIDs []interface{}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.status != fiber.StatusOK {
+			t.Fatalf("verify: %d %v", r.status, r.body)
+		}
+		userIDs = append(userIDs, r.body["user_id"])
+	}
+	if userIDs[0] != userIDs[1] {
+		t.Fatalf("signed in to different accounts: %v", userIDs)
+	}
+	var users int64
+	a.DB.Model(&models.User{}).Where("identifier = ?", "alice@example.com").Count(&users)
+	if users != 1 {
+		t.Fatalf("%d accounts created", users)
+	}
+}
+
+func TestLowOrderIdentityKeyIsRejected(t *testing.T) {
+	a, _ := newTestApp(t)
+	notifier := &capturingNotifier{}
+	a.OTPService.Notifier = notifier
+	lowOrder := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	if _, err := a.OTPService.CreateRegistrationSession(context.Background(), "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	verify := serve(fiber.MethodPost, "/verify", uuid.Nil, a.Verify2FAHandler)
+	status, body := do(t, verify, fiber.MethodPost, "/verify", map[string]string{
+		"identifier":      "alice@example.com",
+		"otp":             notifier.code,
+		"identity_pubkey": lowOrder,
+	})
+	if status != fiber.StatusBadRequest || body["error"] != "invalid identity_pubkey" || body["reason"] != "low_order" {
+		t.Fatalf("verify: %d %v", status, body)
+	}
+
+	user := dbtest.SeedUser(t, a.DB, "bob")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	req := uploadBody(t, signingPriv)
+	req["identity_pub"] = lowOrder
+	status, body = do(t, upload, fiber.MethodPost, "/upload", req)
+	if status != fiber.StatusBadRequest || body["error"] != "invalid identity_pub" || body["reason"] != "low_order" {
+		t.Fatalf("upload: %d %v", status, body)
+	}
+	var stored models.User
+	a.DB.First(&stored, "id = ?", user.ID)
+	if !bytes.Equal(stored.IdentityPubKey, user.IdentityPubKey) {
+		t.Fatal("rejected identity key was stored")
+	}
+}
+
+func TestSignedPreKeySignatureMustBeDomainSeparated(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	enc := base64.StdEncoding.EncodeToString
+	signed := func(message func(spk []byte) []byte) map[string]interface{} {
+		body := uploadBody(t, signingPriv)
+		spk := x25519Key(t)
+		body["signed_prekey"] = enc(spk)
+		body["signed_prekey_signature"] = enc(ed25519.Sign(signingPriv, message(spk)))
+		return body
+	}
+	domainSeparated := func(spk []byte) []byte { return utils.SignedPreKeyMessage(utils.SignedPreKeyID, spk) }
+	bare := func(spk []byte) []byte { return spk }
+
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", signed(domainSeparated)); status != fiber.StatusOK {
+		t.Fatalf("domain-separated: %d %v", status, resp)
+	}
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", signed(bare)); status != fiber.StatusBadRequest || resp["error"] != "signature verification failed" {
+		t.Fatalf("bare key: %d %v", status, resp)
+	}
+	// The key ID is covered too, so a signature can't be moved to another ID
+	body := signed(domainSeparated)
+	body["signed_prekey_id"] = "signed-prekey-v2"
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusBadRequest {
+		t.Fatalf("signature under another key ID: %d %v", status, resp)
+	}
+
+	// With enforcement off, legacy clients signing the bare key still work
+	a.Cfg.SPKDomainSeparation = false
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", signed(bare)); status != fiber.StatusOK {
+		t.Fatalf("bare key, enforcement off: %d %v", status, resp)
+	}
+}
+
+func TestUploadRegistrationIDBounds(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+
+	for _, tc := range []struct {
+		id   int
+		want int
+	}{
+		{1, fiber.StatusOK},
+		{utils.MaxRegistrationID, fiber.StatusOK},
+		{0, fiber.StatusBadRequest},
+		{utils.MaxRegistrationID + 1, fiber.StatusBadRequest},
+		{-5, fiber.StatusBadRequest},
+	} {
+		body := uploadBody(t, signingPriv)
+		body["registration_id"] = tc.id
+		status, resp := do(t, upload, fiber.MethodPost, "/upload", body)
+		if status != tc.want {
+			t.Fatalf("registration_id %d: %d %v", tc.id, status, resp)
+		}
+		if status == fiber.StatusBadRequest && resp["field"] != "registration_id" {
+			t.Fatalf("registration_id %d: %v", tc.id, resp)
+		}
+	}
+
+	// Rejected values never replace the stored one
+	var device models.Device
+	a.DB.Where("user_id = ?", user.ID).First(&device)
+	if device.RegistrationID != utils.MaxRegistrationID {
+		t.Fatalf("stored registration_id = %d", device.RegistrationID)
+	}
+}
+
+func TestRegistrationIDsAreUniquePerUser(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	signingPriv := dbtest.SeedKeys(t, a.DB, alice, 0)
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	upload := serve(fiber.MethodPost, "/upload", alice.ID, a.PreKeysUploadHandler)
+	send := func(deviceID string, regID int) (int, map[string]interface{}) {
+		body := uploadBody(t, signingPriv)
+		body["device_id"] = deviceID
+		body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+		body["registration_id"] = regID
+		return do(t, upload, fiber.MethodPost, "/upload", body)
+	}
+
+	if status, resp := send("device-1", 100); status != fiber.StatusOK {
+		t.Fatalf("device-1: %d %v", status, resp)
+	}
+	// A device may re-send its own ID
+	if status, resp := send("device-1", 100); status != fiber.StatusOK {
+		t.Fatalf("device-1 again: %d %v", status, resp)
+	}
+	status, resp := send("device-2", 100)
+	if status != fiber.StatusConflict || resp["error"] != "registration_id_taken" || resp["field"] != "registration_id" {
+		t.Fatalf("colliding device-2: %d %v", status, resp)
+	}
+	var devices int64
+	a.DB.Model(&models.Device{}).Where("user_id = ? AND device_id = ?", alice.ID, "device-2").Count(&devices)
+	if devices != 0 {
+		t.Fatal("rejected device was registered")
+	}
+	if status, resp := send("device-2", 101); status != fiber.StatusOK {
+		t.Fatalf("device-2: %d %v", status, resp)
+	}
+
+	// Uniqueness is per user: bob's device can take alice's ID, and the index
+	// backs the check for writes that skip the handler
+	if err := a.DB.Model(&models.Device{}).Where("user_id = ?", bob.ID).Update("registration_id", 100).Error; err != nil {
+		t.Fatalf("another user's device: %v", err)
+	}
+	if err := a.DB.Model(&models.Device{}).Where("user_id = ? AND device_id = ?", alice.ID, "device-2").Update("registration_id", 100).Error; err == nil {
+		t.Fatal("index allowed a duplicate registration_id")
+	}
+}
+
+func TestConcurrentRegistrationIDClaimIsAConflict(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, alice, 0)
+	// Another upload claims 100 between the check and this upload's write
+	var once sync.Once
+	a.DB.Callback().Query().After("gorm:query").Register("test:claim", func(tx *gorm.DB) {
+		if tx.Statement.Table != "devices" || !strings.Contains(tx.Statement.SQL.String(), "registration_id > 0") {
+			return
+		}
+		once.Do(func() {
+			tx.Session(&gorm.Session{NewDB: true}).Create(&models.Device{
+				ID:             uuid.Must(uuid.NewV4()),
+				UserID:         alice.ID,
+				DeviceID:       "device-2",
+				DevicePubKey:   x25519Key(t),
+				RegistrationID: 100,
+			})
+		})
+	})
+	upload := serve(fiber.MethodPost, "/upload", alice.ID, a.PreKeysUploadHandler)
+	body := uploadBody(t, signingPriv)
+	body["device_id"] = "device-3"
+	body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+	body["registration_id"] = 100
+
+	status, resp := do(t, upload, fiber.MethodPost, "/upload", body)
+	if status != fiber.StatusConflict || resp["error"] != "registration_id_taken" || resp["field"] != "registration_id" {
+		t.Fatalf("lost race: %d %v", status, resp)
+	}
+}
+
+func TestServerAssignedRegistrationID(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 0)
+	a.DB.Model(&models.Device{}).Where("user_id = ?", user.ID).Update("registration_id", 100)
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	assign := func(deviceID string) (int, map[string]interface{}) {
+		body := uploadBody(t, signingPriv)
+		body["device_id"] = deviceID
+		body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+		body["assign_registration_id"] = true
+		return do(t, upload, fiber.MethodPost, "/upload", body)
+	}
+
+	if status, resp := assign("device-2"); status != fiber.StatusBadRequest || resp["field"] != "assign_registration_id" {
+		t.Fatalf("assignment disabled: %d %v", status, resp)
+	}
+
+	a.Cfg.RegistrationIDAssignment = true
+	status, resp := assign("device-2")
+	if status != fiber.StatusOK {
+		t.Fatalf("assign: %d %v", status, resp)
+	}
+	got, _ := resp["registration_id"].(float64)
+	if !utils.ValidRegistrationID(int(got)) || got == 100 {
+		t.Fatalf("assigned registration_id %v", resp["registration_id"])
+	}
+	var device models.Device
+	a.DB.Where("user_id = ? AND device_id = ?", user.ID, "device-2").First(&device)
+	if device.RegistrationID != int(got) {
+		t.Fatalf("stored %d, returned %v", device.RegistrationID, got)
+	}
+
+	// Asking again keeps the ID the device already has
+	if status, resp := assign("device-2"); status != fiber.StatusOK || resp["registration_id"] != got {
+		t.Fatalf("re-assign: %d %v, want %v", status, resp, got)
+	}
+}
+
+func TestRotateSignedPreKeyUpdatesOnlyThatKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	signingPriv := dbtest.SeedKeys(t, a.DB, user, 2)
+	var userBefore models.User
+	var deviceBefore models.Device
+	a.DB.First(&userBefore, "id = ?", user.ID)
+	a.DB.First(&deviceBefore, "user_id = ?", user.ID)
+	rotate := serve(fiber.MethodPost, "/signed-prekey", user.ID, a.RotateSignedPreKeyHandler)
+	enc := base64.StdEncoding.EncodeToString
+
+	spk := x25519Key(t)
+	body := map[string]string{
+		"signed_prekey_id":        "spk-2",
+		"signed_prekey":           enc(spk),
+		"signed_prekey_signature": enc(ed25519.Sign(signingPriv, utils.SignedPreKeyMessage("spk-2", spk))),
+	}
+	if status, resp := do(t, rotate, fiber.MethodPost, "/signed-prekey", body); status != fiber.StatusOK || resp["device_id"] != "device-1" || resp["signed_prekey_id"] != "spk-2" {
+		t.Fatalf("rotate: %d %v", status, resp)
+	}
+
+	latest, err := a.PreKeySvc.LatestSignedPreKey(user.ID, "device-1")
+	if err != nil || !bytes.Equal(latest.PreKey, spk) || latest.KeyID != "spk-2" {
+		t.Fatalf("signed prekey = %+v, %v", latest, err)
+	}
+	var userAfter models.User
+	var devices []models.Device
+	a.DB.First(&userAfter, "id = ?", user.ID)
+	a.DB.Where("user_id = ?", user.ID).Find(&devices)
+	if !bytes.Equal(userAfter.IdentityPubKey, userBefore.IdentityPubKey) {
+		t.Fatal("rotation changed the identity key")
+	}
+	if len(devices) != 1 || devices[0].ID != deviceBefore.ID || !bytes.Equal(devices[0].DevicePubKey, deviceBefore.DevicePubKey) || !bytes.Equal(devices[0].SigningPubKey, deviceBefore.SigningPubKey) {
+		t.Fatalf("rotation touched the device: %+v", devices)
+	}
+	if n, _ := a.PreKeySvc.CountOneTimePreKeys(user.ID, "device-1"); n != 2 {
+		t.Fatalf("%d one-time prekeys after rotation, want 2", n)
+	}
+
+	// A key signed by anyone else is refused and leaves the current one
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	forged := x25519Key(t)
+	body["signed_prekey"] = enc(forged)
+	body["signed_prekey_signature"] = enc(ed25519.Sign(otherPriv, utils.SignedPreKeyMessage("spk-2", forged)))
+	if status, _ := do(t, rotate, fiber.MethodPost, "/signed-prekey", body); status != fiber.StatusBadRequest {
+		t.Fatalf("forged signature: %d", status)
+	}
+	if latest, _ := a.PreKeySvc.LatestSignedPreKey(user.ID, "device-1"); !bytes.Equal(latest.PreKey, spk) {
+		t.Fatal("forged signed prekey was stored")
+	}
+	body["device_id"] = "device-9"
+	if status, _ := do(t, rotate, fiber.MethodPost, "/signed-prekey", body); status != fiber.StatusNotFound {
+		t.Fatalf("unknown device: %d", status)
+	}
+}
+
+func TestUploadRollsBackWhenDeviceInsertFails(t *testing.T) {
+	a, _ := newTestApp(t)
+	user := dbtest.SeedUser(t, a.DB, "alice")
+	_, signingPriv, _ := ed25519.GenerateKey(rand.Reader)
+	// Fail the last step, after the identity key and prekeys were written
+	a.DB.Callback().Create().Before("gorm:create").Register("test:fail_devices", func(tx *gorm.DB) {
+		if tx.Statement.Table == "devices" {
+			tx.AddError(errors.New("simulated failure"))
+		}
+	})
+
+	body := uploadBody(t, signingPriv)
+	body["device_pubkey"] = base64.StdEncoding.EncodeToString(x25519Key(t))
+	upload := serve(fiber.MethodPost, "/upload", user.ID, a.PreKeysUploadHandler)
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusInternalServerError || resp["error"] != "failed to create device" {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+
+	var stored models.User
+	a.DB.First(&stored, "id = ?", user.ID)
+	if !bytes.Equal(stored.IdentityPubKey, user.IdentityPubKey) {
+		t.Fatal("identity key changed by a failed upload")
+	}
+	for _, model := range []interface{}{&models.PreKey{}, &models.OneTimePreKey{}, &models.Device{}} {
+		var n int64
+		a.DB.Model(model).Where("user_id = ?", user.ID).Count(&n)
+		if n != 0 {
+			t.Fatalf("%T: %d rows left by a failed upload", model, n)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/services"
+)
+
+// testConfig is the subset of configuration the handlers under test read
+func testConfig() *config.Config {
+	return &config.Config{
+		JWTSigningKey:             "test-secret",
+		JWTSigningKeyID:           "test",
+		OTPExpiryMinutes:          10,
+		OTPLength:                 6,
+		OTPAlphabet:               "numeric",
+		OTPMaxActiveSessions:      3,
+		SignedPreKeyTTLDays:       30,
+		OneTimePreKeyTTLDays:      30,
+		PreKeyReservationSec:      60,
+		SessionMarkers:            true,
+		SPKDomainSeparation:       true,
+		MatchMaxTags:              16,
+		MatchMaxTagLength:         64,
+		MaxGroupMembers:           16,
+		WSHeartbeatIntervalSec:    30,
+		HTTPBodyLimitBytes:        1 << 20,
+		CheckUsernameCacheSec:     0,
+		MatchAnonIDMaxLifetimeSec: 0,
+	}
+}
+
+// recordingPush collects push notifications instead of sending them
+type recordingPush struct {
+	mu   sync.Mutex
+	sent []services.PushNotification
+}
+
+func (p *recordingPush) Send(_ context.Context, n services.PushNotification) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, n)
+	return nil
+}
+
+func (p *recordingPush) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sent)
+}
+
+var (
+	serverKeyOnce sync.Once
+	serverKey     *rsa.PrivateKey
+)
+
+// testServerKey is one RSA key shared by every test, since generating one
+// per test is slow
+func testServerKey(t *testing.T) *rsa.PrivateKey {
+	serverKeyOnce.Do(func() {
+		var err error
+		if serverKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return serverKey
+}
+
+// x25519Key returns a fresh X25519 public key that passes key validation
+func x25519Key(t *testing.T) []byte {
+	t.Helper()
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey().Bytes()
+}
+
+// newTestApp wires an App over a fresh in-memory database with a manual
+// clock and a recording push sender
+func newTestApp(t *testing.T) (*App, *recordingPush) {
+	t.Helper()
+	d := dbtest.New(t)
+	cfg := testConfig()
+	hub := services.NewHub()
+	prekeys := services.NewPreKeyService(d, cfg)
+	push := &recordingPush{}
+	a := &App{
+		DB:         d,
+		OTPService: services.NewOTPService(d, cfg, services.LogNotifier{}),
+		PreKeySvc:  prekeys,
+		Matchmaker: services.NewMatchmaker(d, hub),
+		Hub:        hub,
+		Convos:     services.NewConversationService(d),
+		Sessions:   services.NewSessionService(d, prekeys, cfg.SessionMarkers),
+		Push:       services.NewPushService(d, push),
+		Lookups:    NewLookupCache(0),
+		Audit:      services.NewAuditLog(d, []byte("test")),
+		ServerPriv: testServerKey(t),
+		Cfg:        cfg,
+		Clock:      services.NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	a.Push.Clock = a.Clock
+	return a, push
+}
+
+// connect registers a socket-less connection for userID so frames sent to
+// them can be read from its Send channel
+func connect(t *testing.T, a *App, userID uuid.UUID, binary bool) *services.Connection {
+	t.Helper()
+	c := &services.Connection{
+		UserID:     userID,
+		DeviceID:   "device-1",
+		Send:       make(chan services.Frame, 16),
+		Binary:     binary,
+		LastSeen:   time.Now(),
+		LastActive: time.Now(),
+	}
+	if !a.Hub.Register(c) {
+		t.Fatal("register connection")
+	}
+	t.Cleanup(func() { a.Hub.Unregister(c) })
+	return c
+}
+
+// nextFrame returns the next frame queued for c, failing if none arrives.
+// Taking it stands in for the write pump, so Written is called.
+func nextFrame(t *testing.T, c *services.Connection) services.Frame {
+	t.Helper()
+	select {
+	case f := <-c.Send:
+		if f.Written != nil {
+			f.Written()
+		}
+		return f
+	case <-time.After(time.Second):
+		t.Fatal("no frame received")
+		return services.Frame{}
+	}
+}
+
+// noFrame fails if anything is queued for c
+func noFrame(t *testing.T, c *services.Connection) {
+	t.Helper()
+	select {
+	case f := <-c.Send:
+		t.Fatalf("unexpected frame %s", f.Data)
+	default:
+	}
+}
+
+// serve mounts handlers at method and path behind a stub that authenticates
+// every request as userID (none when uuid.Nil)
+func serve(method, path string, userID uuid.UUID, handlers ...fiber.Handler) *fiber.App {
+	app := fiber.New()
+	app.Add(method, path, append([]fiber.Handler{func(c *fiber.Ctx) error {
+		if userID != uuid.Nil {
+			c.Locals("user_id", userID)
+		}
+		return c.Next()
+	}}, handlers...)...)
+	return app
+}
+
+// do sends a JSON request and decodes the JSON response into a map
+func do(t *testing.T, app *fiber.App, method, target string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	status, out, err := tryDo(app, method, target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, out
+}
+
+// tryDo is do for goroutines other than the test's, which must not call
+// t.Fatal; the caller reports the error
+func tryDo(app *fiber.App, method, target string, body interface{}) (int, map[string]interface{}, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, r)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	out := map[string]interface{}{}
+	raw, _ := io.ReadAll(resp.Body)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &out); err != nil {
+			return 0, nil, fmt.Errorf("decode %q: %w", raw, err)
+		}
+	}
+	return resp.StatusCode, out, nil
+}
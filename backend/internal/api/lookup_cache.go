@@ -0,0 +1,70 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// maxLookupCacheEntries bounds memory when many distinct names are probed
+const maxLookupCacheEntries = 10000
+
+// LookupCache remembers recent username availability results for a short
+// TTL so bursts of identical lookups don't each hit the database
+type LookupCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]lookupEntry
+}
+
+type lookupEntry struct {
+	available bool
+	expires   time.Time
+}
+
+func NewLookupCache(ttl time.Duration) *LookupCache {
+	return &LookupCache{TTL: ttl, entries: make(map[string]lookupEntry)}
+}
+
+func (l *LookupCache) Get(name string) (available, ok bool) {
+	if l == nil || l.TTL <= 0 {
+		return false, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[name]
+	if !ok || time.Now().After(e.expires) {
+		return false, false
+	}
+	return e.available, true
+}
+
+func (l *LookupCache) Put(name string, available bool) {
+	if l == nil || l.TTL <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.entries) >= maxLookupCacheEntries {
+		for k, e := range l.entries {
+			if now.After(e.expires) {
+				delete(l.entries, k)
+			}
+		}
+		if len(l.entries) >= maxLookupCacheEntries {
+			l.entries = make(map[string]lookupEntry)
+		}
+	}
+	l.entries[name] = lookupEntry{available: available, expires: now.Add(l.TTL)}
+}
+
+// Forget drops a cached result, e.g. once the name has been registered
+func (l *LookupCache) Forget(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.entries, name)
+	l.mu.Unlock()
+}
@@ -1,13 +1,20 @@
 package api
 
 import (
-	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofrs/uuid"
 	"gorm.io/gorm"
 
 	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/utils"
 ) // POST /api/match/enqueue
 func (a *App) EnqueueMatchHandler(c *fiber.Ctx) error {
 	userID, err := GetUserID(c)
@@ -15,35 +22,59 @@ func (a *App) EnqueueMatchHandler(c *fiber.Ctx) error {
 		return err
 	}
 
-	var req struct {
-		TagHash string `json:"tag_hash"`
-	}
+	var req EnqueueMatchRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid request"})
+		return invalidBody(c, err)
 	}
 
 	if req.TagHash == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "tag_hash required"})
 	}
+	tags, err := normalizeTags(req.TagHash, a.Cfg.MatchMaxTags, a.Cfg.MatchMaxTagLength)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "field": "tag_hash"})
+	}
 
 	// Store match profile
 	id, err := uuid.NewV4()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to generate id"})
 	}
-	profile := &models.MatchProfile{
-		ID:      id,
-		UserID:  userID,
-		TagHash: req.TagHash,
-	}
-	if err := a.DB.FirstOrCreate(profile, "user_id = ?", userID).Error; err != nil {
+	// Re-enqueueing replaces the stored tags
+	var profile models.MatchProfile
+	if err := a.dbFor(c).Where(models.MatchProfile{UserID: userID}).
+		Attrs(models.MatchProfile{ID: id}).
+		Assign(models.MatchProfile{TagHash: strings.Join(tags, ",")}).
+		FirstOrCreate(&profile).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create profile"})
 	} // Enqueue for matching
-	if err := a.Matchmaker.Enqueue(userID); err != nil {
+	// A request abandoned before this point must not leave a queue entry
+	// behind for someone to be paired with
+	ctx := c.UserContext()
+	if err := a.Matchmaker.Enqueue(ctx, userID, tags, req.AutoRequeue); err != nil {
+		if ctx.Err() != nil {
+			return c.Status(fiber.StatusRequestTimeout).JSON(fiber.Map{"error": "request canceled"})
+		}
+		if errors.Is(err, services.ErrAlreadyMatched) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "already_matched"})
+		}
+		if errors.Is(err, services.ErrDraining) {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "draining"})
+		}
 		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "queue full, try again"})
 	}
+	if ctx.Err() != nil {
+		a.Matchmaker.Leave(userID)
+		return c.Status(fiber.StatusRequestTimeout).JSON(fiber.Map{"error": "request canceled"})
+	}
 
-	return c.JSON(fiber.Map{"status": "queued"})
+	// A repeat enqueue updates the existing entry, so report its wait
+	// rather than a fresh one
+	resp := EnqueueMatchResponse{Status: "queued"}
+	if pos, ok := a.Matchmaker.Position(userID); ok {
+		resp.WaitedSeconds = int(pos.Waited.Seconds())
+	}
+	return c.JSON(resp)
 }
 
 // GET /api/match/status
@@ -59,15 +90,117 @@ func (a *App) MatchStatusHandler(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "waiting"})
 	}
 
+	if a.Cfg.MatchAnonymous {
+		self, peer, _ := a.Matchmaker.AnonymousIDs(userID)
+		resp := fiber.Map{
+			"status":       "matched",
+			"pair_id":      peer.String(),
+			"anonymous_id": self.String(),
+			"revealed":     false,
+			"relaxed":      a.Matchmaker.Relaxed(userID),
+		}
+		if a.Matchmaker.Revealed(userID) {
+			resp["revealed"] = true
+			resp["peer_user_id"] = pairID.String()
+		}
+		return c.JSON(resp)
+	}
+
 	return c.JSON(fiber.Map{
 		"status":  "matched",
 		"pair_id": pairID.String(),
+		"relaxed": a.Matchmaker.Relaxed(userID),
 	})
 }
 
+// GET /api/match/position
+func (a *App) MatchPositionHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	pos, ok := a.Matchmaker.Position(userID)
+	if !ok {
+		return c.JSON(fiber.Map{"status": "not_queued"})
+	}
+	resp := fiber.Map{
+		"status":         "queued",
+		"position":       pos.Position,
+		"bucket_size":    pos.BucketSize,
+		"waited_seconds": int(pos.Waited.Seconds()),
+	}
+	if pos.EstimatedWait > 0 {
+		resp["estimated_wait_seconds"] = int(pos.EstimatedWait.Round(time.Second).Seconds())
+	}
+	return c.JSON(resp)
+}
+
+// GET /api/keys/status/:user_id
+// Reports whether a bundle fetch would succeed, without consuming or
+// reserving a one-time prekey. Accepts the same ?device_id as the bundle.
+func (a *App) KeyStatusHandler(c *fiber.Ctx) error {
+	callerID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	targetUserID, err := parseUUIDField("user_id", c.Params("user_id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+	if a.Cfg.MatchAnonymous {
+		if peer, ok := a.Matchmaker.ResolvePeer(callerID, targetUserID); ok {
+			if !a.Matchmaker.Revealed(callerID) {
+				// Only the per-match keys would be served
+				_, ready := a.Matchmaker.AnonymousKeysOf(peer)
+				return c.JSON(KeyStatusResponse{Ready: ready, HasIdentityKey: ready, HasSignedPreKey: ready, HasActiveDevice: ready})
+			}
+			targetUserID = peer
+		}
+	}
+
+	var user models.User
+	if err := a.dbFor(c).Select("id", "identity_pub_key").Where("id = ?", targetUserID).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	resp := KeyStatusResponse{HasIdentityKey: len(user.IdentityPubKey) > 0}
+
+	deviceID := c.Query("device_id")
+	prekey, err := a.PreKeySvc.LatestSignedPreKey(targetUserID, deviceID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if err == nil && prekey.ExpiresAt.After(a.PreKeySvc.Clock.Now()) {
+		resp.HasSignedPreKey = true
+		n, err := a.PreKeySvc.CountOneTimePreKeys(targetUserID, prekey.DeviceID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+		resp.OneTimePreKeysAvailable = n > 0
+	}
+
+	devices := a.dbFor(c).Model(&models.Device{}).Where("user_id = ?", targetUserID)
+	if deviceID != "" {
+		devices = devices.Where("device_id = ?", deviceID)
+	}
+	var deviceCount int64
+	if err := devices.Count(&deviceCount).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	resp.HasActiveDevice = deviceCount > 0
+	resp.Ready = resp.HasIdentityKey && resp.HasSignedPreKey && resp.HasActiveDevice
+	return c.JSON(resp)
+}
+
 // GET /api/keys/bundle/:user_id
+// A caller fetching their own bundle gets it without a one-time prekey, so
+// checking what the server stored doesn't drain their pool.
 func (a *App) GetKeyBundleHandler(c *fiber.Ctx) error {
-	_, err := GetUserID(c)
+	callerID, err := GetUserID(c)
 	if err != nil {
 		return err
 	}
@@ -77,58 +210,209 @@ func (a *App) GetKeyBundleHandler(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user_id required"})
 	}
 
-	targetUserID, err := parseUUID(targetUserIDStr)
+	targetUserID, err := parseUUIDField("user_id", targetUserIDStr)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user_id"})
+		return invalidUUID(c, err)
+	}
+
+	// In anonymous mode the peer is addressed by its per-match ID. Until both
+	// reveal, the bundle carries only the keys the peer made for this match:
+	// the account's keys are the same for anyone who fetches them by real ID.
+	publicID := targetUserID
+	if a.Cfg.MatchAnonymous {
+		if peer, ok := a.Matchmaker.ResolvePeer(callerID, targetUserID); ok {
+			if !a.Matchmaker.Revealed(callerID) {
+				return a.anonymousBundle(c, targetUserID, peer)
+			}
+			targetUserID, publicID = peer, peer
+		}
 	}
 
 	// Get user
 	var user models.User
-	if err := a.DB.Where("id = ?", targetUserID).First(&user).Error; err != nil {
+	if err := a.dbFor(c).Where("id = ?", targetUserID).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 	}
 
-	// Get signed prekey
-	var prekey models.PreKey
-	if err := a.DB.Where("user_id = ?", targetUserID).Order("created_at desc").First(&prekey).Error; err != nil {
+	// Get signed prekey. Keys are per device: ?device_id= picks one, otherwise
+	// the device that most recently uploaded keys is served.
+	prekey, err := a.PreKeySvc.LatestSignedPreKey(targetUserID, c.Query("device_id"))
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "no prekey found"})
 		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 	}
+	if prekey.ExpiresAt.Before(a.Clock.Now()) {
+		// Never hand out an expired signed prekey; the owner must rotate it first
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "keys_not_ready"})
+	}
 
-	// Get one-time prekey
-	oneTimeKey, err := a.PreKeySvc.ConsumeOneTimePreKey(targetUserID)
-	var oneTimeKeyB64 string
-	if err == nil && oneTimeKey != nil {
-		oneTimeKeyB64 = base64.StdEncoding.EncodeToString(oneTimeKey.PreKey)
+	// Get one-time prekey. With ?reserve=true the key is only held until the
+	// sender confirms it via /api/keys/prekeys/confirm, so a bundle lost in
+	// transit doesn't burn it.
+	reserve := c.QueryBool("reserve")
+	var oneTimeKey *models.OneTimePreKey
+	switch {
+	case targetUserID == callerID:
+		// Own bundle: nothing to establish a session with, so leave the pool alone
+	case reserve:
+		oneTimeKey, err = a.PreKeySvc.ReserveOneTimePreKey(targetUserID, prekey.DeviceID, callerID)
+	default:
+		oneTimeKey, err = a.PreKeySvc.ConsumeOneTimePreKey(targetUserID, prekey.DeviceID)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Serving the bundle without a one-time prekey here would silently
+		// weaken the session over a transient failure
+		log.Printf("one-time prekey lookup failed for user %s: %v", targetUserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Pool exhausted: the sender falls back to a session without a
+		// one-time prekey (weaker forward secrecy), so prompt the owner to refill
+		log.Printf("one-time prekeys exhausted for user %s", targetUserID)
+		notice, _ := json.Marshal(map[string]interface{}{"type": "prekeys_low", "remaining": 0})
+		a.Hub.SendTo(targetUserID, notice)
 	}
 
 	// Get devices
 	var devices []models.Device
-	if err := a.DB.Where("user_id = ?", targetUserID).Find(&devices).Error; err != nil {
+	if err := a.dbFor(c).Where("user_id = ?", targetUserID).Find(&devices).Error; err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
 	}
 
-	devicesData := make([]map[string]string, len(devices))
+	devicesData := make([]DeviceInfo, len(devices))
 	for i, d := range devices {
-		devicesData[i] = map[string]string{
-			"device_id":     d.DeviceID,
-			"device_pubkey": base64.StdEncoding.EncodeToString(d.DevicePubKey),
+		devicesData[i] = DeviceInfo{
+			DeviceID:       d.DeviceID,
+			DevicePubKey:   d.DevicePubKey,
+			RegistrationID: d.RegistrationID,
 		}
 	}
 
-	return c.JSON(fiber.Map{
-		"user_id":                 user.ID.String(),
-		"identity_pub":            base64.StdEncoding.EncodeToString(user.IdentityPubKey),
-		"signed_prekey":           base64.StdEncoding.EncodeToString(prekey.PreKey),
-		"signed_prekey_signature": base64.StdEncoding.EncodeToString(prekey.Signature),
-		"one_time_prekey":         oneTimeKeyB64,
-		"devices":                 devicesData,
-	})
+	// Sign identity, signed and one-time prekeys together so a client can detect
+	// a tampered or mismatched bundle. Verify with /auth/server-pubkey.
+	var oneTimeKeyBytes []byte
+	if oneTimeKey != nil {
+		oneTimeKeyBytes = oneTimeKey.PreKey
+	}
+	bundleSig, err := utils.SignBundle(a.ServerPriv,
+		publicID.Bytes(),
+		user.IdentityPubKey,
+		prekey.PreKey,
+		prekey.Signature,
+		oneTimeKeyBytes,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to sign bundle"})
+	}
+
+	resp := KeyBundleResponse{
+		UserID:                 publicID.String(),
+		DeviceID:               prekey.DeviceID,
+		IdentityPub:            user.IdentityPubKey,
+		SignedPreKey:           prekey.PreKey,
+		SignedPreKeyID:         prekey.KeyID,
+		SignedPreKeySignature:  prekey.Signature,
+		OneTimePreKey:          oneTimeKeyBytes,
+		OneTimePreKeyAvailable: oneTimeKey != nil,
+		Devices:                devicesData,
+		BundleSignature:        bundleSig,
+		BundleSignatureAlg:     "RSA-PSS-SHA256",
+	}
+	if oneTimeKey != nil {
+		resp.OneTimePreKeyID = oneTimeKey.ID.String()
+	}
+	if reserve && oneTimeKey != nil {
+		resp.ReservedUntil = oneTimeKey.ReservedUntil.Unix()
+	}
+	return c.JSON(resp)
+}
+
+// POST /api/keys/prekeys/confirm
+func (a *App) ConfirmPreKeyHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req ConfirmPreKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	keyID, err := parseUUIDField("one_time_prekey_id", req.OneTimePreKeyID)
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+
+	if err := a.PreKeySvc.ConfirmOneTimePreKey(keyID, userID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "reservation not found or expired"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// POST /api/sessions/established
+// Optional: the sender reports a session it set up from a fetched bundle.
+// Naming the one-time prekey it used confirms that reservation, like
+// /api/keys/prekeys/confirm.
+func (a *App) SessionEstablishedHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req SessionEstablishedRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	peer, err := parseUUIDField("peer_id", req.PeerID)
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+	peer = a.resolveRecipient(userID, peer)
+	if peer == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "peer_id must be another user", "field": "peer_id"})
+	}
+
+	var convID, keyID *uuid.UUID
+	if req.ConversationID != "" {
+		id, err := parseUUIDField("conversation_id", req.ConversationID)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		for _, member := range []uuid.UUID{userID, peer} {
+			isMember, err := a.Convos.IsMember(id, member)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+			}
+			if !isMember {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_member", "field": "conversation_id"})
+			}
+		}
+		convID = &id
+	}
+	if req.OneTimePreKeyID != "" {
+		id, err := parseUUIDField("one_time_prekey_id", req.OneTimePreKeyID)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		keyID = &id
+	}
+
+	if err := a.Sessions.Establish(userID, peer, convID, keyID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "reservation not found or expired"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
 }
 
 // POST /api/match/leave
@@ -141,3 +425,179 @@ func (a *App) LeaveMatchQueueHandler(c *fiber.Ctx) error {
 	a.Matchmaker.Leave(userID)
 	return c.JSON(fiber.Map{"status": "left"})
 }
+
+// POST /api/match/end
+func (a *App) EndMatchHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := a.Matchmaker.EndMatch(userID); !ok {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "not matched"})
+	}
+	return c.JSON(fiber.Map{"status": "ended"})
+}
+
+// POST /api/match/reveal
+func (a *App) RevealMatchHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	peer, mutual, ok := a.Matchmaker.Reveal(userID)
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "not matched"})
+	}
+	if !mutual {
+		return c.JSON(fiber.Map{"revealed": false})
+	}
+
+	// Both sides consented: tell each the other's real ID
+	for _, pair := range [][2]uuid.UUID{{userID, peer}, {peer, userID}} {
+		notice, _ := json.Marshal(map[string]string{
+			"type":         "match_revealed",
+			"peer_user_id": pair[1].String(),
+		})
+		a.Hub.SendTo(pair[0], notice)
+	}
+	return c.JSON(fiber.Map{"revealed": true, "peer_user_id": peer.String()})
+}
+
+// POST /api/match/keys
+// Anonymous mode only. The caller's peer gets these keys from the bundle
+// endpoint until both sides reveal, so nothing links the pairing to the
+// caller's account keys. The signed prekey is checked against signing_pub.
+func (a *App) SetAnonymousKeysHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+	if !a.Cfg.MatchAnonymous {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "anonymous matching disabled"})
+	}
+
+	var req AnonymousKeysRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if err := utils.ValidateX25519PublicKey(req.IdentityPub); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pub", "field": "identity_pub", "reason": err.Error()})
+	}
+	if len(req.SigningPub) != 32 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signing_pub", "field": "signing_pub"})
+	}
+	if len(req.SignedPreKey) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey", "field": "signed_prekey"})
+	}
+	spkID, ok := signedPreKeyID(req.SignedPreKeyID)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid signed_prekey_id", "field": "signed_prekey_id"})
+	}
+	if !a.verifySignedPreKey(userID, req.SigningPub, spkID, req.SignedPreKey, req.SignedPreKeySig) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "signature verification failed"})
+	}
+
+	if !a.Matchmaker.SetAnonymousKeys(userID, services.AnonymousKeys{
+		IdentityPub:     req.IdentityPub,
+		SignedPreKey:    req.SignedPreKey,
+		SignedPreKeyID:  spkID,
+		SignedPreKeySig: req.SignedPreKeySig,
+	}) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "not matched"})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// anonymousBundle serves the per-pairing keys peer set for an unrevealed
+// anonymous match, addressed by their anonymous ID. There are no one-time
+// prekeys or devices: both would be the account's own.
+func (a *App) anonymousBundle(c *fiber.Ctx, anonID, peer uuid.UUID) error {
+	k, ok := a.Matchmaker.AnonymousKeysOf(peer)
+	if !ok {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "keys_not_ready"})
+	}
+	bundleSig, err := utils.SignBundle(a.ServerPriv, anonID.Bytes(), k.IdentityPub, k.SignedPreKey, k.SignedPreKeySig, nil)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to sign bundle"})
+	}
+	return c.JSON(KeyBundleResponse{
+		UserID:                anonID.String(),
+		IdentityPub:           k.IdentityPub,
+		SignedPreKey:          k.SignedPreKey,
+		SignedPreKeyID:        k.SignedPreKeyID,
+		SignedPreKeySignature: k.SignedPreKeySig,
+		Devices:               []DeviceInfo{},
+		BundleSignature:       bundleSig,
+		BundleSignatureAlg:    "RSA-PSS-SHA256",
+	})
+}
+
+// resolveRecipient maps a "to" address onto a real user ID. In anonymous mode
+// the caller's matched peer may be addressed by its anonymous ID.
+func (a *App) resolveRecipient(sender, to uuid.UUID) uuid.UUID {
+	if a.Cfg.MatchAnonymous {
+		if peer, ok := a.Matchmaker.ResolvePeer(sender, to); ok {
+			return peer
+		}
+	}
+	return to
+}
+
+// senderAddress is the "from" shown to recipient: the sender's anonymous ID
+// while they are an unrevealed anonymous pair, the real ID otherwise
+func (a *App) senderAddress(sender, recipient uuid.UUID) uuid.UUID {
+	if a.Cfg.MatchAnonymous && !a.Matchmaker.Revealed(sender) {
+		if peer, ok := a.Matchmaker.GetPair(sender); ok && peer == recipient {
+			self, _, _ := a.Matchmaker.AnonymousIDs(sender)
+			return self
+		}
+	}
+	return sender
+}
+
+// normalizeTags splits a comma-separated tag_hash into trimmed, lowercased,
+// de-duplicated tags, enforcing the configured count and length caps. Tags are
+// client-side hashes, so only lowercase letters, digits, '-' and '_' are
+// accepted; the same tag in another case lands in the same bucket.
+func normalizeTags(raw string, maxCount, maxLen int) ([]string, error) {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if len(t) > maxLen {
+			return nil, fmt.Errorf("tag exceeds %d characters", maxLen)
+		}
+		for _, r := range t {
+			if !isTagRune(r) {
+				return nil, errors.New("tag contains invalid characters")
+			}
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("tag_hash required")
+	}
+	if len(tags) > maxCount {
+		return nil, fmt.Errorf("at most %d tags allowed", maxCount)
+	}
+	return tags, nil
+}
+
+func isTagRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return true
+	case r == '-' || r == '_':
+		return true
+	}
+	return false
+}
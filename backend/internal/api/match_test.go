@@ -0,0 +1,763 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/utils"
+)
+
+// runMatchmaker runs the matchmaker loop until the test ends. Stopping it
+// clears the queue and every pairing, so it must outlive the assertions.
+func runMatchmaker(t *testing.T, a *App) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a.Matchmaker.TickInterval = time.Millisecond
+	go a.Matchmaker.Run(ctx)
+}
+
+// pair matches two connected users through the real matchmaker loop
+func pair(t *testing.T, a *App, u1, u2 uuid.UUID) {
+	t.Helper()
+	for _, id := range []uuid.UUID{u1, u2} {
+		if err := a.Matchmaker.Enqueue(context.Background(), id, []string{"tag"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runMatchmaker(t, a)
+	waitFor(t, func() bool {
+		p, ok := a.Matchmaker.GetPair(u1)
+		return ok && p == u2
+	})
+}
+
+// anonymousKeysBody makes fresh per-match keys signed the way clients sign
+// their account's signed prekey
+func anonymousKeysBody(t *testing.T) map[string]string {
+	t.Helper()
+	signingPub, signingPriv, _ := ed25519.GenerateKey(rand.Reader)
+	identity, spk := x25519Key(t), x25519Key(t)
+	sig := ed25519.Sign(signingPriv, utils.SignedPreKeyMessage(utils.SignedPreKeyID, spk))
+	enc := base64.StdEncoding.EncodeToString
+	return map[string]string{
+		"identity_pub":      enc(identity),
+		"signing_pub":       enc(signingPub),
+		"signed_prekey":     enc(spk),
+		"signed_prekey_sig": enc(sig),
+	}
+}
+
+func TestAnonymousBundleHidesAccountKeys(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.MatchAnonymous = true
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 3)
+	connect(t, a, alice.ID, false)
+	connect(t, a, bob.ID, false)
+	pair(t, a, alice.ID, bob.ID)
+	_, bobAnon, _ := a.Matchmaker.AnonymousIDs(alice.ID)
+
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bobAnon.String(), nil); status != fiber.StatusConflict || body["error"] != "keys_not_ready" {
+		t.Fatalf("before keys: %d %v", status, body)
+	}
+
+	keys := anonymousKeysBody(t)
+	setKeys := serve(fiber.MethodPost, "/keys", bob.ID, a.SetAnonymousKeysHandler)
+	if status, body := do(t, setKeys, fiber.MethodPost, "/keys", keys); status != fiber.StatusOK {
+		t.Fatalf("set keys: %d %v", status, body)
+	}
+
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bobAnon.String(), nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("bundle: %d %v", status, body)
+	}
+	if body["user_id"] != bobAnon.String() || body["identity_pub"] != keys["identity_pub"] || body["signed_prekey"] != keys["signed_prekey"] {
+		t.Fatalf("bundle = %v", body)
+	}
+	if body["identity_pub"] == base64.StdEncoding.EncodeToString(bob.IdentityPubKey) || body["one_time_prekey"] != nil {
+		t.Fatalf("bundle leaks account keys: %v", body)
+	}
+	if devices := body["devices"].([]interface{}); len(devices) != 0 {
+		t.Fatalf("devices = %v", devices)
+	}
+	var unused int64
+	a.DB.Model(&models.OneTimePreKey{}).Where("user_id = ? AND used = ?", bob.ID, false).Count(&unused)
+	if unused != 3 {
+		t.Fatalf("anonymous bundle consumed account one-time prekeys: %d left", unused)
+	}
+}
+
+func TestRevealedBundleServesAccountKeys(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.MatchAnonymous = true
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	connect(t, a, alice.ID, false)
+	connect(t, a, bob.ID, false)
+	pair(t, a, alice.ID, bob.ID)
+	_, bobAnon, _ := a.Matchmaker.AnonymousIDs(alice.ID)
+	a.Matchmaker.Reveal(alice.ID)
+	a.Matchmaker.Reveal(bob.ID)
+
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bobAnon.String(), nil)
+	if status != fiber.StatusOK || body["user_id"] != bob.ID.String() || body["identity_pub"] != base64.StdEncoding.EncodeToString(bob.IdentityPubKey) {
+		t.Fatalf("bundle: %d %v", status, body)
+	}
+}
+
+func TestSetAnonymousKeysRejectsBadSignature(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.MatchAnonymous = true
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	keys := anonymousKeysBody(t)
+	keys["signed_prekey_sig"] = base64.StdEncoding.EncodeToString(make([]byte, 64))
+	setKeys := serve(fiber.MethodPost, "/keys", bob.ID, a.SetAnonymousKeysHandler)
+	if status, _ := do(t, setKeys, fiber.MethodPost, "/keys", keys); status != fiber.StatusBadRequest {
+		t.Fatalf("status = %d", status)
+	}
+}
+
+func TestBundleRefusesSignedPreKeyExpiredOnAppClock(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	var spk models.PreKey
+	a.DB.Where("user_id = ?", bob.ID).First(&spk)
+
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	a.Clock.(*services.ManualClock).Set(spk.ExpiresAt.Add(-time.Minute))
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK {
+		t.Fatalf("before expiry: %d %v", status, body)
+	}
+	a.Clock.(*services.ManualClock).Set(spk.ExpiresAt.Add(time.Minute))
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusConflict || body["error"] != "keys_not_ready" {
+		t.Fatalf("after expiry: %d %v", status, body)
+	}
+}
+
+func TestBundleRefusesExpiredSignedPreKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+
+	if err := a.DB.Model(&models.PreKey{}).Where("user_id = ?", bob.ID).Update("expires_at", a.Clock.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusConflict || body["error"] != "keys_not_ready" {
+		t.Fatalf("expired: %d %v", status, body)
+	}
+	// Refusing the bundle doesn't burn a one-time prekey
+	var unused int64
+	a.DB.Model(&models.OneTimePreKey{}).Where("user_id = ? AND used = false", bob.ID).Count(&unused)
+	if unused != 1 {
+		t.Fatalf("%d unused one-time prekeys, want 1", unused)
+	}
+
+	if err := a.DB.Model(&models.PreKey{}).Where("user_id = ?", bob.ID).Update("expires_at", a.Clock.Now().Add(time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK {
+		t.Fatalf("live: %d %v", status, body)
+	}
+}
+
+func TestBundleReservationConfirmFlow(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.PreKeySvc.Clock = a.Clock
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	confirm := serve(fiber.MethodPost, "/confirm", alice.ID, a.ConfirmPreKeyHandler)
+
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String()+"?reserve=true", nil)
+	if status != fiber.StatusOK || body["one_time_prekey_id"] == nil || body["reserved_until"] != float64(a.Clock.Now().Unix()+60) {
+		t.Fatalf("reserve: %d %v", status, body)
+	}
+	keyID := body["one_time_prekey_id"].(string)
+	var key models.OneTimePreKey
+	a.DB.First(&key, "id = ?", keyID)
+	if key.Used {
+		t.Fatal("reserved key marked used before confirmation")
+	}
+
+	if status, body := do(t, confirm, fiber.MethodPost, "/confirm", map[string]string{"one_time_prekey_id": keyID}); status != fiber.StatusOK {
+		t.Fatalf("confirm: %d %v", status, body)
+	}
+	a.DB.First(&key, "id = ?", keyID)
+	if !key.Used {
+		t.Fatal("confirmed key not marked used")
+	}
+	if status, _ := do(t, confirm, fiber.MethodPost, "/confirm", map[string]string{"one_time_prekey_id": keyID}); status != fiber.StatusConflict {
+		t.Fatalf("second confirm: %d", status)
+	}
+}
+
+func TestBundleReservationExpires(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.PreKeySvc.Clock = a.Clock
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+
+	status, body := do(t, serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler), fiber.MethodGet, "/bundle/"+bob.ID.String()+"?reserve=true", nil)
+	if status != fiber.StatusOK || body["one_time_prekey_id"] == nil {
+		t.Fatalf("reserve: %d %v", status, body)
+	}
+	keyID := body["one_time_prekey_id"].(string)
+
+	// While held, the next sender gets no one-time prekey
+	carolBundle := serve(fiber.MethodGet, "/bundle/:user_id", carol.ID, a.GetKeyBundleHandler)
+	if status, body := do(t, carolBundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_available"] != false {
+		t.Fatalf("while reserved: %d %v", status, body)
+	}
+
+	a.Clock.(*services.ManualClock).Advance(61 * time.Second)
+	confirm := serve(fiber.MethodPost, "/confirm", alice.ID, a.ConfirmPreKeyHandler)
+	if status, _ := do(t, confirm, fiber.MethodPost, "/confirm", map[string]string{"one_time_prekey_id": keyID}); status != fiber.StatusConflict {
+		t.Fatalf("confirm after expiry: %d", status)
+	}
+	if status, body := do(t, carolBundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_id"] != keyID {
+		t.Fatalf("after expiry: %d %v", status, body)
+	}
+}
+
+func TestSessionEstablishedFinalizesReservedPreKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.PreKeySvc.Clock = a.Clock
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+
+	status, body := do(t, serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler), fiber.MethodGet, "/bundle/"+bob.ID.String()+"?reserve=true", nil)
+	if status != fiber.StatusOK || body["one_time_prekey_id"] == nil {
+		t.Fatalf("reserve: %d %v", status, body)
+	}
+	keyID := body["one_time_prekey_id"].(string)
+	established := func(userID, peer uuid.UUID) (int, map[string]interface{}) {
+		app := serve(fiber.MethodPost, "/sessions/established", userID, a.SessionEstablishedHandler)
+		return do(t, app, fiber.MethodPost, "/sessions/established", map[string]string{"peer_id": peer.String(), "one_time_prekey_id": keyID})
+	}
+
+	// Neither someone else holding no reservation nor a report naming the
+	// wrong owner can finalize the key
+	if status, body := established(carol.ID, bob.ID); status != fiber.StatusConflict {
+		t.Fatalf("non-holder: %d %v", status, body)
+	}
+	if status, body := established(alice.ID, carol.ID); status != fiber.StatusConflict {
+		t.Fatalf("wrong peer: %d %v", status, body)
+	}
+	var key models.OneTimePreKey
+	a.DB.First(&key, "id = ?", keyID)
+	if key.Used {
+		t.Fatal("key used before the holder reported a session")
+	}
+
+	if status, body := established(alice.ID, bob.ID); status != fiber.StatusOK {
+		t.Fatalf("establish: %d %v", status, body)
+	}
+	a.DB.First(&key, "id = ?", keyID)
+	if !key.Used {
+		t.Fatal("established session didn't finalize the reserved key")
+	}
+	var marker models.SessionMarker
+	if err := a.DB.First(&marker, "user_id = ? AND peer_id = ?", alice.ID, bob.ID).Error; err != nil {
+		t.Fatalf("session marker: %v", err)
+	}
+	if status, _ := established(alice.ID, bob.ID); status != fiber.StatusConflict {
+		t.Fatalf("second report with the same key: %d", status)
+	}
+
+	// With markers off the key is still finalized but nothing records the pair
+	a.Sessions.Markers = false
+	dbtest.SeedKeys(t, a.DB, carol, 1)
+	status, body = do(t, serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler), fiber.MethodGet, "/bundle/"+carol.ID.String()+"?reserve=true", nil)
+	if status != fiber.StatusOK || body["one_time_prekey_id"] == nil {
+		t.Fatalf("reserve carol's key: %d %v", status, body)
+	}
+	keyID = body["one_time_prekey_id"].(string)
+	if status, body := established(alice.ID, carol.ID); status != fiber.StatusOK {
+		t.Fatalf("establish without markers: %d %v", status, body)
+	}
+	a.DB.First(&key, "id = ?", keyID)
+	if !key.Used {
+		t.Fatal("key not finalized with markers off")
+	}
+	var markers int64
+	a.DB.Model(&models.SessionMarker{}).Where("peer_id = ?", carol.ID).Count(&markers)
+	if markers != 0 {
+		t.Fatalf("%d markers recorded with markers off", markers)
+	}
+}
+
+func TestBundleReturnsSignedAndOneTimePreKeyIDs(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	signingPriv := dbtest.SeedKeys(t, a.DB, bob, 0)
+	upload := serve(fiber.MethodPost, "/upload", bob.ID, a.PreKeysUploadHandler)
+	rotate := serve(fiber.MethodPost, "/rotate", bob.ID, a.RotateSignedPreKeyHandler)
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	fetch := func() map[string]interface{} {
+		t.Helper()
+		status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("bundle: %d %v", status, body)
+		}
+		return body
+	}
+	signed := func(keyID string) (spk, sig string) {
+		key := x25519Key(t)
+		return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(ed25519.Sign(signingPriv, utils.SignedPreKeyMessage(keyID, key)))
+	}
+
+	// Uploaded under a client-chosen ID
+	body := uploadBody(t, signingPriv)
+	body["signed_prekey_id"] = "spk-42"
+	body["signed_prekey"], body["signed_prekey_signature"] = signed("spk-42")
+	if status, resp := do(t, upload, fiber.MethodPost, "/upload", body); status != fiber.StatusOK {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+	var otk models.OneTimePreKey
+	a.DB.Where("user_id = ? AND used = false", bob.ID).First(&otk)
+	got := fetch()
+	if got["signed_prekey_id"] != "spk-42" || got["one_time_prekey_id"] != otk.ID.String() {
+		t.Fatalf("bundle has signed_prekey_id %v and one_time_prekey_id %v, want spk-42 and %s", got["signed_prekey_id"], got["one_time_prekey_id"], otk.ID)
+	}
+
+	// Rotated under another; without one the default is used
+	spk, sig := signed("spk-43")
+	if status, resp := do(t, rotate, fiber.MethodPost, "/rotate", map[string]string{"signed_prekey_id": "spk-43", "signed_prekey": spk, "signed_prekey_signature": sig}); status != fiber.StatusOK || resp["signed_prekey_id"] != "spk-43" {
+		t.Fatalf("rotate: %d %v", status, resp)
+	}
+	if got := fetch(); got["signed_prekey_id"] != "spk-43" {
+		t.Fatalf("after rotation: signed_prekey_id %v", got["signed_prekey_id"])
+	}
+	spk, sig = signed(utils.SignedPreKeyID)
+	if status, resp := do(t, rotate, fiber.MethodPost, "/rotate", map[string]string{"signed_prekey": spk, "signed_prekey_signature": sig}); status != fiber.StatusOK || resp["signed_prekey_id"] != utils.SignedPreKeyID {
+		t.Fatalf("rotate with default ID: %d %v", status, resp)
+	}
+	if got := fetch(); got["signed_prekey_id"] != utils.SignedPreKeyID {
+		t.Fatalf("after default rotation: signed_prekey_id %v", got["signed_prekey_id"])
+	}
+
+	// The ID is covered by the signature and must be printable
+	spk, sig = signed("spk-44")
+	if status, resp := do(t, rotate, fiber.MethodPost, "/rotate", map[string]string{"signed_prekey_id": "spk-45", "signed_prekey": spk, "signed_prekey_signature": sig}); status != fiber.StatusBadRequest {
+		t.Fatalf("signature over another ID: %d %v", status, resp)
+	}
+	for _, id := range []string{"spk 46", "spk\n47", strings.Repeat("k", maxSignedPreKeyIDLength+1)} {
+		spk, sig = signed(id)
+		if status, resp := do(t, rotate, fiber.MethodPost, "/rotate", map[string]string{"signed_prekey_id": id, "signed_prekey": spk, "signed_prekey_signature": sig}); status != fiber.StatusBadRequest || resp["field"] != "signed_prekey_id" {
+			t.Fatalf("signed_prekey_id %q: %d %v", id, status, resp)
+		}
+	}
+}
+
+func TestOwnBundleDoesNotConsumeOneTimePreKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 2)
+	own := serve(fiber.MethodGet, "/bundle/:user_id", bob.ID, a.GetKeyBundleHandler)
+	available := func() int64 {
+		n, err := a.PreKeySvc.CountOneTimePreKeys(bob.ID, "device-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, target := range []string{"/bundle/" + bob.ID.String(), "/bundle/" + bob.ID.String() + "?reserve=true"} {
+		status, body := do(t, own, fiber.MethodGet, target, nil)
+		if status != fiber.StatusOK || body["signed_prekey"] == nil {
+			t.Fatalf("%s: %d %v", target, status, body)
+		}
+		if body["one_time_prekey_available"] != false || body["one_time_prekey_id"] != nil || body["reserved_until"] != nil {
+			t.Fatalf("%s: own bundle carries a one-time prekey: %v", target, body)
+		}
+		if n := available(); n != 2 {
+			t.Fatalf("%s: %d one-time prekeys left, want 2", target, n)
+		}
+	}
+
+	// Anyone else's fetch still takes one
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	if status, body := do(t, serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler), fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_available"] != true {
+		t.Fatalf("alice's fetch: %d %v", status, body)
+	}
+	if n := available(); n != 1 {
+		t.Fatalf("%d one-time prekeys left after another user's fetch, want 1", n)
+	}
+}
+
+func TestRevokeOneTimePreKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 2)
+	var keys []models.OneTimePreKey
+	if err := a.DB.Where("user_id = ?", bob.ID).Order("id").Find(&keys).Error; err != nil || len(keys) != 2 {
+		t.Fatalf("seeded keys: %v, %v", keys, err)
+	}
+	leaked, kept := keys[0].ID.String(), keys[1].ID.String()
+	revoke := serve(fiber.MethodDelete, "/onetime/:key_id", bob.ID, a.RevokeOneTimePreKeyHandler)
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+
+	// Only the owner can revoke a key
+	asAlice := serve(fiber.MethodDelete, "/onetime/:key_id", alice.ID, a.RevokeOneTimePreKeyHandler)
+	if status, body := do(t, asAlice, fiber.MethodDelete, "/onetime/"+leaked, nil); status != fiber.StatusNotFound {
+		t.Fatalf("revoke someone else's key: %d %v", status, body)
+	}
+
+	if status, body := do(t, revoke, fiber.MethodDelete, "/onetime/"+leaked, nil); status != fiber.StatusOK || body["status"] != "revoked" {
+		t.Fatalf("revoke: %d %v", status, body)
+	}
+	if status, body := do(t, revoke, fiber.MethodDelete, "/onetime/"+leaked, nil); status != fiber.StatusNotFound {
+		t.Fatalf("revoke twice: %d %v", status, body)
+	}
+
+	// The revoked key is never served; the other one is, and then none is left
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_id"] != kept {
+		t.Fatalf("first fetch: %d %v", status, body)
+	}
+	if status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_available"] != false {
+		t.Fatalf("second fetch: %d %v", status, body)
+	}
+
+	// A key that has already been handed out can't be revoked
+	if status, body := do(t, revoke, fiber.MethodDelete, "/onetime/"+kept, nil); status != fiber.StatusConflict || body["error"] != "already_consumed" {
+		t.Fatalf("revoke consumed key: %d %v", status, body)
+	}
+	if status, body := do(t, revoke, fiber.MethodDelete, "/onetime/not-a-uuid", nil); status != fiber.StatusBadRequest {
+		t.Fatalf("bad key id: %d %v", status, body)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	long := strings.Repeat("a", 9)
+	for _, tc := range []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: "a, b ,a,,b", want: []string{"a", "b"}},
+		// Case doesn't make a tag distinct
+		{raw: "Go,GO,go-ln_2", want: []string{"go", "go-ln_2"}},
+		{raw: "a,b,c", want: []string{"a", "b", "c"}},
+		{raw: "a,b,c,d", wantErr: true},
+		// Duplicates don't count towards the cap
+		{raw: "a,b,c,c,c", want: []string{"a", "b", "c"}},
+		{raw: strings.Repeat("a", 8), want: []string{strings.Repeat("a", 8)}},
+		{raw: long, wantErr: true},
+		{raw: "a b", wantErr: true},
+		{raw: "tag;drop", wantErr: true},
+		{raw: "aGk=", wantErr: true},
+		{raw: "a/b+c", wantErr: true},
+		{raw: " , ", wantErr: true},
+	} {
+		got, err := normalizeTags(tc.raw, 3, 8)
+		if (err != nil) != tc.wantErr || strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("normalizeTags(%q) = %v, %v", tc.raw, got, err)
+		}
+	}
+}
+
+func TestEnqueueRejectsInvalidTags(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.MatchMaxTags = 2
+	a.Cfg.MatchMaxTagLength = 8
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	connect(t, a, alice.ID, false)
+	enqueue := serve(fiber.MethodPost, "/enqueue", alice.ID, a.EnqueueMatchHandler)
+
+	for _, tags := range []string{"a,b,c", strings.Repeat("x", 9), "bad tag"} {
+		status, body := do(t, enqueue, fiber.MethodPost, "/enqueue", map[string]string{"tag_hash": tags})
+		if status != fiber.StatusBadRequest || body["field"] != "tag_hash" {
+			t.Fatalf("%q: %d %v", tags, status, body)
+		}
+	}
+	if _, ok := a.Matchmaker.Position(alice.ID); ok {
+		t.Fatal("rejected enqueue left a queue entry")
+	}
+
+	if status, body := do(t, enqueue, fiber.MethodPost, "/enqueue", map[string]string{"tag_hash": "a,b,a,b"}); status != fiber.StatusOK {
+		t.Fatalf("duplicates: %d %v", status, body)
+	}
+	var profile models.MatchProfile
+	a.DB.Where("user_id = ?", alice.ID).First(&profile)
+	if profile.TagHash != "a,b" {
+		t.Fatalf("stored tags %q", profile.TagHash)
+	}
+
+	// Enqueueing again with other tags replaces the stored ones
+	a.Matchmaker.Leave(alice.ID)
+	if status, body := do(t, enqueue, fiber.MethodPost, "/enqueue", map[string]string{"tag_hash": "C"}); status != fiber.StatusOK {
+		t.Fatalf("re-enqueue: %d %v", status, body)
+	}
+	var profiles []models.MatchProfile
+	a.DB.Where("user_id = ?", alice.ID).Find(&profiles)
+	if len(profiles) != 1 || profiles[0].TagHash != "c" {
+		t.Fatalf("profiles after re-enqueue: %+v", profiles)
+	}
+}
+
+func TestBundleSignatureVerifiesWithServerKey(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+
+	_, keyResp := do(t, serve(fiber.MethodGet, "/pubkey", uuid.Nil, a.ServerPublicKeyHandler), fiber.MethodGet, "/pubkey", nil)
+	pub, err := utils.ParseRSAPublicKey([]byte(keyResp["public_key"].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := do(t, serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler), fiber.MethodGet, "/bundle/"+bob.ID.String(), nil)
+	if status != fiber.StatusOK || body["bundle_signature_alg"] != "RSA-PSS-SHA256" {
+		t.Fatalf("bundle: %d %v", status, body)
+	}
+	field := func(name string) []byte {
+		b, err := base64.StdEncoding.DecodeString(body[name].(string))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return b
+	}
+	userID := uuid.FromStringOrNil(body["user_id"].(string))
+	identity, spk, spkSig, otk := field("identity_pub"), field("signed_prekey"), field("signed_prekey_signature"), field("one_time_prekey")
+	sig := field("bundle_signature")
+	if !utils.VerifyBundle(pub, sig, userID.Bytes(), identity, spk, spkSig, otk) {
+		t.Fatal("bundle signature does not verify")
+	}
+
+	// A bundle with any component swapped out doesn't verify
+	other := x25519Key(t)
+	for name, fields := range map[string][][]byte{
+		"identity":  {userID.Bytes(), other, spk, spkSig, otk},
+		"one-time":  {userID.Bytes(), identity, spk, spkSig, other},
+		"user":      {alice.ID.Bytes(), identity, spk, spkSig, otk},
+		"no otk":    {userID.Bytes(), identity, spk, spkSig, nil},
+		"signed pk": {userID.Bytes(), identity, other, spkSig, otk},
+	} {
+		if utils.VerifyBundle(pub, sig, fields...) {
+			t.Errorf("%s swapped: signature still verifies", name)
+		}
+	}
+}
+
+func TestBundleWithNoOneTimePreKeysSignalsExhaustion(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	bobConn := connect(t, a, bob.ID, false)
+
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String(), nil)
+	if status != fiber.StatusOK || body["one_time_prekey_available"] != false || body["one_time_prekey"] != nil {
+		t.Fatalf("bundle: %d %v", status, body)
+	}
+	if body["signed_prekey"] == nil || body["identity_pub"] == nil {
+		t.Fatalf("bundle without one-time prekeys dropped the rest: %v", body)
+	}
+	if f := nextFrame(t, bobConn); !strings.Contains(string(f.Data), `"type":"prekeys_low"`) || !strings.Contains(string(f.Data), `"remaining":0`) {
+		t.Fatalf("notice = %s", f.Data)
+	}
+
+	// A user with keys left gets no notice
+	dbtest.SeedKeys(t, a.DB, alice, 2)
+	aliceConn := connect(t, a, alice.ID, false)
+	fromBob := serve(fiber.MethodGet, "/bundle/:user_id", bob.ID, a.GetKeyBundleHandler)
+	if status, body := do(t, fromBob, fiber.MethodGet, "/bundle/"+alice.ID.String(), nil); status != fiber.StatusOK || body["one_time_prekey_available"] != true {
+		t.Fatalf("bundle with keys: %d %v", status, body)
+	}
+	noFrame(t, aliceConn)
+}
+
+func TestBundleServesOnlyTheRequestedDevicesKeys(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	spk := x25519Key(t)
+	if err := a.PreKeySvc.StoreSignedPreKey(bob.ID, "device-2", "spk-2", spk, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String()+"?device_id=device-2", nil)
+	if status != fiber.StatusOK || body["signed_prekey"] != base64.StdEncoding.EncodeToString(spk) || body["one_time_prekey_available"] != false {
+		t.Fatalf("device-2 bundle: %d %v", status, body)
+	}
+	if n, _ := a.PreKeySvc.CountOneTimePreKeys(bob.ID, "device-1"); n != 1 {
+		t.Fatalf("device-2 fetch consumed device-1's one-time prekey: %d left", n)
+	}
+
+	status, body = do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String()+"?device_id=device-1", nil)
+	if status != fiber.StatusOK || body["signed_prekey"] == base64.StdEncoding.EncodeToString(spk) || body["one_time_prekey_available"] != true {
+		t.Fatalf("device-1 bundle: %d %v", status, body)
+	}
+	if status, _ := do(t, bundle, fiber.MethodGet, "/bundle/"+bob.ID.String()+"?device_id=device-3", nil); status != fiber.StatusNotFound {
+		t.Fatalf("unknown device: %d", status)
+	}
+}
+
+func TestMatchPositionResponse(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	position := serve(fiber.MethodGet, "/position", alice.ID, a.MatchPositionHandler)
+	if status, body := do(t, position, fiber.MethodGet, "/position", nil); status != fiber.StatusOK || body["status"] != "not_queued" {
+		t.Fatalf("not queued: %d %v", status, body)
+	}
+
+	connect(t, a, alice.ID, false)
+	if err := a.Matchmaker.Enqueue(context.Background(), alice.ID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	status, body := do(t, position, fiber.MethodGet, "/position", nil)
+	if status != fiber.StatusOK || body["status"] != "queued" || body["position"] != float64(1) || body["bucket_size"] != float64(1) {
+		t.Fatalf("queued: %d %v", status, body)
+	}
+	if _, ok := body["estimated_wait_seconds"]; ok {
+		t.Fatalf("estimate without any recent pairings: %v", body)
+	}
+}
+
+func TestBundleFailsWhenOneTimePreKeyLookupErrors(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 1)
+	bobConn := connect(t, a, bob.ID, false)
+	a.DB.Callback().Query().Before("gorm:query").Register("test:fail_otk", func(tx *gorm.DB) {
+		if tx.Statement.Table == "one_time_pre_keys" {
+			tx.AddError(errors.New("simulated failure"))
+		}
+	})
+
+	// A real error must not be served as an exhausted pool
+	for _, target := range []string{"/bundle/" + bob.ID.String(), "/bundle/" + bob.ID.String() + "?reserve=true"} {
+		bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice.ID, a.GetKeyBundleHandler)
+		if status, body := do(t, bundle, fiber.MethodGet, target, nil); status != fiber.StatusInternalServerError || body["error"] != "database error" {
+			t.Fatalf("%s: %d %v", target, status, body)
+		}
+	}
+	noFrame(t, bobConn)
+}
+
+func TestKeyStatusReportsReadinessWithoutConsumingKeys(t *testing.T) {
+	a, _ := newTestApp(t)
+	caller := dbtest.SeedUser(t, a.DB, "caller")
+	ready := dbtest.SeedUser(t, a.DB, "ready")
+	dbtest.SeedKeys(t, a.DB, ready, 2)
+	drained := dbtest.SeedUser(t, a.DB, "drained")
+	dbtest.SeedKeys(t, a.DB, drained, 0)
+	identityOnly := dbtest.SeedUser(t, a.DB, "identity-only")
+	blank := dbtest.SeedUser(t, a.DB, "blank")
+	if err := a.DB.Model(&models.User{}).Where("id = ?", blank.ID).Update("identity_pub_key", []byte{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	keyStatus := serve(fiber.MethodGet, "/status/:user_id", caller.ID, a.KeyStatusHandler)
+
+	for _, tc := range []struct {
+		name, target string
+		want         map[string]bool
+	}{
+		{"fully ready", ready.ID.String(), map[string]bool{"ready": true, "has_identity_key": true, "has_signed_prekey": true, "one_time_prekeys_available": true, "has_active_device": true}},
+		{"no one-time prekeys", drained.ID.String(), map[string]bool{"ready": true, "has_identity_key": true, "has_signed_prekey": true, "one_time_prekeys_available": false, "has_active_device": true}},
+		{"other device", ready.ID.String() + "?device_id=device-2", map[string]bool{"ready": false, "has_identity_key": true, "has_signed_prekey": false, "one_time_prekeys_available": false, "has_active_device": false}},
+		{"identity only", identityOnly.ID.String(), map[string]bool{"ready": false, "has_identity_key": true, "has_signed_prekey": false, "one_time_prekeys_available": false, "has_active_device": false}},
+		{"not ready", blank.ID.String(), map[string]bool{"ready": false, "has_identity_key": false, "has_signed_prekey": false, "one_time_prekeys_available": false, "has_active_device": false}},
+	} {
+		status, body := do(t, keyStatus, fiber.MethodGet, "/status/"+tc.target, nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("%s: %d %v", tc.name, status, body)
+		}
+		for field, want := range tc.want {
+			if body[field] != want {
+				t.Errorf("%s: %s = %v, want %v", tc.name, field, body[field], want)
+			}
+		}
+	}
+
+	// Probing neither consumes nor reserves a one-time prekey
+	if n, _ := a.PreKeySvc.CountOneTimePreKeys(ready.ID, "device-1"); n != 2 {
+		t.Fatalf("%d one-time prekeys left after probing, want 2", n)
+	}
+	if status, _ := do(t, keyStatus, fiber.MethodGet, "/status/"+uuid.Must(uuid.NewV4()).String(), nil); status != fiber.StatusNotFound {
+		t.Fatalf("unknown user: %d", status)
+	}
+}
+
+func TestCanceledEnqueueLeavesUserOutOfQueue(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	connect(t, a, alice.ID, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client goes away just after the profile is stored
+	a.DB.Callback().Create().After("gorm:create").Register("test:client_gone", func(tx *gorm.DB) {
+		if tx.Statement.Table == "match_profiles" {
+			cancel()
+		}
+	})
+	enqueue := serve(fiber.MethodPost, "/enqueue", alice.ID, func(c *fiber.Ctx) error {
+		c.SetUserContext(ctx)
+		return c.Next()
+	}, a.EnqueueMatchHandler)
+
+	status, body := do(t, enqueue, fiber.MethodPost, "/enqueue", map[string]string{"tag_hash": "go"})
+	if status != fiber.StatusRequestTimeout || body["error"] != "request canceled" {
+		t.Fatalf("enqueue: %d %v", status, body)
+	}
+	if _, ok := a.Matchmaker.Position(alice.ID); ok {
+		t.Fatal("canceled request left the user queued")
+	}
+	if err := a.Matchmaker.Enqueue(ctx, alice.ID, []string{"go"}, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Enqueue with a canceled context = %v", err)
+	}
+	if _, ok := a.Matchmaker.Position(alice.ID); ok {
+		t.Fatal("Enqueue with a canceled context queued the user")
+	}
+}
+
+func TestEnqueueWhileMatchedCanBeRejected(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Matchmaker.WhileMatched = services.WhileMatchedReject
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	connect(t, a, alice.ID, false)
+	connect(t, a, bob.ID, false)
+	pair(t, a, alice.ID, bob.ID)
+
+	enqueue := serve(fiber.MethodPost, "/enqueue", alice.ID, a.EnqueueMatchHandler)
+	if status, body := do(t, enqueue, fiber.MethodPost, "/enqueue", map[string]string{"tag_hash": "go"}); status != fiber.StatusConflict || body["error"] != "already_matched" {
+		t.Fatalf("enqueue: %d %v", status, body)
+	}
+	if p, ok := a.Matchmaker.GetPair(alice.ID); !ok || p != bob.ID {
+		t.Fatal("rejected enqueue ended the match")
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/services"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+// GET /api/messages/backlog
+// Size of the caller's offline queue across conversations, so a reconnecting
+// client can show sync progress before draining it.
+func (a *App) MessageBacklogHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	b, err := a.Convos.Backlog(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	resp := MessageBacklogResponse{Count: b.Count, Bytes: b.Bytes}
+	if b.Count > 0 {
+		resp.Oldest = b.Oldest.Unix()
+		resp.Newest = b.Newest.Unix()
+	}
+	return c.JSON(resp)
+}
+
+// GET /api/messages/search
+// Filters the caller's stored ciphertext by conversation, sender and time.
+// since and until are Unix seconds; nothing is decrypted or returned beyond
+// metadata. Only messages still queued are stored: nothing is kept once
+// delivered, so the server holds no record of who talked to whom.
+func (a *App) SearchMessagesHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var f services.MessageFilter
+	if s := c.Query("conversation_id"); s != "" {
+		convID, err := parseUUIDField("conversation_id", s)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		isMember, err := a.Convos.IsMember(convID, userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+		if !isMember {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_member"})
+		}
+		f.ConversationID = &convID
+	}
+	if s := c.Query("from"); s != "" {
+		senderID, err := parseUUIDField("from", s)
+		if err != nil {
+			return invalidUUID(c, err)
+		}
+		f.SenderID = &senderID
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		s := c.Query(p.name)
+		if s == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || sec < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid timestamp", "field": p.name})
+		}
+		*p.dst = time.Unix(sec, 0)
+	}
+
+	limit := c.QueryInt("limit", defaultSearchLimit)
+	if limit < 1 || limit > maxSearchLimit {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid limit", "field": "limit"})
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid offset", "field": "offset"})
+	}
+
+	// One extra row tells us whether another page exists
+	msgs, err := a.Convos.SearchQueued(userID, f, limit+1, offset)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	resp := MessageSearchResponse{Messages: make([]MessageMetadata, 0, len(msgs))}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		resp.NextOffset = offset + limit
+	}
+	for _, m := range msgs {
+		meta := MessageMetadata{
+			MessageID: m.ID.String(),
+			SenderID:  m.SenderID.String(),
+			CreatedAt: m.CreatedAt.Unix(),
+		}
+		if m.ConversationID != nil {
+			meta.ConversationID = m.ConversationID.String()
+		}
+		resp.Messages = append(resp.Messages, meta)
+	}
+	return c.JSON(resp)
+}
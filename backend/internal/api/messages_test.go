@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// sendMessage sends "ct" from from to a user, or to every other member of a
+// conversation
+func sendMessage(t *testing.T, a *App, from *services.Connection, field, to string) {
+	t.Helper()
+	msg := map[string]interface{}{"type": "message", field: to, "payload": "ct"}
+	if field == "conversation_id" {
+		delete(msg, "payload")
+		members, err := a.Convos.MemberIDs(uuid.FromStringOrNil(to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads := make(map[string]string)
+		for _, id := range members {
+			if id != from.UserID {
+				payloads[id.String()] = "ct"
+			}
+		}
+		msg["payloads"] = payloads
+	}
+	frame, _ := json.Marshal(msg)
+	a.dispatchText(&wsSession{conn: from}, frame)
+	noFrame(t, from)
+}
+
+func searchTimes(t *testing.T, search *fiber.App, query string) []int64 {
+	t.Helper()
+	status, body := do(t, search, fiber.MethodGet, "/search?"+query, nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("%q: %d %v", query, status, body)
+	}
+	var times []int64
+	for _, m := range body["messages"].([]interface{}) {
+		times = append(times, int64(m.(map[string]interface{})["created_at"].(float64)))
+	}
+	return times
+}
+
+func TestSearchMessagesFilters(t *testing.T) {
+	a, _ := newTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := func(from uuid.UUID, convID *uuid.UUID, at time.Time) {
+		t.Helper()
+		if err := a.DB.Create(&models.QueuedMessage{
+			ID:             uuid.Must(uuid.NewV4()),
+			RecipientID:    bob.ID,
+			SenderID:       from,
+			ConversationID: convID,
+			Payload:        []byte("ct"),
+			CreatedAt:      at,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := clock.Now()
+	t1 := t0.Add(time.Hour)
+	t2 := t1.Add(time.Hour)
+	queue(alice.ID, nil, t0)
+	queue(alice.ID, &conv.ID, t1)
+	queue(carol.ID, nil, t2)
+
+	search := serve(fiber.MethodGet, "/search", bob.ID, a.SearchMessagesHandler)
+	cases := []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{t2.Unix(), t1.Unix(), t0.Unix()}},
+		{"from=" + alice.ID.String(), []int64{t1.Unix(), t0.Unix()}},
+		{"conversation_id=" + conv.ID.String(), []int64{t1.Unix()}},
+		{"conversation_id=" + conv.ID.String() + "&from=" + carol.ID.String(), nil},
+		{fmt.Sprintf("since=%d", t1.Unix()), []int64{t2.Unix(), t1.Unix()}},
+		{fmt.Sprintf("until=%d", t1.Unix()), []int64{t0.Unix()}},
+		{fmt.Sprintf("since=%d&until=%d&from=%s", t0.Unix(), t2.Unix(), alice.ID), []int64{t1.Unix(), t0.Unix()}},
+	}
+	for _, tc := range cases {
+		got := searchTimes(t, search, tc.query)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%q: got %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	status, body := do(t, search, fiber.MethodGet, "/search?limit=2", nil)
+	if status != fiber.StatusOK || len(body["messages"].([]interface{})) != 2 || body["next_offset"] != float64(2) {
+		t.Fatalf("first page: %d %v", status, body)
+	}
+	status, body = do(t, search, fiber.MethodGet, "/search?limit=2&offset=2", nil)
+	if status != fiber.StatusOK || len(body["messages"].([]interface{})) != 1 || body["next_offset"] != nil {
+		t.Fatalf("last page: %d %v", status, body)
+	}
+}
+
+func TestSearchMessagesForgetsDelivered(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	fromAlice := connect(t, a, alice.ID, false)
+	search := serve(fiber.MethodGet, "/search", bob.ID, a.SearchMessagesHandler)
+
+	bobConn := connect(t, a, bob.ID, false)
+	sendMessage(t, a, fromAlice, "to", bob.ID.String())
+	nextFrame(t, bobConn)
+	if got := searchTimes(t, search, ""); len(got) != 0 {
+		t.Fatalf("live delivery left a record: %v", got)
+	}
+
+	a.Hub.Unregister(bobConn)
+	sendMessage(t, a, fromAlice, "to", bob.ID.String())
+	if got := searchTimes(t, search, ""); len(got) != 1 {
+		t.Fatalf("queued message not searchable: %v", got)
+	}
+	bobConn = connect(t, a, bob.ID, false)
+	a.flushQueued(bobConn, make(chan struct{}))
+	nextFrame(t, bobConn)
+	waitFor(t, func() bool { return len(searchTimes(t, search, "")) == 0 })
+}
+
+func TestSearchMessagesRequiresMembership(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(t, a, connect(t, a, alice.ID, false), "conversation_id", conv.ID.String())
+
+	search := serve(fiber.MethodGet, "/search", carol.ID, a.SearchMessagesHandler)
+	status, body := do(t, search, fiber.MethodGet, "/search?conversation_id="+conv.ID.String(), nil)
+	if status != fiber.StatusForbidden || body["error"] != "not_a_member" {
+		t.Fatalf("non-member: %d %v", status, body)
+	}
+	// Without a conversation filter carol sees only her own messages
+	status, body = do(t, search, fiber.MethodGet, "/search?from="+alice.ID.String(), nil)
+	if status != fiber.StatusOK || len(body["messages"].([]interface{})) != 0 {
+		t.Fatalf("non-member search: %d %v", status, body)
+	}
+	for _, q := range []string{"limit=0", "offset=-1", "since=abc", "from=nope"} {
+		if status, _ := do(t, search, fiber.MethodGet, "/search?"+q, nil); status != fiber.StatusBadRequest {
+			t.Fatalf("%s: status %d", q, status)
+		}
+	}
+}
+
+func TestMessageBacklogMatchesQueuedRows(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backlog := func(userID uuid.UUID) map[string]interface{} {
+		t.Helper()
+		status, body := do(t, serve(fiber.MethodGet, "/messages/backlog", userID, a.MessageBacklogHandler), fiber.MethodGet, "/messages/backlog", nil)
+		if status != fiber.StatusOK {
+			t.Fatalf("backlog: %d %v", status, body)
+		}
+		return body
+	}
+
+	if got := backlog(bob.ID); got["count"] != float64(0) || got["bytes"] != float64(0) || got["oldest"] != nil || got["newest"] != nil {
+		t.Fatalf("empty backlog = %v", got)
+	}
+
+	// Queued for bob across a direct chat and a conversation, plus one for
+	// carol that mustn't show up in his numbers
+	base := time.Unix(1700000000, 0)
+	rows := []models.QueuedMessage{
+		{RecipientID: bob.ID, SenderID: alice.ID, Payload: make([]byte, 10), CreatedAt: base.Add(2 * time.Minute)},
+		{RecipientID: bob.ID, SenderID: alice.ID, ConversationID: &conv.ID, Payload: make([]byte, 25), CreatedAt: base},
+		{RecipientID: bob.ID, SenderID: carol.ID, Payload: make([]byte, 7), CreatedAt: base.Add(5 * time.Minute)},
+		{RecipientID: carol.ID, SenderID: alice.ID, Payload: make([]byte, 1000), CreatedAt: base.Add(time.Hour)},
+	}
+	for i := range rows {
+		rows[i].ID = uuid.Must(uuid.NewV4())
+		if err := a.DB.Create(&rows[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := backlog(bob.ID)
+	if got["count"] != float64(3) || got["bytes"] != float64(42) {
+		t.Fatalf("bob's backlog = %v, want 3 messages of 42 bytes", got)
+	}
+	if got["oldest"] != float64(base.Unix()) || got["newest"] != float64(base.Add(5*time.Minute).Unix()) {
+		t.Fatalf("bob's backlog spans %v..%v", got["oldest"], got["newest"])
+	}
+	if got := backlog(carol.ID); got["count"] != float64(1) || got["bytes"] != float64(1000) {
+		t.Fatalf("carol's backlog = %v", got)
+	}
+
+	// Delivering the queue empties the backlog
+	bobConn := connect(t, a, bob.ID, false)
+	a.flushQueued(bobConn, make(chan struct{}))
+	for i := 0; i < 3; i++ {
+		nextFrame(t, bobConn)
+	}
+	waitFor(t, func() bool { return backlog(bob.ID)["count"] == float64(0) })
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/utils"
+)
+
+// POST /api/keys/pin/:user_id
+// Pins by real user ID only; anonymous match IDs are not resolved, so pins
+// never tie a caller to an unrevealed peer.
+func (a *App) PinIdentityHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	peerID, err := parseUUIDField("user_id", c.Params("user_id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+	if peerID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "cannot pin own identity"})
+	}
+
+	var req PinIdentityRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return invalidBody(c, err)
+		}
+	}
+
+	var peer models.User
+	if err := a.dbFor(c).Select("id", "identity_pub_key").Where("id = ?", peerID).First(&peer).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	key := peer.IdentityPubKey
+	if len(req.IdentityPub) > 0 {
+		key = req.IdentityPub
+		if err := utils.ValidateX25519PublicKey(key); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid identity_pub", "field": "identity_pub"})
+		}
+	}
+
+	pin := models.IdentityPin{UserID: userID, PeerID: peerID, IdentityPubKey: key}
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "peer_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"identity_pub_key", "updated_at"}),
+	}
+	if err := a.dbFor(c).Clauses(upsert).Create(&pin).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to pin identity"})
+	}
+	return c.JSON(pinJSON(pin, peer.IdentityPubKey))
+}
+
+// GET /api/keys/pins
+func (a *App) ListIdentityPinsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var pins []models.IdentityPin
+	if err := a.dbFor(c).Where("user_id = ?", userID).Order("updated_at desc").Find(&pins).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	peerIDs := make([]uuid.UUID, len(pins))
+	for i, p := range pins {
+		peerIDs[i] = p.PeerID
+	}
+	var peers []models.User
+	if len(peerIDs) > 0 {
+		if err := a.dbFor(c).Select("id", "identity_pub_key").Where("id IN ?", peerIDs).Find(&peers).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+	}
+	current := make(map[uuid.UUID][]byte, len(peers))
+	for _, p := range peers {
+		current[p.ID] = p.IdentityPubKey
+	}
+
+	out := make([]IdentityPinResponse, len(pins))
+	for i, p := range pins {
+		out[i] = pinJSON(p, current[p.PeerID])
+	}
+	return c.JSON(IdentityPinListResponse{Pins: out})
+}
+
+func pinJSON(pin models.IdentityPin, current []byte) IdentityPinResponse {
+	return IdentityPinResponse{
+		PeerUserID:     pin.PeerID.String(),
+		IdentityPub:    pin.IdentityPubKey,
+		MatchesCurrent: bytes.Equal(pin.IdentityPubKey, current),
+		PinnedAt:       pin.UpdatedAt.Unix(),
+	}
+}
+
+// notifyIdentityChanged tells everyone who pinned userID's identity that it
+// changed, and whether their pin no longer matches the new key
+func (a *App) notifyIdentityChanged(userID uuid.UUID, newKey []byte) {
+	if !a.Cfg.IdentityChangeNotify {
+		return
+	}
+	var pins []models.IdentityPin
+	if err := a.DB.Where("peer_id = ?", userID).Find(&pins).Error; err != nil {
+		log.Printf("identity change for %s: loading pins: %v", userID, err)
+		return
+	}
+	for _, p := range pins {
+		notice, _ := json.Marshal(map[string]interface{}{
+			"type":            "identity_changed",
+			"peer_user_id":    userID.String(),
+			"pin_invalidated": !bytes.Equal(p.IdentityPubKey, newKey),
+		})
+		a.Hub.SendTo(p.UserID, notice)
+	}
+}
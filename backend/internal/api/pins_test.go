@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+)
+
+func TestIdentityPinsTrackKeyChanges(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.IdentityChangeNotify = true
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	dave := dbtest.SeedUser(t, a.DB, "dave")
+	signingPriv := dbtest.SeedKeys(t, a.DB, bob, 0)
+	enc := base64.StdEncoding.EncodeToString
+	pinFor := func(userID uuid.UUID) *fiber.App {
+		return serve(fiber.MethodPost, "/pin/:user_id", userID, a.PinIdentityHandler)
+	}
+	listPins := serve(fiber.MethodGet, "/pins", alice.ID, a.ListIdentityPinsHandler)
+
+	// alice pins bob's current key; dave pins the key bob is about to move to
+	status, body := do(t, pinFor(alice.ID), fiber.MethodPost, "/pin/"+bob.ID.String(), nil)
+	if status != fiber.StatusOK || body["identity_pub"] != enc(bob.IdentityPubKey) || body["matches_current"] != true {
+		t.Fatalf("pin current key: %d %v", status, body)
+	}
+	upload := uploadBody(t, signingPriv)
+	newKey := upload["identity_pub"].(string)
+	if status, body := do(t, pinFor(dave.ID), fiber.MethodPost, "/pin/"+bob.ID.String(), map[string]string{"identity_pub": newKey}); status != fiber.StatusOK || body["matches_current"] != false {
+		t.Fatalf("pin given key: %d %v", status, body)
+	}
+	if status, _ := do(t, pinFor(alice.ID), fiber.MethodPost, "/pin/"+alice.ID.String(), nil); status != fiber.StatusBadRequest {
+		t.Fatalf("pin own identity: %d", status)
+	}
+	if status, _ := do(t, pinFor(alice.ID), fiber.MethodPost, "/pin/"+uuid.Must(uuid.NewV4()).String(), nil); status != fiber.StatusNotFound {
+		t.Fatalf("pin unknown user: %d", status)
+	}
+
+	aliceConn := connect(t, a, alice.ID, false)
+	carolConn := connect(t, a, carol.ID, false)
+	daveConn := connect(t, a, dave.ID, false)
+	if status, resp := do(t, serve(fiber.MethodPost, "/upload", bob.ID, a.PreKeysUploadHandler), fiber.MethodPost, "/upload", upload); status != fiber.StatusOK {
+		t.Fatalf("upload: %d %v", status, resp)
+	}
+
+	notice := func(data []byte) map[string]interface{} {
+		t.Helper()
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if m := notice(nextFrame(t, aliceConn).Data); m["type"] != "identity_changed" || m["peer_user_id"] != bob.ID.String() || m["pin_invalidated"] != true {
+		t.Fatalf("alice: %v", m)
+	}
+	if m := notice(nextFrame(t, daveConn).Data); m["type"] != "identity_changed" || m["pin_invalidated"] != false {
+		t.Fatalf("dave: %v", m)
+	}
+	// Peers who never pinned bob aren't told
+	noFrame(t, carolConn)
+
+	status, body = do(t, listPins, fiber.MethodGet, "/pins", nil)
+	pins, _ := body["pins"].([]interface{})
+	if status != fiber.StatusOK || len(pins) != 1 {
+		t.Fatalf("list: %d %v", status, body)
+	}
+	if pin := pins[0].(map[string]interface{}); pin["peer_user_id"] != bob.ID.String() || pin["matches_current"] != false {
+		t.Fatalf("stale pin: %v", pin)
+	}
+
+	// Re-pinning accepts the new key
+	if status, body := do(t, pinFor(alice.ID), fiber.MethodPost, "/pin/"+bob.ID.String(), nil); status != fiber.StatusOK || body["identity_pub"] != newKey || body["matches_current"] != true {
+		t.Fatalf("re-pin: %d %v", status, body)
+	}
+	if _, body := do(t, serve(fiber.MethodGet, "/pins", carol.ID, a.ListIdentityPinsHandler), fiber.MethodGet, "/pins", nil); len(body["pins"].([]interface{})) != 0 {
+		t.Fatalf("carol's pins: %v", body)
+	}
+}
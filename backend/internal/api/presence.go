@@ -0,0 +1,79 @@
+package api
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// GET /api/presence/:user_id
+// Only the caller's current match or someone sharing a conversation with them
+// can be looked up. Online comes from the hub alone; the stored last-seen may
+// predate a crash and is never read as online. Users who don't share presence
+// come back hidden to everyone but themselves.
+func (a *App) PresenceHandler(c *fiber.Ctx) error {
+	callerID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	targetID, err := parseUUIDField("user_id", c.Params("user_id"))
+	if err != nil {
+		return invalidUUID(c, err)
+	}
+	if a.Cfg.MatchAnonymous {
+		if peer, ok := a.Matchmaker.ResolvePeer(callerID, targetID); ok {
+			targetID = peer
+		}
+	}
+
+	allowed, err := a.canSeePresence(callerID, targetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "not_a_contact"})
+	}
+
+	var user models.User
+	if err := a.dbFor(c).Select("id", "last_seen_at", "share_presence").Where("id = ?", targetID).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "user not found"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+
+	if !user.SharePresence && callerID != targetID {
+		return c.JSON(PresenceResponse{Hidden: true})
+	}
+
+	resp := PresenceResponse{}
+	var lastSeen time.Time
+	if user.LastSeenAt != nil {
+		lastSeen = *user.LastSeenAt
+	}
+	if seen, ok := a.Hub.LastSeenOf(targetID); ok {
+		resp.Online = true
+		if seen.After(lastSeen) {
+			lastSeen = seen
+		}
+	}
+	if !lastSeen.IsZero() {
+		resp.LastSeen = lastSeen.Unix()
+	}
+	return c.JSON(resp)
+}
+
+func (a *App) canSeePresence(callerID, targetID uuid.UUID) (bool, error) {
+	if callerID == targetID {
+		return true, nil
+	}
+	if peer, ok := a.Matchmaker.GetPair(callerID); ok && peer == targetID {
+		return true, nil
+	}
+	return a.Convos.SharesConversation(callerID, targetID)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// PUT /api/me/privacy
+// Omitted fields keep their current value.
+func (a *App) UpdatePrivacyHandler(c *fiber.Ctx) error {
+	userID, err := GetUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var req PrivacySettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	updates := map[string]interface{}{}
+	if req.SharePresence != nil {
+		updates["share_presence"] = *req.SharePresence
+	}
+	if req.ShareTyping != nil {
+		updates["share_typing"] = *req.ShareTyping
+	}
+	if req.ShareReadReceipts != nil {
+		updates["share_read_receipts"] = *req.ShareReadReceipts
+	}
+	if len(updates) > 0 {
+		if err := a.dbFor(c).Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		}
+	}
+
+	user, err := a.privacyOf(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+	}
+	return c.JSON(PrivacySettingsResponse{
+		SharePresence:     user.SharePresence,
+		ShareTyping:       user.ShareTyping,
+		ShareReadReceipts: user.ShareReadReceipts,
+	})
+}
+
+// privacyOf loads only the user's privacy settings
+func (a *App) privacyOf(userID uuid.UUID) (models.User, error) {
+	var user models.User
+	err := a.DB.Select("id", "share_presence", "share_typing", "share_read_receipts").Where("id = ?", userID).First(&user).Error
+	return user, err
+}
+
+// relaySignal forwards a typing or read frame to a contact or to the other
+// members of a conversation. Signals are ephemeral: recipients who are offline
+// miss them, and nothing is sent when the sender has switched the signal off.
+func (a *App) relaySignal(conn *services.Connection, msg WSClientMessage) {
+	sender, err := a.privacyOf(conn.UserID)
+	if err != nil {
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	if (msg.Type == "typing" && !sender.ShareTyping) || (msg.Type == "read" && !sender.ShareReadReceipts) {
+		return
+	}
+
+	frame := map[string]interface{}{"type": msg.Type}
+	if msg.Type == "typing" {
+		frame["typing"] = msg.Typing
+	} else {
+		frame["read_up_to"] = msg.ReadUpTo
+	}
+
+	if msg.ConversationID != "" {
+		convID, err := parseUUIDField("conversation_id", msg.ConversationID)
+		if err != nil {
+			sendWSError(conn, "invalid_uuid", "conversation_id")
+			return
+		}
+		isMember, err := a.Convos.IsMember(convID, conn.UserID)
+		if err != nil {
+			sendWSError(conn, "internal_error", "")
+			return
+		}
+		if !isMember {
+			sendWSError(conn, "not_a_member", "conversation_id")
+			return
+		}
+		members, err := a.Convos.MemberIDs(convID)
+		if err != nil {
+			sendWSError(conn, "internal_error", "")
+			return
+		}
+		frame["from"] = conn.UserID.String()
+		frame["conversation_id"] = convID.String()
+		notice, _ := json.Marshal(frame)
+		for _, id := range members {
+			if id != conn.UserID {
+				a.Hub.SendTo(id, notice)
+			}
+		}
+		return
+	}
+
+	to, err := parseUUIDField("to", msg.To)
+	if err != nil {
+		sendWSError(conn, "invalid_uuid", "to")
+		return
+	}
+	recipient := a.resolveRecipient(conn.UserID, to)
+	allowed, err := a.canSeePresence(conn.UserID, recipient)
+	if err != nil {
+		log.Printf("signal from %s: %v", conn.UserID, err)
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	if !allowed {
+		sendWSError(conn, "not_a_contact", "to")
+		return
+	}
+	frame["from"] = a.senderAddress(conn.UserID, recipient).String()
+	notice, _ := json.Marshal(frame)
+	a.Hub.SendTo(recipient, notice)
+}
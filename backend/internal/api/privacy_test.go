@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+)
+
+func TestDisablingPrivacySettingSuppressesItsEvent(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	if _, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID}); err != nil {
+		t.Fatal(err)
+	}
+	fromAlice := connect(t, a, alice.ID, false)
+	bobConn := connect(t, a, bob.ID, false)
+
+	privacy := serve(fiber.MethodPut, "/me/privacy", alice.ID, a.UpdatePrivacyHandler)
+	set := func(field string, on bool) {
+		t.Helper()
+		if status, body := do(t, privacy, fiber.MethodPut, "/me/privacy", map[string]bool{field: on}); status != fiber.StatusOK || body[field] != on {
+			t.Fatalf("set %s=%v: %d %v", field, on, status, body)
+		}
+	}
+	signal := func(frame map[string]interface{}) {
+		t.Helper()
+		frame["to"] = bob.ID.String()
+		data, _ := json.Marshal(frame)
+		if !a.dispatchText(&wsSession{conn: fromAlice}, data) {
+			t.Fatal("session ended")
+		}
+	}
+	relayed := func(kind string) {
+		t.Helper()
+		var got map[string]interface{}
+		if err := json.Unmarshal(nextFrame(t, bobConn).Data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["type"] != kind || got["from"] != alice.ID.String() {
+			t.Fatalf("bob got %v", got)
+		}
+	}
+
+	for _, tc := range []struct {
+		field string
+		frame map[string]interface{}
+	}{
+		{"share_typing", map[string]interface{}{"type": "typing", "typing": true}},
+		{"share_read_receipts", map[string]interface{}{"type": "read", "read_up_to": 1700000000}},
+	} {
+		signal(tc.frame)
+		relayed(tc.frame["type"].(string))
+
+		set(tc.field, false)
+		signal(tc.frame)
+		noFrame(t, bobConn)
+		noFrame(t, fromAlice)
+
+		set(tc.field, true)
+	}
+
+	// Hidden presence hides alice from bob but not from herself
+	set("share_presence", false)
+	asBob := serve(fiber.MethodGet, "/presence/:user_id", bob.ID, a.PresenceHandler)
+	if status, body := do(t, asBob, fiber.MethodGet, "/presence/"+alice.ID.String(), nil); status != fiber.StatusOK || body["hidden"] != true || body["online"] == true {
+		t.Fatalf("bob sees %d %v", status, body)
+	}
+	asAlice := serve(fiber.MethodGet, "/presence/:user_id", alice.ID, a.PresenceHandler)
+	if status, body := do(t, asAlice, fiber.MethodGet, "/presence/"+alice.ID.String(), nil); status != fiber.StatusOK || body["hidden"] == true || body["online"] != true {
+		t.Fatalf("alice sees %d %v", status, body)
+	}
+	set("share_presence", true)
+	if status, body := do(t, asBob, fiber.MethodGet, "/presence/"+alice.ID.String(), nil); status != fiber.StatusOK || body["hidden"] == true || body["online"] != true {
+		t.Fatalf("bob sees %d %v once shared again", status, body)
+	}
+}
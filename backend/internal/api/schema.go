@@ -0,0 +1,382 @@
+package api
+
+// Request and response bodies. Handlers decode requests into these types and
+// the OpenAPI spec served at /openapi.json is generated from their json tags.
+
+type RegisterRequest struct {
+	Identifier string `json:"identifier" doc:"Username or phone/email, at least 3 characters"`
+}
+
+type Verify2FARequest struct {
+	Identifier     string      `json:"identifier"`
+	OTP            string      `json:"otp"`
+	IdentityPubKey Base64Bytes `json:"identity_pubkey,omitempty" doc:"Identity key; required for new users"`
+}
+
+type PreKeyUploadRequest struct {
+	IdentityPub     Base64Bytes `json:"identity_pub"`
+	SigningPub      Base64Bytes `json:"signing_pub"`
+	SignedPreKey    Base64Bytes `json:"signed_prekey"`
+	SignedPreKeyID  string      `json:"signed_prekey_id,omitempty" doc:"Up to 64 printable ASCII characters; defaults to signed-prekey-v1"`
+	SignedPreKeySig Base64Bytes `json:"signed_prekey_signature" doc:"Ed25519 over \"securechat-spk-v1\" || len || signed_prekey_id || len || signed_prekey, with 4-byte big-endian lengths"`
+	// Base64 strings rather than Base64Bytes so one bad key is skipped
+	// instead of failing the whole upload
+	OneTimePreKeys []string    `json:"one_time_prekeys"`
+	DeviceID       string      `json:"device_id" doc:"Optional when the account has exactly one device"`
+	DevicePubKey   Base64Bytes `json:"device_pubkey" doc:"Registers or refreshes the device; omit to upload keys only"`
+	RegistrationID *int        `json:"registration_id,omitempty" doc:"Signal registration ID for the device, 1-16383; must differ from the account's other devices"`
+	// AssignRegistrationID is for clients that don't generate their own
+	AssignRegistrationID bool `json:"assign_registration_id,omitempty" doc:"Have the server pick a registration ID; ignored when registration_id is set"`
+}
+
+type SignedPreKeyRotateRequest struct {
+	DeviceID        string      `json:"device_id" doc:"Optional when the account has exactly one device"`
+	SignedPreKey    Base64Bytes `json:"signed_prekey"`
+	SignedPreKeyID  string      `json:"signed_prekey_id,omitempty" doc:"Defaults to signed-prekey-v1"`
+	SignedPreKeySig Base64Bytes `json:"signed_prekey_signature" doc:"Signed with the signing_pub from the device's last full upload"`
+}
+
+type SignedPreKeyRotateResponse struct {
+	Status         string `json:"status"`
+	DeviceID       string `json:"device_id"`
+	SignedPreKeyID string `json:"signed_prekey_id"`
+}
+
+type ConfirmPreKeyRequest struct {
+	OneTimePreKeyID string `json:"one_time_prekey_id"`
+}
+
+type SessionEstablishedRequest struct {
+	PeerID          string `json:"peer_id" doc:"Peer user ID (or anonymous match ID)"`
+	ConversationID  string `json:"conversation_id,omitempty" doc:"Conversation the session is for; both users must be members"`
+	OneTimePreKeyID string `json:"one_time_prekey_id,omitempty" doc:"Reserved one-time prekey the session consumed"`
+}
+
+type EnqueueMatchRequest struct {
+	TagHash     string `json:"tag_hash" doc:"Comma-separated tag hashes; lowercased, a-z, 0-9, - and _ only"`
+	AutoRequeue bool   `json:"auto_requeue" doc:"Re-enter the queue with the same tags when the match ends"`
+}
+
+type EnqueueMatchResponse struct {
+	Status        string `json:"status" doc:"queued"`
+	WaitedSeconds int    `json:"waited_seconds" doc:"Time already spent in the queue; a repeat enqueue keeps the original wait"`
+}
+
+type CreateConversationRequest struct {
+	MemberIDs []string `json:"member_ids"`
+}
+
+type AdminDisconnectRequest struct {
+	RevokeSessions bool `json:"revoke_sessions,omitempty"`
+}
+
+type AccountExportRequest struct {
+	PublicKey string `json:"public_key,omitempty" doc:"Optional RSA public key (PEM) to encrypt the bundle to"`
+}
+
+type PreKeyUploadResponse struct {
+	Status                  string   `json:"status"`
+	OneTimePreKeysRequested int      `json:"one_time_prekeys_requested"`
+	OneTimePreKeysStored    int      `json:"one_time_prekeys_stored"`
+	OneTimePreKeyIDs        []string `json:"one_time_prekey_ids" doc:"ID of each one-time prekey in upload order; empty for keys that were skipped"`
+	DeviceID                string   `json:"device_id" doc:"Device the keys were stored for"`
+	RegistrationID          int      `json:"registration_id,omitempty" doc:"Set when registration_id was sent or assigned"`
+}
+
+type DeviceSummary struct {
+	DeviceID       string `json:"device_id"`
+	RegistrationID int    `json:"registration_id,omitempty"`
+	PushPlatform   string `json:"push_platform,omitempty" doc:"Set when the device has a push token"`
+	LastSeenAt     int64  `json:"last_seen_at" doc:"Unix seconds"`
+	CreatedAt      int64  `json:"created_at" doc:"Unix seconds"`
+}
+
+type DeviceListResponse struct {
+	Devices    []DeviceSummary `json:"devices"`
+	NextOffset int             `json:"next_offset,omitempty" doc:"Pass as offset for the next page; omitted on the last page"`
+}
+
+type PushTokenRequest struct {
+	Token    string `json:"token" doc:"APNs or FCM token; empty clears it"`
+	Platform string `json:"platform" doc:"apns or fcm; required with a token"`
+}
+
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+type HealthResponse = StatusResponse
+
+type ReadinessResponse struct {
+	Status string `json:"status" doc:"ready, or draining with a 503"`
+}
+
+type AdminDrainResponse struct {
+	Status         string `json:"status"`
+	QueuedNotified int    `json:"queued_notified" doc:"Queued users sent service_restarting"`
+}
+
+type AuditEventResponse struct {
+	Seq       int64  `json:"seq"`
+	Event     string `json:"event" doc:"login, 2fa_failed, key_upload, device_added, identity_changed or account_deleted"`
+	UserID    string `json:"user_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	CreatedAt int64  `json:"created_at" doc:"Unix seconds"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash"`
+}
+
+type AuditLogResponse struct {
+	Events     []AuditEventResponse `json:"events"`
+	NextOffset int                  `json:"next_offset,omitempty" doc:"Pass as offset for the next page; omitted on the last page"`
+}
+
+type AuditVerifyResponse struct {
+	Intact   bool  `json:"intact"`
+	Checked  int64 `json:"checked" doc:"Entries verified before the first break, or all of them"`
+	BrokenAt int64 `json:"broken_at,omitempty" doc:"Sequence number of the first entry that fails verification"`
+}
+
+type VersionResponse struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+type CheckUsernameResponse struct {
+	Available bool   `json:"available"`
+	Message   string `json:"message"`
+}
+
+type RegisterResponse struct {
+	Status string `json:"status"`
+	OTP    string `json:"otp,omitempty" doc:"Only when OTP_RETURN_IN_RESPONSE is enabled"`
+}
+
+type Verify2FAResponse struct {
+	Status string `json:"status"`
+	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+type PendingResponse struct {
+	Pending   bool `json:"pending"`
+	ExpiresIn int  `json:"expires_in"`
+}
+
+type ServerPublicKeyResponse struct {
+	PublicKey string `json:"public_key" doc:"PEM (SPKI); also verifies bundle_signature"`
+}
+
+type DeviceInfo struct {
+	DeviceID       string      `json:"device_id"`
+	DevicePubKey   Base64Bytes `json:"device_pubkey"`
+	RegistrationID int         `json:"registration_id,omitempty" doc:"Omitted for devices registered without one"`
+}
+
+type KeyBundleResponse struct {
+	UserID                 string       `json:"user_id"`
+	DeviceID               string       `json:"device_id" doc:"Device the prekeys belong to"`
+	IdentityPub            Base64Bytes  `json:"identity_pub"`
+	SignedPreKey           Base64Bytes  `json:"signed_prekey"`
+	SignedPreKeyID         string       `json:"signed_prekey_id" doc:"Key ID covered by signed_prekey_signature"`
+	SignedPreKeySignature  Base64Bytes  `json:"signed_prekey_signature"`
+	OneTimePreKey          Base64Bytes  `json:"one_time_prekey" doc:"Null when none was served"`
+	OneTimePreKeyAvailable bool         `json:"one_time_prekey_available"`
+	Devices                []DeviceInfo `json:"devices"`
+	BundleSignature        Base64Bytes  `json:"bundle_signature"`
+	BundleSignatureAlg     string       `json:"bundle_signature_alg"`
+	OneTimePreKeyID        string       `json:"one_time_prekey_id,omitempty" doc:"Set whenever one_time_prekey is; reserved keys are confirmed by this ID"`
+	ReservedUntil          int64        `json:"reserved_until,omitempty" doc:"Set with ?reserve=true"`
+}
+
+type AnonymousKeysRequest struct {
+	IdentityPub     Base64Bytes `json:"identity_pub" doc:"X25519 identity key made for this match only"`
+	SigningPub      Base64Bytes `json:"signing_pub" doc:"Ed25519 key that signed signed_prekey; not stored"`
+	SignedPreKey    Base64Bytes `json:"signed_prekey"`
+	SignedPreKeyID  string      `json:"signed_prekey_id,omitempty"`
+	SignedPreKeySig Base64Bytes `json:"signed_prekey_sig"`
+}
+
+type PinIdentityRequest struct {
+	IdentityPub Base64Bytes `json:"identity_pub" doc:"Key the caller verified; defaults to the peer's current key"`
+}
+
+type IdentityPinResponse struct {
+	PeerUserID     string      `json:"peer_user_id"`
+	IdentityPub    Base64Bytes `json:"identity_pub"`
+	MatchesCurrent bool        `json:"matches_current" doc:"False once the peer has changed identity key since it was pinned"`
+	PinnedAt       int64       `json:"pinned_at" doc:"Unix seconds"`
+}
+
+type IdentityPinListResponse struct {
+	Pins []IdentityPinResponse `json:"pins"`
+}
+
+type PresenceResponse struct {
+	Online   bool  `json:"online" doc:"Connected to this instance"`
+	LastSeen int64 `json:"last_seen,omitempty" doc:"Unix seconds; omitted if never seen"`
+	Hidden   bool  `json:"hidden,omitempty" doc:"The user doesn't share presence; online and last_seen are left unset"`
+}
+
+type PrivacySettingsRequest struct {
+	SharePresence     *bool `json:"share_presence,omitempty"`
+	ShareTyping       *bool `json:"share_typing,omitempty"`
+	ShareReadReceipts *bool `json:"share_read_receipts,omitempty"`
+}
+
+type PrivacySettingsResponse struct {
+	SharePresence     bool `json:"share_presence"`
+	ShareTyping       bool `json:"share_typing"`
+	ShareReadReceipts bool `json:"share_read_receipts"`
+}
+
+type KeyStatusResponse struct {
+	Ready                   bool `json:"ready" doc:"Identity key, live signed prekey and a device are all present"`
+	HasIdentityKey          bool `json:"has_identity_key"`
+	HasSignedPreKey         bool `json:"has_signed_prekey" doc:"An unexpired signed prekey exists"`
+	OneTimePreKeysAvailable bool `json:"one_time_prekeys_available" doc:"Without one, sessions fall back to weaker forward secrecy"`
+	HasActiveDevice         bool `json:"has_active_device"`
+}
+
+type MatchStatusResponse struct {
+	Status      string `json:"status" doc:"waiting or matched"`
+	PairID      string `json:"pair_id,omitempty" doc:"Peer user ID, or its anonymous ID in anonymous mode"`
+	AnonymousID string `json:"anonymous_id,omitempty"`
+	Revealed    bool   `json:"revealed,omitempty"`
+	PeerUserID  string `json:"peer_user_id,omitempty"`
+	Relaxed     bool   `json:"relaxed,omitempty" doc:"Paired from the fallback pool after a long wait, so no tag may be shared"`
+}
+
+type MatchPositionResponse struct {
+	Status               string `json:"status" doc:"queued or not_queued"`
+	Position             int    `json:"position,omitempty" doc:"1 means next in the caller's tag bucket"`
+	BucketSize           int    `json:"bucket_size,omitempty"`
+	WaitedSeconds        int    `json:"waited_seconds,omitempty"`
+	EstimatedWaitSeconds int    `json:"estimated_wait_seconds,omitempty" doc:"Omitted when no match completed recently"`
+}
+
+type MessageMetadata struct {
+	MessageID      string `json:"message_id"`
+	SenderID       string `json:"sender_id"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	CreatedAt      int64  `json:"created_at" doc:"Unix seconds"`
+}
+
+type MessageBacklogResponse struct {
+	Count  int64 `json:"count"`
+	Bytes  int64 `json:"bytes" doc:"Total ciphertext size"`
+	Oldest int64 `json:"oldest,omitempty" doc:"Unix seconds; omitted when nothing is queued"`
+	Newest int64 `json:"newest,omitempty" doc:"Unix seconds; omitted when nothing is queued"`
+}
+
+type MessageSearchResponse struct {
+	Messages   []MessageMetadata `json:"messages"`
+	NextOffset int               `json:"next_offset,omitempty" doc:"Pass as offset for the next page; omitted on the last page"`
+}
+
+type RevealResponse struct {
+	Revealed   bool   `json:"revealed"`
+	PeerUserID string `json:"peer_user_id,omitempty"`
+}
+
+type ConversationResponse struct {
+	ConversationID string   `json:"conversation_id"`
+	CreatedBy      string   `json:"created_by"`
+	CreatedAt      int64    `json:"created_at"`
+	Members        []string `json:"members"`
+	Muted          bool     `json:"muted,omitempty" doc:"The caller has muted this conversation"`
+	MutedUntil     int64    `json:"muted_until,omitempty" doc:"Unix seconds; omitted for an indefinite mute"`
+}
+
+type ConversationMuteRequest struct {
+	DurationSeconds int `json:"duration_seconds,omitempty" doc:"Omit or 0 to mute until unmuted"`
+}
+
+type ConversationMuteResponse struct {
+	Status     string `json:"status" doc:"muted or unmuted"`
+	MutedUntil int64  `json:"muted_until,omitempty" doc:"Unix seconds; omitted for an indefinite mute"`
+}
+
+type ConversationListResponse struct {
+	Conversations []ConversationResponse `json:"conversations"`
+}
+
+type AdminDisconnectResponse struct {
+	Status            string `json:"status"`
+	ConnectionsClosed int    `json:"connections_closed"`
+	SessionsRevoked   bool   `json:"sessions_revoked"`
+}
+
+type DBPoolStats struct {
+	MaxOpen           int   `json:"max_open"`
+	Open              int   `json:"open"`
+	InUse             int   `json:"in_use"`
+	Idle              int   `json:"idle"`
+	WaitCount         int64 `json:"wait_count"`
+	WaitDurationMs    int64 `json:"wait_duration_ms"`
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+type MetricsResponse struct {
+	DB          DBPoolStats `json:"db"`
+	SlowQueries int64       `json:"slow_queries"`
+}
+
+type KeyHealthResponse struct {
+	UsersWithoutIdentityKey   int64            `json:"users_without_identity_key"`
+	OneTimePreKeyBuckets      map[string]int64 `json:"one_time_prekey_buckets" doc:"Users per bucket of available one-time prekeys: 0, 1-9, 10-49, 50-99, 100+"`
+	SignedPreKeysExpired      int64            `json:"signed_prekeys_expired" doc:"Devices whose newest signed prekey has expired"`
+	SignedPreKeysExpiringSoon int64            `json:"signed_prekeys_expiring_soon" doc:"Devices whose newest signed prekey expires within 7 days"`
+}
+
+type MatchmakerStatsResponse struct {
+	Waiting           int            `json:"waiting"`
+	ActivePairings    int            `json:"active_pairings"`
+	OldestWaitSeconds int            `json:"oldest_wait_seconds"`
+	WaitAges          map[string]int `json:"wait_ages" doc:"Waiting users per wait bucket"`
+	Buckets           map[string]int `json:"buckets" doc:"Waiting users per tag, keyed by a short hash of the tag"`
+}
+
+type AccountExportResponse struct {
+	Encrypted  bool           `json:"encrypted"`
+	Data       *accountExport `json:"data,omitempty"`
+	WrappedKey Base64Bytes    `json:"wrapped_key,omitempty"`
+	Nonce      Base64Bytes    `json:"nonce,omitempty"`
+	Ciphertext Base64Bytes    `json:"ciphertext,omitempty"`
+}
+
+// WSClientMessage is a frame sent by the client over /api/ws
+type WSClientMessage struct {
+	Type           string            `json:"type" doc:"message, typing, read, heartbeat, ping or auth_refresh"`
+	To             string            `json:"to,omitempty" doc:"Recipient user ID (or anonymous match ID)"`
+	ConversationID string            `json:"conversation_id,omitempty" doc:"Group conversation; takes precedence over to"`
+	Payload        string            `json:"payload,omitempty" doc:"Direct messages: ciphertext, relayed to the recipient unchanged"`
+	Payloads       map[string]string `json:"payloads,omitempty" doc:"Conversation messages: ciphertext keyed by recipient user ID, one for every other member"`
+	Token          string            `json:"token,omitempty" doc:"Replacement JWT for auth_refresh"`
+	Typing         bool              `json:"typing,omitempty" doc:"typing: whether the sender started or stopped typing"`
+	ReadUpTo       int64             `json:"read_up_to,omitempty" doc:"read: Unix seconds of the newest message read"`
+}
+
+// WSServerEvent is a frame sent by the server over /api/ws
+type WSServerEvent struct {
+	Type            string `json:"type" doc:"message, typing, read, pong, error, prekeys_low, match_revealed, match_ended, anonymous_id_rotated, requeued, identity_changed, conversation_deleted, auth_refreshed or service_restarting"`
+	From            string `json:"from,omitempty"`
+	ConversationID  string `json:"conversation_id,omitempty"`
+	Payload         string `json:"payload,omitempty"`
+	PayloadEncoding string `json:"payload_encoding,omitempty" doc:"base64 when the payload came from a binary client and isn't valid UTF-8"`
+	Timestamp       int64  `json:"timestamp,omitempty"`
+	Queued          bool   `json:"queued,omitempty"`
+	Error           string `json:"error,omitempty"`
+	Field           string `json:"field,omitempty"`
+	Remaining       int    `json:"remaining,omitempty"`
+	PeerUserID      string `json:"peer_user_id,omitempty"`
+	AnonymousID     string `json:"anonymous_id,omitempty" doc:"anonymous_id_rotated: the recipient's new anonymous ID"`
+	PairID          string `json:"pair_id,omitempty" doc:"anonymous_id_rotated: the peer's new anonymous ID"`
+	ExpiresAt       int64  `json:"expires_at,omitempty" doc:"New token expiry for auth_refreshed"`
+	PinInvalidated  bool   `json:"pin_invalidated,omitempty" doc:"identity_changed: the recipient's pin no longer matches"`
+	Typing          bool   `json:"typing,omitempty" doc:"typing: false when the sender stopped"`
+	ReadUpTo        int64  `json:"read_up_to,omitempty" doc:"read: Unix seconds of the newest message read"`
+}
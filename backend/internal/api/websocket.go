@@ -1,15 +1,17 @@
 package api
 
 import (
-	"encoding/json"
 	"log"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/gofrs/uuid"
-	"github.com/golang-jwt/jwt/v5"
 
+	"github.com/securechat/backend/internal/models"
 	"github.com/securechat/backend/internal/services"
 )
 
@@ -20,82 +22,156 @@ func (a *App) WebSocketHandler(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{"error": "websocket upgrade required"})
 	}
 
-	// Try to get user_id from context (if auth middleware was used)
-	userID, err := GetUserID(c)
-	if err != nil {
-		// If not from middleware, try token from query param
-		tokenStr := c.Query("token")
-		if tokenStr == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing token"})
-		}
-
-		// Parse token manually
-		token, parseErr := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fiber.ErrUnauthorized
-			}
-			return []byte(a.Cfg.JWTSigningKey), nil
-		})
-
-		if parseErr != nil || !token.Valid {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token claims"})
-		}
+	// Send new sockets to another instance; the load balancer will stop
+	// routing here once readiness reports draining
+	if a.Hub.Draining() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "draining"})
+	}
 
-		userIDStr, ok := claims["user_id"].(string)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid user_id in token"})
-		}
+	// Browsers attach cookies and tokens cross-site, so only accept origins we trust
+	if !a.originAllowed(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "origin not allowed"})
+	}
 
-		userID, parseErr = uuid.FromString(userIDStr)
-		if parseErr != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid user_id format"})
+	// The socket lives until the token it was opened with expires, unless the
+	// client sends auth_refresh with a newer one
+	tokenStr := c.Query("token")
+	if tokenStr == "" {
+		if h := c.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			tokenStr = strings.TrimPrefix(h, "Bearer ")
 		}
 	}
+	if tokenStr == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing token"})
+	}
+	userID, expiresAt, err := a.verifyToken(tokenStr)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Read device_id before WebSocket upgrade
 	deviceID := c.Query("device_id", "default")
 
+	wsConfig := websocket.Config{
+		Subprotocols:      []string{services.BinarySubprotocol},
+		EnableCompression: a.Cfg.WSCompression,
+	}
 	return websocket.New(func(ws *websocket.Conn) {
-		defer func() {
-			a.Hub.Unregister(userID)
-			ws.Close()
-		}()
-
 		// Create connection
 		conn := &services.Connection{
-			UserID:   userID,
-			DeviceID: deviceID,
-			Conn:     ws,
-			Send:     make(chan []byte, 256),
-			LastSeen: time.Now(),
+			UserID:     userID,
+			DeviceID:   deviceID,
+			Conn:       ws,
+			Send:       make(chan services.Frame, 256),
+			Binary:     ws.Subprotocol() == services.BinarySubprotocol,
+			LastSeen:   time.Now(),
+			LastActive: time.Now(),
+		}
+
+		// Release runs after teardown, as the handler returns, so no hub-side
+		// CloseWith touches ws once the library takes it back
+		defer conn.Release()
+
+		// Either side failing tears down both: done stops the write pump and
+		// idle watcher, an expired read deadline unblocks the read loop, and
+		// the hub entry is removed exactly once. Close alone won't do for the
+		// read loop, since fasthttp only closes a hijacked connection once
+		// this handler returns.
+		done := make(chan struct{})
+		var once sync.Once
+		teardown := func() {
+			once.Do(func() {
+				close(done)
+				a.Hub.Unregister(conn)
+				ws.SetReadDeadline(time.Now())
+				ws.Close()
+			})
+		}
+		defer teardown()
+
+		// Register connection; under the reject policy a device that is
+		// still connected can't open a second socket
+		if !a.Hub.Register(conn) {
+			conn.CloseWith(services.CloseDuplicate)
+			return
 		}
 
-		// Register connection
-		a.Hub.Register(conn)
+		// A peer that stops reading or answering pings must not pin this
+		// goroutine forever: every read and write runs against a deadline
+		readTimeout := time.Duration(a.Cfg.WSReadTimeoutSec) * time.Second
+		writeTimeout := time.Duration(a.Cfg.WSWriteTimeoutSec) * time.Second
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(readTimeout))
+		})
 
 		// Start write pump (send messages from channel to websocket)
+		refreshed := make(chan time.Time, 1)
 		go func() {
+			// Ping often enough that a healthy peer's pong lands before the read deadline
+			pingTicker := time.NewTicker(readTimeout * 9 / 10)
+			defer pingTicker.Stop()
+			expiry := time.NewTimer(time.Until(expiresAt))
+			if expiresAt.IsZero() {
+				expiry.Stop()
+			}
+			defer expiry.Stop()
+
 			for {
 				select {
-				case message, ok := <-conn.Send:
-					if !ok {
-						ws.WriteMessage(websocket.CloseMessage, []byte{})
-						return
+				case <-done:
+					return
+				case exp := <-refreshed:
+					if !expiry.Stop() {
+						select {
+						case <-expiry.C:
+						default:
+						}
 					}
-					if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+					if !exp.IsZero() {
+						expiry.Reset(time.Until(exp))
+					}
+				case <-expiry.C:
+					conn.CloseWith(services.CloseTokenExpired)
+					teardown()
+					return
+				case frame := <-conn.Send:
+					ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+					messageType := websocket.TextMessage
+					if frame.Binary {
+						messageType = websocket.BinaryMessage
+					}
+					// Deflating small frames costs more than it saves; this is
+					// a no-op unless the client negotiated compression
+					ws.EnableWriteCompression(a.Cfg.WSCompression && len(frame.Data) >= a.Cfg.WSCompressionMinBytes)
+					if err := ws.WriteMessage(messageType, frame.Data); err != nil {
 						log.Printf("write error: %v", err)
+						teardown()
+						return
+					}
+					if frame.Written != nil {
+						frame.Written()
+					}
+				case <-pingTicker.C:
+					if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+						log.Printf("ping error: %v", err)
+						teardown()
 						return
 					}
 				}
 			}
 		}()
 
+		// Close connections that stay alive but carry no application messages
+		if a.Cfg.WSIdleTimeoutSec > 0 {
+			go a.watchIdle(conn, time.Duration(a.Cfg.WSIdleTimeoutSec)*time.Second, done)
+		}
+
+		// Deliver anything queued while offline now that the write pump is draining
+		a.flushQueued(conn, done)
+
 		// Read messages from client
+		session := &wsSession{conn: conn, refreshed: refreshed, done: done}
 		for {
 			messageType, message, err := ws.ReadMessage()
 			if err != nil {
@@ -104,53 +180,108 @@ func (a *App) WebSocketHandler(c *fiber.Ctx) error {
 				}
 				break
 			}
+			ws.SetReadDeadline(time.Now().Add(readTimeout))
 
-			conn.LastSeen = time.Now()
-
-			if messageType == websocket.TextMessage {
-				// Parse message
-				var msg struct {
-					Type    string `json:"type"`
-					To      string `json:"to"`
-					Payload string `json:"payload"`
+			if messageType == websocket.BinaryMessage {
+				env, err := services.ParseEnvelope(message)
+				if err != nil || env.Type != services.EnvelopeTypeMessage {
+					sendWSError(conn, "invalid_envelope", "")
+					continue
 				}
-
-				if err := json.Unmarshal(message, &msg); err != nil {
-					log.Printf("invalid message format: %v", err)
+				conn.Touch()
+				if env.ConversationID == uuid.Nil {
+					a.routeMessage(conn, env.Peer, env.Payload)
 					continue
 				}
-
-				// Handle different message types
-				switch msg.Type {
-				case "message":
-					// Forward message to recipient
-					if msg.To != "" {
-						toUserID, err := uuid.FromString(msg.To)
-						if err == nil {
-							forward := map[string]interface{}{
-								"type":      "message",
-								"from":      userID.String(),
-								"payload":   msg.Payload,
-								"timestamp": time.Now().Unix(),
-							}
-							forwardBytes, _ := json.Marshal(forward)
-							a.Hub.SendTo(toUserID, forwardBytes)
-						}
-					}
-				case "ping":
-					// Respond with pong
-					pong := map[string]string{"type": "pong"}
-					pongBytes, _ := json.Marshal(pong)
-					conn.Send <- pongBytes
-				default:
-					log.Printf("unknown message type: %s", msg.Type)
+				payloads, err := services.ParseRecipientPayloads(env.Payload)
+				if err != nil {
+					sendWSError(conn, "invalid_envelope", "")
+					continue
 				}
+				a.forwardToConversation(conn, env.ConversationID, payloads)
+				continue
+			}
+
+			if messageType == websocket.TextMessage && !a.dispatchText(session, message) {
+				return
 			}
 		}
-	})(c)
+	}, wsConfig)(c)
 }
 
-// Helper function to parse UUID
-func parseUUID(s string) (uuid.UUID, error) {
-	return uuid.FromString(s)
+// routeMessage forwards ciphertext from conn to a single recipient,
+// re-encoding it for their negotiated protocol. A message for an offline
+// recipient is queued under the address they would have seen it from, and
+// their devices are woken by push.
+func (a *App) routeMessage(conn *services.Connection, to uuid.UUID, payload []byte) {
+	if to == uuid.Nil {
+		return
+	}
+	recipient := a.resolveRecipient(conn.UserID, to)
+	from := a.senderAddress(conn.UserID, recipient)
+	if a.Hub.SendEnvelope(recipient, &services.Envelope{
+		Type:      services.EnvelopeTypeMessage,
+		Peer:      from,
+		Timestamp: a.Clock.Now().Unix(),
+		Payload:   payload,
+	}) {
+		return
+	}
+
+	var n int64
+	if err := a.DB.Model(&models.User{}).Where("id = ?", recipient).Count(&n).Error; err != nil {
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	if n == 0 {
+		sendWSError(conn, "unknown_recipient", "to")
+		return
+	}
+	if err := a.Convos.QueueMessage(recipient, from, nil, payload); err != nil {
+		log.Printf("queue message for %s: %v", recipient, err)
+		sendWSError(conn, "internal_error", "")
+		return
+	}
+	go a.Push.NotifyQueued(recipient, nil)
+}
+
+// originAllowed reports whether the upgrade request's Origin is same-origin or
+// in the configured allowlist. Same-origin means the scheme matches too, so a
+// plain-HTTP page can't open a socket on an HTTPS deployment. Requests without
+// an Origin (native apps) are accepted only when WSAllowNoOrigin is set.
+func (a *App) originAllowed(c *fiber.Ctx) bool {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return a.Cfg.WSAllowNoOrigin
+	}
+	if u, err := url.Parse(origin); err == nil && u.Scheme == c.Protocol() && u.Host == string(c.Request().Host()) {
+		return true
+	}
+	for _, allowed := range a.Cfg.CORSAllowOrigins {
+		if allowed == "*" || origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// watchIdle closes the connection with a reconnect hint once it has been idle
+// for longer than timeout. Only application messages reset the idle timer.
+func (a *App) watchIdle(conn *services.Connection, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if conn.IdleFor() < timeout {
+				continue
+			}
+			log.Printf("closing idle connection: %s", conn.UserID)
+			conn.CloseWith(services.CloseIdleTimeout)
+			return
+		}
+	}
 }
@@ -0,0 +1,838 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+// waitFor polls cond until it holds or five seconds pass, which leaves room
+// for bcrypt under the race detector
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// listenWS serves a's WebSocket handler on a loopback port and returns its URL
+func listenWS(t *testing.T, a *App) string {
+	t.Helper()
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/ws", a.WebSocketHandler)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.ShutdownWithTimeout(time.Second) })
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+// dialWS opens a socket to url authenticated as userID's deviceID, offering
+// subprotocols if any
+func dialWS(t *testing.T, a *App, url string, userID uuid.UUID, deviceID string, subprotocols ...string) (*websocket.Conn, error) {
+	t.Helper()
+	token, err := a.issueJWT(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = subprotocols
+	ws, _, err := dialer.Dial(url+"?device_id="+deviceID+"&token="+token, nil)
+	if err == nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, err
+}
+
+// newSocketTestApp is newTestApp set up for real sockets: token expiry runs
+// on the wall clock, so the app clock starts at the current time
+func newSocketTestApp(t *testing.T) *App {
+	t.Helper()
+	a, _ := newTestApp(t)
+	a.Clock = services.NewManualClock(time.Now())
+	a.Cfg.WSReadTimeoutSec = 60
+	a.Cfg.WSWriteTimeoutSec = 10
+	a.Cfg.WSAllowNoOrigin = true
+	return a
+}
+
+// awaitSession waits until the server is reading from ws, which it starts
+// only after registering the connection
+func awaitSession(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame map[string]interface{}
+		if json.Unmarshal(data, &frame) == nil && frame["type"] == "pong" {
+			return
+		}
+	}
+}
+
+// readClose reads from ws until it fails and returns the close frame that
+// ended it
+func readClose(t *testing.T, ws *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			t.Fatalf("read error = %v, want a close frame", err)
+		}
+		return ce
+	}
+}
+
+// assertClosedWith fails unless ws is closed with code and its reason
+func assertClosedWith(t *testing.T, ws *websocket.Conn, code int, reason string) {
+	t.Helper()
+	ce := readClose(t, ws)
+	var r map[string]interface{}
+	if ce.Code != code || json.Unmarshal([]byte(ce.Text), &r) != nil || r["reason"] != reason {
+		t.Fatalf("closed with %d %q, want %d %s", ce.Code, ce.Text, code, reason)
+	}
+}
+
+func TestIdleConnectionIsClosedDespitePingsAndHeartbeats(t *testing.T) {
+	a := newSocketTestApp(t)
+	a.Cfg.WSIdleTimeoutSec = 1
+	a.Cfg.WSHeartbeatIntervalSec = 0
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+
+	ws, err := dialWS(t, a, listenWS(t, a), alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the socket alive without sending any application message
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) != nil ||
+					ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"heartbeat"}`)) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	start := time.Now()
+	assertClosedWith(t, ws, services.CloseIdleTimeout, "idle_timeout")
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("closed after %v, before the idle timeout", elapsed)
+	}
+	waitFor(t, func() bool { return !a.Hub.IsOnline(alice.ID) })
+}
+
+func TestCloseCodePerScenario(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		code   int
+		reason string
+		close  func(a *App, userID uuid.UUID, ws *websocket.Conn)
+	}{
+		{"shutdown", services.CloseServerShutdown, "server_shutdown", func(a *App, _ uuid.UUID, _ *websocket.Conn) {
+			a.Hub.CloseAll(services.CloseServerShutdown)
+		}},
+		{"kicked", services.CloseKicked, "kicked", func(a *App, userID uuid.UUID, _ *websocket.Conn) {
+			a.Hub.Disconnect(userID, services.CloseKicked)
+		}},
+		{"account deleted", services.CloseAccountDeleted, "account_deleted", func(a *App, userID uuid.UUID, _ *websocket.Conn) {
+			a.Hub.Disconnect(userID, services.CloseAccountDeleted)
+		}},
+		{"bad refresh", services.CloseAuthFailed, "auth_failed", func(_ *App, _ uuid.UUID, ws *websocket.Conn) {
+			ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"auth_refresh","token":"bogus"}`))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newSocketTestApp(t)
+			alice := dbtest.SeedUser(t, a.DB, "alice")
+			ws, err := dialWS(t, a, listenWS(t, a), alice.ID, "device-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return a.Hub.IsOnline(alice.ID) })
+			tc.close(a, alice.ID, ws)
+			assertClosedWith(t, ws, tc.code, tc.reason)
+		})
+	}
+}
+
+func TestTokenExpiryClosesSocket(t *testing.T) {
+	a := newSocketTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	url := listenWS(t, a)
+	// Issue a token that expires within two seconds; exp has whole-second precision
+	a.Clock.(*services.ManualClock).Set(time.Now().Add(-24*time.Hour + 1500*time.Millisecond))
+	ws, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertClosedWith(t, ws, services.CloseTokenExpired, "token_expired")
+}
+
+func TestAuthRefreshExtendsSocket(t *testing.T) {
+	a := newSocketTestApp(t)
+	clock := a.Clock.(*services.ManualClock)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	url := listenWS(t, a)
+	clock.Set(time.Now().Add(-24*time.Hour + 1500*time.Millisecond))
+	ws, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Set(time.Now())
+	token, _ := a.issueJWT(alice.ID)
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"auth_refresh","token":"`+token+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := ws.ReadMessage()
+	var frame map[string]interface{}
+	if err != nil || json.Unmarshal(data, &frame) != nil || frame["type"] != "auth_refreshed" ||
+		frame["expires_at"] != float64(clock.Now().Add(24*time.Hour).Unix()) {
+		t.Fatalf("refresh reply %s, %v", data, err)
+	}
+
+	// Past the original token's expiry the socket is still open
+	time.Sleep(2 * time.Second)
+	awaitSession(t, ws)
+	if !a.Hub.IsOnline(alice.ID) {
+		t.Fatal("refreshed socket was unregistered")
+	}
+
+	// A valid token for someone else ends the session
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	other, _ := a.issueJWT(bob.ID)
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"auth_refresh","token":"`+other+`"}`))
+	assertClosedWith(t, ws, services.CloseAuthFailed, "auth_failed")
+	waitFor(t, func() bool { return !a.Hub.IsOnline(alice.ID) })
+}
+
+func TestStalledPeerHitsWriteDeadline(t *testing.T) {
+	a := newSocketTestApp(t)
+	a.Cfg.WSWriteTimeoutSec = 1
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	ws, err := dialWS(t, a, listenWS(t, a), alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, ws)
+
+	// The client stops reading; once the socket buffers fill, a write blocks
+	// until its deadline and the server drops the connection
+	frame := []byte(`{"type":"message","payload":"` + strings.Repeat("x", 1<<20) + `"}`)
+	deadline := time.Now().Add(10 * time.Second)
+	for a.Hub.IsOnline(alice.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled connection still registered")
+		}
+		a.Hub.SendTo(alice.ID, frame)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteFailureTearsDownReadSide(t *testing.T) {
+	a := newSocketTestApp(t)
+	a.Cfg.WSWriteTimeoutSec = 1
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	url := listenWS(t, a)
+	ws, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, ws)
+
+	frame := []byte(`{"type":"message","payload":"` + strings.Repeat("x", 1<<20) + `"}`)
+	deadline := time.Now().Add(10 * time.Second)
+	for a.Hub.IsOnline(alice.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still registered after its write failed")
+		}
+		a.Hub.SendTo(alice.ID, frame)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The read loop was still blocked on a live peer; the socket must be
+	// closed under it rather than left open until the read deadline
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err = ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server left the socket open after the write failure")
+	}
+
+	// The same device can come straight back, and the old session's
+	// teardown doesn't unregister the new one
+	again, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, again)
+	time.Sleep(50 * time.Millisecond)
+	if !a.Hub.IsOnline(alice.ID) {
+		t.Fatal("reconnected device was unregistered")
+	}
+}
+
+func TestSilentPeerHitsReadDeadline(t *testing.T) {
+	a := newSocketTestApp(t)
+	a.Cfg.WSReadTimeoutSec = 1
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	ws, err := dialWS(t, a, listenWS(t, a), alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, ws)
+
+	// Not reading means the server's pings go unanswered
+	start := time.Now()
+	for a.Hub.IsOnline(alice.ID) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("silent connection still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("dropped after %v, before the read deadline", elapsed)
+	}
+}
+
+func TestDirectMessageToOfflineRecipientIsQueuedAndPushed(t *testing.T) {
+	a, push := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	if err := a.DB.Model(&models.Device{}).Where("user_id = ?", bob.ID).
+		Updates(map[string]interface{}{"push_token": "tok", "push_platform": "fcm"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	sender := connect(t, a, alice.ID, false)
+
+	frame, _ := json.Marshal(map[string]string{"type": "message", "to": bob.ID.String(), "payload": "ct"})
+	a.dispatchText(&wsSession{conn: sender}, frame)
+	noFrame(t, sender)
+
+	var queued []models.QueuedMessage
+	if err := a.DB.Where("recipient_id = ?", bob.ID).Find(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].SenderID != alice.ID || string(queued[0].Payload) != "ct" || queued[0].ConversationID != nil {
+		t.Fatalf("queued = %+v", queued)
+	}
+	waitFor(t, func() bool { return push.count() == 1 })
+
+	// Bob comes online and gets it from the queue
+	recipient := connect(t, a, bob.ID, false)
+	a.flushQueued(recipient, make(chan struct{}))
+	var got map[string]interface{}
+	if err := json.Unmarshal(nextFrame(t, recipient).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["payload"] != "ct" || got["from"] != alice.ID.String() || got["queued"] != true {
+		t.Fatalf("frame = %v", got)
+	}
+}
+
+func TestQueuedMessageReachesEveryDevice(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	dbtest.SeedKeys(t, a.DB, bob, 0)
+	if err := a.DB.Create(&models.Device{ID: uuid.Must(uuid.NewV4()), UserID: bob.ID, DeviceID: "device-2", DevicePubKey: []byte("pub")}).Error; err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(t, a, connect(t, a, alice.ID, false), "to", bob.ID.String())
+	var queued models.QueuedMessage
+	if err := a.DB.Where("recipient_id = ?", bob.ID).First(&queued).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// A frame taken off the send queue but never written doesn't count, and
+	// the message keeps its original timestamp for the next attempt
+	first := connect(t, a, bob.ID, false)
+	done := make(chan struct{})
+	a.flushQueued(first, done)
+	<-first.Send
+	close(done)
+	a.Hub.Unregister(first)
+	if pending, _ := a.Convos.Pending(bob.ID, "device-1"); len(pending) != 1 || !pending[0].CreatedAt.Equal(queued.CreatedAt) {
+		t.Fatalf("device-1 pending after an unwritten flush = %+v", pending)
+	}
+
+	// Once written to device-1 it is still kept for device-2
+	first = connect(t, a, bob.ID, false)
+	a.flushQueued(first, make(chan struct{}))
+	var got map[string]interface{}
+	if err := json.Unmarshal(nextFrame(t, first).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["queued"] != true || got["timestamp"] != float64(queued.CreatedAt.Unix()) {
+		t.Fatalf("device-1 frame = %v", got)
+	}
+	waitFor(t, func() bool {
+		pending, _ := a.Convos.Pending(bob.ID, "device-1")
+		return len(pending) == 0
+	})
+	var n int64
+	a.DB.Model(&models.QueuedMessage{}).Count(&n)
+	if n != 1 {
+		t.Fatalf("%d queued messages after device-1's delivery, want 1", n)
+	}
+
+	second := &services.Connection{UserID: bob.ID, DeviceID: "device-2", Send: make(chan services.Frame, 16)}
+	a.flushQueued(second, make(chan struct{}))
+	if err := json.Unmarshal(nextFrame(t, second).Data, &got); err != nil || got["payload"] != "ct" {
+		t.Fatalf("device-2 frame = %v, %v", got, err)
+	}
+	waitFor(t, func() bool {
+		var rows int64
+		a.DB.Model(&models.QueuedMessage{}).Count(&rows)
+		a.DB.Model(&models.QueuedDelivery{}).Count(&n)
+		return rows == 0 && n == 0
+	})
+}
+
+func TestDirectMessageToOnlineRecipientIsNotQueued(t *testing.T) {
+	a, push := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	sender := connect(t, a, alice.ID, false)
+	recipient := connect(t, a, bob.ID, false)
+
+	frame, _ := json.Marshal(map[string]string{"type": "message", "to": bob.ID.String(), "payload": "ct"})
+	a.dispatchText(&wsSession{conn: sender}, frame)
+	nextFrame(t, recipient)
+
+	var n int64
+	a.DB.Model(&models.QueuedMessage{}).Count(&n)
+	if n != 0 || push.count() != 0 {
+		t.Fatalf("queued=%d pushes=%d", n, push.count())
+	}
+}
+
+func TestDirectMessageToUnknownRecipient(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	sender := connect(t, a, alice.ID, false)
+
+	frame, _ := json.Marshal(map[string]string{"type": "message", "to": uuid.Must(uuid.NewV4()).String(), "payload": "ct"})
+	a.dispatchText(&wsSession{conn: sender}, frame)
+
+	var got map[string]interface{}
+	json.Unmarshal(nextFrame(t, sender).Data, &got)
+	if got["error"] != "unknown_recipient" {
+		t.Fatalf("frame = %v", got)
+	}
+}
+
+func TestWebSocketOriginCheck(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.CORSAllowOrigins = []string{"https://app.example.com"}
+	app := fiber.New()
+	app.Get("/ws", a.WebSocketHandler)
+
+	// Without a token, getting past the origin check ends in 401
+	upgrade := func(origin, proto string) int {
+		req := httptest.NewRequest(fiber.MethodGet, "http://chat.example.com/ws", nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if origin != "" {
+			req.Header.Set(fiber.HeaderOrigin, origin)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		name     string
+		origin   string
+		proto    string
+		noOrigin bool
+		want     int
+	}{
+		{"allowlisted", "https://app.example.com", "", false, fiber.StatusUnauthorized},
+		{"same origin", "http://chat.example.com", "", false, fiber.StatusUnauthorized},
+		{"same origin behind a proxy", "https://chat.example.com", "https", false, fiber.StatusUnauthorized},
+		{"https page, plain connection", "https://chat.example.com", "", false, fiber.StatusForbidden},
+		{"http page, https proxy", "http://chat.example.com", "https", false, fiber.StatusForbidden},
+		{"disallowed", "https://evil.example.net", "", false, fiber.StatusForbidden},
+		{"allowlisted prefix", "https://app.example.com.evil.net", "", false, fiber.StatusForbidden},
+		{"missing, allowed", "", "", true, fiber.StatusUnauthorized},
+		{"missing, refused", "", "", false, fiber.StatusForbidden},
+	} {
+		a.Cfg.WSAllowNoOrigin = tc.noOrigin
+		if got := upgrade(tc.origin, tc.proto); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBinaryMessageIsDeliveredByteExact(t *testing.T) {
+	a := newSocketTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	url := listenWS(t, a)
+	open := func(userID uuid.UUID, subprotocols ...string) *websocket.Conn {
+		ws, err := dialWS(t, a, url, userID, "device-1", subprotocols...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaitSession(t, ws)
+		return ws
+	}
+	fromAlice := open(alice.ID, services.BinarySubprotocol)
+	if fromAlice.Subprotocol() != services.BinarySubprotocol {
+		t.Fatalf("negotiated %q", fromAlice.Subprotocol())
+	}
+	toBob := open(bob.ID, services.BinarySubprotocol)
+	toCarol := open(carol.ID)
+
+	payload := make([]byte, 256)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	send := func(to uuid.UUID) {
+		env := &services.Envelope{Type: services.EnvelopeTypeMessage, Peer: to, Payload: payload}
+		if err := fromAlice.WriteMessage(websocket.BinaryMessage, env.MarshalBinary()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(ws *websocket.Conn) (int, []byte) {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		kind, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kind, data
+	}
+
+	// A binary peer gets the ciphertext as raw bytes
+	send(bob.ID)
+	kind, data := read(toBob)
+	env, err := services.ParseEnvelope(data)
+	if kind != websocket.BinaryMessage || err != nil {
+		t.Fatalf("bob got frame type %d: %v", kind, err)
+	}
+	if env.Peer != alice.ID || !bytes.Equal(env.Payload, payload) {
+		t.Fatalf("bob got %+v", env)
+	}
+
+	// A text peer gets the same bytes base64-encoded in JSON
+	send(carol.ID)
+	kind, data = read(toCarol)
+	var frame map[string]interface{}
+	if kind != websocket.TextMessage || json.Unmarshal(data, &frame) != nil {
+		t.Fatalf("carol got frame type %d: %s", kind, data)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(frame["payload"].(string))
+	if err != nil || frame["payload_encoding"] != "base64" || frame["from"] != alice.ID.String() || !bytes.Equal(decoded, payload) {
+		t.Fatalf("carol got %s", data)
+	}
+
+	// A conversation envelope carries each member's own ciphertext
+	conv, err := a.Convos.Create(alice.ID, []uuid.UUID{bob.ID, carol.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env = &services.Envelope{
+		Type:           services.EnvelopeTypeMessage,
+		ConversationID: conv.ID,
+		Payload:        services.MarshalRecipientPayloads(map[uuid.UUID][]byte{bob.ID: payload, carol.ID: []byte("for carol")}),
+	}
+	if err := fromAlice.WriteMessage(websocket.BinaryMessage, env.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	_, data = read(toBob)
+	if env, err = services.ParseEnvelope(data); err != nil || env.ConversationID != conv.ID || !bytes.Equal(env.Payload, payload) {
+		t.Fatalf("bob got %+v, %v", env, err)
+	}
+	_, data = read(toCarol)
+	if json.Unmarshal(data, &frame) != nil || frame["conversation_id"] != conv.ID.String() || frame["payload"] != "for carol" {
+		t.Fatalf("carol got %s", data)
+	}
+}
+
+func TestSecondSocketForDeviceSupersedesFirst(t *testing.T) {
+	a := newSocketTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	url := listenWS(t, a)
+	open := func(deviceID string) *websocket.Conn {
+		ws, err := dialWS(t, a, url, alice.ID, deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaitSession(t, ws)
+		return ws
+	}
+	first := open("device-1")
+	other := open("device-2")
+	second := open("device-1")
+	assertClosedWith(t, first, services.CloseSuperseded, "superseded")
+
+	// The first socket's teardown must not unregister its replacement
+	time.Sleep(50 * time.Millisecond)
+	if !a.Hub.SendTo(alice.ID, []byte(`{"type":"test"}`)) {
+		t.Fatal("alice offline after the old socket closed")
+	}
+	for name, ws := range map[string]*websocket.Conn{"replacement": second, "other device": other} {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if _, data, err := ws.ReadMessage(); err != nil || string(data) != `{"type":"test"}` {
+			t.Fatalf("%s got %s, %v", name, data, err)
+		}
+	}
+}
+
+func TestSecondSocketForDeviceCanBeRejected(t *testing.T) {
+	a := newSocketTestApp(t)
+	a.Hub.DuplicatePolicy = services.DuplicateReject
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	url := listenWS(t, a)
+	first, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, first)
+
+	second, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertClosedWith(t, second, services.CloseDuplicate, "duplicate_connection")
+
+	// The original socket carries on
+	awaitSession(t, first)
+	if !a.Hub.SendTo(alice.ID, []byte(`{"type":"test"}`)) {
+		t.Fatal("alice offline after the duplicate was rejected")
+	}
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, data, err := first.ReadMessage(); err != nil || string(data) != `{"type":"test"}` {
+		t.Fatalf("first socket got %s, %v", data, err)
+	}
+
+	// Once it is gone the device can connect again
+	first.Close()
+	waitFor(t, func() bool { return !a.Hub.IsOnline(alice.ID) })
+	third, err := dialWS(t, a, url, alice.ID, "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSession(t, third)
+}
+
+func TestDrainRefusesNewSocketsButKeepsExistingOnes(t *testing.T) {
+	a := newSocketTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	bob := dbtest.SeedUser(t, a.DB, "bob")
+	carol := dbtest.SeedUser(t, a.DB, "carol")
+	url := listenWS(t, a)
+	open := func(userID uuid.UUID) *websocket.Conn {
+		ws, err := dialWS(t, a, url, userID, "device-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaitSession(t, ws)
+		return ws
+	}
+	read := func(ws *websocket.Conn) map[string]interface{} {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame map[string]interface{}
+		json.Unmarshal(data, &frame)
+		return frame
+	}
+	toAlice := open(alice.ID)
+	toBob := open(bob.ID)
+	if err := a.Matchmaker.Enqueue(context.Background(), bob.ID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if notified := a.Drain(); notified != 1 {
+		t.Fatalf("drain notified %d queued users, want 1", notified)
+	}
+	if frame := read(toBob); frame["type"] != "service_restarting" {
+		t.Fatalf("queued user got %v", frame)
+	}
+
+	// New upgrades are turned away
+	if _, err := dialWS(t, a, url, carol.ID, "device-1"); !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Fatalf("dial while draining: %v", err)
+	}
+	if a.Hub.IsOnline(carol.ID) {
+		t.Fatal("carol connected while draining")
+	}
+	// So are new match requests
+	enqueue := serve(fiber.MethodPost, "/match/enqueue", alice.ID, a.EnqueueMatchHandler)
+	if status, body := do(t, enqueue, fiber.MethodPost, "/match/enqueue", map[string]string{"tag_hash": "go"}); status != fiber.StatusServiceUnavailable || body["error"] != "draining" {
+		t.Fatalf("enqueue while draining: %d %v", status, body)
+	}
+
+	// Existing sockets keep working in both directions
+	awaitSession(t, toAlice)
+	if !a.Hub.SendTo(alice.ID, []byte(`{"type":"test"}`)) {
+		t.Fatal("alice offline while draining")
+	}
+	if frame := read(toAlice); frame["type"] != "test" {
+		t.Fatalf("alice got %v", frame)
+	}
+}
+
+// countingConn counts the bytes read off the wire, i.e. after compression
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	var users []string
+	for i := 0; i < 40; i++ {
+		users = append(users, uuid.Must(uuid.NewV4()).String())
+	}
+	// Metadata-heavy chatter compresses; it's what compression is for
+	presence, _ := json.Marshal(map[string]interface{}{"type": "presence_snapshot", "online": users, "typing": users[:20]})
+	small := []byte(`{"type":"typing","typing":true}`)
+
+	// dial connects a new user with compression offered and returns the
+	// socket and its byte counter, reset once the session is up
+	dial := func(t *testing.T, a *App, subprotocols ...string) (uuid.UUID, *websocket.Conn, *atomic.Int64) {
+		t.Helper()
+		user := dbtest.SeedUser(t, a.DB, "user-"+uuid.Must(uuid.NewV4()).String())
+		token, err := a.issueJWT(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read := &atomic.Int64{}
+		dialer := *websocket.DefaultDialer
+		dialer.EnableCompression = true
+		dialer.Subprotocols = subprotocols
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{conn, read}, err
+		}
+		ws, _, err := dialer.Dial(listenWS(t, a)+"?device_id=phone&token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		awaitSession(t, ws)
+		read.Store(0)
+		return user.ID, ws, read
+	}
+	receive := func(t *testing.T, ws *websocket.Conn, want []byte) {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("read %q, %v", data, err)
+		}
+	}
+	// wireBytes sends frames to a fresh socket and returns what they cost
+	wireBytes := func(t *testing.T, compress bool, frame []byte, n int) int64 {
+		a := newSocketTestApp(t)
+		a.Cfg.WSCompression = compress
+		a.Cfg.WSCompressionMinBytes = 512
+		user, ws, read := dial(t, a)
+		for i := 0; i < n; i++ {
+			a.Hub.SendTo(user, frame)
+			receive(t, ws, frame)
+		}
+		return read.Load()
+	}
+
+	plain, deflated := wireBytes(t, false, presence, 20), wireBytes(t, true, presence, 20)
+	t.Logf("20 presence frames of %d bytes: %d bytes plain, %d deflated", len(presence), plain, deflated)
+	if deflated*2 > plain {
+		t.Fatalf("compression saved too little: %d bytes plain, %d deflated", plain, deflated)
+	}
+
+	// Frames under the threshold go out as they are: payload plus a
+	// two-byte header
+	if got := wireBytes(t, true, small, 1); got != int64(len(small)+2) {
+		t.Fatalf("small frame took %d bytes on the wire, want %d", got, len(small)+2)
+	}
+
+	// Binary-mode envelopes come through compression intact
+	a := newSocketTestApp(t)
+	a.Cfg.WSCompression = true
+	a.Cfg.WSCompressionMinBytes = 512
+	user, ws, read := dial(t, a, services.BinarySubprotocol)
+	env := &services.Envelope{Type: services.EnvelopeTypeMessage, Peer: uuid.Must(uuid.NewV4()), Payload: bytes.Repeat([]byte("ciphertext"), 400)}
+	a.Hub.SendEnvelope(user, env)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	kind, data, err := ws.ReadMessage()
+	if err != nil || kind != websocket.BinaryMessage {
+		t.Fatalf("binary frame: %d, %v", kind, err)
+	}
+	got, err := services.ParseEnvelope(data)
+	if err != nil || !bytes.Equal(got.Payload, env.Payload) || got.Peer != env.Peer {
+		t.Fatalf("envelope: %+v, %v", got, err)
+	}
+	if read.Load() >= int64(len(data)) {
+		t.Fatalf("binary frame of %d bytes took %d on the wire", len(data), read.Load())
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/services"
+)
+
+// WSFrameError rejects a client frame; it is sent back as an error frame with
+// Code and, when one field is at fault, Field
+type WSFrameError struct {
+	Code  string
+	Field string
+}
+
+func (e *WSFrameError) Error() string {
+	if e.Field == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Field
+}
+
+func missingField(field string) *WSFrameError {
+	return &WSFrameError{Code: "missing_field", Field: field}
+}
+
+// Validate checks that msg has a known type and the fields that type needs.
+// Fields another type uses are ignored rather than rejected, so clients can
+// reuse one struct for every frame.
+func (msg *WSClientMessage) Validate() error {
+	switch msg.Type {
+	case "message":
+		if msg.To == "" && msg.ConversationID == "" {
+			return missingField("to")
+		}
+		if msg.ConversationID != "" && len(msg.Payloads) == 0 {
+			return missingField("payloads")
+		}
+		if msg.ConversationID == "" && msg.Payload == "" {
+			return missingField("payload")
+		}
+	case "typing", "read":
+		if msg.To == "" && msg.ConversationID == "" {
+			return missingField("to")
+		}
+	case "auth_refresh":
+		if msg.Token == "" {
+			return missingField("token")
+		}
+	case "heartbeat", "ping":
+	case "":
+		return missingField("type")
+	default:
+		return &WSFrameError{Code: "unknown_type", Field: "type"}
+	}
+	return nil
+}
+
+// parseWSClientMessage decodes and validates a text frame
+func parseWSClientMessage(data []byte) (WSClientMessage, error) {
+	var msg WSClientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, &WSFrameError{Code: "invalid_json"}
+	}
+	return msg, msg.Validate()
+}
+
+// wsSession is the per-socket state text frame handlers share with the
+// write pump
+type wsSession struct {
+	conn      *services.Connection
+	refreshed chan<- time.Time
+	done      <-chan struct{}
+}
+
+// reply queues frame unless the socket is closing
+func (s *wsSession) reply(frame interface{}) {
+	b, _ := json.Marshal(frame)
+	select {
+	case s.conn.Send <- services.TextFrame(b):
+	case <-s.done:
+	}
+}
+
+// wsHandler handles a validated text frame; returning false ends the session
+type wsHandler func(a *App, s *wsSession, msg WSClientMessage) bool
+
+// wsHandlers maps every type Validate accepts to its handler
+var wsHandlers = map[string]wsHandler{
+	"message":      (*App).handleWSMessage,
+	"typing":       (*App).handleWSSignal,
+	"read":         (*App).handleWSSignal,
+	"heartbeat":    (*App).handleWSHeartbeat,
+	"auth_refresh": (*App).handleWSAuthRefresh,
+	"ping":         (*App).handleWSPing,
+}
+
+// dispatchText parses a text frame and runs its handler, answering invalid
+// frames with an error frame. It returns false when the session must end.
+func (a *App) dispatchText(s *wsSession, data []byte) bool {
+	msg, err := parseWSClientMessage(data)
+	if err != nil {
+		fe, ok := err.(*WSFrameError)
+		if !ok {
+			fe = &WSFrameError{Code: "invalid_frame"}
+		}
+		sendWSError(s.conn, fe.Code, fe.Field)
+		return true
+	}
+	return wsHandlers[msg.Type](a, s, msg)
+}
+
+func (a *App) handleWSMessage(s *wsSession, msg WSClientMessage) bool {
+	s.conn.Touch()
+	// The text protocol's payloads are opaque to the server and relayed as sent
+	if msg.ConversationID != "" {
+		convID, err := parseUUIDField("conversation_id", msg.ConversationID)
+		if err != nil {
+			sendWSError(s.conn, "invalid_uuid", "conversation_id")
+			return true
+		}
+		payloads := make(map[uuid.UUID][]byte, len(msg.Payloads))
+		for to, ct := range msg.Payloads {
+			id, err := uuid.FromString(to)
+			if err != nil {
+				sendWSError(s.conn, "invalid_uuid", "payloads")
+				return true
+			}
+			payloads[id] = []byte(ct)
+		}
+		a.forwardToConversation(s.conn, convID, payloads)
+		return true
+	}
+	toUserID, err := parseUUIDField("to", msg.To)
+	if err != nil {
+		sendWSError(s.conn, "invalid_uuid", "to")
+		return true
+	}
+	a.routeMessage(s.conn, toUserID, []byte(msg.Payload))
+	return true
+}
+
+func (a *App) handleWSSignal(s *wsSession, msg WSClientMessage) bool {
+	a.relaySignal(s.conn, msg)
+	return true
+}
+
+// handleWSHeartbeat keeps presence fresh without resetting the idle timer
+func (a *App) handleWSHeartbeat(s *wsSession, msg WSClientMessage) bool {
+	s.conn.Heartbeat(time.Duration(a.Cfg.WSHeartbeatIntervalSec) * time.Second)
+	return true
+}
+
+// handleWSAuthRefresh extends the socket to the new token's expiry. A bad
+// token or one for another account ends the session rather than leaving it
+// on the old credentials.
+func (a *App) handleWSAuthRefresh(s *wsSession, msg WSClientMessage) bool {
+	refreshedID, exp, err := a.verifyToken(msg.Token)
+	if err != nil || refreshedID != s.conn.UserID {
+		s.conn.CloseWith(services.CloseAuthFailed)
+		return false
+	}
+	select {
+	case s.refreshed <- exp:
+	case <-s.done:
+		return false
+	}
+	s.reply(map[string]interface{}{"type": "auth_refreshed", "expires_at": exp.Unix()})
+	return true
+}
+
+func (a *App) handleWSPing(s *wsSession, msg WSClientMessage) bool {
+	s.reply(map[string]string{"type": "pong"})
+	return true
+}
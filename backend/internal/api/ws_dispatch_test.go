@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+)
+
+func TestTextMessagePayloadRelayedUnchanged(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice, bob := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	sender := connect(t, a, alice, false)
+	recipient := connect(t, a, bob, false)
+
+	// What the web client sends: JSON.stringify of its encrypted envelope
+	payload := `{"ciphertext":"q83v","iv":"AAEC","ephemeral":"x"}`
+	frame, _ := json.Marshal(map[string]string{"type": "message", "to": bob.String(), "payload": payload})
+	if !a.dispatchText(&wsSession{conn: sender}, frame) {
+		t.Fatal("session ended")
+	}
+	noFrame(t, sender)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(nextFrame(t, recipient).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "message" || got["from"] != alice.String() || got["payload"] != payload {
+		t.Fatalf("frame = %v", got)
+	}
+}
+
+func TestTextMessageToBinaryRecipient(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice, bob := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	sender := connect(t, a, alice, false)
+	recipient := connect(t, a, bob, true)
+
+	frame, _ := json.Marshal(map[string]string{"type": "message", "to": bob.String(), "payload": "hello"})
+	a.dispatchText(&wsSession{conn: sender}, frame)
+
+	f := nextFrame(t, recipient)
+	if !f.Binary {
+		t.Fatal("binary recipient got a text frame")
+	}
+	env, err := services.ParseEnvelope(f.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Peer != alice || string(env.Payload) != "hello" {
+		t.Fatalf("envelope = %+v", env)
+	}
+}
+
+func TestMalformedUUIDFieldsAreReported(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	sender := connect(t, a, alice.ID, false)
+
+	conv := uuid.Must(uuid.NewV4()).String()
+	for _, tc := range []struct {
+		frame map[string]interface{}
+		field string
+	}{
+		{map[string]interface{}{"type": "message", "to": "not-a-uuid", "payload": "ct"}, "to"},
+		{map[string]interface{}{"type": "message", "conversation_id": "1234", "payloads": map[string]string{alice.ID.String(): "ct"}}, "conversation_id"},
+		{map[string]interface{}{"type": "message", "conversation_id": conv, "payloads": map[string]string{"bob": "ct"}}, "payloads"},
+		{map[string]interface{}{"type": "typing", "to": "bob"}, "to"},
+		{map[string]interface{}{"type": "read", "conversation_id": "x"}, "conversation_id"},
+	} {
+		frame, _ := json.Marshal(tc.frame)
+		if !a.dispatchText(&wsSession{conn: sender}, frame) {
+			t.Fatalf("%v ended the session", tc.frame)
+		}
+		var got map[string]string
+		if err := json.Unmarshal(nextFrame(t, sender).Data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["type"] != "error" || got["error"] != "invalid_uuid" || got["field"] != tc.field {
+			t.Fatalf("%v: frame = %v", tc.frame, got)
+		}
+	}
+}
+
+func TestMalformedUUIDParamIsReported(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := uuid.Must(uuid.NewV4())
+	bundle := serve(fiber.MethodGet, "/bundle/:user_id", alice, a.GetKeyBundleHandler)
+	status, body := do(t, bundle, fiber.MethodGet, "/bundle/not-a-uuid", nil)
+	if status != fiber.StatusBadRequest || body["error"] != "invalid_uuid" || body["field"] != "user_id" {
+		t.Fatalf("%d %v", status, body)
+	}
+}
+
+func TestHeartbeatRefreshesPresenceNotIdleTimer(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.Cfg.WSHeartbeatIntervalSec = 30
+	alice := dbtest.SeedUser(t, a.DB, "alice")
+	conn := connect(t, a, alice.ID, false)
+	quietSince := time.Now().Add(-10 * time.Minute)
+	conn.LastSeen, conn.LastActive = quietSince, quietSince
+	heartbeat := []byte(`{"type":"heartbeat"}`)
+
+	if !a.dispatchText(&wsSession{conn: conn}, heartbeat) {
+		t.Fatal("session ended")
+	}
+	noFrame(t, conn)
+	seen, ok := a.Hub.LastSeenOf(alice.ID)
+	if !ok || !seen.After(quietSince) {
+		t.Fatalf("last seen = %v, %t", seen, ok)
+	}
+	if idle := conn.IdleFor(); idle < 10*time.Minute {
+		t.Fatalf("heartbeat reset the idle timer: idle for %v", idle)
+	}
+
+	// The refreshed presence reaches users.last_seen_at
+	if _, err := services.NewPresenceReconciler(a.DB, a.Hub, time.Minute).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var stored models.User
+	a.DB.First(&stored, "id = ?", alice.ID)
+	if stored.LastSeenAt == nil || !stored.LastSeenAt.Equal(seen) {
+		t.Fatalf("last_seen_at = %v, want %v", stored.LastSeenAt, seen)
+	}
+
+	// A second heartbeat inside the interval is ignored
+	a.dispatchText(&wsSession{conn: conn}, heartbeat)
+	if again, _ := a.Hub.LastSeenOf(alice.ID); !again.Equal(seen) {
+		t.Fatalf("rate-limited heartbeat moved last seen from %v to %v", seen, again)
+	}
+}
+
+func TestClientMessageValidationPerType(t *testing.T) {
+	id := uuid.Must(uuid.NewV4()).String()
+	for _, tc := range []struct {
+		frame string
+		code  string // empty when valid
+		field string
+	}{
+		{`{"type":"message","to":"` + id + `","payload":"ct"}`, "", ""},
+		{`{"type":"message","conversation_id":"` + id + `","payloads":{"` + id + `":"ct"}}`, "", ""},
+		{`{"type":"message","conversation_id":"` + id + `","payload":"ct"}`, "missing_field", "payloads"},
+		{`{"type":"message","payload":"ct"}`, "missing_field", "to"},
+		{`{"type":"message","to":"` + id + `"}`, "missing_field", "payload"},
+		{`{"type":"typing","to":"` + id + `","typing":true}`, "", ""},
+		{`{"type":"typing","typing":true}`, "missing_field", "to"},
+		{`{"type":"read","conversation_id":"` + id + `","read_up_to":1}`, "", ""},
+		{`{"type":"read","read_up_to":1}`, "missing_field", "to"},
+		{`{"type":"auth_refresh","token":"t"}`, "", ""},
+		{`{"type":"auth_refresh"}`, "missing_field", "token"},
+		{`{"type":"heartbeat"}`, "", ""},
+		{`{"type":"ping"}`, "", ""},
+		// Fields another type uses are ignored
+		{`{"type":"ping","to":"` + id + `","token":"t"}`, "", ""},
+		{`{"to":"` + id + `","payload":"ct"}`, "missing_field", "type"},
+		{`{"type":"shout"}`, "unknown_type", "type"},
+		{`{"type":"message",`, "invalid_json", ""},
+		{`["message"]`, "invalid_json", ""},
+	} {
+		msg, err := parseWSClientMessage([]byte(tc.frame))
+		if tc.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.frame, err)
+			} else if wsHandlers[msg.Type] == nil {
+				t.Errorf("%s: valid but has no handler", tc.frame)
+			}
+			continue
+		}
+		fe, ok := err.(*WSFrameError)
+		if !ok || fe.Code != tc.code || fe.Field != tc.field {
+			t.Errorf("%s: error %v, want %s on %q", tc.frame, err, tc.code, tc.field)
+		}
+	}
+}
+
+func TestInvalidFrameGetsTypedErrorAndSessionContinues(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := uuid.Must(uuid.NewV4())
+	bob := uuid.Must(uuid.NewV4())
+	sender := connect(t, a, alice, false)
+	recipient := connect(t, a, bob, false)
+
+	// A message with no recipient is rejected, not silently dropped
+	if !a.dispatchText(&wsSession{conn: sender}, []byte(`{"type":"message","payload":"ct"}`)) {
+		t.Fatal("invalid frame ended the session")
+	}
+	var got map[string]string
+	if err := json.Unmarshal(nextFrame(t, sender).Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["type"] != "error" || got["error"] != "missing_field" || got["field"] != "to" {
+		t.Fatalf("frame = %v", got)
+	}
+	noFrame(t, recipient)
+
+	// The next, valid frame is handled as usual
+	sendMessage(t, a, sender, "to", bob.String())
+	if frame := nextFrame(t, recipient); frame.Binary {
+		t.Fatal("text recipient got a binary frame")
+	}
+}
@@ -1,46 +1,347 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port               string
-	DatabaseDSN        string
-	ServerRSAPrivPath  string
-	JWTSigningKey      string
-	OTPExpiryMinutes   int
-	RateLimitRequests  int
-	RateLimitWindowSec int
-	TLSCertPath        string
-	TLSKeyPath         string
+	Port              string
+	AppEnv            string
+	DatabaseDSN       string
+	DBLogLevel        string
+	DBSlowQueryMs     int
+	DBAutoMigrate     bool
+	ServerRSAPrivPath string
+	CryptoSelfTest    bool
+	JWTSigningKey     string
+	JWTSigningKeyID   string
+	// The previous signing key still verifies tokens, by kid, until
+	// JWTPreviousKeyValidUntil; new tokens always use the current key
+	JWTPreviousSigningKey     string
+	JWTPreviousSigningKeyID   string
+	JWTPreviousKeyValidUntil  time.Time
+	OTPExpiryMinutes          int
+	OTPLength                 int
+	OTPAlphabet               string
+	OTPMaxActiveSessions      int
+	OTPResendIntervalSec      int
+	OTPCleanupIntervalSec     int
+	IncompleteAccountTTLHours int
+	AuditLogKey               string
+	OTPDelivery               string
+	OTPReturnInResponse       bool
+	AuthJitterMs              int
+	SMTPAddr                  string
+	SMTPFrom                  string
+	SMTPUsername              string
+	SMTPPassword              string
+	SMSWebhookURL             string
+	SMSWebhookToken           string
+	RateLimitRequests         int
+	RateLimitWindowSec        int
+	PendingCheckRateLimit     int
+	CheckUsernameRateLimit    int
+	CheckUsernameCacheSec     int
+	TLSCertPath               string
+	TLSKeyPath                string
+	TLSMinVersion             string
+	HTTPRedirectPort          string
+	RequireHTTPS              bool
+	TrustedProxies            []string
+	HTTPBodyLimitBytes        int
+	HTTPReadTimeoutSec        int
+	// HTTPRouteLimits overrides the body limit, and optionally sets a
+	// handler timeout, per route; keys are "METHOD /path" as registered
+	HTTPRouteLimits           map[string]RouteLimit
+	ShutdownDrainSec          int
+	WSIdleTimeoutSec          int
+	WSHeartbeatIntervalSec    int
+	WSReadTimeoutSec          int
+	WSWriteTimeoutSec         int
+	WSCompression             bool
+	WSCompressionMinBytes     int
+	WSDuplicatePolicy         string
+	PresenceFlushSec          int
+	HubBus                    string
+	InstanceID                string
+	SignedPreKeyTTLDays       int
+	SPKDomainSeparation       bool
+	OneTimePreKeyTTLDays      int
+	CORSAllowOrigins          []string
+	CORSAllowMethods          []string
+	CORSAllowHeaders          []string
+	CORSAllowCredentials      bool
+	WSAllowNoOrigin           bool
+	PreKeyReservationSec      int
+	SessionMarkers            bool
+	RegistrationIDAssignment  bool
+	MatchMaxTags              int
+	MatchMaxTagLength         int
+	MatchEnqueueRateLimit     int
+	MatchAnonymous            bool
+	MatchAnalytics            bool
+	MatchFairness             string
+	MatchWhileMatched         string
+	MatchRematchCooldownSec   int
+	MatchMinOverlap           int
+	MatchOverlapFallbackSec   int
+	MatchFallbackPoolSec      int
+	MatchWaitTimeoutSec       int
+	MatchTickMs               int
+	MatchAnonIDMaxLifetimeSec int
+	IdentityChangeNotify      bool
+	AdminUserIDs              []string
+	MaxGroupMembers           int
 }
 
 func Load() *Config {
 	_ = godotenv.Load()
 
 	cfg := &Config{
-		Port:               getEnv("PORT", "8081"),
-		DatabaseDSN:        getEnv("DATABASE_DSN", "postgres://postgres:@localhost:5432/secure_chat_new?sslmode=disable"),
-		ServerRSAPrivPath:  getEnv("SERVER_RSA_PRIV_PATH", "/secrets/server_rsa_priv.pem"),
-		JWTSigningKey:      getEnv("JWT_SIGNING_KEY", "change_this_secret"),
-		OTPExpiryMinutes:   getEnvInt("OTP_EXPIRY_MINUTES", 10),
-		RateLimitRequests:  getEnvInt("RATE_LIMIT_REQUESTS", 1000),
-		RateLimitWindowSec: getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
-		TLSCertPath:        getEnv("TLS_CERT_PATH", ""),
-		TLSKeyPath:         getEnv("TLS_KEY_PATH", ""),
+		Port:                      getEnv("PORT", "8081"),
+		AppEnv:                    getEnv("APP_ENV", "production"),
+		DatabaseDSN:               getEnv("DATABASE_DSN", "postgres://postgres:@localhost:5432/secure_chat_new?sslmode=disable"),
+		DBLogLevel:                getEnv("DB_LOG_LEVEL", ""),
+		DBSlowQueryMs:             getEnvInt("DB_SLOW_QUERY_MS", 200),
+		DBAutoMigrate:             getEnvBool("DB_AUTO_MIGRATE", true),
+		ServerRSAPrivPath:         getEnv("SERVER_RSA_PRIV_PATH", "/secrets/server_rsa_priv.pem"),
+		CryptoSelfTest:            getEnvBool("CRYPTO_SELF_TEST", true),
+		JWTSigningKey:             getEnv("JWT_SIGNING_KEY", "change_this_secret"),
+		JWTSigningKeyID:           getEnv("JWT_SIGNING_KEY_ID", ""),
+		JWTPreviousSigningKey:     getEnv("JWT_PREVIOUS_SIGNING_KEY", ""),
+		JWTPreviousSigningKeyID:   getEnv("JWT_PREVIOUS_SIGNING_KEY_ID", ""),
+		OTPExpiryMinutes:          getEnvInt("OTP_EXPIRY_MINUTES", 10),
+		OTPLength:                 getEnvInt("OTP_LENGTH", 6),
+		OTPAlphabet:               getEnv("OTP_ALPHABET", "alphanumeric"),
+		OTPMaxActiveSessions:      getEnvInt("OTP_MAX_ACTIVE_SESSIONS", 3),
+		OTPResendIntervalSec:      getEnvInt("OTP_RESEND_INTERVAL_SECONDS", 60),
+		OTPCleanupIntervalSec:     getEnvInt("OTP_CLEANUP_INTERVAL_SECONDS", 300),
+		IncompleteAccountTTLHours: getEnvInt("INCOMPLETE_ACCOUNT_TTL_HOURS", 168),
+		AuditLogKey:               getEnv("AUDIT_LOG_KEY", ""),
+		OTPDelivery:               getEnv("OTP_DELIVERY", "log"),
+		AuthJitterMs:              getEnvInt("AUTH_JITTER_MS", 50),
+		SMTPAddr:                  getEnv("SMTP_ADDR", ""),
+		SMTPFrom:                  getEnv("SMTP_FROM", ""),
+		SMTPUsername:              getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:              getEnv("SMTP_PASSWORD", ""),
+		SMSWebhookURL:             getEnv("SMS_WEBHOOK_URL", ""),
+		SMSWebhookToken:           getEnv("SMS_WEBHOOK_TOKEN", ""),
+		RateLimitRequests:         getEnvInt("RATE_LIMIT_REQUESTS", 1000),
+		RateLimitWindowSec:        getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
+		PendingCheckRateLimit:     getEnvInt("PENDING_CHECK_RATE_LIMIT", 10),
+		CheckUsernameRateLimit:    getEnvInt("CHECK_USERNAME_RATE_LIMIT", 20),
+		CheckUsernameCacheSec:     getEnvInt("CHECK_USERNAME_CACHE_SECONDS", 10),
+		TLSCertPath:               getEnv("TLS_CERT_PATH", ""),
+		TLSKeyPath:                getEnv("TLS_KEY_PATH", ""),
+		TLSMinVersion:             getEnv("TLS_MIN_VERSION", "1.2"),
+		HTTPRedirectPort:          getEnv("HTTP_REDIRECT_PORT", ""),
+		RequireHTTPS:              getEnvBool("REQUIRE_HTTPS", false),
+		TrustedProxies:            getEnvList("TRUSTED_PROXIES", ""),
+		HTTPBodyLimitBytes:        getEnvInt("HTTP_BODY_LIMIT_BYTES", 1<<20),
+		HTTPReadTimeoutSec:        getEnvInt("HTTP_READ_TIMEOUT_SECONDS", 15),
+		HTTPRouteLimits:           parseRouteLimits(getEnvList("HTTP_ROUTE_LIMITS", defaultRouteLimits)),
+		ShutdownDrainSec:          getEnvInt("SHUTDOWN_DRAIN_SECONDS", 0),
+		WSIdleTimeoutSec:          getEnvInt("WS_IDLE_TIMEOUT_SECONDS", 900),
+		WSHeartbeatIntervalSec:    getEnvInt("WS_HEARTBEAT_INTERVAL_SECONDS", 30),
+		WSReadTimeoutSec:          getEnvInt("WS_READ_TIMEOUT_SECONDS", 60),
+		WSWriteTimeoutSec:         getEnvInt("WS_WRITE_TIMEOUT_SECONDS", 10),
+		WSCompression:             getEnvBool("WS_COMPRESSION", false),
+		WSCompressionMinBytes:     getEnvInt("WS_COMPRESSION_MIN_BYTES", 512),
+		WSDuplicatePolicy:         getEnv("WS_DUPLICATE_POLICY", "replace"),
+		PresenceFlushSec:          getEnvInt("PRESENCE_FLUSH_SECONDS", 60),
+		HubBus:                    getEnv("HUB_BUS", ""),
+		InstanceID:                getEnv("INSTANCE_ID", ""),
+		SignedPreKeyTTLDays:       getEnvInt("SIGNED_PREKEY_TTL_DAYS", 30),
+		SPKDomainSeparation:       getEnvBool("SPK_REQUIRE_DOMAIN_SEPARATION", true),
+		OneTimePreKeyTTLDays:      getEnvInt("ONE_TIME_PREKEY_TTL_DAYS", 90),
+		CORSAllowOrigins:          getEnvList("CORS_ALLOW_ORIGINS", ""),
+		CORSAllowMethods:          getEnvList("CORS_ALLOW_METHODS", "GET,POST,PUT,DELETE,OPTIONS"),
+		CORSAllowHeaders:          getEnvList("CORS_ALLOW_HEADERS", "Origin,Content-Type,Accept,Authorization"),
+		CORSAllowCredentials:      getEnvBool("CORS_ALLOW_CREDENTIALS", true),
+		WSAllowNoOrigin:           getEnvBool("WS_ALLOW_NO_ORIGIN", true),
+		PreKeyReservationSec:      getEnvInt("PREKEY_RESERVATION_SECONDS", 120),
+		SessionMarkers:            getEnvBool("SESSION_MARKERS", true),
+		RegistrationIDAssignment:  getEnvBool("REGISTRATION_ID_ASSIGNMENT", true),
+		MatchMaxTags:              getEnvInt("MATCH_MAX_TAGS", 16),
+		MatchMaxTagLength:         getEnvInt("MATCH_MAX_TAG_LENGTH", 64),
+		MatchEnqueueRateLimit:     getEnvInt("MATCH_ENQUEUE_RATE_LIMIT", 10),
+		MatchAnonymous:            getEnvBool("MATCH_ANONYMOUS", false),
+		MatchAnalytics:            getEnvBool("MATCH_ANALYTICS", false),
+		MatchFairness:             getEnv("MATCH_FAIRNESS", "wait"),
+		MatchWhileMatched:         getEnv("MATCH_WHILE_MATCHED", "end"),
+		MatchRematchCooldownSec:   getEnvInt("MATCH_REMATCH_COOLDOWN_SECONDS", 600),
+		MatchMinOverlap:           getEnvInt("MATCH_MIN_OVERLAP", 1),
+		MatchOverlapFallbackSec:   getEnvInt("MATCH_OVERLAP_FALLBACK_SECONDS", 60),
+		MatchFallbackPoolSec:      getEnvInt("MATCH_FALLBACK_POOL_SECONDS", 0),
+		MatchWaitTimeoutSec:       getEnvInt("MATCH_WAIT_TIMEOUT_SECONDS", 300),
+		MatchTickMs:               getEnvInt("MATCH_TICK_MS", 100),
+		MatchAnonIDMaxLifetimeSec: getEnvInt("MATCH_ANON_ID_MAX_LIFETIME_SECONDS", 86400),
+		IdentityChangeNotify:      getEnvBool("IDENTITY_CHANGE_NOTIFY", true),
+		AdminUserIDs:              getEnvList("ADMIN_USER_IDS", ""),
+		MaxGroupMembers:           getEnvInt("MAX_GROUP_MEMBERS", 64),
+	}
+
+	// Echoing codes in the register response is a development convenience only
+	cfg.OTPReturnInResponse = getEnvBool("OTP_RETURN_IN_RESPONSE", cfg.AppEnv == "development")
+	switch cfg.OTPDelivery {
+	case "log":
+		if cfg.AppEnv != "development" {
+			log.Println("WARNING: OTP_DELIVERY=log only writes codes to the server log")
+		}
+	case "provider":
+	default:
+		log.Printf("WARNING: unknown OTP_DELIVERY %q; using log", cfg.OTPDelivery)
+		cfg.OTPDelivery = "log"
+	}
+
+	if cfg.OTPLength < 4 || cfg.OTPLength > 12 {
+		log.Printf("WARNING: OTP_LENGTH %d out of range [4, 12]; using 6", cfg.OTPLength)
+		cfg.OTPLength = 6
+	}
+	if cfg.OTPAlphabet != "numeric" && cfg.OTPAlphabet != "alphanumeric" {
+		log.Printf("WARNING: unknown OTP_ALPHABET %q; using alphanumeric", cfg.OTPAlphabet)
+		cfg.OTPAlphabet = "alphanumeric"
+	}
+
+	if cfg.MatchMinOverlap > cfg.MatchMaxTags {
+		log.Printf("WARNING: MATCH_MIN_OVERLAP %d exceeds MATCH_MAX_TAGS; using %d", cfg.MatchMinOverlap, cfg.MatchMaxTags)
+		cfg.MatchMinOverlap = cfg.MatchMaxTags
+	}
+
+	if cfg.MatchWaitTimeoutSec <= 0 {
+		log.Printf("WARNING: MATCH_WAIT_TIMEOUT_SECONDS must be positive; using 300")
+		cfg.MatchWaitTimeoutSec = 300
+	}
+	if cfg.MatchTickMs <= 0 {
+		log.Printf("WARNING: MATCH_TICK_MS must be positive; using 100")
+		cfg.MatchTickMs = 100
+	}
+	if cfg.MatchFairness != "wait" && cfg.MatchFairness != "arrival" {
+		log.Printf("WARNING: unknown MATCH_FAIRNESS %q; using wait", cfg.MatchFairness)
+		cfg.MatchFairness = "wait"
+	}
+	if cfg.MatchWhileMatched != "end" && cfg.MatchWhileMatched != "reject" {
+		log.Printf("WARNING: unknown MATCH_WHILE_MATCHED %q; using end", cfg.MatchWhileMatched)
+		cfg.MatchWhileMatched = "end"
+	}
+
+	if cfg.TLSMinVersion != "1.2" && cfg.TLSMinVersion != "1.3" {
+		log.Printf("WARNING: unsupported TLS_MIN_VERSION %q; using 1.2", cfg.TLSMinVersion)
+		cfg.TLSMinVersion = "1.2"
+	}
+	if cfg.HTTPRedirectPort != "" && (cfg.TLSCertPath == "" || cfg.TLSKeyPath == "") {
+		log.Println("WARNING: HTTP_REDIRECT_PORT is set but TLS is off; not redirecting")
+	}
+	if cfg.RequireHTTPS && (cfg.TLSCertPath == "" || cfg.TLSKeyPath == "") && len(cfg.TrustedProxies) == 0 {
+		log.Println("WARNING: REQUIRE_HTTPS is set with neither TLS nor TRUSTED_PROXIES; every guarded request will be rejected")
+	}
+
+	if cfg.WSDuplicatePolicy != "replace" && cfg.WSDuplicatePolicy != "reject" {
+		log.Printf("WARNING: unknown WS_DUPLICATE_POLICY %q; using replace", cfg.WSDuplicatePolicy)
+		cfg.WSDuplicatePolicy = "replace"
+	}
+
+	switch cfg.HubBus {
+	case "", "postgres":
+	default:
+		log.Printf("WARNING: unknown HUB_BUS %q; running single-instance", cfg.HubBus)
+		cfg.HubBus = ""
+	}
+	if cfg.InstanceID == "" {
+		host, _ := os.Hostname()
+		cfg.InstanceID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	// SQL at Info level includes key blobs and identifiers; keep it to dev
+	switch cfg.DBLogLevel {
+	case "silent", "error", "warn", "info":
+	case "":
+		cfg.DBLogLevel = "warn"
+		if cfg.AppEnv == "development" {
+			cfg.DBLogLevel = "info"
+		}
+	default:
+		log.Printf("WARNING: unknown DB_LOG_LEVEL %q; using warn", cfg.DBLogLevel)
+		cfg.DBLogLevel = "warn"
+	}
+
+	if len(cfg.CORSAllowOrigins) == 0 && cfg.AppEnv == "development" {
+		cfg.CORSAllowOrigins = devCORSOrigins
+	}
+	if err := validateCORS(cfg); err != nil {
+		log.Fatalf("invalid CORS configuration: %v", err)
+	}
+
+	if cfg.HTTPBodyLimitBytes <= 0 {
+		cfg.HTTPBodyLimitBytes = 1 << 20
+	}
+	if cfg.HTTPReadTimeoutSec < 0 {
+		cfg.HTTPReadTimeoutSec = 15
+	}
+	for route, limit := range cfg.HTTPRouteLimits {
+		if limit.BodyBytes == 0 {
+			limit.BodyBytes = cfg.HTTPBodyLimitBytes
+			cfg.HTTPRouteLimits[route] = limit
+		}
+	}
+
+	if cfg.WSReadTimeoutSec <= 0 {
+		cfg.WSReadTimeoutSec = 60
+	}
+	if cfg.WSWriteTimeoutSec <= 0 {
+		cfg.WSWriteTimeoutSec = 10
+	}
+
+	if !cfg.SPKDomainSeparation {
+		log.Println("WARNING: SPK_REQUIRE_DOMAIN_SEPARATION=false accepts signed prekeys signed without a domain tag")
 	}
 
 	if cfg.JWTSigningKey == "change_this_secret" {
 		log.Println("WARNING: using default JWT signing key; replace in production")
 	}
+	if cfg.AuditLogKey == "" {
+		log.Println("WARNING: AUDIT_LOG_KEY is empty; anyone who can write the audit table can rebuild its hash chain")
+	}
+	if cfg.JWTSigningKeyID == "" {
+		cfg.JWTSigningKeyID = jwtKeyID(cfg.JWTSigningKey)
+	}
+	if cfg.JWTPreviousSigningKey != "" {
+		if cfg.JWTPreviousSigningKeyID == "" {
+			cfg.JWTPreviousSigningKeyID = jwtKeyID(cfg.JWTPreviousSigningKey)
+		}
+		until, err := time.Parse(time.RFC3339, os.Getenv("JWT_PREVIOUS_SIGNING_KEY_VALID_UNTIL"))
+		switch {
+		case err != nil:
+			log.Println("WARNING: JWT_PREVIOUS_SIGNING_KEY_VALID_UNTIL missing or not RFC 3339; ignoring the previous JWT key")
+			cfg.JWTPreviousSigningKey = ""
+		case cfg.JWTPreviousSigningKeyID == cfg.JWTSigningKeyID:
+			log.Println("WARNING: JWT_PREVIOUS_SIGNING_KEY_ID matches the current key ID; ignoring the previous JWT key")
+			cfg.JWTPreviousSigningKey = ""
+		default:
+			cfg.JWTPreviousKeyValidUntil = until
+		}
+	}
 	return cfg
 }
 
+// jwtKeyID derives a kid from a signing key when none is configured. It is a
+// short hash, so it names the key without revealing it.
+func jwtKeyID(secret string) string {
+	sum := sha256.Sum256([]byte("securechat-jwt-kid:" + secret))
+	return hex.EncodeToString(sum[:4])
+}
+
 func getEnv(key, def string) string {
 	v := os.Getenv(key)
 	if v == "" {
@@ -59,3 +360,93 @@ func getEnvInt(key string, def int) int {
 	}
 	return def
 }
+
+func getEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return def
+}
+
+// RouteLimit is the request profile of one route
+type RouteLimit struct {
+	BodyBytes int
+	// Timeout bounds the handler through its request context; zero means none
+	Timeout time.Duration
+}
+
+// defaultRouteLimits keeps auth bodies small and lets prekey batches through
+const defaultRouteLimits = "POST /auth/register=4096,POST /auth/verify-2fa=8192,POST /api/keys/prekeys/upload=4194304:30"
+
+// parseRouteLimits reads "METHOD /path=BYTES[:SECONDS]" entries, skipping
+// malformed ones with a warning. A BYTES of 0 keeps HTTP_BODY_LIMIT_BYTES.
+func parseRouteLimits(entries []string) map[string]RouteLimit {
+	limits := make(map[string]RouteLimit, len(entries))
+	for _, e := range entries {
+		route, spec, ok := strings.Cut(e, "=")
+		method, path, okRoute := strings.Cut(strings.TrimSpace(route), " ")
+		bytesStr, secStr, hasSec := strings.Cut(spec, ":")
+		n, errBytes := strconv.Atoi(strings.TrimSpace(bytesStr))
+		sec := 0
+		var errSec error
+		if hasSec {
+			sec, errSec = strconv.Atoi(strings.TrimSpace(secStr))
+		}
+		path = strings.TrimSpace(path)
+		if !ok || !okRoute || !strings.HasPrefix(path, "/") || errBytes != nil || n < 0 || errSec != nil || sec < 0 {
+			log.Printf("WARNING: ignoring malformed HTTP_ROUTE_LIMITS entry %q", e)
+			continue
+		}
+		limits[strings.ToUpper(method)+" "+path] = RouteLimit{BodyBytes: n, Timeout: time.Duration(sec) * time.Second}
+	}
+	return limits
+}
+
+// getEnvList reads a comma-separated list, trimming whitespace and empty items
+func getEnvList(key, def string) []string {
+	var out []string
+	for _, item := range strings.Split(getEnv(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// devCORSOrigins are the local frontend dev servers, allowed only when
+// APP_ENV=development and CORS_ALLOW_ORIGINS is unset
+var devCORSOrigins = []string{"http://localhost:5173", "http://localhost:3000", "http://localhost:3001"}
+
+var corsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+func validateCORS(cfg *Config) error {
+	for _, o := range cfg.CORSAllowOrigins {
+		if o == "*" {
+			if cfg.CORSAllowCredentials {
+				return errors.New("wildcard origin cannot be combined with CORS_ALLOW_CREDENTIALS=true")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("origin %q must be scheme://host[:port]", o)
+		}
+	}
+	for _, m := range cfg.CORSAllowMethods {
+		if !corsMethods[strings.ToUpper(m)] {
+			return fmt.Errorf("unknown method %q", m)
+		}
+	}
+	for _, h := range cfg.CORSAllowHeaders {
+		if h == "" || strings.ContainsAny(h, " \t:;\"") {
+			return fmt.Errorf("invalid header name %q", h)
+		}
+	}
+	return nil
+}
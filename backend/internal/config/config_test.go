@@ -0,0 +1,170 @@
+package config
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOTPLengthBounds(t *testing.T) {
+	for _, tc := range []struct {
+		env  string
+		want int
+	}{
+		{"", 6},
+		{"3", 6},
+		{"4", 4},
+		{"12", 12},
+		{"13", 6},
+	} {
+		t.Setenv("OTP_LENGTH", tc.env)
+		if got := Load().OTPLength; got != tc.want {
+			t.Errorf("OTP_LENGTH=%q: got %d, want %d", tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestOTPAlphabetSelection(t *testing.T) {
+	for env, want := range map[string]string{
+		"numeric":      "numeric",
+		"alphanumeric": "alphanumeric",
+		"hex":          "alphanumeric",
+	} {
+		t.Setenv("OTP_ALPHABET", env)
+		if got := Load().OTPAlphabet; got != want {
+			t.Errorf("OTP_ALPHABET=%q: got %q, want %q", env, got, want)
+		}
+	}
+}
+
+func TestEmptyAuditLogKeyWarns(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for key, warned := range map[string]bool{"": true, "secret": false} {
+		out.Reset()
+		t.Setenv("AUDIT_LOG_KEY", key)
+		Load()
+		if got := strings.Contains(out.String(), "AUDIT_LOG_KEY is empty"); got != warned {
+			t.Errorf("AUDIT_LOG_KEY=%q: warned = %v", key, got)
+		}
+	}
+}
+
+func TestDBLogLevelDefaultsByEnvironment(t *testing.T) {
+	for _, tc := range []struct {
+		appEnv, level, want string
+	}{
+		{"production", "", "warn"},
+		{"development", "", "info"},
+		{"production", "info", "info"},
+		{"development", "error", "error"},
+		{"production", "verbose", "warn"},
+	} {
+		t.Setenv("APP_ENV", tc.appEnv)
+		t.Setenv("DB_LOG_LEVEL", tc.level)
+		if got := Load().DBLogLevel; got != tc.want {
+			t.Errorf("APP_ENV=%s DB_LOG_LEVEL=%q: got %q, want %q", tc.appEnv, tc.level, got, tc.want)
+		}
+	}
+}
+
+func TestCORSFromEnvironment(t *testing.T) {
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("CORS_ALLOW_ORIGINS", "https://chat.example.com, https://admin.example.com")
+	t.Setenv("CORS_ALLOW_METHODS", "GET,POST")
+	t.Setenv("CORS_ALLOW_HEADERS", "Authorization")
+	cfg := Load()
+	if strings.Join(cfg.CORSAllowOrigins, ",") != "https://chat.example.com,https://admin.example.com" ||
+		strings.Join(cfg.CORSAllowMethods, ",") != "GET,POST" || strings.Join(cfg.CORSAllowHeaders, ",") != "Authorization" {
+		t.Fatalf("origins %v, methods %v, headers %v", cfg.CORSAllowOrigins, cfg.CORSAllowMethods, cfg.CORSAllowHeaders)
+	}
+
+	// The localhost origins are a development-only fallback
+	t.Setenv("CORS_ALLOW_ORIGINS", "")
+	if origins := Load().CORSAllowOrigins; len(origins) != 0 {
+		t.Fatalf("production defaults to %v", origins)
+	}
+	t.Setenv("APP_ENV", "development")
+	if origins := Load().CORSAllowOrigins; strings.Join(origins, ",") != strings.Join(devCORSOrigins, ",") {
+		t.Fatalf("development defaults to %v", origins)
+	}
+}
+
+func TestPreviousJWTKeyFromEnvironment(t *testing.T) {
+	t.Setenv("JWT_SIGNING_KEY", "current")
+	t.Setenv("JWT_SIGNING_KEY_ID", "")
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY", "previous")
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY_ID", "")
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY_VALID_UNTIL", "2026-02-01T00:00:00Z")
+	cfg := Load()
+	if cfg.JWTPreviousSigningKey != "previous" || !cfg.JWTPreviousKeyValidUntil.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("previous key %q valid until %v", cfg.JWTPreviousSigningKey, cfg.JWTPreviousKeyValidUntil)
+	}
+	// Derived key IDs name each key without revealing it
+	if cfg.JWTSigningKeyID == "" || cfg.JWTPreviousSigningKeyID == "" || cfg.JWTSigningKeyID == cfg.JWTPreviousSigningKeyID ||
+		strings.Contains(cfg.JWTSigningKeyID, "current") {
+		t.Fatalf("key IDs %q and %q", cfg.JWTSigningKeyID, cfg.JWTPreviousSigningKeyID)
+	}
+
+	// Without an end to the overlap, or under the current key's ID, the
+	// previous key is dropped
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY_VALID_UNTIL", "tomorrow")
+	if cfg := Load(); cfg.JWTPreviousSigningKey != "" {
+		t.Fatal("kept a previous key with no valid-until time")
+	}
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY_VALID_UNTIL", "2026-02-01T00:00:00Z")
+	t.Setenv("JWT_SIGNING_KEY_ID", "k1")
+	t.Setenv("JWT_PREVIOUS_SIGNING_KEY_ID", "k1")
+	if cfg := Load(); cfg.JWTPreviousSigningKey != "" {
+		t.Fatal("kept a previous key sharing the current key's ID")
+	}
+}
+
+func TestRouteLimitsFromEnvironment(t *testing.T) {
+	t.Setenv("HTTP_BODY_LIMIT_BYTES", "2048")
+	t.Setenv("HTTP_ROUTE_LIMITS", "post /auth/register=512, POST /api/keys/prekeys/upload=65536:30,GET /api/me=0,POST nopath=1,POST /x=-1,POST /y=10:soon")
+	got := Load().HTTPRouteLimits
+	want := map[string]RouteLimit{
+		"POST /auth/register":           {BodyBytes: 512},
+		"POST /api/keys/prekeys/upload": {BodyBytes: 65536, Timeout: 30 * time.Second},
+		// Zero keeps the global limit
+		"GET /api/me": {BodyBytes: 2048},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("limits = %v, want %v", got, want)
+	}
+	for route, limit := range want {
+		if got[route] != limit {
+			t.Fatalf("%s: %+v, want %+v", route, got[route], limit)
+		}
+	}
+
+	t.Setenv("HTTP_ROUTE_LIMITS", "")
+	if got := Load().HTTPRouteLimits; got["POST /auth/register"].BodyBytes != 4096 || got["POST /api/keys/prekeys/upload"].Timeout != 30*time.Second {
+		t.Fatalf("defaults = %v", got)
+	}
+}
+
+func TestValidateCORS(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"explicit origins", Config{CORSAllowOrigins: []string{"https://chat.example.com:8443"}, CORSAllowCredentials: true}, false},
+		{"wildcard without credentials", Config{CORSAllowOrigins: []string{"*"}}, false},
+		{"wildcard with credentials", Config{CORSAllowOrigins: []string{"*"}, CORSAllowCredentials: true}, true},
+		{"origin with path", Config{CORSAllowOrigins: []string{"https://chat.example.com/app"}}, true},
+		{"origin without scheme", Config{CORSAllowOrigins: []string{"chat.example.com"}}, true},
+		{"unknown method", Config{CORSAllowMethods: []string{"FETCH"}}, true},
+		{"bad header", Config{CORSAllowHeaders: []string{"X-Bad: 1"}}, true},
+	} {
+		if err := validateCORS(&tc.cfg); (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
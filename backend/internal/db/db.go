@@ -1,9 +1,14 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -11,9 +16,64 @@ import (
 	"github.com/securechat/backend/internal/models"
 )
 
-func Connect(dsn string) (*gorm.DB, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+// sqlitePrefix selects the embedded SQLite driver, e.g. "sqlite::memory:" or
+// "sqlite:file:dev.db". It exists for tests and local experiments; production
+// runs on Postgres.
+const sqlitePrefix = "sqlite:"
+
+// Connect opens dsn, migrates the schema when autoMigrate is set and then
+// verifies every table and column the models need exists. A DSN starting with
+// "sqlite:" uses SQLite; anything else is treated as a Postgres DSN. logLevel
+// is one of "silent", "error", "warn" or "info".
+func Connect(dsn, logLevel string, autoMigrate bool) (*gorm.DB, error) {
+	return connect(dsn, NewLogger(logLevel), autoMigrate)
+}
+
+// ConnectQuiet is Connect with SQL logging disabled and migration on, for tests
+func ConnectQuiet(dsn string) (*gorm.DB, error) {
+	return connect(dsn, NewLogger("silent"), true)
+}
+
+// NewLogger builds the GORM logger for logLevel. Only "info" logs bound
+// parameter values; at every other level statements (slow queries, errors)
+// are logged with placeholders so key material and identifiers stay out of
+// the logs.
+func NewLogger(logLevel string) logger.Interface {
+	level := ParseLogLevel(logLevel)
+	return logger.New(log.New(os.Stdout, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold:             0, // SlowQueryLogger reports slow statements with their route
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+		ParameterizedQueries:      level != logger.Info,
+		Colorful:                  true,
+	})
+}
+
+// ParseLogLevel maps a config string to a GORM log level, defaulting to Warn
+func ParseLogLevel(s string) logger.LogLevel {
+	switch strings.ToLower(s) {
+	case "silent":
+		return logger.Silent
+	case "error":
+		return logger.Error
+	case "info":
+		return logger.Info
+	default:
+		return logger.Warn
+	}
+}
+
+func connect(dsn string, log logger.Interface, autoMigrate bool) (*gorm.DB, error) {
+	isSQLite := strings.HasPrefix(dsn, sqlitePrefix)
+	var dialector gorm.Dialector
+	if isSQLite {
+		dialector = sqlite.Open(strings.TrimPrefix(dsn, sqlitePrefix))
+	} else {
+		dialector = postgres.Open(dsn)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger: log,
 	})
 	if err != nil {
 		return nil, err
@@ -22,20 +82,119 @@ func Connect(dsn string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	sqlDB.SetMaxOpenConns(50)
-	sqlDB.SetMaxIdleConns(25)
-	sqlDB.SetConnMaxLifetime(5 * time.Minute)
+	if isSQLite {
+		// Every SQLite connection to ":memory:" is a separate database, so
+		// pin the pool to one connection
+		sqlDB.SetMaxOpenConns(1)
+	} else {
+		sqlDB.SetMaxOpenConns(50)
+		sqlDB.SetMaxIdleConns(25)
+		sqlDB.SetConnMaxLifetime(5 * time.Minute)
+	}
+
+	if autoMigrate {
+		if err := Migrate(db); err != nil {
+			return nil, err
+		}
+	}
+	if err := VerifySchema(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
 
-	if err := db.AutoMigrate(
+// schemaModels lists every model the application reads or writes
+func schemaModels() []interface{} {
+	return []interface{}{
 		&models.User{},
 		&models.Device{},
 		&models.PreKey{},
 		&models.OneTimePreKey{},
 		&models.RegistrationSession{},
 		&models.MatchProfile{},
-	); err != nil {
+		&models.IdentityPin{},
+		&models.Conversation{},
+		&models.ConversationMember{},
+		&models.QueuedMessage{},
+		&models.QueuedDelivery{},
+		&models.SessionMarker{},
+		&models.MatchAnalyticsEvent{},
+		&models.AuditEvent{},
+	}
+}
+
+// Migrate creates or updates the tables for all models
+func Migrate(db *gorm.DB) error {
+	if err := dedupeDevices(db); err != nil {
+		log.Printf("dedupe devices error: %v", err)
+		return err
+	}
+	if err := dedupeRegistrationIDs(db); err != nil {
+		log.Printf("dedupe registration ids error: %v", err)
+		return err
+	}
+	if err := db.AutoMigrate(schemaModels()...); err != nil {
 		log.Printf("auto migrate error: %v", err)
-		return nil, err
+		return err
 	}
-	return db, nil
+	if err := dropRedundantIndexes(db); err != nil {
+		log.Printf("drop redundant indexes error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// dropRedundantIndexes removes indexes older schemas created that a newer
+// index now covers. devices(user_id) is the leading column of
+// idx_devices_user_device, which serves the same lookups.
+func dropRedundantIndexes(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasIndex(&models.Device{}, "idx_devices_user_id") {
+		return m.DropIndex(&models.Device{}, "idx_devices_user_id")
+	}
+	return nil
+}
+
+// dedupeDevices keeps only the newest row per (user_id, device_id) so the
+// unique index on that pair can be created over data written before it existed
+func dedupeDevices(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Device{}) {
+		return nil
+	}
+	return db.Exec(`DELETE FROM devices WHERE id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id, device_id ORDER BY created_at DESC) AS rn
+			FROM devices
+		) ranked WHERE rn > 1
+	)`).Error
+}
+
+// dedupeRegistrationIDs clears all but the newest device's copy of a
+// registration ID repeated within one user, so the per-user unique index can
+// be created; the cleared devices have none until their next key upload sets one
+func dedupeRegistrationIDs(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.Device{}, "registration_id") {
+		return nil
+	}
+	return db.Exec(`UPDATE devices SET registration_id = 0 WHERE id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id, registration_id ORDER BY created_at DESC) AS rn
+			FROM devices WHERE registration_id > 0
+		) ranked WHERE rn > 1
+	)`).Error
+}
+
+// IsUniqueViolation reports whether err is a unique-constraint violation from
+// gdb's driver
+func IsUniqueViolation(gdb *gorm.DB, err error) bool {
+	if t, ok := gdb.Dialector.(gorm.ErrorTranslator); ok {
+		err = t.Translate(err)
+	}
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
+
+// WithTx runs fn in a transaction, committing if it returns nil and rolling
+// back if it returns an error or panics
+func WithTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(fn)
 }
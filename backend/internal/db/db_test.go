@@ -0,0 +1,241 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	gdb, err := ConnectQuiet("sqlite::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := gdb.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return gdb
+}
+
+func TestWithTx(t *testing.T) {
+	gdb := newTestDB(t)
+	insert := func(tx *gorm.DB, identifier string) error {
+		return tx.Create(&models.User{ID: uuid.Must(uuid.NewV4()), Identifier: identifier, IdentityPubKey: make([]byte, 32)}).Error
+	}
+	count := func() int64 {
+		var n int64
+		gdb.Model(&models.User{}).Count(&n)
+		return n
+	}
+
+	boom := errors.New("boom")
+	err := WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+		if err := insert(tx, "first"); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) || count() != 0 {
+		t.Fatalf("error: err=%v, %d rows kept", err, count())
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic swallowed")
+			}
+		}()
+		WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+			insert(tx, "second")
+			panic("boom")
+		})
+	}()
+	if count() != 0 {
+		t.Fatalf("panic: %d rows kept", count())
+	}
+
+	err = WithTx(context.Background(), gdb, func(tx *gorm.DB) error {
+		if err := insert(tx, "third"); err != nil {
+			return err
+		}
+		return insert(tx, "fourth")
+	})
+	if err != nil || count() != 2 {
+		t.Fatalf("commit: err=%v, %d rows", err, count())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WithTx(ctx, gdb, func(tx *gorm.DB) error { return insert(tx, "fifth") }); err == nil || count() != 2 {
+		t.Fatalf("cancelled context: err=%v, %d rows", err, count())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for s, want := range map[string]logger.LogLevel{
+		"silent": logger.Silent,
+		"error":  logger.Error,
+		"warn":   logger.Warn,
+		"INFO":   logger.Info,
+		"":       logger.Warn,
+		"bogus":  logger.Warn,
+	} {
+		if got := ParseLogLevel(s); got != want {
+			t.Errorf("ParseLogLevel(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+// sqlLog connects at logLevel, runs queries against the database and returns
+// what GORM logged
+func sqlLog(t *testing.T, logLevel string, queries func(*gorm.DB)) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		logged <- out
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	gdb, err := Connect("sqlite::memory:", logLevel, true)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries(gdb)
+	if sqlDB, err := gdb.DB(); err == nil {
+		sqlDB.Close()
+	}
+	w.Close()
+	return string(<-logged)
+}
+
+func TestLogLevelIsApplied(t *testing.T) {
+	queries := func(gdb *gorm.DB) {
+		u := models.User{ID: uuid.Must(uuid.NewV4()), Identifier: "secret-identifier", IdentityPubKey: make([]byte, 32)}
+		gdb.Create(&u)
+		u.ID = uuid.Must(uuid.NewV4())
+		gdb.Create(&u) // duplicate identifier: logged as an error
+	}
+
+	if out := sqlLog(t, "info", queries); !strings.Contains(out, "secret-identifier") {
+		t.Fatalf("info level did not log statements with values:\n%s", out)
+	}
+	out := sqlLog(t, "warn", queries)
+	if !strings.Contains(out, "UNIQUE") {
+		t.Fatalf("warn level did not log the failed insert:\n%s", out)
+	}
+	if strings.Contains(out, "secret-identifier") {
+		t.Fatalf("warn level logged a bound value:\n%s", out)
+	}
+	if out := sqlLog(t, "silent", queries); out != "" {
+		t.Fatalf("silent level logged:\n%s", out)
+	}
+}
+
+func TestSlowQueryIsLoggedWithoutParameters(t *testing.T) {
+	gdb := newTestDB(t)
+	if err := gdb.Use(NewSlowQueryLogger(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ctx := WithRoute(context.Background(), RouteLabel("GET", "/api/keys/bundle/"+uuid.Must(uuid.NewV4()).String()))
+	var n int64
+	gdb.WithContext(ctx).Model(&models.User{}).Where("identifier = ?", "fast-param").Count(&n)
+	if SlowQueries(gdb) != 0 || buf.Len() != 0 {
+		t.Fatalf("fast query logged: %s", buf.String())
+	}
+
+	slow := "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < ?) SELECT count(*) FROM c WHERE ? <> ''"
+	if err := gdb.WithContext(ctx).Raw(slow, 300000, "secret-param").Find(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if SlowQueries(gdb) != 1 || !strings.Contains(out, `route="GET /api/keys/bundle/:id"`) || !strings.Contains(out, "WITH RECURSIVE") {
+		t.Fatalf("slow query not logged with its route: %q", out)
+	}
+	if strings.Contains(out, "secret-param") || strings.Contains(out, "300000") {
+		t.Fatalf("slow query log contains parameters: %q", out)
+	}
+}
+
+func TestConnectRefusesIncompleteSchema(t *testing.T) {
+	dsn := "sqlite:file:" + filepath.Join(t.TempDir(), "drifted.db")
+	gdb, err := Connect(dsn, "silent", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{"ALTER TABLE devices DROP COLUMN push_token", "DROP TABLE match_analytics"} {
+		if err := gdb.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sqlDB, err := gdb.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	_, err = Connect(dsn, "silent", false)
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Connect = %v, want a SchemaError", err)
+	}
+	if got := strings.Join(schemaErr.Missing, ", "); got != "column devices.push_token, table match_analytics" {
+		t.Fatalf("missing = %q", got)
+	}
+	if !strings.HasPrefix(err.Error(), "database schema is missing: ") {
+		t.Fatalf("message = %q", err)
+	}
+
+	// Migrating repairs the drift
+	if gdb, err = Connect(dsn, "silent", true); err != nil {
+		t.Fatalf("Connect with migration: %v", err)
+	}
+	if sqlDB, err := gdb.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func TestMigrateDropsRedundantDeviceIndex(t *testing.T) {
+	gdb := newTestDB(t)
+	m := gdb.Migrator()
+	if m.HasIndex(&models.Device{}, "idx_devices_user_id") {
+		t.Fatal("fresh schema has a separate devices(user_id) index")
+	}
+
+	// What schemas migrated before it was dropped still have
+	if err := gdb.Exec("CREATE INDEX idx_devices_user_id ON devices (user_id)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(gdb); err != nil {
+		t.Fatal(err)
+	}
+	if m.HasIndex(&models.Device{}, "idx_devices_user_id") {
+		t.Fatal("migration kept the redundant devices(user_id) index")
+	}
+	if !m.HasIndex(&models.Device{}, "idx_devices_user_device") {
+		t.Fatal("migration dropped idx_devices_user_device")
+	}
+}
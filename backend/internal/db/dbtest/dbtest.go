@@ -0,0 +1,108 @@
+// Package dbtest provides a migrated in-memory database and seed helpers for
+// tests that exercise services and handlers without a Postgres server.
+package dbtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/db"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/utils"
+)
+
+// New returns a fresh, migrated in-memory SQLite database that is closed when
+// the test finishes
+func New(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	gdb, err := db.ConnectQuiet("sqlite::memory:")
+	if err != nil {
+		tb.Fatalf("open in-memory db: %v", err)
+	}
+	tb.Cleanup(func() {
+		if sqlDB, err := gdb.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return gdb
+}
+
+// SeedUser inserts a user with a random 32-byte identity key
+func SeedUser(tb testing.TB, gdb *gorm.DB, identifier string) models.User {
+	tb.Helper()
+	identity := make([]byte, 32)
+	if _, err := rand.Read(identity); err != nil {
+		tb.Fatalf("identity key: %v", err)
+	}
+	user := models.User{
+		ID:             uuid.Must(uuid.NewV4()),
+		Identifier:     identifier,
+		IdentityPubKey: identity,
+	}
+	if err := gdb.Create(&user).Error; err != nil {
+		tb.Fatalf("seed user: %v", err)
+	}
+	return user
+}
+
+// SeedKeys gives user a device, a signed prekey signed by a fresh Ed25519 key
+// and n one-time prekeys. It returns the signing key for signature checks.
+func SeedKeys(tb testing.TB, gdb *gorm.DB, user models.User, n int) ed25519.PrivateKey {
+	tb.Helper()
+	_, signingPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("signing key: %v", err)
+	}
+
+	device := models.Device{
+		ID:            uuid.Must(uuid.NewV4()),
+		UserID:        user.ID,
+		DeviceID:      "device-1",
+		DevicePubKey:  randomKey(tb),
+		SigningPubKey: signingPriv.Public().(ed25519.PublicKey),
+	}
+	if err := gdb.Create(&device).Error; err != nil {
+		tb.Fatalf("seed device: %v", err)
+	}
+
+	spk := randomKey(tb)
+	prekey := models.PreKey{
+		ID:        uuid.Must(uuid.NewV4()),
+		UserID:    user.ID,
+		DeviceID:  device.DeviceID,
+		KeyID:     utils.SignedPreKeyID,
+		PreKey:    spk,
+		Signature: ed25519.Sign(signingPriv, utils.SignedPreKeyMessage(utils.SignedPreKeyID, spk)),
+		ExpiresAt: time.Now().Add(30 * 24 * time.Hour),
+	}
+	if err := gdb.Create(&prekey).Error; err != nil {
+		tb.Fatalf("seed signed prekey: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		otp := models.OneTimePreKey{
+			ID:        uuid.Must(uuid.NewV4()),
+			UserID:    user.ID,
+			DeviceID:  device.DeviceID,
+			PreKey:    randomKey(tb),
+			ExpiresAt: time.Now().Add(90 * 24 * time.Hour),
+		}
+		if err := gdb.Create(&otp).Error; err != nil {
+			tb.Fatalf("seed one-time prekey: %v", err)
+		}
+	}
+	return signingPriv
+}
+
+func randomKey(tb testing.TB) []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		tb.Fatalf("random key: %v", err)
+	}
+	return b
+}
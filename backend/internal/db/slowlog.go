@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type routeKey struct{}
+
+// WithRoute tags ctx with the HTTP route issuing queries, for slow-query logs
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+func routeFrom(ctx context.Context) string {
+	if ctx != nil {
+		if r, ok := ctx.Value(routeKey{}).(string); ok {
+			return r
+		}
+	}
+	return "unknown"
+}
+
+var uuidSegment = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// RouteLabel turns a request path into a label without user or key IDs
+func RouteLabel(method, path string) string {
+	return method + " " + uuidSegment.ReplaceAllString(path, ":id")
+}
+
+const (
+	slowQueryPluginName = "securechat:slowquery"
+	slowQueryStartKey   = "securechat:slowquery_start"
+)
+
+// SlowQueryLogger is a GORM plugin that logs statements slower than
+// Threshold with their route and duration. Only the SQL text with
+// placeholders is logged, never the bound parameter values.
+type SlowQueryLogger struct {
+	Threshold time.Duration
+	count     atomic.Int64
+}
+
+func NewSlowQueryLogger(threshold time.Duration) *SlowQueryLogger {
+	return &SlowQueryLogger{Threshold: threshold}
+}
+
+func (l *SlowQueryLogger) Name() string {
+	return slowQueryPluginName
+}
+
+// Initialize wraps every GORM operation with timing callbacks
+func (l *SlowQueryLogger) Initialize(gdb *gorm.DB) error {
+	cb := gdb.Callback()
+	if err := cb.Create().Before("gorm:create").Register("slowquery:before_create", l.before); err != nil {
+		return err
+	}
+	if err := cb.Create().After("gorm:create").Register("slowquery:after_create", l.after); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("gorm:query").Register("slowquery:before_query", l.before); err != nil {
+		return err
+	}
+	if err := cb.Query().After("gorm:query").Register("slowquery:after_query", l.after); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("slowquery:before_update", l.before); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("slowquery:after_update", l.after); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("gorm:delete").Register("slowquery:before_delete", l.before); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:delete").Register("slowquery:after_delete", l.after); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("gorm:row").Register("slowquery:before_row", l.before); err != nil {
+		return err
+	}
+	if err := cb.Row().After("gorm:row").Register("slowquery:after_row", l.after); err != nil {
+		return err
+	}
+	if err := cb.Raw().Before("gorm:raw").Register("slowquery:before_raw", l.before); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("slowquery:after_raw", l.after)
+}
+
+func (l *SlowQueryLogger) before(tx *gorm.DB) {
+	tx.InstanceSet(slowQueryStartKey, time.Now())
+}
+
+func (l *SlowQueryLogger) after(tx *gorm.DB) {
+	v, ok := tx.InstanceGet(slowQueryStartKey)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(v.(time.Time))
+	if l.Threshold <= 0 || elapsed < l.Threshold {
+		return
+	}
+	l.count.Add(1)
+	log.Printf("slow query route=%q duration=%s sql=%q", routeFrom(tx.Statement.Context), elapsed.Round(time.Millisecond), tx.Statement.SQL.String())
+}
+
+// Count returns how many slow queries have been logged
+func (l *SlowQueryLogger) Count() int64 {
+	return l.count.Load()
+}
+
+// SlowQueries returns the slow-query count recorded on gdb, or 0 when the
+// plugin isn't installed
+func SlowQueries(gdb *gorm.DB) int64 {
+	if p, ok := gdb.Config.Plugins[slowQueryPluginName].(*SlowQueryLogger); ok {
+		return p.Count()
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// SchemaError lists the tables and columns the models need but the database
+// lacks
+type SchemaError struct {
+	Missing []string
+}
+
+func (e *SchemaError) Error() string {
+	return "database schema is missing: " + strings.Join(e.Missing, ", ")
+}
+
+// VerifySchema checks that every model's table and columns exist, so a
+// drifted schema stops startup with one clear message instead of surfacing
+// as SQL errors on individual requests
+func VerifySchema(gdb *gorm.DB) error {
+	m := gdb.Migrator()
+	var missing []string
+	for _, model := range schemaModels() {
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(model); err != nil {
+			return fmt.Errorf("parse model %T: %w", model, err)
+		}
+		table := stmt.Schema.Table
+		if !m.HasTable(model) {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			if !m.HasColumn(model, field.DBName) {
+				missing = append(missing, "column "+table+"."+field.DBName)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &SchemaError{Missing: missing}
+	}
+	return nil
+}
@@ -8,25 +8,47 @@ import (
 )
 
 type User struct {
-	ID             uuid.UUID `gorm:"type:uuid;primaryKey"`
-	Identifier     string    `gorm:"index;unique;not null"`
-	IdentityPubKey []byte    `gorm:"type:bytea;not null"`
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Devices        []Device
+	ID                uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Identifier        string    `gorm:"index;unique;not null"`
+	IdentityPubKey    []byte    `gorm:"type:bytea;not null"`
+	SessionsRevokedAt *time.Time
+	// LastSeenAt is flushed from hub presence periodically; it is a lower
+	// bound on the user's last activity, never proof they are online
+	LastSeenAt *time.Time
+	// Privacy settings: when off, the matching signal is never relayed and
+	// presence lookups by others come back hidden
+	SharePresence     bool `gorm:"not null;default:true"`
+	ShareTyping       bool `gorm:"not null;default:true"`
+	ShareReadReceipts bool `gorm:"not null;default:true"`
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Devices           []Device
 }
 
 type Device struct {
 	ID           uuid.UUID `gorm:"type:uuid;primaryKey"`
-	UserID       uuid.UUID `gorm:"type:uuid;index"`
-	DeviceID     string    `gorm:"index;not null"`
+	UserID       uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_devices_user_device;uniqueIndex:idx_devices_user_registration,where:registration_id > 0"`
+	DeviceID     string    `gorm:"index;not null;uniqueIndex:idx_devices_user_device"`
 	DevicePubKey []byte    `gorm:"type:bytea;not null"`
+	// RegistrationID is the Signal registration ID, in [1, 16383]; zero for
+	// devices registered before it was collected. Nonzero IDs are unique per
+	// user, since Signal addresses a user's devices by it.
+	RegistrationID int `gorm:"not null;default:0;uniqueIndex:idx_devices_user_registration,where:registration_id > 0"`
+	// SigningPubKey verifies signed-prekey rotations; devices registered
+	// before it was stored must re-upload their keys to set it
+	SigningPubKey []byte `gorm:"type:bytea"`
+	LastSeenAt    time.Time
+	// PushToken is the APNs or FCM token for offline wake-ups; empty when
+	// the device hasn't registered one
+	PushToken    string `gorm:"not null;default:''"`
+	PushPlatform string `gorm:"not null;default:''"`
 	CreatedAt    time.Time
 }
 
 type PreKey struct {
 	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	UserID    uuid.UUID `gorm:"type:uuid;index"`
+	DeviceID  string    `gorm:"index;not null;default:''"`
 	KeyID     string    `gorm:"index;not null"`
 	PreKey    []byte    `gorm:"type:bytea;not null"`
 	Signature []byte    `gorm:"type:bytea;not null"`
@@ -35,28 +57,129 @@ type PreKey struct {
 }
 
 type OneTimePreKey struct {
-	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
-	UserID    uuid.UUID `gorm:"type:uuid;index:idx_user_used"`
-	PreKey    []byte    `gorm:"type:bytea;not null"`
-	Used      bool      `gorm:"default:false;index:idx_user_used"`
-	CreatedAt time.Time
+	ID            uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	UserID        uuid.UUID  `gorm:"type:uuid;index:idx_user_used"`
+	DeviceID      string     `gorm:"index;not null;default:''"`
+	PreKey        []byte     `gorm:"type:bytea;not null"`
+	Used          bool       `gorm:"default:false;index:idx_user_used"`
+	ExpiresAt     time.Time  `gorm:"index"`
+	ReservedBy    *uuid.UUID `gorm:"type:uuid"`
+	ReservedUntil *time.Time `gorm:"index"`
+	CreatedAt     time.Time
 }
 
 type RegistrationSession struct {
-	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
-	Identifier string    `gorm:"index"`
+	ID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	// (identifier, expires_at) serves the live-session lookups; expires_at
+	// alone serves the expiry sweep
+	Identifier string    `gorm:"index:idx_registration_sessions_identifier_expires,priority:1"`
 	OTPHash    []byte    `gorm:"type:bytea"`
-	ExpiresAt  time.Time `gorm:"index"`
+	ExpiresAt  time.Time `gorm:"index;index:idx_registration_sessions_identifier_expires,priority:2"`
 	CreatedAt  time.Time
 }
 
 type MatchProfile struct {
-	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
 	UserID    uuid.UUID `gorm:"type:uuid;index"`
 	TagHash   string    `gorm:"index"`
 	CreatedAt time.Time
 }
 
+// IdentityPin is the identity key a user has chosen to trust for a peer
+// (trust on first use). It is kept when the peer's key changes, so the
+// mismatch stays visible until the user re-pins.
+type IdentityPin struct {
+	UserID         uuid.UUID `gorm:"type:uuid;primaryKey"`
+	PeerID         uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	IdentityPubKey []byte    `gorm:"type:bytea;not null"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type Conversation struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedBy uuid.UUID `gorm:"type:uuid;index"`
+	CreatedAt time.Time
+	Members   []ConversationMember
+}
+
+type ConversationMember struct {
+	ConversationID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID         uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	// Muted suppresses push wake-ups for this member until MutedUntil, or
+	// indefinitely when MutedUntil is nil; messages are still delivered
+	Muted      bool `gorm:"not null;default:false"`
+	MutedUntil *time.Time
+	CreatedAt  time.Time
+}
+
+// MutedAt reports whether the member has the conversation muted at now
+func (m ConversationMember) MutedAt(now time.Time) bool {
+	return m.Muted && (m.MutedUntil == nil || now.Before(*m.MutedUntil))
+}
+
+// SessionMarker records that UserID reported an established end-to-end
+// session with PeerID, so delivery can tell a fresh pair from one that is
+// already talking
+type SessionMarker struct {
+	UserID         uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	PeerID         uuid.UUID  `gorm:"type:uuid;primaryKey;index"`
+	ConversationID *uuid.UUID `gorm:"type:uuid"`
+	EstablishedAt  time.Time
+}
+
+// QueuedMessage holds ciphertext for a recipient who was offline at send time
+type QueuedMessage struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	RecipientID    uuid.UUID  `gorm:"type:uuid;index;not null"`
+	SenderID       uuid.UUID  `gorm:"type:uuid;not null"`
+	ConversationID *uuid.UUID `gorm:"type:uuid;index"`
+	Payload        []byte     `gorm:"type:bytea;not null"`
+	CreatedAt      time.Time  `gorm:"index"`
+}
+
+// QueuedDelivery records that one of the recipient's devices was sent a
+// queued message; the message is deleted once all of their devices have it
+type QueuedDelivery struct {
+	MessageID   uuid.UUID `gorm:"type:uuid;primaryKey"`
+	DeviceID    string    `gorm:"primaryKey"`
+	DeliveredAt time.Time
+}
+
+// MatchAnalyticsEvent is an identifier-free matching outcome. CreatedAt is
+// truncated to the hour so rows can't be joined back to request logs.
+type MatchAnalyticsEvent struct {
+	ID         uint   `gorm:"primaryKey"`
+	Outcome    string `gorm:"index;not null"`
+	WaitBucket string `gorm:"not null"`
+	BucketSize int
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+func (MatchAnalyticsEvent) TableName() string {
+	return "match_analytics"
+}
+
+// AuditEvent is one entry in the append-only security audit log. Entries
+// carry no secrets or message content. Hash covers the entry's fields and the
+// previous entry's hash, so editing or removing an entry breaks the chain.
+type AuditEvent struct {
+	Seq       int64      `gorm:"primaryKey;autoIncrement:false"`
+	Event     string     `gorm:"index;not null"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index"`
+	IP        string     `gorm:"not null;default:''"`
+	Detail    string     `gorm:"not null;default:''"`
+	CreatedAt time.Time  `gorm:"index"`
+	PrevHash  string     `gorm:"not null"`
+	Hash      string     `gorm:"not null"`
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_log"
+}
+
+// BeforeCreate assigns the ID in Go rather than via a database default so the
+// model works on any dialect
 func (m *MatchProfile) BeforeCreate(tx *gorm.DB) error {
 	if m.ID == uuid.Nil {
 		id, err := uuid.NewV4()
@@ -0,0 +1,247 @@
+// Package openapi builds an OpenAPI 3 description from routes registered
+// alongside their request and response types.
+package openapi
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Operation documents one route. Request and Response are zero values of the
+// body types (nil for none); their json tags drive the generated schemas.
+type Operation struct {
+	Method   string
+	Path     string // Fiber syntax, e.g. /api/keys/bundle/:user_id
+	Tag      string
+	Summary  string
+	Auth     bool
+	Query    []string
+	Request  interface{}
+	Response interface{}
+}
+
+// Registry collects operations and extra named schemas
+type Registry struct {
+	Title   string
+	Version string
+
+	ops     []Operation
+	schemas map[string]interface{}
+}
+
+func NewRegistry(title, version string) *Registry {
+	return &Registry{Title: title, Version: version, schemas: make(map[string]interface{})}
+}
+
+// Add records an operation
+func (r *Registry) Add(op Operation) {
+	r.ops = append(r.ops, op)
+}
+
+// AddSchema records a named schema that isn't a route body, such as a
+// WebSocket message envelope
+func (r *Registry) AddSchema(name string, v interface{}) {
+	r.schemas[name] = v
+}
+
+// Operations returns the registered operations in registration order
+func (r *Registry) Operations() []Operation {
+	return append([]Operation(nil), r.ops...)
+}
+
+// Spec renders the registry as an OpenAPI 3.0 document
+func (r *Registry) Spec() map[string]interface{} {
+	g := &generator{components: make(map[string]interface{})}
+
+	paths := make(map[string]map[string]interface{})
+	for _, op := range r.ops {
+		path, params := convertPath(op.Path)
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query", "required": false,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		o := map[string]interface{}{
+			"summary":   op.Summary,
+			"responses": map[string]interface{}{"200": g.response(op.Response), "default": g.response(errorBody{})},
+		}
+		if op.Tag != "" {
+			o["tags"] = []string{op.Tag}
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		if op.Request != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+		if op.Auth {
+			o["security"] = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(op.Method)] = o
+	}
+
+	names := make([]string, 0, len(r.schemas))
+	for name := range r.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.components[name] = g.structSchema(reflect.TypeOf(r.schemas[name]))
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": r.Title, "version": r.Version},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// errorBody is the shape of every error response
+type errorBody struct {
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+// convertPath rewrites Fiber ":param" segments to OpenAPI "{param}"
+func convertPath(path string) (string, []map[string]interface{}) {
+	var params []map[string]interface{}
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		if strings.HasPrefix(s, ":") {
+			name := strings.TrimSuffix(s[1:], "?")
+			segs[i] = "{" + name + "}"
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segs, "/"), params
+}
+
+type generator struct {
+	components map[string]interface{}
+}
+
+func (g *generator) response(v interface{}) map[string]interface{} {
+	if v == nil {
+		return map[string]interface{}{"description": "OK"}
+	}
+	return map[string]interface{}{
+		"description": "OK",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(v))},
+		},
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+// schema maps a Go type to a schema, registering named structs as components
+func (g *generator) schema(t reflect.Type) map[string]interface{} {
+	nullable := false
+	for t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+
+	var s map[string]interface{}
+	switch {
+	case t == timeType:
+		s = map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == uuidType:
+		s = map[string]interface{}{"type": "string", "format": "uuid"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		s = map[string]interface{}{"type": "string", "format": "byte"}
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			s = map[string]interface{}{"type": "string"}
+		case reflect.Bool:
+			s = map[string]interface{}{"type": "boolean"}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			s = map[string]interface{}{"type": "integer"}
+		case reflect.Float32, reflect.Float64:
+			s = map[string]interface{}{"type": "number"}
+		case reflect.Slice, reflect.Array:
+			s = map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+		case reflect.Map:
+			s = map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+		case reflect.Struct:
+			if t.Name() == "" {
+				s = g.structSchema(t)
+				break
+			}
+			if _, ok := g.components[t.Name()]; !ok {
+				g.components[t.Name()] = nil // guard against recursion
+				g.components[t.Name()] = g.structSchema(t)
+			}
+			s = map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		default:
+			s = map[string]interface{}{}
+		}
+	}
+	if nullable {
+		if _, isRef := s["$ref"]; isRef {
+			s = map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		} else {
+			s["nullable"] = true
+		}
+	}
+	return s
+}
+
+func (g *generator) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := g.schema(f.Type)
+		if desc := f.Tag.Get("doc"); desc != "" {
+			prop["description"] = desc
+		}
+		props[name] = prop
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
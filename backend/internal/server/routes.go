@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/openapi"
+)
+
+// routeGroup registers handlers on a Fiber router and documents them in the
+// OpenAPI registry under the group's full path prefix
+type routeGroup struct {
+	router fiber.Router
+	prefix string
+	tag    string
+	auth   bool
+	docs   *openapi.Registry
+	// limits holds the per-route profiles; routes without one get
+	// defaultBody and no timeout
+	limits      map[string]config.RouteLimit
+	defaultBody int
+}
+
+// group nests a Fiber group. Passing middleware marks the group's routes as
+// authenticated in the spec.
+func (g routeGroup) group(prefix, tag string, middleware ...fiber.Handler) routeGroup {
+	if tag == "" {
+		tag = g.tag
+	}
+	return routeGroup{
+		router: g.router.Group(prefix, middleware...),
+		prefix: g.prefix + prefix,
+		tag:    tag,
+		auth:   g.auth || len(middleware) > 0,
+		docs:   g.docs,
+
+		limits:      g.limits,
+		defaultBody: g.defaultBody,
+	}
+}
+
+// tagged returns the same group with a different spec tag
+func (g routeGroup) tagged(tag string) routeGroup {
+	g.tag = tag
+	return g
+}
+
+func (g routeGroup) add(method, path string, op openapi.Operation, handlers ...fiber.Handler) {
+	op.Method = method
+	op.Path = g.prefix + path
+	op.Auth = g.auth
+	if op.Tag == "" {
+		op.Tag = g.tag
+	}
+	g.docs.Add(op)
+
+	limit, ok := g.limits[method+" "+op.Path]
+	if !ok {
+		limit.BodyBytes = g.defaultBody
+	}
+	g.router.Add(method, path, append([]fiber.Handler{routeLimiter(limit)}, handlers...)...)
+}
+
+// routeLimiter enforces a route's body limit, which the app-wide Fiber limit
+// can't since it must admit the largest profile, and bounds the handler's
+// request context by the route's timeout
+func routeLimiter(limit config.RouteLimit) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if limit.BodyBytes > 0 && len(c.Request().Body()) > limit.BodyBytes {
+			return fiber.ErrRequestEntityTooLarge
+		}
+		if limit.Timeout <= 0 {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), limit.Timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+		err := c.Next()
+		// Handlers report a cancelled query as their own 500; report the
+		// timeout instead
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && (err != nil || c.Response().StatusCode() >= fiber.StatusInternalServerError) {
+			return fiber.NewError(fiber.StatusServiceUnavailable, "request timed out")
+		}
+		return err
+	}
+}
+
+// maxBodyLimit is the largest body any route accepts, for the app-wide limit
+func maxBodyLimit(cfg *config.Config) int {
+	n := cfg.HTTPBodyLimitBytes
+	for _, l := range cfg.HTTPRouteLimits {
+		if l.BodyBytes > n {
+			n = l.BodyBytes
+		}
+	}
+	return n
+}
+
+// warnUnusedRouteLimits reports profiles that name no registered route, which
+// is almost always a typo in HTTP_ROUTE_LIMITS
+func warnUnusedRouteLimits(app *fiber.App, limits map[string]config.RouteLimit) {
+	routes := make(map[string]bool)
+	for _, r := range app.GetRoutes(true) {
+		routes[r.Method+" "+r.Path] = true
+	}
+	for key := range limits {
+		if !routes[key] {
+			log.Printf("WARNING: HTTP_ROUTE_LIMITS entry %q matches no route", key)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/helmet"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/api"
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db"
+	"github.com/securechat/backend/internal/openapi"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/utils"
+	"github.com/securechat/backend/internal/version"
+)
+
+type Server struct {
+	App  *fiber.App
+	API  *api.App
+	Cfg  *config.Config
+	Docs *openapi.Registry
+
+	// redirect serves HTTP_REDIRECT_PORT while TLS is on
+	redirect *http.Server
+}
+
+func NewServer(cfg *config.Config, gdb *gorm.DB, otpSvc *services.OTPService, prekeySvc *services.PreKeyService, matchmaker *services.Matchmaker, hub *services.Hub) *Server {
+	priv, err := utils.LoadRSAPrivateKey(cfg.ServerRSAPrivPath)
+	if err != nil {
+		log.Printf("WARNING: could not load server RSA key (%v); using ephemeral key", err)
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Fatal("generate RSA key:", err)
+		}
+	}
+	if cfg.CryptoSelfTest {
+		if err := utils.SelfTest(priv); err != nil {
+			log.Fatalf("crypto self-test failed: %v", err)
+		}
+	}
+
+	a := &api.App{
+		DB:         gdb,
+		OTPService: otpSvc,
+		PreKeySvc:  prekeySvc,
+		Matchmaker: matchmaker,
+		Hub:        hub,
+		Convos:     services.NewConversationService(gdb),
+		Sessions:   services.NewSessionService(gdb, prekeySvc, cfg.SessionMarkers),
+		Push:       services.NewPushService(gdb, services.LogPushSender{}),
+		Lookups:    api.NewLookupCache(time.Duration(cfg.CheckUsernameCacheSec) * time.Second),
+		Audit:      services.NewAuditLog(gdb, []byte(cfg.AuditLogKey)),
+		ServerPriv: priv,
+		Cfg:        cfg,
+		Clock:      services.RealClock{},
+	}
+
+	// Bound how long a client can take to send a request and how large it
+	// can be, so a stalled or oversized upload can't tie up a handler
+	app := fiber.New(fiber.Config{
+		BodyLimit:    maxBodyLimit(cfg),
+		ReadTimeout:  time.Duration(cfg.HTTPReadTimeoutSec) * time.Second,
+		ErrorHandler: jsonErrorHandler,
+		// Only configured proxies may set the scheme with X-Forwarded-Proto
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          cfg.TrustedProxies,
+	})
+	app.Use(recover.New())
+	// The API serves JSON only: forbid sniffing, framing and any active content
+	securityHeaders := helmet.Config{
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         "DENY",
+		ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+		ReferrerPolicy:        "no-referrer",
+	}
+	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
+		securityHeaders.HSTSMaxAge = 63072000 // two years
+	}
+	app.Use(helmet.New(securityHeaders))
+	app.Use(logger.New())
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(db.WithRoute(c.UserContext(), db.RouteLabel(c.Method(), c.Path())))
+		return c.Next()
+	})
+	// With no configured origins the API is same-origin only; an empty
+	// AllowOrigins would otherwise mean "*" to the CORS middleware
+	if len(cfg.CORSAllowOrigins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     strings.Join(cfg.CORSAllowOrigins, ","),
+			AllowHeaders:     strings.Join(cfg.CORSAllowHeaders, ","),
+			AllowMethods:     strings.Join(cfg.CORSAllowMethods, ","),
+			AllowCredentials: cfg.CORSAllowCredentials,
+		}))
+	}
+	app.Use(limiter.New(limiter.Config{
+		Max:        cfg.RateLimitRequests,
+		Expiration: time.Duration(cfg.RateLimitWindowSec) * time.Second,
+	}))
+
+	s := &Server{App: app, API: a, Cfg: cfg, Docs: openapi.NewRegistry("SecureChat API", version.Commit)}
+	// Built here rather than in Start so Shutdown never races its creation
+	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" && cfg.HTTPRedirectPort != "" {
+		s.redirect = &http.Server{
+			Addr:              ":" + cfg.HTTPRedirectPort,
+			Handler:           httpsRedirect(cfg.Port),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+	}
+	s.routes()
+	warnUnusedRouteLimits(app, cfg.HTTPRouteLimits)
+	return s
+}
+
+func (s *Server) routes() {
+	a := s.API
+	root := routeGroup{router: s.App, docs: s.Docs, limits: s.Cfg.HTTPRouteLimits, defaultBody: s.Cfg.HTTPBodyLimitBytes}
+
+	root.add(fiber.MethodGet, "/health", openapi.Operation{Tag: "meta", Summary: "Liveness check", Response: api.HealthResponse{}},
+		func(c *fiber.Ctx) error {
+			return c.JSON(fiber.Map{"status": "ok"})
+		})
+	root.add(fiber.MethodGet, "/ready", openapi.Operation{Tag: "meta", Summary: "Readiness check; 503 while draining so load balancers stop routing here", Response: api.ReadinessResponse{}},
+		func(c *fiber.Ctx) error {
+			if a.Hub.Draining() {
+				return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "draining"})
+			}
+			return c.JSON(fiber.Map{"status": "ready"})
+		})
+	root.add(fiber.MethodGet, "/version", openapi.Operation{Tag: "meta", Summary: "Build information", Response: api.VersionResponse{}},
+		func(c *fiber.Ctx) error {
+			return c.JSON(fiber.Map{
+				"commit":     version.Commit,
+				"build_time": version.BuildTime,
+				"go_version": version.GoVersion,
+			})
+		})
+
+	// Jitter the responses whose timing could reveal whether an identifier
+	// or code is valid
+	auth := root.group("/auth", "auth", a.RequireHTTPS)
+	// Unauthenticated and DB-backed, so it gets its own stricter per-IP limit
+	auth.add(fiber.MethodGet, "/check-username", openapi.Operation{Summary: "Check whether a username is free", Query: []string{"username"}, Response: api.CheckUsernameResponse{}},
+		limiter.New(limiter.Config{
+			Max:        s.Cfg.CheckUsernameRateLimit,
+			Expiration: time.Duration(s.Cfg.RateLimitWindowSec) * time.Second,
+			LimitReached: func(c *fiber.Ctx) error {
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many lookups, slow down"})
+			},
+		}), a.CheckUsernameHandler)
+	auth.add(fiber.MethodPost, "/register", openapi.Operation{Summary: "Start registration and issue an OTP", Request: api.RegisterRequest{}, Response: api.RegisterResponse{}},
+		a.AuthJitter, a.RegisterHandler)
+	auth.add(fiber.MethodPost, "/verify-2fa", openapi.Operation{Summary: "Verify the OTP and obtain a session token", Request: api.Verify2FARequest{}, Response: api.Verify2FAResponse{}},
+		a.AuthJitter, a.Verify2FAHandler)
+	auth.add(fiber.MethodGet, "/pending", openapi.Operation{Summary: "Check for a pending registration", Query: []string{"identifier"}, Response: api.PendingResponse{}},
+		limiter.New(limiter.Config{
+			Max:        s.Cfg.PendingCheckRateLimit,
+			Expiration: time.Duration(s.Cfg.RateLimitWindowSec) * time.Second,
+		}), a.AuthJitter, a.PendingVerificationHandler)
+	auth.add(fiber.MethodGet, "/server-pubkey", openapi.Operation{Summary: "Server RSA public key", Response: api.ServerPublicKeyResponse{}},
+		a.ServerPublicKeyHandler)
+
+	// WebSocket authenticates via query token, so register it ahead of the
+	// protected group to keep AuthMiddleware from rejecting the upgrade
+	root.add(fiber.MethodGet, "/api/ws", openapi.Operation{Tag: "websocket", Summary: "Upgrade to a WebSocket; frames are WSClientMessage in and WSServerEvent out, or binary envelopes for message frames when the securechat.binary.v1 subprotocol is negotiated", Query: []string{"token", "device_id"}},
+		a.WebSocketHandler)
+	s.Docs.AddSchema("WSClientMessage", api.WSClientMessage{})
+	s.Docs.AddSchema("WSServerEvent", api.WSServerEvent{})
+
+	protected := root.group("/api", "", a.AuthMiddleware)
+	keys := protected.tagged("keys")
+	keys.add(fiber.MethodPost, "/keys/prekeys/upload", openapi.Operation{Summary: "Upload identity, signed and one-time prekeys", Request: api.PreKeyUploadRequest{}, Response: api.PreKeyUploadResponse{}},
+		a.RequireHTTPS, a.PreKeysUploadHandler)
+	keys.add(fiber.MethodPost, "/keys/signed-prekey", openapi.Operation{Summary: "Rotate a device's signed prekey only", Request: api.SignedPreKeyRotateRequest{}, Response: api.SignedPreKeyRotateResponse{}},
+		a.RequireHTTPS, a.RotateSignedPreKeyHandler)
+	keys.add(fiber.MethodGet, "/keys/status/:user_id", openapi.Operation{Summary: "Check whether a user's key bundle is available, without consuming prekeys", Query: []string{"device_id"}, Response: api.KeyStatusResponse{}},
+		a.KeyStatusHandler)
+	keys.add(fiber.MethodPost, "/keys/pin/:user_id", openapi.Operation{Summary: "Pin the identity key trusted for a peer", Request: api.PinIdentityRequest{}, Response: api.IdentityPinResponse{}},
+		a.PinIdentityHandler)
+	keys.add(fiber.MethodGet, "/keys/pins", openapi.Operation{Summary: "List the caller's identity pins", Response: api.IdentityPinListResponse{}},
+		a.ListIdentityPinsHandler)
+	keys.add(fiber.MethodGet, "/keys/bundle/:user_id", openapi.Operation{Summary: "Fetch a signed key bundle; one's own comes without a one-time prekey", Query: []string{"device_id", "reserve"}, Response: api.KeyBundleResponse{}},
+		a.GetKeyBundleHandler)
+	keys.add(fiber.MethodDelete, "/keys/prekeys/onetime/:key_id", openapi.Operation{Summary: "Revoke one unused one-time prekey", Response: api.StatusResponse{}},
+		a.RevokeOneTimePreKeyHandler)
+	keys.add(fiber.MethodPost, "/keys/prekeys/confirm", openapi.Operation{Summary: "Confirm use of a reserved one-time prekey", Request: api.ConfirmPreKeyRequest{}, Response: api.StatusResponse{}},
+		a.ConfirmPreKeyHandler)
+
+	// Matching and messaging need the caller's identity key in place
+	match := protected.group("/match", "match", a.RequireIdentityKey)
+	// Enqueueing again is harmless but still takes the queue lock, so cap
+	// how often one user can do it
+	match.add(fiber.MethodPost, "/enqueue", openapi.Operation{Summary: "Join the match queue, or update the tags of an existing entry", Request: api.EnqueueMatchRequest{}, Response: api.EnqueueMatchResponse{}},
+		limiter.New(limiter.Config{
+			Max:        s.Cfg.MatchEnqueueRateLimit,
+			Expiration: time.Duration(s.Cfg.RateLimitWindowSec) * time.Second,
+			KeyGenerator: func(c *fiber.Ctx) string {
+				userID, _ := api.GetUserID(c)
+				return "enqueue:" + userID.String()
+			},
+			LimitReached: func(c *fiber.Ctx) error {
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "too many enqueue attempts, slow down"})
+			},
+		}), a.EnqueueMatchHandler)
+	match.add(fiber.MethodGet, "/status", openapi.Operation{Summary: "Poll for a match", Response: api.MatchStatusResponse{}},
+		a.MatchStatusHandler)
+	match.add(fiber.MethodGet, "/position", openapi.Operation{Summary: "Queue position and estimated wait", Response: api.MatchPositionResponse{}},
+		a.MatchPositionHandler)
+	match.add(fiber.MethodPost, "/leave", openapi.Operation{Summary: "Leave the match queue", Response: api.StatusResponse{}},
+		a.LeaveMatchQueueHandler)
+	match.add(fiber.MethodPost, "/end", openapi.Operation{Summary: "End the current match; auto-requeue users go back in the queue", Response: api.StatusResponse{}},
+		a.EndMatchHandler)
+	match.add(fiber.MethodPost, "/keys", openapi.Operation{Summary: "Set the keys an anonymous match's peer is served until both reveal", Request: api.AnonymousKeysRequest{}, Response: api.StatusResponse{}},
+		a.SetAnonymousKeysHandler)
+	match.add(fiber.MethodPost, "/reveal", openapi.Operation{Summary: "Consent to revealing real IDs to an anonymous match", Response: api.RevealResponse{}},
+		a.RevealMatchHandler)
+
+	sessions := protected.group("/sessions", "sessions", a.RequireIdentityKey)
+	sessions.add(fiber.MethodPost, "/established", openapi.Operation{Summary: "Report an established end-to-end session, finalizing the prekey it consumed", Request: api.SessionEstablishedRequest{}, Response: api.StatusResponse{}},
+		a.SessionEstablishedHandler)
+
+	presence := protected.tagged("presence")
+	presence.add(fiber.MethodGet, "/presence/:user_id", openapi.Operation{Summary: "Online status and last seen of a match or conversation contact", Response: api.PresenceResponse{}},
+		a.PresenceHandler)
+
+	messages := protected.group("/messages", "messages", a.RequireIdentityKey)
+	messages.add(fiber.MethodGet, "/backlog", openapi.Operation{Summary: "Count and size of the caller's queued messages", Response: api.MessageBacklogResponse{}},
+		a.MessageBacklogHandler)
+	messages.add(fiber.MethodGet, "/search", openapi.Operation{Summary: "Search stored messages by metadata", Query: []string{"conversation_id", "from", "since", "until", "limit", "offset"}, Response: api.MessageSearchResponse{}},
+		a.SearchMessagesHandler)
+
+	convos := protected.group("/conversations", "conversations", a.RequireIdentityKey)
+	convos.add(fiber.MethodPost, "", openapi.Operation{Summary: "Create a group conversation", Request: api.CreateConversationRequest{}, Response: api.ConversationResponse{}},
+		a.CreateConversationHandler)
+	convos.add(fiber.MethodGet, "", openapi.Operation{Summary: "List the caller's conversations", Response: api.ConversationListResponse{}},
+		a.ListConversationsHandler)
+	convos.add(fiber.MethodPost, "/:id/mute", openapi.Operation{Summary: "Mute push notifications for a conversation, optionally for a duration", Request: api.ConversationMuteRequest{}, Response: api.ConversationMuteResponse{}},
+		a.MuteConversationHandler)
+	convos.add(fiber.MethodDelete, "/:id/mute", openapi.Operation{Summary: "Unmute a conversation", Response: api.ConversationMuteResponse{}},
+		a.UnmuteConversationHandler)
+	convos.add(fiber.MethodDelete, "/:id", openapi.Operation{Summary: "End a conversation and purge its queued messages for every member", Response: api.StatusResponse{}},
+		a.DeleteConversationHandler)
+
+	admin := protected.group("/admin", "admin", a.AdminMiddleware)
+	admin.add(fiber.MethodGet, "/metrics", openapi.Operation{Summary: "Database pool and slow-query metrics", Response: api.MetricsResponse{}},
+		a.AdminMetricsHandler)
+	admin.add(fiber.MethodGet, "/matchmaker", openapi.Operation{Summary: "Queue depth, wait ages, pairings and tag bucket sizes, without user IDs", Response: api.MatchmakerStatsResponse{}},
+		a.AdminMatchmakerHandler)
+	admin.add(fiber.MethodGet, "/keys/health", openapi.Operation{Summary: "Aggregate identity, one-time and signed prekey health across users", Response: api.KeyHealthResponse{}},
+		a.AdminKeyHealthHandler)
+	admin.add(fiber.MethodGet, "/audit", openapi.Operation{Summary: "Query the security audit log, newest first", Query: []string{"event", "user_id", "since", "until", "limit", "offset"}, Response: api.AuditLogResponse{}},
+		a.AdminAuditLogHandler)
+	admin.add(fiber.MethodGet, "/audit/verify", openapi.Operation{Summary: "Check the audit log's hash chain", Response: api.AuditVerifyResponse{}},
+		a.AdminAuditVerifyHandler)
+	admin.add(fiber.MethodPost, "/drain", openapi.Operation{Summary: "Stop accepting new sockets and match requests ahead of a restart", Response: api.AdminDrainResponse{}},
+		a.AdminDrainHandler)
+	admin.add(fiber.MethodPost, "/users/:id/disconnect", openapi.Operation{Summary: "Close a user's connections, optionally revoking sessions", Request: api.AdminDisconnectRequest{}, Response: api.AdminDisconnectResponse{}},
+		a.AdminDisconnectUserHandler)
+
+	account := protected.tagged("account")
+	account.add(fiber.MethodGet, "/me/devices", openapi.Operation{Summary: "List the caller's devices, most recently seen first", Query: []string{"limit", "offset"}, Response: api.DeviceListResponse{}},
+		a.ListDevicesHandler)
+	account.add(fiber.MethodPut, "/me/devices/:device_id/push-token", openapi.Operation{Summary: "Set or clear a device's push token", Request: api.PushTokenRequest{}, Response: api.StatusResponse{}},
+		a.UpdatePushTokenHandler)
+	// Data exports are expensive and sensitive, so allow one per user per day
+	account.add(fiber.MethodPut, "/me/privacy", openapi.Operation{Summary: "Update presence, typing and read-receipt sharing", Request: api.PrivacySettingsRequest{}, Response: api.PrivacySettingsResponse{}},
+		a.UpdatePrivacyHandler)
+	account.add(fiber.MethodPost, "/account/export", openapi.Operation{Summary: "Export account data, optionally encrypted", Request: api.AccountExportRequest{}, Response: api.AccountExportResponse{}},
+		limiter.New(limiter.Config{
+			Max:                1,
+			Expiration:         24 * time.Hour,
+			SkipFailedRequests: true,
+			KeyGenerator: func(c *fiber.Ctx) string {
+				userID, _ := api.GetUserID(c)
+				return "export:" + userID.String()
+			},
+			LimitReached: func(c *fiber.Ctx) error {
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "export limit reached, try again tomorrow"})
+			},
+		}), a.AccountExportHandler)
+
+	// Render once; the route table is fixed after startup
+	spec := s.Docs.Spec()
+	s.App.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(spec)
+	})
+}
+
+// Start listens on the configured port, using TLS when a certificate is
+// configured, plus the HTTP-to-HTTPS redirect listener if one is set
+func (s *Server) Start() error {
+	addr := ":" + s.Cfg.Port
+	if s.Cfg.TLSCertPath == "" || s.Cfg.TLSKeyPath == "" {
+		return s.App.Listen(addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.Cfg.TLSCertPath, s.Cfg.TLSKeyPath)
+	if err != nil {
+		return err
+	}
+	minVersion := uint16(tls.VersionTLS12)
+	if s.Cfg.TLSMinVersion == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion})
+	if err != nil {
+		return err
+	}
+	if s.redirect != nil {
+		go func() {
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("https redirect listener: %v", err)
+			}
+		}()
+	}
+	return s.App.Listener(ln)
+}
+
+// httpsRedirect answers every plain-HTTP request with a 301 to the same
+// host and path on the TLS port
+func httpsRedirect(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests.
+// WebSocket clients get a shutdown close frame with a jittered reconnect hint,
+// and queued match analytics are written out once requests have finished.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.API.Hub.CloseAll(services.CloseServerShutdown)
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
+	err := s.App.ShutdownWithContext(ctx)
+	s.API.Matchmaker.Analytics.Close()
+	return err
+}
+
+// jsonErrorHandler renders errors that reach Fiber (including 413 for bodies
+// over the limit) in the API's {"error": ...} shape
+func jsonErrorHandler(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+	msg := err.Error()
+	if code == fiber.StatusInternalServerError {
+		msg = "internal error"
+	}
+	return c.Status(code).JSON(fiber.Map{"error": msg})
+}
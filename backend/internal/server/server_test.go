@@ -0,0 +1,692 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+	"github.com/securechat/backend/internal/services"
+	"github.com/securechat/backend/internal/version"
+)
+
+// serverKeyPath holds one RSA key for every test server, since generating
+// one per server is slow
+var serverKeyPath string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "server-test")
+	if err != nil {
+		panic(err)
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	serverKeyPath = filepath.Join(dir, "server_rsa_priv.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := os.WriteFile(serverKeyPath, keyPEM, 0o600); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testConfig is the default configuration with the shared server key
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := config.Load()
+	cfg.ServerRSAPrivPath = serverKeyPath
+	return cfg
+}
+
+// newTestServer builds the full route table over a fresh in-memory database
+func newTestServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+	d := dbtest.New(t)
+	hub := services.NewHub()
+	return NewServer(cfg, d, services.NewOTPService(d, cfg, services.LogNotifier{}), services.NewPreKeyService(d, cfg), services.NewMatchmaker(d, hub), hub)
+}
+
+// get sends req to s and decodes a JSON body into a map
+func get(t *testing.T, s *Server, req *http.Request) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	resp, body, err := tryGet(s, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// tryGet is get for goroutines other than the test's, which must not call
+// t.Fatal; the caller reports the error
+func tryGet(s *Server, req *http.Request) (*http.Response, map[string]interface{}, error) {
+	resp, err := s.App.Test(req, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	raw, _ := io.ReadAll(resp.Body)
+	if len(raw) > 0 {
+		json.Unmarshal(raw, &body)
+	}
+	return resp, body, nil
+}
+
+func TestHealthAndVersionEndpoints(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	if resp, body := get(t, s, httptest.NewRequest(http.MethodGet, "/health", nil)); resp.StatusCode != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("health: %d %v", resp.StatusCode, body)
+	}
+
+	_, body := get(t, s, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if body["commit"] != "unknown" || body["build_time"] != "unknown" || body["go_version"] != runtime.Version() {
+		t.Fatalf("defaults: %v", body)
+	}
+
+	// What -ldflags "-X ..." sets at link time
+	commit, built := version.Commit, version.BuildTime
+	t.Cleanup(func() { version.Commit, version.BuildTime = commit, built })
+	version.Commit, version.BuildTime = "abc1234", "2026-01-01T00:00:00Z"
+	resp, body := get(t, s, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if resp.StatusCode != http.StatusOK || body["commit"] != "abc1234" || body["build_time"] != "2026-01-01T00:00:00Z" {
+		t.Fatalf("injected: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestReadinessReportsDraining(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	if resp, body := get(t, s, httptest.NewRequest(http.MethodGet, "/ready", nil)); resp.StatusCode != http.StatusOK || body["status"] != "ready" {
+		t.Fatalf("before drain: %d %v", resp.StatusCode, body)
+	}
+	s.API.Drain()
+	if resp, body := get(t, s, httptest.NewRequest(http.MethodGet, "/ready", nil)); resp.StatusCode != http.StatusServiceUnavailable || body["status"] != "draining" {
+		t.Fatalf("while draining: %d %v", resp.StatusCode, body)
+	}
+	// Liveness is unaffected, so the instance isn't killed before it drains
+	if resp, _ := get(t, s, httptest.NewRequest(http.MethodGet, "/health", nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("health while draining: %d", resp.StatusCode)
+	}
+}
+
+// request builds a JSON request, authenticated when token is set
+func request(t *testing.T, method, target, token string, body interface{}) *http.Request {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, r)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+type codeNotifier struct{ code string }
+
+func (n *codeNotifier) SendOTP(_ context.Context, _, _, code string) error {
+	n.code = code
+	return nil
+}
+
+// signUp registers identifier over HTTP and returns its user ID and token
+func signUp(t *testing.T, s *Server, identifier string) (string, string) {
+	t.Helper()
+	notifier := &codeNotifier{}
+	s.API.OTPService.Notifier = notifier
+	if resp, body := get(t, s, request(t, http.MethodPost, "/auth/register", "", map[string]string{"identifier": identifier})); resp.StatusCode != http.StatusOK || notifier.code == "" {
+		t.Fatalf("register: %d %v", resp.StatusCode, body)
+	}
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := get(t, s, request(t, http.MethodPost, "/auth/verify-2fa", "", map[string]string{
+		"identifier":      identifier,
+		"otp":             notifier.code,
+		"identity_pubkey": base64.StdEncoding.EncodeToString(identity.PublicKey().Bytes()),
+	}))
+	userID, _ := body["user_id"].(string)
+	token, _ := body["token"].(string)
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("verify: %d %v", resp.StatusCode, body)
+	}
+	return userID, token
+}
+
+// TestRegisterAndFetchBundle drives the full route table against the
+// in-memory database: sign up over HTTP, then fetch a seeded user's bundle
+func TestRegisterAndFetchBundle(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	bob := dbtest.SeedUser(t, s.API.DB, "bob")
+	dbtest.SeedKeys(t, s.API.DB, bob, 1)
+	_, token := signUp(t, s, "alice@example.com")
+
+	if resp, _ := get(t, s, request(t, http.MethodGet, "/api/keys/bundle/"+bob.ID.String(), "", nil)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bundle without token: %d", resp.StatusCode)
+	}
+	resp, body := get(t, s, request(t, http.MethodGet, "/api/keys/bundle/"+bob.ID.String(), token, nil))
+	if resp.StatusCode != http.StatusOK || body["user_id"] != bob.ID.String() || body["one_time_prekey_available"] != true {
+		t.Fatalf("bundle: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestOpenAPISpecCoversEveryRoute(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	resp, spec := get(t, s, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if resp.StatusCode != http.StatusOK || spec["openapi"] != "3.0.3" {
+		t.Fatalf("spec: %d %v", resp.StatusCode, spec["openapi"])
+	}
+	paths := spec["paths"].(map[string]interface{})
+
+	served := map[string]bool{}
+	for _, r := range s.App.GetRoutes(true) {
+		if r.Method == http.MethodHead || r.Path == "/openapi.json" {
+			continue
+		}
+		path := openAPIPath(r.Path)
+		served[r.Method+" "+path] = true
+		op, _ := paths[path].(map[string]interface{})
+		if op[strings.ToLower(r.Method)] == nil {
+			t.Errorf("%s %s is not in the spec", r.Method, r.Path)
+		}
+	}
+	if len(served) == 0 {
+		t.Fatal("no routes registered")
+	}
+	for path, ops := range paths {
+		for method := range ops.(map[string]interface{}) {
+			if !served[strings.ToUpper(method)+" "+path] {
+				t.Errorf("spec documents %s %s, which isn't routed", method, path)
+			}
+		}
+	}
+
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	for _, name := range []string{"WSClientMessage", "WSServerEvent"} {
+		if schemas[name] == nil {
+			t.Errorf("WebSocket schema %s missing", name)
+		}
+	}
+}
+
+// openAPIPath rewrites Fiber ":param" segments to OpenAPI "{param}"
+func openAPIPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		if strings.HasPrefix(s, ":") {
+			segs[i] = "{" + strings.TrimSuffix(s[1:], "?") + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func TestCORSOriginsAreApplied(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CORSAllowOrigins = []string{"https://chat.example.com"}
+	s := newTestServer(t, cfg)
+	preflight := func(origin string) string {
+		req := httptest.NewRequest(http.MethodOptions, "/api/keys/pins", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		resp, _ := get(t, s, req)
+		return resp.Header.Get("Access-Control-Allow-Origin")
+	}
+	if got := preflight("https://chat.example.com"); got != "https://chat.example.com" {
+		t.Fatalf("allowed origin: Access-Control-Allow-Origin = %q", got)
+	}
+	if got := preflight("https://evil.example.com"); got != "" {
+		t.Fatalf("other origin: Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestCheckUsernameIsRateLimited(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CheckUsernameRateLimit = 3
+	cfg.RateLimitWindowSec = 1
+	s := newTestServer(t, cfg)
+	lookup := func() (*http.Response, map[string]interface{}) {
+		return get(t, s, httptest.NewRequest(http.MethodGet, "/auth/check-username?username=alice", nil))
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp, body := lookup(); resp.StatusCode != http.StatusOK || body["available"] != true {
+			t.Fatalf("lookup %d: %d %v", i, resp.StatusCode, body)
+		}
+	}
+	resp, body := lookup()
+	if resp.StatusCode != http.StatusTooManyRequests || body["error"] != "too many lookups, slow down" || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("burst: %d %v, Retry-After %q", resp.StatusCode, body, resp.Header.Get("Retry-After"))
+	}
+
+	// The limiter's clock ticks in whole seconds, so one window can take
+	// up to two to roll over
+	time.Sleep(2100 * time.Millisecond)
+	if resp, body := lookup(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("spaced lookup: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		port, host, target, want string
+	}{
+		{"8443", "chat.example.com:8080", "/auth/register?x=1", "https://chat.example.com:8443/auth/register?x=1"},
+		{"443", "chat.example.com", "/", "https://chat.example.com/"},
+		{"443", "chat.example.com:80", "/health", "https://chat.example.com/health"},
+		{"8443", "[::1]:8080", "/api/me", "https://[::1]:8443/api/me"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		httpsRedirect(tc.port).ServeHTTP(rec, req)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s%s to port %s: %d %q, want %q", tc.host, tc.target, tc.port, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+func TestRequireHTTPSRejectsPlainHTTP(t *testing.T) {
+	cfg := testConfig(t)
+	// App.Test requests come from 0.0.0.0; trust it as the proxy
+	cfg.TrustedProxies = []string{"0.0.0.0"}
+	s := newTestServer(t, cfg)
+	userID, token := signUp(t, s, "alice@example.com")
+	cfg.RequireHTTPS = true
+
+	overHTTPS := func(req *http.Request) *http.Request {
+		req.Header.Set("X-Forwarded-Proto", "https")
+		return req
+	}
+	register := map[string]string{"identifier": "bob@example.com"}
+	for name, tc := range map[string]struct {
+		req      *http.Request
+		rejected bool
+	}{
+		"auth over http":         {request(t, http.MethodPost, "/auth/register", "", register), true},
+		"key upload over http":   {request(t, http.MethodPost, "/api/keys/prekeys/upload", token, map[string]string{}), true},
+		"key rotation over http": {request(t, http.MethodPost, "/api/keys/signed-prekey", token, map[string]string{}), true},
+		"auth over https":        {overHTTPS(request(t, http.MethodPost, "/auth/register", "", register)), false},
+		"key upload over https":  {overHTTPS(request(t, http.MethodPost, "/api/keys/prekeys/upload", token, map[string]string{})), false},
+		// Routes without keys or credentials in them stay reachable
+		"key status over http":   {request(t, http.MethodGet, "/api/keys/status/"+userID, token, nil), false},
+		"devices over http":      {request(t, http.MethodGet, "/api/me/devices", token, nil), false},
+		"health check over http": {httptest.NewRequest(http.MethodGet, "/health", nil), false},
+	} {
+		resp, body := get(t, s, tc.req)
+		rejected := resp.StatusCode == http.StatusBadRequest && body["error"] == "https_required"
+		if rejected != tc.rejected {
+			t.Errorf("%s: %d %v", name, resp.StatusCode, body)
+		}
+	}
+
+	// Anyone else claiming HTTPS is still on plain HTTP
+	untrusted := *cfg
+	untrusted.TrustedProxies = nil
+	resp, body := get(t, newTestServer(t, &untrusted), overHTTPS(request(t, http.MethodPost, "/auth/register", "", register)))
+	if resp.StatusCode != http.StatusBadRequest || body["error"] != "https_required" {
+		t.Fatalf("spoofed X-Forwarded-Proto: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	want := map[string]string{
+		"Content-Type":            "application/json",
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+		"Referrer-Policy":         "no-referrer",
+	}
+	// Successes, errors from handlers and errors from the router all carry them
+	for _, target := range []string{"/health", "/api/keys/pins", "/no-such-route"} {
+		resp, _ := get(t, s, httptest.NewRequest(http.MethodGet, target, nil))
+		for name, value := range want {
+			if got := resp.Header.Get(name); !strings.HasPrefix(got, value) {
+				t.Errorf("%s: %s = %q, want %q", target, name, got, value)
+			}
+		}
+		if hsts := resp.Header.Get("Strict-Transport-Security"); hsts != "" {
+			t.Errorf("%s: HSTS sent without TLS: %q", target, hsts)
+		}
+	}
+
+	// With TLS configured, HTTPS responses also carry HSTS
+	cfg := testConfig(t)
+	cfg.TLSCertPath, cfg.TLSKeyPath = "cert.pem", "key.pem"
+	cfg.TrustedProxies = []string{"0.0.0.0"}
+	s = newTestServer(t, cfg)
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	resp, _ := get(t, s, req)
+	if hsts := resp.Header.Get("Strict-Transport-Security"); !strings.HasPrefix(hsts, "max-age=63072000") {
+		t.Fatalf("HSTS = %q", hsts)
+	}
+}
+
+// listen serves s on a loopback port until the test ends and returns its address
+func listen(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Serving through fasthttp directly skips Fiber's startup banner
+	go s.App.Server().Serve(ln)
+	t.Cleanup(func() { s.App.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestRequestBodyErrors(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HTTPBodyLimitBytes = 1024
+	cfg.HTTPRouteLimits = nil
+	s := newTestServer(t, cfg)
+	send := func(body string) (*http.Response, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return get(t, s, req)
+	}
+
+	if resp, body := send(""); resp.StatusCode != http.StatusBadRequest || body["error"] != "body required" {
+		t.Fatalf("empty: %d %v", resp.StatusCode, body)
+	}
+	if resp, body := send(`{"identifier": `); resp.StatusCode != http.StatusBadRequest || body["error"] != "invalid request" || body["detail"] == nil {
+		t.Fatalf("malformed: %d %v", resp.StatusCode, body)
+	}
+	if resp, body := send(`{"identifier": 7}`); resp.StatusCode != http.StatusBadRequest || body["field"] != "identifier" {
+		t.Fatalf("wrong type: %d %v", resp.StatusCode, body)
+	}
+
+	// Fiber refuses an oversized body while reading it, before any handler,
+	// so this needs a real connection
+	oversized := `{"identifier": "` + strings.Repeat("a", 2048) + `"}`
+	resp, err := http.Post("http://"+listen(t, s)+"/auth/register", "application/json", strings.NewReader(oversized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized: %d", resp.StatusCode)
+	}
+}
+
+func TestRoutesEnforceTheirBodyLimits(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HTTPBodyLimitBytes = 2048
+	cfg.HTTPRouteLimits = map[string]config.RouteLimit{
+		"POST /auth/register":           {BodyBytes: 256},
+		"POST /api/keys/prekeys/upload": {BodyBytes: 8192},
+	}
+	s := newTestServer(t, cfg)
+	_, token := signUp(t, s, "alice@example.com")
+	// A JSON body of exactly n bytes
+	padded := func(n int) map[string]string {
+		return map[string]string{"identifier": strings.Repeat("a", n-len(`{"identifier":""}`))}
+	}
+
+	for _, tc := range []struct {
+		route, target, token string
+		size                 int
+		tooLarge             bool
+	}{
+		// A tight auth profile, below the global limit
+		{"register", "/auth/register", "", 256, false},
+		{"register", "/auth/register", "", 257, true},
+		// Routes without a profile keep the global limit
+		{"verify", "/auth/verify-2fa", "", 2048, false},
+		{"verify", "/auth/verify-2fa", "", 2049, true},
+		// Prekey uploads may go past the global limit, up to their own
+		{"upload", "/api/keys/prekeys/upload", token, 8192, false},
+	} {
+		resp, body := get(t, s, request(t, http.MethodPost, tc.target, tc.token, padded(tc.size)))
+		if got := resp.StatusCode == http.StatusRequestEntityTooLarge; got != tc.tooLarge {
+			t.Fatalf("%s with %d bytes: %d %v", tc.route, tc.size, resp.StatusCode, body)
+		}
+	}
+
+	// Past the largest profile Fiber refuses the body while reading it,
+	// which needs a real connection
+	b, _ := json.Marshal(padded(8193))
+	req, _ := http.NewRequest(http.MethodPost, "http://"+listen(t, s)+"/api/keys/prekeys/upload", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload past its limit: %d", resp.StatusCode)
+	}
+}
+
+func TestRouteTimeoutCancelsHandler(t *testing.T) {
+	app := fiber.New()
+	slow := func(c *fiber.Ctx) error {
+		select {
+		case <-c.UserContext().Done():
+			// What a handler does with a cancelled query
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "database error"})
+		case <-time.After(time.Second):
+			return c.SendString("done")
+		}
+	}
+	app.Get("/bounded", routeLimiter(config.RouteLimit{Timeout: 20 * time.Millisecond}), slow)
+	app.Get("/unbounded", routeLimiter(config.RouteLimit{}), slow)
+
+	start := time.Now()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/bounded", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("bounded: %d after %v", resp.StatusCode, time.Since(start))
+	}
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/unbounded", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unbounded: %d", resp.StatusCode)
+	}
+}
+
+func TestStalledBodyIsCutOff(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HTTPReadTimeoutSec = 1
+	conn, err := net.Dial("tcp", listen(t, newTestServer(t, cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Promise a body and never finish sending it
+	fmt.Fprint(conn, "POST /auth/register HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"identifier\"")
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if waited := time.Since(start); waited > 3*time.Second {
+		t.Fatalf("stalled request held the connection for %v", waited)
+	}
+}
+
+func TestKeylessUserIsBlockedFromMatchingAndMessaging(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	userID, token := signUp(t, s, "alice@example.com")
+	if err := s.API.DB.Model(&models.User{}).Where("id = ?", userID).Update("identity_pub_key", []byte{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/api/match/enqueue", "/api/conversations"} {
+		resp, body := get(t, s, request(t, http.MethodPost, target, token, map[string]interface{}{"tags": []string{"go"}}))
+		if resp.StatusCode != http.StatusConflict || body["error"] != "keys_not_ready" {
+			t.Fatalf("%s: %d %v", target, resp.StatusCode, body)
+		}
+	}
+	if _, ok := s.API.Matchmaker.Position(uuid.FromStringOrNil(userID)); ok {
+		t.Fatal("keyless user was queued")
+	}
+	// Routes that set the keys up stay reachable
+	if resp, body := get(t, s, request(t, http.MethodGet, "/api/keys/pins", token, nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pins: %d %v", resp.StatusCode, body)
+	}
+
+	// A user with an identity key gets past the check
+	_, token = signUp(t, s, "bob@example.com")
+	if resp, body := get(t, s, request(t, http.MethodPost, "/api/match/enqueue", token, map[string]interface{}{"tags": []string{"go"}})); resp.StatusCode == http.StatusConflict {
+		t.Fatalf("enqueue with keys: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestRepeatedEnqueuesKeepOneQueueEntry(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MatchEnqueueRateLimit = 5
+	s := newTestServer(t, cfg)
+	userID, token := signUp(t, s, "alice@example.com")
+	_, bobToken := signUp(t, s, "bob@example.com")
+	enqueue := func(token string) (*http.Response, map[string]interface{}) {
+		return get(t, s, request(t, http.MethodPost, "/api/match/enqueue", token, map[string]string{"tag_hash": "go"}))
+	}
+
+	// Fired at once, as a retrying client would
+	type result struct {
+		status int
+		err    error
+	}
+	results := make(chan result, cfg.MatchEnqueueRateLimit)
+	for i := 0; i < cfg.MatchEnqueueRateLimit; i++ {
+		req := request(t, http.MethodPost, "/api/match/enqueue", token, map[string]string{"tag_hash": "go"})
+		go func() {
+			resp, _, err := tryGet(s, req)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			results <- result{status: resp.StatusCode}
+		}()
+	}
+	for i := 0; i < cfg.MatchEnqueueRateLimit; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("enqueue %d: %v", i, r.err)
+		}
+		if r.status != http.StatusOK {
+			t.Fatalf("enqueue %d: %d", i, r.status)
+		}
+	}
+	if waiting := s.API.Matchmaker.Stats().Waiting; waiting != 1 {
+		t.Fatalf("%d queue entries after repeated enqueues, want 1", waiting)
+	}
+	if _, ok := s.API.Matchmaker.Position(uuid.FromStringOrNil(userID)); !ok {
+		t.Fatal("alice not queued")
+	}
+
+	// Past the limit the user is told to slow down; others are unaffected
+	if resp, body := enqueue(token); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: %d %v", resp.StatusCode, body)
+	}
+	if resp, body := enqueue(bobToken); resp.StatusCode != http.StatusOK || body["status"] != "queued" {
+		t.Fatalf("bob: %d %v", resp.StatusCode, body)
+	}
+	if waiting := s.API.Matchmaker.Stats().Waiting; waiting != 2 {
+		t.Fatalf("%d queue entries, want 2", waiting)
+	}
+}
+
+// rankSumZ is the Mann-Whitney U statistic of a against b as a z-score. Near
+// zero the samples look drawn from one distribution; it doesn't assume the
+// timings are normal, which jitter and scheduling noise make them not.
+func rankSumZ(a, b []time.Duration) float64 {
+	var rankA float64
+	for _, x := range a {
+		// Rank of x in the pooled sample, with ties split evenly
+		below, ties := 0, 0
+		for _, pool := range [][]time.Duration{a, b} {
+			for _, y := range pool {
+				if y < x {
+					below++
+				} else if y == x {
+					ties++
+				}
+			}
+		}
+		rankA += float64(below) + float64(ties+1)/2
+	}
+	n1, n2 := float64(len(a)), float64(len(b))
+	u := rankA - n1*(n1+1)/2
+	return (u - n1*n2/2) / math.Sqrt(n1*n2*(n1+n2+1)/12)
+}
+
+func TestVerifyTimingDoesNotRevealIdentifiers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	cfg := testConfig(t)
+	cfg.RateLimitRequests = 1000
+	cfg.AuthJitterMs = 20
+	s := newTestServer(t, cfg)
+	s.API.OTPService.Notifier = &codeNotifier{}
+	if resp, body := get(t, s, request(t, http.MethodPost, "/auth/register", "", map[string]string{"identifier": "alice@example.com"})); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register: %d %v", resp.StatusCode, body)
+	}
+	timed := func(req *http.Request) time.Duration {
+		start := time.Now()
+		get(t, s, req)
+		return time.Since(start)
+	}
+	verify := func(identifier string) time.Duration {
+		return timed(request(t, http.MethodPost, "/auth/verify-2fa", "", map[string]string{"identifier": identifier, "otp": "000000x"}))
+	}
+
+	// Interleaved so drift in machine load hits both samples alike
+	const n = 15
+	var known, unknown, health []time.Duration
+	for i := 0; i < n; i++ {
+		known = append(known, verify("alice@example.com"))
+		unknown = append(unknown, verify(fmt.Sprintf("nobody-%d@example.com", i)))
+		health = append(health, timed(httptest.NewRequest(http.MethodGet, "/health", nil)))
+	}
+
+	// |z| > 3.3 happens by chance about once in a thousand runs
+	if z := rankSumZ(known, unknown); math.Abs(z) > 3.3 {
+		t.Fatalf("wrong code vs unknown identifier: z = %.2f\nknown:   %v\nunknown: %v", z, known, unknown)
+	}
+	// The statistic does tell apart requests that do different work
+	if z := rankSumZ(known, health); z < 3.3 {
+		t.Fatalf("verify vs health: z = %.2f, the comparison has no power", z)
+	}
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// incompleteAccountBatch bounds how many accounts one sweep deletes, so a
+// large backlog is worked off over several sweeps without a long transaction
+const incompleteAccountBatch = 500
+
+// incompleteAccount selects users who verified an identifier but never
+// registered a device or uploaded prekeys. Verification already stores the
+// identity key, so its presence says nothing about completion.
+const incompleteAccount = "NOT EXISTS (SELECT 1 FROM devices WHERE devices.user_id = users.id)" +
+	" AND NOT EXISTS (SELECT 1 FROM pre_keys WHERE pre_keys.user_id = users.id)" +
+	" AND NOT EXISTS (SELECT 1 FROM one_time_pre_keys WHERE one_time_pre_keys.user_id = users.id)"
+
+// AccountCleanup deletes accounts left incomplete for longer than MaxAge.
+// Accounts with any device or prekey are never touched.
+type AccountCleanup struct {
+	DB       *gorm.DB
+	Hub      *Hub
+	MaxAge   time.Duration
+	Interval time.Duration
+	Clock    Clock
+	// Audit is optional; nil skips recording deletions
+	Audit *AuditLog
+}
+
+func NewAccountCleanup(db *gorm.DB, hub *Hub, maxAge time.Duration) *AccountCleanup {
+	return &AccountCleanup{DB: db, Hub: hub, MaxAge: maxAge, Interval: time.Hour, Clock: RealClock{}}
+}
+
+// DeleteIncomplete removes up to incompleteAccountBatch incomplete accounts
+// created before MaxAge ago, with their registration sessions and anything
+// else that references them, and closes their sockets. It returns how many
+// accounts were deleted.
+func (a *AccountCleanup) DeleteIncomplete() (int, error) {
+	cutoff := a.Clock.Now().Add(-a.MaxAge)
+	var users []models.User
+	err := a.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id", "identifier").
+			Where("created_at < ?", cutoff).
+			Where(incompleteAccount).
+			Limit(incompleteAccountBatch).
+			Find(&users).Error; err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return nil
+		}
+		ids := make([]uuid.UUID, len(users))
+		for i, u := range users {
+			ids[i] = u.ID
+		}
+
+		// Delete the accounts first, re-checking the condition, so one that
+		// completed registration since the select keeps its keys
+		if err := tx.Where("id IN ?", ids).Where(incompleteAccount).Delete(&models.User{}).Error; err != nil {
+			return err
+		}
+		var kept []uuid.UUID
+		if err := tx.Model(&models.User{}).Where("id IN ?", ids).Pluck("id", &kept).Error; err != nil {
+			return err
+		}
+		users = withoutUsers(users, kept)
+		if len(users) == 0 {
+			return nil
+		}
+		ids = ids[:0]
+		identifiers := make([]string, len(users))
+		for i, u := range users {
+			ids = append(ids, u.ID)
+			identifiers[i] = u.Identifier
+		}
+
+		deletes := []struct {
+			model interface{}
+			query string
+			args  []interface{}
+		}{
+			{&models.RegistrationSession{}, "identifier IN ?", []interface{}{identifiers}},
+			{&models.MatchProfile{}, "user_id IN ?", []interface{}{ids}},
+			{&models.IdentityPin{}, "user_id IN ? OR peer_id IN ?", []interface{}{ids, ids}},
+			{&models.SessionMarker{}, "user_id IN ? OR peer_id IN ?", []interface{}{ids, ids}},
+			{&models.ConversationMember{}, "user_id IN ?", []interface{}{ids}},
+			{&models.QueuedDelivery{}, "message_id IN (?)", []interface{}{tx.Model(&models.QueuedMessage{}).Select("id").Where("recipient_id IN ? OR sender_id IN ?", ids, ids)}},
+			{&models.QueuedMessage{}, "recipient_id IN ? OR sender_id IN ?", []interface{}{ids, ids}},
+			{&models.OneTimePreKey{}, "user_id IN ?", []interface{}{ids}},
+			{&models.PreKey{}, "user_id IN ?", []interface{}{ids}},
+		}
+		for _, d := range deletes {
+			if err := tx.Where(d.query, d.args...).Delete(d.model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		a.Hub.Disconnect(u.ID, CloseAccountDeleted)
+		a.Audit.Record(AuditEntry{Event: AuditAccountDeleted, UserID: u.ID, Detail: "incomplete"})
+	}
+	return len(users), nil
+}
+
+// withoutUsers drops the users whose IDs are in kept
+func withoutUsers(users []models.User, kept []uuid.UUID) []models.User {
+	if len(kept) == 0 {
+		return users
+	}
+	skip := make(map[uuid.UUID]bool, len(kept))
+	for _, id := range kept {
+		skip[id] = true
+	}
+	out := users[:0]
+	for _, u := range users {
+		if !skip[u.ID] {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// Run sweeps every Interval until ctx is cancelled; a zero MaxAge disables it
+func (a *AccountCleanup) Run(ctx context.Context) {
+	if a.MaxAge <= 0 || a.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := a.DeleteIncomplete()
+			if err != nil {
+				log.Printf("incomplete account cleanup error: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("removed %d incomplete accounts", n)
+			}
+		}
+	}
+}
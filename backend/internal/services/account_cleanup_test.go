@@ -0,0 +1,58 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func TestDeleteIncompletePurgesOnlyAccountsWithoutKeys(t *testing.T) {
+	d := dbtest.New(t)
+	// Every seeded user has an identity key, as Verify2FA leaves them
+	stale := dbtest.SeedUser(t, d, "stale")
+	complete := dbtest.SeedUser(t, d, "complete")
+	dbtest.SeedKeys(t, d, complete, 2)
+	prekeysOnly := dbtest.SeedUser(t, d, "prekeys-only")
+	if err := d.Create(&models.OneTimePreKey{ID: uuid.Must(uuid.NewV4()), UserID: prekeysOnly.ID, DeviceID: "device-1", PreKey: []byte{1}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(&models.RegistrationSession{ID: uuid.Must(uuid.NewV4()), Identifier: stale.Identifier}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := NewAccountCleanup(d, NewHub(), 24*time.Hour)
+	cleanup.Clock = NewManualClock(time.Now().Add(25 * time.Hour))
+	// A user created "now" by the manual clock is too young to purge
+	fresh := models.User{ID: uuid.Must(uuid.NewV4()), Identifier: "fresh", IdentityPubKey: make([]byte, 32), CreatedAt: cleanup.Clock.Now()}
+	if err := d.Create(&fresh).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := cleanup.DeleteIncomplete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("deleted %d accounts, want 1", n)
+	}
+
+	var remaining []string
+	d.Model(&models.User{}).Order("identifier").Pluck("identifier", &remaining)
+	if len(remaining) != 3 || remaining[0] != "complete" || remaining[1] != "fresh" || remaining[2] != "prekeys-only" {
+		t.Fatalf("remaining users = %v", remaining)
+	}
+	var sessions int64
+	d.Model(&models.RegistrationSession{}).Where("identifier = ?", stale.Identifier).Count(&sessions)
+	if sessions != 0 {
+		t.Fatalf("%d registration sessions left for the purged account", sessions)
+	}
+
+	// A second sweep finds nothing more
+	if n, err := cleanup.DeleteIncomplete(); err != nil || n != 0 {
+		t.Fatalf("second sweep: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// Security events recorded in the audit log
+const (
+	AuditLogin           = "login"
+	AuditOTPFailed       = "2fa_failed"
+	AuditKeyUpload       = "key_upload"
+	AuditDeviceAdded     = "device_added"
+	AuditIdentityChanged = "identity_changed"
+	AuditAccountDeleted  = "account_deleted"
+)
+
+// auditRetries bounds how often Record retries when another writer took the
+// next sequence number first
+const auditRetries = 5
+
+// AuditEntry is what a caller records; the log fills in the sequence number,
+// time and hashes. Detail must never hold secrets or message content.
+type AuditEntry struct {
+	Event  string
+	UserID uuid.UUID
+	IP     string
+	Detail string
+}
+
+// AuditLog appends security events to the audit_log table as a hash chain.
+// Each entry's hash is an HMAC, under Key, of its fields and the previous
+// entry's hash; without a Key the chain still catches edits by anyone who
+// doesn't recompute every later hash.
+type AuditLog struct {
+	DB    *gorm.DB
+	Key   []byte
+	Clock Clock
+
+	// mu keeps this process's writers from racing for the same sequence
+	// number; writers in other processes are caught by the primary key
+	mu sync.Mutex
+}
+
+func NewAuditLog(db *gorm.DB, key []byte) *AuditLog {
+	return &AuditLog{DB: db, Key: key, Clock: RealClock{}}
+}
+
+// Record appends e to the log. It is a no-op on a nil receiver. Failures are
+// logged rather than returned so auditing never fails the action it records.
+func (l *AuditLog) Record(e AuditEntry) {
+	if l == nil {
+		return
+	}
+	if err := l.append(e); err != nil {
+		log.Printf("audit log write error (%s): %v", e.Event, err)
+	}
+}
+
+func (l *AuditLog) append(e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ev := models.AuditEvent{
+		Event:  e.Event,
+		IP:     e.IP,
+		Detail: e.Detail,
+		// Stored to the microsecond so the hash survives a database round trip
+		CreatedAt: l.Clock.Now().UTC().Truncate(time.Microsecond),
+	}
+	if e.UserID != uuid.Nil {
+		id := e.UserID
+		ev.UserID = &id
+	}
+
+	var err error
+	for i := 0; i < auditRetries; i++ {
+		err = l.DB.Transaction(func(tx *gorm.DB) error {
+			var last models.AuditEvent
+			err := tx.Select("seq", "hash").Order("seq DESC").Limit(1).Take(&last).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			ev.Seq = last.Seq + 1
+			ev.PrevHash = last.Hash
+			ev.Hash = l.hash(ev)
+			return tx.Create(&ev).Error
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// hash computes the chained HMAC for ev from its fields and PrevHash
+func (l *AuditLog) hash(ev models.AuditEvent) string {
+	userID := ""
+	if ev.UserID != nil {
+		userID = ev.UserID.String()
+	}
+	mac := hmac.New(sha256.New, l.Key)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s\n%d\n%s", ev.Seq, ev.Event, userID, ev.IP, ev.Detail, ev.CreatedAt.UnixMicro(), ev.PrevHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditFilter narrows a Query; zero fields don't filter
+type AuditFilter struct {
+	Event  string
+	UserID uuid.UUID
+	Since  time.Time
+	Until  time.Time
+}
+
+// Query returns a page of matching entries, newest first
+func (l *AuditLog) Query(f AuditFilter, limit, offset int) ([]models.AuditEvent, error) {
+	q := l.DB.Order("seq DESC").Limit(limit).Offset(offset)
+	if f.Event != "" {
+		q = q.Where("event = ?", f.Event)
+	}
+	if f.UserID != uuid.Nil {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	var events []models.AuditEvent
+	err := q.Find(&events).Error
+	return events, err
+}
+
+// auditVerifyBatch bounds how many entries Verify loads at once
+const auditVerifyBatch = 1000
+
+// Verify walks the whole chain in order and returns the sequence number of
+// the first entry whose hash or link doesn't check out, or 0 if the chain is
+// intact. A gap in the sequence counts as a break at the entry after it;
+// dropping the newest entries can't be detected from the chain alone.
+func (l *AuditLog) Verify() (brokenAt int64, checked int64, err error) {
+	prev := models.AuditEvent{}
+	for {
+		var batch []models.AuditEvent
+		if err := l.DB.Where("seq > ?", prev.Seq).Order("seq").Limit(auditVerifyBatch).Find(&batch).Error; err != nil {
+			return 0, checked, err
+		}
+		for _, ev := range batch {
+			if ev.Seq != prev.Seq+1 || ev.PrevHash != prev.Hash || !hmac.Equal([]byte(ev.Hash), []byte(l.hash(ev))) {
+				return ev.Seq, checked, nil
+			}
+			checked++
+			prev = ev
+		}
+		if len(batch) < auditVerifyBatch {
+			return 0, checked, nil
+		}
+	}
+}
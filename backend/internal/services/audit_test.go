@@ -0,0 +1,70 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func TestAuditLogChainDetectsTampering(t *testing.T) {
+	d := dbtest.New(t)
+	audit := NewAuditLog(d, []byte("audit-key"))
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	audit.Clock = clock
+	alice := uuid.Must(uuid.NewV4())
+	bob := uuid.Must(uuid.NewV4())
+	for _, e := range []AuditEntry{
+		{Event: AuditLogin, UserID: alice, IP: "10.0.0.1"},
+		{Event: AuditOTPFailed, UserID: bob, IP: "10.0.0.2"},
+		{Event: AuditKeyUpload, UserID: alice, IP: "10.0.0.1", Detail: "device_id=phone"},
+		{Event: AuditAccountDeleted, UserID: bob, Detail: "incomplete"},
+	} {
+		audit.Record(e)
+		clock.Advance(time.Minute)
+	}
+
+	if brokenAt, checked, err := audit.Verify(); err != nil || brokenAt != 0 || checked != 4 {
+		t.Fatalf("intact chain: broken at %d, checked %d, %v", brokenAt, checked, err)
+	}
+	events, err := audit.Query(AuditFilter{UserID: alice}, 10, 0)
+	if err != nil || len(events) != 2 || events[0].Event != AuditKeyUpload || events[1].Event != AuditLogin {
+		t.Fatalf("alice's events: %v, %v", events, err)
+	}
+	since := time.Date(2026, 1, 1, 12, 1, 0, 0, time.UTC)
+	events, err = audit.Query(AuditFilter{Event: AuditOTPFailed, Since: since}, 10, 0)
+	if err != nil || len(events) != 1 || events[0].Seq != 2 {
+		t.Fatalf("2FA failures since 12:01: %v, %v", events, err)
+	}
+
+	// Editing an entry breaks the chain at that entry
+	if err := d.Model(&models.AuditEvent{}).Where("seq = ?", 2).Update("ip", "10.9.9.9").Error; err != nil {
+		t.Fatal(err)
+	}
+	if brokenAt, _, err := audit.Verify(); err != nil || brokenAt != 2 {
+		t.Fatalf("edited entry: broken at %d, %v", brokenAt, err)
+	}
+	d.Model(&models.AuditEvent{}).Where("seq = ?", 2).Update("ip", "10.0.0.2")
+	if brokenAt, _, _ := audit.Verify(); brokenAt != 0 {
+		t.Fatalf("restored entry: broken at %d", brokenAt)
+	}
+
+	// So does removing one, at the entry after the gap
+	if err := d.Delete(&models.AuditEvent{}, "seq = ?", 3).Error; err != nil {
+		t.Fatal(err)
+	}
+	if brokenAt, _, err := audit.Verify(); err != nil || brokenAt != 4 {
+		t.Fatalf("removed entry: broken at %d, %v", brokenAt, err)
+	}
+
+	// Without the key the hashes can't be recomputed to match
+	d.Where("seq > 0").Delete(&models.AuditEvent{})
+	audit.Record(AuditEntry{Event: AuditLogin, UserID: alice})
+	forger := NewAuditLog(d, []byte("guessed-key"))
+	if brokenAt, _, err := forger.Verify(); err != nil || brokenAt != 1 {
+		t.Fatalf("wrong key: broken at %d, %v", brokenAt, err)
+	}
+}
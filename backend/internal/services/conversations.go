@@ -0,0 +1,237 @@
+package services
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// ConversationService manages group membership and the offline message queue.
+// The server only ever sees ciphertext; senders encrypt for each recipient.
+type ConversationService struct {
+	DB *gorm.DB
+}
+
+func NewConversationService(db *gorm.DB) *ConversationService {
+	return &ConversationService{DB: db}
+}
+
+// Create makes a conversation owned by creator with the given members. The
+// creator is always a member; duplicates are ignored.
+func (s *ConversationService) Create(creator uuid.UUID, memberIDs []uuid.UUID) (*models.Conversation, error) {
+	conv := &models.Conversation{
+		ID:        uuid.Must(uuid.NewV4()),
+		CreatedBy: creator,
+	}
+	seen := map[uuid.UUID]bool{creator: true}
+	conv.Members = append(conv.Members, models.ConversationMember{ConversationID: conv.ID, UserID: creator})
+	for _, id := range memberIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		conv.Members = append(conv.Members, models.ConversationMember{ConversationID: conv.ID, UserID: id})
+	}
+	if err := s.DB.Create(conv).Error; err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// IsMember reports whether userID belongs to the conversation
+func (s *ConversationService) IsMember(convID, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.DB.Model(&models.ConversationMember{}).
+		Where("conversation_id = ? AND user_id = ?", convID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// MemberIDs lists the conversation's members
+func (s *ConversationService) MemberIDs(convID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := s.DB.Model(&models.ConversationMember{}).
+		Where("conversation_id = ?", convID).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// SharesConversation reports whether a and b are members of a common conversation
+func (s *ConversationService) SharesConversation(a, b uuid.UUID) (bool, error) {
+	var n int64
+	err := s.DB.Model(&models.ConversationMember{}).
+		Where("user_id = ? AND conversation_id IN (?)", b, s.DB.Model(&models.ConversationMember{}).Select("conversation_id").Where("user_id = ?", a)).
+		Limit(1).Count(&n).Error
+	return n > 0, err
+}
+
+// ListForUser returns the conversations userID belongs to, with members
+func (s *ConversationService) ListForUser(userID uuid.UUID) ([]models.Conversation, error) {
+	var convs []models.Conversation
+	err := s.DB.Preload("Members").
+		Where("id IN (?)", s.DB.Model(&models.ConversationMember{}).Select("conversation_id").Where("user_id = ?", userID)).
+		Order("created_at desc").
+		Find(&convs).Error
+	return convs, err
+}
+
+// SetMute mutes the conversation for userID until until, or indefinitely
+// when until is nil. It returns gorm.ErrRecordNotFound if userID is not a
+// member.
+func (s *ConversationService) SetMute(convID, userID uuid.UUID, until *time.Time) error {
+	return s.updateMember(convID, userID, map[string]interface{}{"muted": true, "muted_until": until})
+}
+
+// Unmute clears any mute userID has on the conversation. It returns
+// gorm.ErrRecordNotFound if userID is not a member.
+func (s *ConversationService) Unmute(convID, userID uuid.UUID) error {
+	return s.updateMember(convID, userID, map[string]interface{}{"muted": false, "muted_until": nil})
+}
+
+func (s *ConversationService) updateMember(convID, userID uuid.UUID, updates map[string]interface{}) error {
+	res := s.DB.Model(&models.ConversationMember{}).
+		Where("conversation_id = ? AND user_id = ?", convID, userID).
+		Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge deletes the conversation, its membership and any ciphertext still
+// queued for it, returning the members it had
+func (s *ConversationService) Purge(convID uuid.UUID) ([]uuid.UUID, error) {
+	var members []uuid.UUID
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.ConversationMember{}).Where("conversation_id = ?", convID).Pluck("user_id", &members).Error; err != nil {
+			return err
+		}
+		queued := tx.Model(&models.QueuedMessage{}).Select("id").Where("conversation_id = ?", convID)
+		if err := tx.Where("message_id IN (?)", queued).Delete(&models.QueuedDelivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("conversation_id = ?", convID).Delete(&models.QueuedMessage{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("conversation_id = ?", convID).Delete(&models.ConversationMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", convID).Delete(&models.Conversation{}).Error
+	})
+	return members, err
+}
+
+// QueueMessage stores ciphertext for an offline recipient until each of their
+// devices has been sent it
+func (s *ConversationService) QueueMessage(recipient, sender uuid.UUID, convID *uuid.UUID, payload []byte) error {
+	return s.DB.Create(&models.QueuedMessage{
+		ID:             uuid.Must(uuid.NewV4()),
+		RecipientID:    recipient,
+		SenderID:       sender,
+		ConversationID: convID,
+		Payload:        payload,
+	}).Error
+}
+
+// Pending returns the recipient's queued messages that deviceID hasn't been
+// sent yet, oldest first
+func (s *ConversationService) Pending(recipient uuid.UUID, deviceID string) ([]models.QueuedMessage, error) {
+	var msgs []models.QueuedMessage
+	delivered := s.DB.Model(&models.QueuedDelivery{}).Select("message_id").Where("device_id = ?", deviceID)
+	err := s.DB.Where("recipient_id = ? AND id NOT IN (?)", recipient, delivered).
+		Order("created_at asc").Order("id").
+		Find(&msgs).Error
+	return msgs, err
+}
+
+// MarkDelivered records that deviceID was sent the queued message and
+// deletes the message once every device the recipient has registered was
+// sent it. A recipient without registered devices needs only one delivery.
+func (s *ConversationService) MarkDelivered(recipient, msgID uuid.UUID, deviceID string, at time.Time) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		delivery := models.QueuedDelivery{MessageID: msgID, DeviceID: deviceID, DeliveredAt: at}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery).Error; err != nil {
+			return err
+		}
+		var waiting int64
+		delivered := tx.Model(&models.QueuedDelivery{}).Select("device_id").Where("message_id = ?", msgID)
+		if err := tx.Model(&models.Device{}).Where("user_id = ? AND device_id NOT IN (?)", recipient, delivered).Count(&waiting).Error; err != nil {
+			return err
+		}
+		if waiting > 0 {
+			return nil
+		}
+		if err := tx.Where("message_id = ?", msgID).Delete(&models.QueuedDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", msgID).Delete(&models.QueuedMessage{}).Error
+	})
+}
+
+// MessageFilter narrows SearchQueued by metadata; zero fields match anything
+type MessageFilter struct {
+	ConversationID *uuid.UUID
+	SenderID       *uuid.UUID
+	Since          time.Time
+	Until          time.Time
+}
+
+// Backlog summarizes a recipient's queued messages
+type Backlog struct {
+	Count  int64
+	Bytes  int64
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Backlog counts recipient's queued messages and their payload bytes. Oldest
+// and Newest are zero when nothing is queued.
+func (s *ConversationService) Backlog(recipient uuid.UUID) (Backlog, error) {
+	var b Backlog
+	err := s.DB.Model(&models.QueuedMessage{}).
+		Select("COUNT(*) AS count, COALESCE(SUM(LENGTH(payload)), 0) AS bytes").
+		Where("recipient_id = ?", recipient).
+		Scan(&b).Error
+	if err != nil || b.Count == 0 {
+		return b, err
+	}
+	for _, end := range []struct {
+		order string
+		dst   *time.Time
+	}{{"created_at asc", &b.Oldest}, {"created_at desc", &b.Newest}} {
+		var m models.QueuedMessage
+		if err := s.DB.Select("created_at").Where("recipient_id = ?", recipient).Order(end.order).First(&m).Error; err != nil {
+			return b, err
+		}
+		*end.dst = m.CreatedAt
+	}
+	return b, nil
+}
+
+// SearchQueued lists recipient's stored messages matching f, newest first.
+// Only metadata columns are read; payloads stay in the database.
+func (s *ConversationService) SearchQueued(recipient uuid.UUID, f MessageFilter, limit, offset int) ([]models.QueuedMessage, error) {
+	q := s.DB.Select("id", "sender_id", "conversation_id", "created_at").Where("recipient_id = ?", recipient)
+	if f.ConversationID != nil {
+		q = q.Where("conversation_id = ?", *f.ConversationID)
+	}
+	if f.SenderID != nil {
+		q = q.Where("sender_id = ?", *f.SenderID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	var msgs []models.QueuedMessage
+	err := q.Order("created_at desc").Order("id").Limit(limit).Offset(offset).Find(&msgs).Error
+	return msgs, err
+}
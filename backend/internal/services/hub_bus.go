@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// Bus carries hub traffic between server instances. A hub without a bus
+// delivers only to its own connections, which is all a single-instance
+// deployment needs.
+type Bus interface {
+	Publish(ctx context.Context, msg BusMessage) error
+	// Subscribe registers handler for every message published by any
+	// instance, including this one, until ctx is done. It returns once the
+	// subscription is live; an error means nothing will be delivered.
+	Subscribe(ctx context.Context, handler func(BusMessage)) error
+}
+
+const (
+	busKindOnline  = "online"
+	busKindOffline = "offline"
+	busKindSync    = "sync"
+	busKindDeliver = "deliver"
+	busKindAck     = "ack"
+)
+
+// BusMessage is a presence announcement (online, offline, sync), a frame for
+// a user connected to the Target instance, or the Target's acknowledgement
+// of such a frame. Envelope holds the binary envelope encoding; Text is an
+// already-encoded JSON frame. A deliver with an ID asks for an ack carrying
+// the same ID and whether a local connection took the frame.
+type BusMessage struct {
+	Kind      string    `json:"kind"`
+	Origin    string    `json:"origin"`
+	Target    string    `json:"target,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	UserID    uuid.UUID `json:"user_id,omitempty"`
+	Queued    bool      `json:"queued,omitempty"`
+	Delivered bool      `json:"delivered,omitempty"`
+	Envelope  []byte    `json:"envelope,omitempty"`
+	Text      []byte    `json:"text,omitempty"`
+}
+
+// MemoryBus fans messages out to subscribers in the same process. It lets
+// several hubs share one process in tests and local setups.
+type MemoryBus struct {
+	mu   sync.RWMutex
+	subs map[int]func(BusMessage)
+	next int
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subs: make(map[int]func(BusMessage))}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, msg BusMessage) error {
+	b.mu.RLock()
+	handlers := make([]func(BusMessage), 0, len(b.subs))
+	for _, h := range b.subs {
+		handlers = append(handlers, h)
+	}
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, handler func(BusMessage)) error {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = handler
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// PostgresBusChannel is the LISTEN/NOTIFY channel shared by all instances
+const PostgresBusChannel = "securechat_hub"
+
+// ErrBusPayloadTooLarge is returned for frames that exceed the NOTIFY payload
+// limit; callers treat the recipient as unreachable and queue instead
+var ErrBusPayloadTooLarge = errors.New("bus payload too large")
+
+// postgresNotifyLimit leaves headroom under Postgres's 8000-byte NOTIFY cap
+const postgresNotifyLimit = 7900
+
+// PostgresBus uses LISTEN/NOTIFY on the application database, so running
+// several instances needs no extra infrastructure. NOTIFY payloads are
+// small; larger frames fail to publish and fall back to the offline queue.
+type PostgresBus struct {
+	DB  *gorm.DB
+	DSN string
+}
+
+func NewPostgresBus(db *gorm.DB, dsn string) *PostgresBus {
+	return &PostgresBus{DB: db, DSN: dsn}
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, msg BusMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(payload) > postgresNotifyLimit {
+		return ErrBusPayloadTooLarge
+	}
+	return b.DB.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", PostgresBusChannel, string(payload)).Error
+}
+
+// Subscribe holds a dedicated connection for LISTEN, reconnecting with
+// backoff if it drops. Notifications sent while reconnecting are lost.
+func (b *PostgresBus) Subscribe(ctx context.Context, handler func(BusMessage)) error {
+	conn, err := b.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		backoff := time.Second
+		for {
+			err := b.receive(ctx, conn, handler)
+			conn.Close(context.Background())
+			if ctx.Err() != nil {
+				return
+			}
+			for {
+				log.Printf("hub bus: listen failed: %v; retrying in %s", err, backoff)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+				if conn, err = b.listen(ctx); err == nil {
+					backoff = time.Second
+					break
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *PostgresBus) listen(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, b.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+PostgresBusChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (b *PostgresBus) receive(ctx context.Context, conn *pgx.Conn, handler func(BusMessage)) error {
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var msg BusMessage
+		if err := json.Unmarshal([]byte(n.Payload), &msg); err != nil {
+			log.Printf("hub bus: bad message: %v", err)
+			continue
+		}
+		handler(msg)
+	}
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+// filterBus wraps a bus, failing deliveries with deliverErr and silently
+// dropping messages of the kinds in drop
+type filterBus struct {
+	Bus
+	deliverErr error
+	drop       map[string]bool
+}
+
+func (b *filterBus) Publish(ctx context.Context, msg BusMessage) error {
+	if msg.Kind == busKindDeliver && b.deliverErr != nil {
+		return b.deliverErr
+	}
+	if b.drop[msg.Kind] {
+		return nil
+	}
+	return b.Bus.Publish(ctx, msg)
+}
+
+// twoHubs returns hubs for instances "a" and "b" sharing bus
+func twoHubs(t *testing.T, bus Bus) (*Hub, *Hub) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a, b := NewHub(), NewHub()
+	if err := a.EnableBus(ctx, bus, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.EnableBus(ctx, bus, "b"); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func register(t testing.TB, h *Hub, userID uuid.UUID, deviceID string) *Connection {
+	t.Helper()
+	c := &Connection{UserID: userID, DeviceID: deviceID, Send: make(chan Frame, 4), Binary: true}
+	if !h.Register(c) {
+		t.Fatal("register rejected")
+	}
+	return c
+}
+
+func testEnvelope() *Envelope {
+	return &Envelope{
+		Type:    EnvelopeTypeMessage,
+		Peer:    uuid.Must(uuid.NewV4()),
+		Queued:  true,
+		Payload: []byte("hello"),
+	}
+}
+
+func receive(t *testing.T, c *Connection) *Envelope {
+	t.Helper()
+	select {
+	case f := <-c.Send:
+		env, err := ParseEnvelope(f.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env
+	default:
+		t.Fatalf("%s got no frame", c.DeviceID)
+		return nil
+	}
+}
+
+func TestHubRelaysToOtherInstance(t *testing.T) {
+	a, b := twoHubs(t, NewMemoryBus())
+	user := uuid.Must(uuid.NewV4())
+	conn := register(t, b, user, "phone")
+
+	if !a.IsOnline(user) {
+		t.Fatal("user on b not online at a")
+	}
+	env := testEnvelope()
+	if !a.SendEnvelope(user, env) {
+		t.Fatal("relay not reported delivered")
+	}
+	got := receive(t, conn)
+	if got.Peer != env.Peer || !got.Queued || !bytes.Equal(got.Payload, env.Payload) {
+		t.Fatalf("relayed envelope = %+v", got)
+	}
+}
+
+func TestHubFansOutToEveryInstance(t *testing.T) {
+	a, b := twoHubs(t, NewMemoryBus())
+	user := uuid.Must(uuid.NewV4())
+	local := register(t, a, user, "laptop")
+	remote := register(t, b, user, "phone")
+
+	if !a.SendEnvelope(user, testEnvelope()) {
+		t.Fatal("not delivered")
+	}
+	receive(t, local)
+	receive(t, remote)
+}
+
+func TestHubRelayFailureIsUndelivered(t *testing.T) {
+	bus := &filterBus{Bus: NewMemoryBus(), deliverErr: ErrBusPayloadTooLarge}
+	a, b := twoHubs(t, bus)
+	user := uuid.Must(uuid.NewV4())
+	conn := register(t, b, user, "phone")
+
+	if a.SendEnvelope(user, testEnvelope()) {
+		t.Fatal("failed publish reported delivered")
+	}
+	if len(conn.Send) != 0 {
+		t.Fatal("frame reached the connection")
+	}
+}
+
+func TestHubRelayToGoneConnectionIsUndelivered(t *testing.T) {
+	// b's offline announcement is lost, so a still thinks the user is there
+	bus := &filterBus{Bus: NewMemoryBus(), drop: map[string]bool{busKindOffline: true}}
+	a, b := twoHubs(t, bus)
+	user := uuid.Must(uuid.NewV4())
+	b.Unregister(register(t, b, user, "phone"))
+
+	if !a.IsOnline(user) {
+		t.Fatal("expected stale presence at a")
+	}
+	if a.SendEnvelope(user, testEnvelope()) {
+		t.Fatal("relay without a connection reported delivered")
+	}
+}
+
+func TestHubOfflineClearsOnlyThatInstance(t *testing.T) {
+	bus := NewMemoryBus()
+	a, b := twoHubs(t, bus)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewHub()
+	if err := c.EnableBus(ctx, bus, "c"); err != nil {
+		t.Fatal(err)
+	}
+	user := uuid.Must(uuid.NewV4())
+	onB := register(t, b, user, "phone")
+	register(t, c, user, "laptop")
+
+	b.Unregister(onB)
+	if !a.IsOnline(user) {
+		t.Fatal("offline from b hid the connection on c")
+	}
+	if !a.SendEnvelope(user, testEnvelope()) {
+		t.Fatal("not delivered to c")
+	}
+}
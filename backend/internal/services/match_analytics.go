@@ -0,0 +1,109 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+const (
+	OutcomeMatched = "matched"
+	OutcomeTimeout = "timeout"
+)
+
+// MatchAnalytics records matching outcomes for product metrics. Events carry
+// no user IDs, tags or exact timestamps: only the outcome, a coarse wait
+// bucket and the size of the tag bucket (or fallback pool) the user was
+// matched from or timed out of.
+type MatchAnalytics struct {
+	events chan models.MatchAnalyticsEvent
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewMatchAnalytics starts a background writer so recording never blocks
+// the matchmaker on the database; Close stops it
+func NewMatchAnalytics(db *gorm.DB) *MatchAnalytics {
+	a := &MatchAnalytics{
+		events: make(chan models.MatchAnalyticsEvent, 1000),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.write(db)
+	return a
+}
+
+func (a *MatchAnalytics) write(db *gorm.DB) {
+	defer close(a.done)
+	save := func(ev models.MatchAnalyticsEvent) {
+		if err := db.Create(&ev).Error; err != nil {
+			log.Printf("match analytics write error: %v", err)
+		}
+	}
+	for {
+		select {
+		case ev := <-a.events:
+			save(ev)
+		case <-a.stop:
+			// Flush what was queued before Close
+			for {
+				select {
+				case ev := <-a.events:
+					save(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close writes out queued events and stops the writer. Events recorded
+// after Close are dropped. It is safe to call more than once and on a nil
+// receiver.
+func (a *MatchAnalytics) Close() {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() { close(a.stop) })
+	<-a.done
+}
+
+// Record queues an event. It is a no-op on a nil receiver and drops events
+// when the writer falls behind.
+func (a *MatchAnalytics) Record(outcome string, wait time.Duration, bucketSize int) {
+	if a == nil {
+		return
+	}
+	ev := models.MatchAnalyticsEvent{
+		Outcome:    outcome,
+		WaitBucket: waitBucket(wait),
+		BucketSize: bucketSize,
+		CreatedAt:  time.Now().UTC().Truncate(time.Hour),
+	}
+	select {
+	case <-a.stop:
+	case a.events <- ev:
+	default:
+	}
+}
+
+func waitBucket(d time.Duration) string {
+	switch {
+	case d < 10*time.Second:
+		return "<10s"
+	case d < 30*time.Second:
+		return "10-30s"
+	case d < time.Minute:
+		return "30-60s"
+	case d < 5*time.Minute:
+		return "1-5m"
+	default:
+		return ">5m"
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func TestMatchAnalyticsRecordsAnonymizedOutcomes(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	gdb := dbtest.New(t)
+	m.Analytics = NewMatchAnalytics(gdb)
+	m.FallbackAfter = 0
+	m.WaitTimeout = 5 * time.Minute
+
+	a := queueUser(t, m, hub, "secret-tag")
+	clock.Advance(20 * time.Second)
+	b := queueUser(t, m, hub, "secret-tag")
+	lonely := queueUser(t, m, hub, "lonely-tag")
+	m.tryMatch()
+	assertPaired(t, m, a, b)
+	clock.Advance(6 * time.Minute)
+	m.cleanupWaiting()
+
+	// Close flushes the writer, so every event is in the table after it
+	m.Analytics.Close()
+	var events []models.MatchAnalyticsEvent
+	gdb.Order("id").Find(&events)
+	if len(events) != 3 {
+		t.Fatalf("recorded %d events, want 3: %+v", len(events), events)
+	}
+	// One matched event per side of the pair, then the timeout
+	outcomes := fmt.Sprintf("%s %s %s", events[0].Outcome, events[1].Outcome, events[2].Outcome)
+	if outcomes != "matched matched timeout" {
+		t.Fatalf("outcomes = %s", outcomes)
+	}
+	if events[2].WaitBucket != "1-5m" && events[2].WaitBucket != ">5m" {
+		t.Fatalf("timeout wait bucket = %q", events[2].WaitBucket)
+	}
+	// The pair came from a two-user tag bucket while three users were
+	// queued; the timed-out user was alone in theirs
+	for i, want := range []int{2, 2, 1} {
+		if events[i].BucketSize != want {
+			t.Fatalf("event %d bucket size = %d, want %d", i, events[i].BucketSize, want)
+		}
+	}
+
+	var rows []map[string]interface{}
+	gdb.Raw("SELECT * FROM match_analytics").Scan(&rows)
+	dump := fmt.Sprint(rows)
+	for _, secret := range []string{a.String(), b.String(), lonely.String(), "secret-tag", "lonely-tag"} {
+		if strings.Contains(dump, secret) {
+			t.Fatalf("analytics rows contain %q: %s", secret, dump)
+		}
+	}
+	for _, ev := range events {
+		if !ev.CreatedAt.Equal(ev.CreatedAt.Truncate(time.Hour)) {
+			t.Fatalf("event timestamp %v is finer than an hour", ev.CreatedAt)
+		}
+	}
+}
+
+func TestMatchAnalyticsCloseStopsWriter(t *testing.T) {
+	gdb := dbtest.New(t)
+	a := NewMatchAnalytics(gdb)
+	a.Record(OutcomeMatched, time.Second, 1)
+	a.Close()
+	a.Close()
+
+	a.Record(OutcomeTimeout, time.Minute, 1)
+	var n int64
+	gdb.Model(&models.MatchAnalyticsEvent{}).Count(&n)
+	if n != 1 {
+		t.Fatalf("stored %d events, want only the one recorded before Close", n)
+	}
+	select {
+	case <-a.done:
+	default:
+		t.Fatal("writer still running after Close")
+	}
+	var nilAnalytics *MatchAnalytics
+	nilAnalytics.Close()
+}
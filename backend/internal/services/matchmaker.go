@@ -1,8 +1,14 @@
 package services
 
 import (
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,44 +16,244 @@ import (
 	"gorm.io/gorm"
 )
 
+// Queue ordering modes. FairnessWait keeps every user at the position their
+// first enqueue gave them, so whoever has waited longest is considered first on
+// each tick. FairnessArrival rotates users that found no partner to the back,
+// which was the behaviour of the original channel-based queue.
+const (
+	FairnessWait    = "wait"
+	FairnessArrival = "arrival"
+)
+
+// What Enqueue does for a user who is still paired. WhileMatchedEnd ends the
+// pairing and queues them again; WhileMatchedReject refuses with
+// ErrAlreadyMatched, leaving the pairing in place.
+const (
+	WhileMatchedEnd    = "end"
+	WhileMatchedReject = "reject"
+)
+
+const maxQueueSize = 1000
+
+// throughputWindow is how far back completed matches count towards the
+// estimated wait reported by Position
+const throughputWindow = 5 * time.Minute
+
+var ErrQueueFull = errors.New("match queue full")
+
+var ErrAlreadyMatched = errors.New("already matched")
+
+var ErrDraining = errors.New("matchmaker draining")
+
+// queueEntry is one waiting user. It is linked into the global order and into
+// the bucket of every tag it carries, so both can be walked oldest-first.
+type queueEntry struct {
+	userID      uuid.UUID
+	tags        []string
+	since       time.Time
+	autoRequeue bool
+	order       *list.Element
+	buckets     map[string]*list.Element
+}
+
+// recentPeer is the partner of a user's last ended match
+type recentPeer struct {
+	peer    uuid.UUID
+	endedAt time.Time
+}
+
 type Matchmaker struct {
 	DB      *gorm.DB
 	Hub     *Hub
-	queue   chan uuid.UUID
 	mu      sync.Mutex
 	pairing map[uuid.UUID]uuid.UUID
-	waiting map[uuid.UUID]time.Time
+	waiting map[uuid.UUID]*queueEntry
+	order   *list.List
+	buckets map[string]*list.List
+	// Per-pairing anonymous IDs and reveal consent, keyed by real user ID
+	anonID map[uuid.UUID]uuid.UUID
+	reveal map[uuid.UUID]bool
+	// Per-pairing key material served instead of the account's own keys
+	// until both sides reveal
+	anonKeys map[uuid.UUID]AnonymousKeys
+	// Users whose current pairing came from the fallback pool
+	relaxed map[uuid.UUID]bool
+	// Times of recent pairings, oldest first, for throughput estimates
+	matchedAt []time.Time
+	// Tags of paired users who asked to be re-queued when the match ends
+	requeueTags map[uuid.UUID][]string
+	lastPeer    map[uuid.UUID]recentPeer
+	// When each paired user's current anonymous ID was issued
+	anonIssuedAt map[uuid.UUID]time.Time
+	// draining is set by Drain and never cleared; the process is on its
+	// way out
+	draining bool
+
+	// Clock times waits, timeouts and throughput
+	Clock Clock
+	// Fairness selects the queue ordering; empty means FairnessWait
+	Fairness string
+	// WhileMatched is the policy for enqueueing while paired; empty means
+	// WhileMatchedEnd
+	WhileMatched string
+	// RematchCooldown keeps two users who just ended a match from being
+	// paired again for this long
+	RematchCooldown time.Duration
+	// MinOverlap is how many tags two users must share to be paired; below
+	// 2 any shared tag will do. Once either has waited OverlapFallback, a
+	// single shared tag is enough.
+	MinOverlap      int
+	OverlapFallback time.Duration
+	// FallbackAfter moves users who have waited this long into a general
+	// pool where they can be paired with anyone else in it, tags or not;
+	// zero keeps matching strictly by tag
+	FallbackAfter time.Duration
+	// WaitTimeout drops users still unmatched after this long, counted
+	// from when they enter the fallback pool if there is one; zero means
+	// DefaultWaitTimeout
+	WaitTimeout time.Duration
+	// AnonIDMaxLifetime rotates both anonymous IDs of a pairing this long
+	// after they were issued; the pairing continues. Zero means no limit.
+	AnonIDMaxLifetime time.Duration
+	// Analytics is optional; nil disables outcome recording
+	Analytics *MatchAnalytics
+	// TickInterval is how often Run matches the queue; zero means
+	// DefaultMatchTick
+	TickInterval time.Duration
 }
 
+// DefaultMatchTick is the matching interval when TickInterval is unset
+const DefaultMatchTick = 100 * time.Millisecond
+
+// DefaultWaitTimeout is how long users wait unmatched when WaitTimeout is unset
+const DefaultWaitTimeout = 5 * time.Minute
+
 func NewMatchmaker(db *gorm.DB, hub *Hub) *Matchmaker {
 	return &Matchmaker{
 		DB:      db,
 		Hub:     hub,
-		queue:   make(chan uuid.UUID, 1000),
 		pairing: make(map[uuid.UUID]uuid.UUID),
-		waiting: make(map[uuid.UUID]time.Time),
+		waiting: make(map[uuid.UUID]*queueEntry),
+		order:   list.New(),
+		buckets: make(map[string]*list.List),
+		anonID:  make(map[uuid.UUID]uuid.UUID),
+		reveal:  make(map[uuid.UUID]bool),
+
+		anonKeys: make(map[uuid.UUID]AnonymousKeys),
+		relaxed:  make(map[uuid.UUID]bool),
+		Clock:    RealClock{},
+
+		requeueTags:  make(map[uuid.UUID][]string),
+		lastPeer:     make(map[uuid.UUID]recentPeer),
+		anonIssuedAt: make(map[uuid.UUID]time.Time),
 	}
 }
 
-func (m *Matchmaker) Enqueue(userID uuid.UUID) error {
-	select {
-	case m.queue <- userID:
-		m.mu.Lock()
-		m.waiting[userID] = time.Now()
+// Enqueue adds userID to the bucket of each tag. Two users are compatible when
+// they share at least one tag. Enqueueing again replaces the tags but keeps
+// the original wait time. With autoRequeue, the user goes back in the queue
+// with the same tags when the match they get ends. A user who is still paired
+// ends that match first, so the next one starts with fresh anonymous IDs and
+// nothing maps back to the old peer; under WhileMatchedReject they get
+// ErrAlreadyMatched instead and stay paired. A ctx that is already done adds nothing
+// and returns its error. Once Drain has been called it returns ErrDraining and
+// leaves any pairing alone.
+func (m *Matchmaker) Enqueue(ctx context.Context, userID uuid.UUID, tags []string, autoRequeue bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if err := ctx.Err(); err != nil {
 		m.mu.Unlock()
-		return nil
-	default:
-		return context.DeadlineExceeded
+		return err
+	}
+	if m.draining {
+		m.mu.Unlock()
+		return ErrDraining
+	}
+	if _, paired := m.pairing[userID]; paired && m.WhileMatched == WhileMatchedReject {
+		m.mu.Unlock()
+		return ErrAlreadyMatched
+	}
+	var ended []endedPair
+	if p, ok := m.endPairing(userID); ok {
+		// The caller is enqueueing explicitly; only the peer needs telling
+		p.requeued = removeID(p.requeued, userID)
+		ended = append(ended, p)
+	}
+	err := m.enqueue(userID, tags, autoRequeue)
+	m.mu.Unlock()
+
+	m.notifyEnded(ended)
+	return err
+}
+
+// enqueue is Enqueue with m.mu held
+func (m *Matchmaker) enqueue(userID uuid.UUID, tags []string, autoRequeue bool) error {
+	if m.draining {
+		return ErrDraining
+	}
+	since := m.Clock.Now()
+	if e, ok := m.waiting[userID]; ok {
+		since = e.since
+		m.remove(e)
+	} else if len(m.waiting) >= maxQueueSize {
+		return ErrQueueFull
+	}
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+
+	e := &queueEntry{userID: userID, tags: tags, since: since, autoRequeue: autoRequeue, buckets: make(map[string]*list.Element, len(tags))}
+	e.order = m.insertByWait(m.order, e)
+	for _, tag := range tags {
+		b, ok := m.buckets[tag]
+		if !ok {
+			b = list.New()
+			m.buckets[tag] = b
+		}
+		e.buckets[tag] = m.insertByWait(b, e)
+	}
+	m.waiting[userID] = e
+	return nil
+}
+
+// insertByWait places e after every entry that has waited at least as long.
+// New users land at the back in O(1); only a re-enqueue walks the list.
+func (m *Matchmaker) insertByWait(l *list.List, e *queueEntry) *list.Element {
+	for el := l.Back(); el != nil; el = el.Prev() {
+		if !el.Value.(*queueEntry).since.After(e.since) {
+			return l.InsertAfter(e, el)
+		}
+	}
+	return l.PushFront(e)
+}
+
+// remove unlinks e from the queue; the caller holds m.mu
+func (m *Matchmaker) remove(e *queueEntry) {
+	m.order.Remove(e.order)
+	for tag, el := range e.buckets {
+		b := m.buckets[tag]
+		b.Remove(el)
+		if b.Len() == 0 {
+			delete(m.buckets, tag)
+		}
 	}
+	delete(m.waiting, e.userID)
 }
 
 func (m *Matchmaker) Run(ctx context.Context) {
-	ticker := time.NewTicker(100 * time.Millisecond)
+	interval := m.TickInterval
+	if interval <= 0 {
+		interval = DefaultMatchTick
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
+			m.shutdown()
 			return
 		case <-ticker.C:
 			// Try to match pairs from queue
@@ -58,78 +264,462 @@ func (m *Matchmaker) Run(ctx context.Context) {
 	}
 }
 
+// madePair is one pairing made by tryMatch, kept for logging and analytics
+// after m.mu is released
+type madePair struct {
+	uid1, uid2 uuid.UUID
+	waits      []time.Duration
+	bucketSize int
+	relaxed    bool
+}
+
+// tryMatch walks the queue once, longest-waiting first, pairing each online
+// user that has a compatible partner with the longest-waiting such partner,
+// so one tick matches everyone who can be matched. Presence is checked
+// before m.mu is taken, and users who went offline are dropped before the
+// walk; users enqueued in between wait for the next tick.
 func (m *Matchmaker) tryMatch() {
-	// Try to get two users from queue
-	var uid1, uid2 uuid.UUID
-	var hasFirst, hasSecond bool
-
-	select {
-	case uid1 = <-m.queue:
-		// Check if first user is online
-		if !m.Hub.IsOnline(uid1) {
-			// User disconnected, skip and remove from waiting
-			m.mu.Lock()
-			delete(m.waiting, uid1)
-			m.mu.Unlock()
-			return
+	m.mu.Lock()
+	ids := make([]uuid.UUID, 0, len(m.waiting))
+	for id := range m.waiting {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+	online := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		online[id] = m.Hub.IsOnline(id)
+	}
+
+	m.mu.Lock()
+	now := m.Clock.Now()
+	for id, ok := range online {
+		if e, waiting := m.waiting[id]; waiting && !ok {
+			m.remove(e)
 		}
-		hasFirst = true
-	default:
-		return
 	}
+	pool := m.fallbackPool(online, now)
+	var made []madePair
+	var skipped []*queueEntry
+	for el := m.order.Front(); el != nil; {
+		e := el.Value.(*queueEntry)
+		el = el.Next()
+		if !online[e.userID] {
+			continue
+		}
+		relaxed := false
+		bucketSize := pool.Len()
+		p, tag := m.oldestPartner(e, online, now)
+		if p != nil {
+			bucketSize = m.buckets[tag].Len()
+		} else {
+			p, relaxed = m.fallbackPartner(pool, e, now), true
+		}
+		if p == nil {
+			skipped = append(skipped, e)
+			continue
+		}
+		// The partner may be the next element; step past it before it is
+		// unlinked
+		if el != nil && el.Value.(*queueEntry) == p {
+			el = el.Next()
+		}
+		made = append(made, m.pair(e, p, relaxed, bucketSize, now))
+	}
+	if m.Fairness == FairnessArrival {
+		for _, e := range skipped {
+			m.order.MoveToBack(e.order)
+			for tag, el := range e.buckets {
+				m.buckets[tag].MoveToBack(el)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, mp := range made {
+		log.Printf("matched users: %s <-> %s (relaxed=%t)", mp.uid1, mp.uid2, mp.relaxed)
+		for _, w := range mp.waits {
+			m.Analytics.Record(OutcomeMatched, w, mp.bucketSize)
+		}
+	}
+}
+
+// pair takes first and second out of the queue and pairs them. bucketSize is
+// the length of the tag bucket or fallback pool they were matched from,
+// before they left it; the caller holds m.mu.
+func (m *Matchmaker) pair(first, second *queueEntry, relaxed bool, bucketSize int, now time.Time) madePair {
+	mp := madePair{
+		uid1:       first.userID,
+		uid2:       second.userID,
+		waits:      []time.Duration{now.Sub(first.since), now.Sub(second.since)},
+		bucketSize: bucketSize,
+		relaxed:    relaxed,
+	}
+	uid1, uid2 := mp.uid1, mp.uid2
+	m.remove(first)
+	m.remove(second)
+	m.pairing[uid1] = uid2
+	m.pairing[uid2] = uid1
+	m.anonID[uid1] = uuid.Must(uuid.NewV4())
+	m.anonID[uid2] = uuid.Must(uuid.NewV4())
+	m.anonIssuedAt[uid1] = now
+	m.anonIssuedAt[uid2] = now
+	if relaxed {
+		m.relaxed[uid1] = true
+		m.relaxed[uid2] = true
+	}
+	for _, e := range []*queueEntry{first, second} {
+		if e.autoRequeue {
+			m.requeueTags[e.userID] = e.tags
+		}
+	}
+	m.matchedAt = append(m.pruneMatched(now), now)
+	return mp
+}
 
-	// Try to get second user with timeout
-	select {
-	case uid2 = <-m.queue:
-		// Check if second user is online
-		if !m.Hub.IsOnline(uid2) {
-			// Second user disconnected, requeue first user and skip
-			select {
-			case m.queue <- uid1:
-			default:
-				log.Printf("failed to requeue user %s", uid1)
+// oldestPartner returns the first eligible online user in any of e's tag
+// buckets, preferring the one that has waited longest, and the tag whose
+// bucket it came from; the caller holds m.mu
+func (m *Matchmaker) oldestPartner(e *queueEntry, online map[uuid.UUID]bool, now time.Time) (*queueEntry, string) {
+	var best *queueEntry
+	var bestTag string
+	for _, tag := range e.tags {
+		for el := m.buckets[tag].Front(); el != nil; el = el.Next() {
+			p := el.Value.(*queueEntry)
+			if p == e || !online[p.userID] || m.coolingDown(e.userID, p.userID) {
+				continue
 			}
-			m.mu.Lock()
-			delete(m.waiting, uid2)
-			m.mu.Unlock()
-			return
+			if !m.overlapSatisfied(e, p, now) {
+				continue
+			}
+			if best == nil || p.since.Before(best.since) {
+				best, bestTag = p, tag
+			}
+			break
 		}
-		hasSecond = true
-	case <-time.After(50 * time.Millisecond):
-		// No second user available, requeue first user
-		select {
-		case m.queue <- uid1:
-		default:
-			log.Printf("failed to requeue user %s", uid1)
+	}
+	return best, bestTag
+}
+
+// largestBucket returns the length of the biggest tag bucket e is in; the
+// caller holds m.mu
+func (m *Matchmaker) largestBucket(e *queueEntry) int {
+	size := 0
+	for _, tag := range e.tags {
+		if n := m.buckets[tag].Len(); n > size {
+			size = n
 		}
-		return
 	}
+	return size
+}
 
-	if hasFirst && hasSecond {
-		m.mu.Lock()
-		m.pairing[uid1] = uid2
-		m.pairing[uid2] = uid1
-		delete(m.waiting, uid1)
-		delete(m.waiting, uid2)
-		m.mu.Unlock()
-		log.Printf("matched users: %s <-> %s", uid1, uid2)
+// fallbackPool lists the online users who have waited FallbackAfter,
+// longest first, so a tick takes general-pool partners from its front
+// instead of rescanning the queue for each user; the caller holds m.mu
+func (m *Matchmaker) fallbackPool(online map[uuid.UUID]bool, now time.Time) *list.List {
+	pool := list.New()
+	if m.FallbackAfter <= 0 {
+		return pool
+	}
+	var entries []*queueEntry
+	for el := m.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*queueEntry)
+		if online[e.userID] && now.Sub(e.since) >= m.FallbackAfter {
+			entries = append(entries, e)
+		}
+	}
+	// Under FairnessArrival the queue order isn't the wait order
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].since.Before(entries[j].since) })
+	for _, e := range entries {
+		pool.PushBack(e)
 	}
+	return pool
 }
 
-func (m *Matchmaker) cleanupWaiting() {
+// fallbackPartner returns the longest-waiting other user in pool when e has
+// itself waited FallbackAfter. Users paired since the pool was built are
+// dropped from it as they are reached, so each is passed over once; the
+// caller holds m.mu.
+func (m *Matchmaker) fallbackPartner(pool *list.List, e *queueEntry, now time.Time) *queueEntry {
+	if m.FallbackAfter <= 0 || now.Sub(e.since) < m.FallbackAfter {
+		return nil
+	}
+	for el := pool.Front(); el != nil; {
+		p := el.Value.(*queueEntry)
+		next := el.Next()
+		if m.waiting[p.userID] != p {
+			pool.Remove(el)
+		} else if p != e && !m.coolingDown(e.userID, p.userID) {
+			return p
+		}
+		el = next
+	}
+	return nil
+}
+
+// overlapSatisfied reports whether e and p share enough tags, relaxing to one
+// shared tag once either has waited OverlapFallback; the caller holds m.mu
+func (m *Matchmaker) overlapSatisfied(e, p *queueEntry, now time.Time) bool {
+	if m.MinOverlap < 2 {
+		return true
+	}
+	oldest := e.since
+	if p.since.Before(oldest) {
+		oldest = p.since
+	}
+	if m.OverlapFallback > 0 && now.Sub(oldest) >= m.OverlapFallback {
+		return true
+	}
+	shared := 0
+	for tag := range e.buckets {
+		if _, ok := p.buckets[tag]; ok {
+			shared++
+		}
+	}
+	return shared >= m.MinOverlap
+}
+
+// coolingDown reports whether a and b ended a match with each other less than
+// RematchCooldown ago; the caller holds m.mu
+func (m *Matchmaker) coolingDown(a, b uuid.UUID) bool {
+	r, ok := m.lastPeer[a]
+	return ok && r.peer == b && m.Clock.Now().Sub(r.endedAt) < m.RematchCooldown
+}
+
+// pruneMatched drops pairings older than throughputWindow; the caller holds m.mu
+func (m *Matchmaker) pruneMatched(now time.Time) []time.Time {
+	i := 0
+	for i < len(m.matchedAt) && now.Sub(m.matchedAt[i]) > throughputWindow {
+		i++
+	}
+	m.matchedAt = m.matchedAt[i:]
+	return m.matchedAt
+}
+
+// QueuePosition describes where a waiting user stands in their best bucket
+type QueuePosition struct {
+	// Position is 1 for the user at the front of the bucket
+	Position   int
+	BucketSize int
+	Waited     time.Duration
+	// EstimatedWait is zero when no pairing happened in the recent window
+	EstimatedWait time.Duration
+}
+
+// Position reports the caller's place in whichever of their tag buckets they
+// are nearest the front of. The estimate assumes each user ahead leaves at the
+// rate users were paired over the last throughputWindow.
+func (m *Matchmaker) Position(userID uuid.UUID) (QueuePosition, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	now := time.Now()
-	for userID, t := range m.waiting {
-		// Remove users waiting for more than 5 minutes
-		if now.Sub(t) > 5*time.Minute {
-			delete(m.waiting, userID)
+	e, ok := m.waiting[userID]
+	if !ok {
+		return QueuePosition{}, false
+	}
+	now := m.Clock.Now()
+	pos := QueuePosition{Waited: now.Sub(e.since)}
+	for tag := range e.buckets {
+		b := m.buckets[tag]
+		n := 1
+		for el := b.Front(); el != nil && el.Value.(*queueEntry) != e; el = el.Next() {
+			n++
+		}
+		if pos.Position == 0 || n < pos.Position {
+			pos.Position, pos.BucketSize = n, b.Len()
+		}
+	}
+	if pairs := len(m.pruneMatched(now)); pairs > 0 {
+		perUser := throughputWindow / time.Duration(2*pairs)
+		pos.EstimatedWait = time.Duration(pos.Position) * perUser
+	}
+	return pos, true
+}
+
+// MatchmakerStats is an operator view of the queue. It carries no user IDs,
+// and tags appear only as short hashes.
+type MatchmakerStats struct {
+	Waiting        int
+	ActivePairings int
+	OldestWait     time.Duration
+	// WaitAges counts waiting users per match-analytics wait bucket
+	WaitAges map[string]int
+	// Buckets maps a tag's hash label to the number of users waiting on it
+	Buckets map[string]int
+}
+
+// Stats snapshots the queue and pairings under the lock
+func (m *Matchmaker) Stats() MatchmakerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Clock.Now()
+	st := MatchmakerStats{
+		Waiting:        len(m.waiting),
+		ActivePairings: len(m.pairing) / 2,
+		WaitAges:       make(map[string]int),
+		Buckets:        make(map[string]int, len(m.buckets)),
+	}
+	if front := m.order.Front(); front != nil {
+		st.OldestWait = now.Sub(front.Value.(*queueEntry).since)
+	}
+	for _, e := range m.waiting {
+		st.WaitAges[waitBucket(now.Sub(e.since))]++
+	}
+	for tag, b := range m.buckets {
+		st.Buckets[tagLabel(tag)] = b.Len()
+	}
+	return st
+}
+
+// tagLabel identifies a tag in operator output without revealing it
+func tagLabel(tag string) string {
+	if tag == "" {
+		return "(untagged)"
+	}
+	sum := sha256.Sum256([]byte(tag))
+	return hex.EncodeToString(sum[:6])
+}
+
+// shutdown drains the queue and tells every connected waiting user the
+// service is restarting, so clients re-enqueue after reconnecting instead of
+// polling a queue that no longer exists
+func (m *Matchmaker) shutdown() {
+	m.mu.Lock()
+	notify := make([]uuid.UUID, 0, len(m.waiting))
+	for uid := range m.waiting {
+		notify = append(notify, uid)
+	}
+	m.waiting = make(map[uuid.UUID]*queueEntry)
+	m.order.Init()
+	m.buckets = make(map[string]*list.List)
+	m.pairing = make(map[uuid.UUID]uuid.UUID)
+	m.anonID = make(map[uuid.UUID]uuid.UUID)
+	m.anonKeys = make(map[uuid.UUID]AnonymousKeys)
+	m.reveal = make(map[uuid.UUID]bool)
+	m.relaxed = make(map[uuid.UUID]bool)
+	m.matchedAt = nil
+	m.requeueTags = make(map[uuid.UUID][]string)
+	m.lastPeer = make(map[uuid.UUID]recentPeer)
+	m.anonIssuedAt = make(map[uuid.UUID]time.Time)
+	m.mu.Unlock()
+
+	m.notifyRestarting(notify)
+	log.Printf("matchmaker stopped; notified %d queued users", len(notify))
+}
+
+// Drain stops taking users ahead of a restart. The queue is emptied and its
+// users told the service is restarting, as on shutdown, but pairings are
+// left to run until the process exits. It returns how many users were queued.
+func (m *Matchmaker) Drain() int {
+	m.mu.Lock()
+	m.draining = true
+	notify := make([]uuid.UUID, 0, len(m.waiting))
+	for uid := range m.waiting {
+		notify = append(notify, uid)
+	}
+	m.waiting = make(map[uuid.UUID]*queueEntry)
+	m.order.Init()
+	m.buckets = make(map[string]*list.List)
+	m.requeueTags = make(map[uuid.UUID][]string)
+	m.mu.Unlock()
+
+	m.notifyRestarting(notify)
+	log.Printf("matchmaker draining; notified %d queued users", len(notify))
+	return len(notify)
+}
+
+func (m *Matchmaker) notifyRestarting(userIDs []uuid.UUID) {
+	msg, _ := json.Marshal(map[string]string{"type": "service_restarting"})
+	for _, uid := range userIDs {
+		m.Hub.SendTo(uid, msg)
+	}
+}
+
+func (m *Matchmaker) cleanupWaiting() {
+	m.mu.Lock()
+	var ended []endedPair
+	var rotated []rotatedIDs
+	defer func() {
+		m.mu.Unlock()
+		m.notifyEnded(ended)
+		m.notifyRotated(rotated)
+	}()
+
+	now := m.Clock.Now()
+	if m.AnonIDMaxLifetime > 0 {
+		for userID, at := range m.anonIssuedAt {
+			// The peer's entry is reset along with this one, so each pair
+			// rotates once
+			if now.Sub(at) < m.AnonIDMaxLifetime {
+				continue
+			}
+			rotated = append(rotated, m.rotateAnonIDs(userID, now)...)
+		}
+	}
+	for userID, r := range m.lastPeer {
+		if now.Sub(r.endedAt) >= m.RematchCooldown {
+			delete(m.lastPeer, userID)
+		}
+	}
+	// A fallback pool only helps users who are still queued when they
+	// reach it, so the timeout starts there
+	timeout := m.WaitTimeout
+	if timeout <= 0 {
+		timeout = DefaultWaitTimeout
+	}
+	if m.FallbackAfter > 0 {
+		timeout += m.FallbackAfter
+	}
+	for userID, e := range m.waiting {
+		if now.Sub(e.since) > timeout {
+			bucketSize := m.largestBucket(e)
+			m.remove(e)
 			log.Printf("removed expired waiting user: %s", userID)
+			m.Analytics.Record(OutcomeTimeout, now.Sub(e.since), bucketSize)
 		}
 	}
 }
 
+// rotatedIDs is a paired user's new anonymous ID and their peer's, for
+// notification once m.mu is released
+type rotatedIDs struct {
+	user, self, peer uuid.UUID
+}
+
+// rotateAnonIDs gives userID and their peer fresh anonymous IDs, leaving the
+// pairing and reveal consent in place. Per-pairing keys are dropped too,
+// since a peer could otherwise link the old and new IDs through them; the
+// caller holds m.mu.
+func (m *Matchmaker) rotateAnonIDs(userID uuid.UUID, now time.Time) []rotatedIDs {
+	p, ok := m.pairing[userID]
+	if !ok {
+		delete(m.anonIssuedAt, userID)
+		return nil
+	}
+	for _, id := range []uuid.UUID{userID, p} {
+		m.anonID[id] = uuid.Must(uuid.NewV4())
+		m.anonIssuedAt[id] = now
+		delete(m.anonKeys, id)
+	}
+	log.Printf("rotated anonymous IDs: %s <-> %s", userID, p)
+	return []rotatedIDs{
+		{user: userID, self: m.anonID[userID], peer: m.anonID[p]},
+		{user: p, self: m.anonID[p], peer: m.anonID[userID]},
+	}
+}
+
+// notifyRotated tells each user their pairing's new anonymous IDs
+func (m *Matchmaker) notifyRotated(rotated []rotatedIDs) {
+	for _, r := range rotated {
+		msg, _ := json.Marshal(map[string]string{
+			"type":         "anonymous_id_rotated",
+			"anonymous_id": r.self.String(),
+			"pair_id":      r.peer.String(),
+		})
+		m.Hub.SendTo(r.user, msg)
+	}
+}
+
 func (m *Matchmaker) GetPair(userID uuid.UUID) (uuid.UUID, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -137,13 +727,84 @@ func (m *Matchmaker) GetPair(userID uuid.UUID) (uuid.UUID, bool) {
 	return p, ok
 }
 
-func (m *Matchmaker) RemovePair(userID uuid.UUID) {
+// EndMatch dissolves the caller's current pairing. The peer is sent
+// match_ended, and either side that enqueued with auto-requeue is put back in
+// the queue with its previous tags and sent requeued. The two users won't be
+// paired again until RematchCooldown has passed.
+func (m *Matchmaker) EndMatch(userID uuid.UUID) (uuid.UUID, bool) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	if p, ok := m.pairing[userID]; ok {
-		delete(m.pairing, p)
-		delete(m.pairing, userID)
-		log.Printf("removed pairing: %s <-> %s", userID, p)
+	p, ok := m.endPairing(userID)
+	m.mu.Unlock()
+	if !ok {
+		return uuid.Nil, false
+	}
+	m.notifyEnded([]endedPair{p})
+	return p.peer, true
+}
+
+// endedPair records a dissolved pairing for notification once m.mu is
+// released: peer is told the match ended, and requeued users are told
+// they are back in the queue
+type endedPair struct {
+	user, peer uuid.UUID
+	requeued   []uuid.UUID
+}
+
+// endPairing dissolves userID's pairing and drops every mapping tied to it,
+// re-queueing auto-requeue users; the caller holds m.mu
+func (m *Matchmaker) endPairing(userID uuid.UUID) (endedPair, bool) {
+	p, ok := m.pairing[userID]
+	if !ok {
+		return endedPair{}, false
+	}
+	now := m.Clock.Now()
+	delete(m.pairing, p)
+	delete(m.pairing, userID)
+	m.lastPeer[userID] = recentPeer{peer: p, endedAt: now}
+	m.lastPeer[p] = recentPeer{peer: userID, endedAt: now}
+	ended := endedPair{user: userID, peer: p}
+	for _, id := range []uuid.UUID{userID, p} {
+		delete(m.anonID, id)
+		delete(m.anonKeys, id)
+		delete(m.reveal, id)
+		delete(m.relaxed, id)
+		delete(m.anonIssuedAt, id)
+		tags, auto := m.requeueTags[id]
+		delete(m.requeueTags, id)
+		if !auto {
+			continue
+		}
+		if err := m.enqueue(id, tags, true); err != nil {
+			log.Printf("auto-requeue %s: %v", id, err)
+			continue
+		}
+		ended.requeued = append(ended.requeued, id)
+	}
+	log.Printf("ended pairing: %s <-> %s", userID, p)
+	return ended, true
+}
+
+func removeID(ids []uuid.UUID, id uuid.UUID) []uuid.UUID {
+	out := ids[:0]
+	for _, x := range ids {
+		if x != id {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+func (m *Matchmaker) notifyEnded(ended []endedPair) {
+	if len(ended) == 0 {
+		return
+	}
+	msg, _ := json.Marshal(map[string]string{"type": "match_ended"})
+	notice, _ := json.Marshal(map[string]string{"type": "requeued"})
+	for _, e := range ended {
+		m.Hub.SendTo(e.peer, msg)
+		for _, id := range e.requeued {
+			m.Hub.SendTo(id, notice)
+		}
 	}
 }
 
@@ -152,8 +813,89 @@ func (m *Matchmaker) Leave(userID uuid.UUID) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Remove from waiting map
-	delete(m.waiting, userID)
+	if e, ok := m.waiting[userID]; ok {
+		m.remove(e)
+	}
 	log.Printf("user left queue: %s", userID)
-	// Note: Cannot remove from channel easily, but will be filtered out by IsOnline check
+}
+
+// AnonymousIDs returns the caller's and their peer's anonymous IDs for the
+// current pairing
+func (m *Matchmaker) AnonymousIDs(userID uuid.UUID) (self, peer uuid.UUID, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pairing[userID]
+	if !ok {
+		return uuid.Nil, uuid.Nil, false
+	}
+	return m.anonID[userID], m.anonID[p], true
+}
+
+// Relaxed reports whether the caller's current pairing came from the
+// fallback pool rather than a shared tag
+func (m *Matchmaker) Relaxed(userID uuid.UUID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.relaxed[userID]
+}
+
+// ResolvePeer maps anonID to the caller's real peer, if anonID belongs to it
+func (m *Matchmaker) ResolvePeer(userID, anonID uuid.UUID) (uuid.UUID, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pairing[userID]
+	if !ok || m.anonID[p] != anonID {
+		return uuid.Nil, false
+	}
+	return p, true
+}
+
+// Reveal records the caller's consent to disclose real IDs to their peer and
+// reports whether both sides have now consented
+func (m *Matchmaker) Reveal(userID uuid.UUID) (peer uuid.UUID, mutual bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pairing[userID]
+	if !ok {
+		return uuid.Nil, false, false
+	}
+	m.reveal[userID] = true
+	return p, m.reveal[p], true
+}
+
+// Revealed reports whether the caller and their peer have both consented
+func (m *Matchmaker) Revealed(userID uuid.UUID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pairing[userID]
+	return ok && m.reveal[userID] && m.reveal[p]
+}
+
+// AnonymousKeys is key material a user generated for one anonymous pairing,
+// so their peer never sees keys that also appear in the account's bundle
+type AnonymousKeys struct {
+	IdentityPub     []byte
+	SignedPreKey    []byte
+	SignedPreKeyID  string
+	SignedPreKeySig []byte
+}
+
+// SetAnonymousKeys stores the caller's keys for their current pairing,
+// replacing any set earlier; it reports false when they aren't paired
+func (m *Matchmaker) SetAnonymousKeys(userID uuid.UUID, k AnonymousKeys) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pairing[userID]; !ok {
+		return false
+	}
+	m.anonKeys[userID] = k
+	return true
+}
+
+// AnonymousKeysOf returns the keys userID set for their current pairing
+func (m *Matchmaker) AnonymousKeysOf(userID uuid.UUID) (AnonymousKeys, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.anonKeys[userID]
+	return k, ok
 }
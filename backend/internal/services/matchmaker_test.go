@@ -0,0 +1,541 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// newTestMatchmaker returns a matchmaker on a manual clock and the hub its
+// users must be connected to
+func newTestMatchmaker(t *testing.T) (*Matchmaker, *Hub, *ManualClock) {
+	t.Helper()
+	hub := NewHub()
+	m := NewMatchmaker(nil, hub)
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	m.Clock = clock
+	return m, hub, clock
+}
+
+// queueUser connects a new user and enqueues them with tags
+func queueUser(t *testing.T, m *Matchmaker, hub *Hub, tags ...string) uuid.UUID {
+	t.Helper()
+	id := uuid.Must(uuid.NewV4())
+	register(t, hub, id, "device-1")
+	if err := m.Enqueue(context.Background(), id, tags, false); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func assertPaired(t *testing.T, m *Matchmaker, a, b uuid.UUID) {
+	t.Helper()
+	if p, ok := m.GetPair(a); !ok || p != b {
+		t.Fatalf("%s paired with %s (%t), want %s", a, p, ok, b)
+	}
+}
+
+func TestTryMatchPairsLongestWaitingFirst(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	oldest := queueUser(t, m, hub, "go")
+	clock.Advance(time.Minute)
+	older := queueUser(t, m, hub, "go")
+	clock.Advance(time.Minute)
+	newcomer := queueUser(t, m, hub, "go")
+	// Re-enqueueing with new tags keeps the original wait
+	if err := m.Enqueue(context.Background(), oldest, []string{"go", "rust"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	m.tryMatch()
+	assertPaired(t, m, oldest, older)
+	if _, ok := m.GetPair(newcomer); ok {
+		t.Fatal("newcomer paired ahead of a longer wait")
+	}
+	if pos, ok := m.Position(newcomer); !ok || pos.Position != 1 {
+		t.Fatalf("newcomer position = %+v, %t", pos, ok)
+	}
+}
+
+func TestTryMatchDropsOfflineUsers(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	offline := uuid.Must(uuid.NewV4())
+	if err := m.Enqueue(context.Background(), offline, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	a := queueUser(t, m, hub, "go")
+	b := queueUser(t, m, hub, "go")
+
+	m.tryMatch()
+	assertPaired(t, m, a, b)
+	if _, waiting := m.Position(offline); waiting {
+		t.Fatal("offline user still queued")
+	}
+}
+
+func TestTryMatchFallbackPoolPairsLongWaiters(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	m.FallbackAfter = time.Minute
+	first := queueUser(t, m, hub, "chess")
+	second := queueUser(t, m, hub, "knitting")
+	third := queueUser(t, m, hub, "origami")
+	m.tryMatch()
+	if _, ok := m.GetPair(first); ok {
+		t.Fatal("strict matching paired users with no shared tag")
+	}
+
+	clock.Advance(time.Minute)
+	fresh := queueUser(t, m, hub, "bonsai")
+	m.tryMatch()
+	assertPaired(t, m, first, second)
+	if !m.Relaxed(first) || !m.Relaxed(second) {
+		t.Fatal("fallback pairing not marked relaxed")
+	}
+	for _, id := range []uuid.UUID{third, fresh} {
+		if _, ok := m.GetPair(id); ok {
+			t.Fatalf("%s paired without a pool partner", id)
+		}
+	}
+}
+
+func TestWaitTimeoutStartsAtFallbackPool(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	m.FallbackAfter = 10 * time.Minute
+	m.WaitTimeout = 5 * time.Minute
+	niche := queueUser(t, m, hub, "bagpipes")
+	other := queueUser(t, m, hub, "falconry")
+	tick := func(d time.Duration) {
+		clock.Advance(d)
+		m.tryMatch()
+		m.cleanupWaiting()
+	}
+
+	// Past the plain wait timeout but short of the pool: still queued
+	tick(6 * time.Minute)
+	if _, waiting := m.Position(niche); !waiting {
+		t.Fatal("niche user expired before reaching the fallback pool")
+	}
+	tick(4 * time.Minute)
+	assertPaired(t, m, niche, other)
+
+	// Alone in the pool, a user lasts FallbackAfter+WaitTimeout
+	lonely := queueUser(t, m, hub, "zither")
+	tick(14 * time.Minute)
+	if _, waiting := m.Position(lonely); !waiting {
+		t.Fatal("expired early")
+	}
+	tick(2 * time.Minute)
+	if _, waiting := m.Position(lonely); waiting {
+		t.Fatal("never expired")
+	}
+}
+
+// BenchmarkTryMatchDeepQueue times one tick over a nearly full queue; every
+// user has a partner, so a tick should pair them all
+func BenchmarkTryMatchDeepQueue(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	hub := NewHub()
+	users := make([]uuid.UUID, maxQueueSize-2)
+	tags := make([][]string, len(users))
+	for i := range users {
+		users[i] = uuid.Must(uuid.NewV4())
+		register(b, hub, users[i], "device-1")
+		tags[i] = []string{fmt.Sprintf("tag-%d", i/2%50), fmt.Sprintf("tag-%d", (i/2+7)%50)}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := NewMatchmaker(nil, hub)
+		for j, id := range users {
+			if err := m.Enqueue(context.Background(), id, tags[j], false); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		m.tryMatch()
+
+		if n := m.Stats().Waiting; n != 0 {
+			b.Fatalf("%d users left unmatched", n)
+		}
+	}
+	b.ReportMetric(float64(len(users)/2), "pairs/op")
+}
+
+// benchmarkPartnerLookup times finding the partner of a newcomer who shares a
+// tag with one user in a queue of depth others, none of whom match each other.
+// The newcomer is queued too, as tryMatch only looks up partners for queued users.
+func benchmarkPartnerLookup(b *testing.B, depth int) {
+	m := NewMatchmaker(nil, NewHub())
+	online := make(map[uuid.UUID]bool, depth)
+	for i := 0; i < depth; i++ {
+		id := uuid.Must(uuid.NewV4())
+		online[id] = true
+		if err := m.Enqueue(context.Background(), id, []string{fmt.Sprintf("solo-%d", i), fmt.Sprintf("solo-%d-b", i)}, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	id := uuid.Must(uuid.NewV4())
+	online[id] = true
+	if err := m.Enqueue(context.Background(), id, []string{"nobody", fmt.Sprintf("solo-%d", depth/2)}, false); err != nil {
+		b.Fatal(err)
+	}
+	newcomer := m.waiting[id]
+	now := m.Clock.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p, _ := m.oldestPartner(newcomer, online, now); p == nil {
+			b.Fatal("no partner found")
+		}
+	}
+}
+
+// BenchmarkPartnerLookup looks partners up through the tag buckets, so its
+// cost follows the newcomer's tags, not the queue depth
+func BenchmarkPartnerLookup(b *testing.B) {
+	for _, depth := range []int{10, 100, maxQueueSize - 1} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) { benchmarkPartnerLookup(b, depth) })
+	}
+}
+
+func TestPartnerLookupIsSublinearInQueueDepth(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing comparison")
+	}
+	shallow := testing.Benchmark(func(b *testing.B) { benchmarkPartnerLookup(b, 10) })
+	deep := testing.Benchmark(func(b *testing.B) { benchmarkPartnerLookup(b, maxQueueSize-1) })
+	// A scan would be ~100x slower on the deep queue; allow noise well short
+	// of that
+	if ratio := float64(deep.NsPerOp()) / float64(shallow.NsPerOp()); ratio > 10 {
+		t.Fatalf("lookup took %dns at depth %d vs %dns at depth 10 (%.1fx)", deep.NsPerOp(), maxQueueSize-1, shallow.NsPerOp(), ratio)
+	}
+}
+
+// pairUsers connects and pairs two new users, returning their connections
+func pairUsers(t *testing.T, m *Matchmaker, hub *Hub) (a, b *Connection) {
+	t.Helper()
+	a = register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	b = register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	for _, c := range []*Connection{a, b} {
+		if err := m.Enqueue(context.Background(), c.UserID, []string{"go"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.tryMatch()
+	assertPaired(t, m, a.UserID, b.UserID)
+	return a, b
+}
+
+func TestAnonIDRotationKeepsPairing(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	m.AnonIDMaxLifetime = time.Hour
+	a, b := pairUsers(t, m, hub)
+	oldA, oldB, _ := m.AnonymousIDs(a.UserID)
+	m.SetAnonymousKeys(a.UserID, AnonymousKeys{IdentityPub: []byte{1}})
+	m.Reveal(a.UserID)
+
+	clock.Advance(59 * time.Minute)
+	m.cleanupWaiting()
+	if self, _, _ := m.AnonymousIDs(a.UserID); self != oldA {
+		t.Fatal("rotated before the lifetime")
+	}
+
+	clock.Advance(time.Minute)
+	m.cleanupWaiting()
+	assertPaired(t, m, a.UserID, b.UserID)
+	newA, newB, _ := m.AnonymousIDs(a.UserID)
+	if newA == oldA || newB == oldB {
+		t.Fatal("anonymous IDs not rotated")
+	}
+	if _, ok := m.ResolvePeer(a.UserID, oldB); ok {
+		t.Fatal("old anonymous ID still resolves")
+	}
+	if p, ok := m.ResolvePeer(a.UserID, newB); !ok || p != b.UserID {
+		t.Fatal("new anonymous ID doesn't resolve")
+	}
+	if _, ok := m.AnonymousKeysOf(a.UserID); ok {
+		t.Fatal("per-pairing keys survived rotation")
+	}
+	if _, mutual, _ := m.Reveal(b.UserID); !mutual {
+		t.Fatal("reveal consent lost on rotation")
+	}
+
+	for _, tc := range []struct {
+		conn       *Connection
+		self, peer uuid.UUID
+	}{{a, newA, newB}, {b, newB, newA}} {
+		var got map[string]string
+		select {
+		case f := <-tc.conn.Send:
+			json.Unmarshal(f.Data, &got)
+		default:
+			t.Fatal("no rotation notice")
+		}
+		if got["type"] != "anonymous_id_rotated" || got["anonymous_id"] != tc.self.String() || got["pair_id"] != tc.peer.String() {
+			t.Fatalf("notice = %v", got)
+		}
+	}
+}
+
+func TestEnqueueAgainGetsFreshAnonID(t *testing.T) {
+	m, hub, _ := newTestMatchmaker(t)
+	a, b := pairUsers(t, m, hub)
+	oldA, oldB, _ := m.AnonymousIDs(a.UserID)
+
+	if err := m.Enqueue(context.Background(), a.UserID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := m.AnonymousIDs(b.UserID); ok {
+		t.Fatal("old pairing kept its anonymous IDs")
+	}
+	if _, ok := m.ResolvePeer(b.UserID, oldA); ok {
+		t.Fatal("old anonymous ID still resolves")
+	}
+
+	c := register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	if err := m.Enqueue(context.Background(), c.UserID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	m.tryMatch()
+	assertPaired(t, m, a.UserID, c.UserID)
+	if self, _, _ := m.AnonymousIDs(a.UserID); self == oldA || self == oldB {
+		t.Fatal("anonymous ID reused across pairings")
+	}
+}
+
+func TestShutdownNotifiesQueuedUsersAndClearsState(t *testing.T) {
+	m, hub, _ := newTestMatchmaker(t)
+	a, b := pairUsers(t, m, hub)
+	waiting := register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	if err := m.Enqueue(context.Background(), waiting.UserID, []string{"rust"}, false); err != nil {
+		t.Fatal(err)
+	}
+	m.TickInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	select {
+	case f := <-waiting.Send:
+		var msg map[string]string
+		if err := json.Unmarshal(f.Data, &msg); err != nil || msg["type"] != "service_restarting" {
+			t.Fatalf("queued user got %s", f.Data)
+		}
+	default:
+		t.Fatal("queued user was not notified")
+	}
+	for _, c := range []*Connection{a, b} {
+		if len(c.Send) != 0 {
+			t.Fatalf("paired user was sent %d frames", len(c.Send))
+		}
+		if _, ok := m.GetPair(c.UserID); ok {
+			t.Fatal("pairing survived shutdown")
+		}
+	}
+	if _, ok := m.Position(waiting.UserID); ok {
+		t.Fatal("queue entry survived shutdown")
+	}
+	if stats := m.Stats(); stats.Waiting != 0 || stats.ActivePairings != 0 || len(stats.Buckets) != 0 {
+		t.Fatalf("stats after shutdown = %+v", stats)
+	}
+}
+
+func TestPositionDecreasesAsUsersAheadAreMatched(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	first := queueUser(t, m, hub, "go")
+	clock.Advance(time.Second)
+	second := queueUser(t, m, hub, "go")
+	clock.Advance(time.Second)
+	target := queueUser(t, m, hub, "go")
+
+	// Nobody has been paired recently, so there's no estimate yet
+	pos, ok := m.Position(target)
+	if !ok || pos.Position != 3 || pos.BucketSize != 3 || pos.EstimatedWait != 0 {
+		t.Fatalf("before matching: %+v, %t", pos, ok)
+	}
+
+	// The two users ahead pair with each other and target moves to the front
+	m.tryMatch()
+	assertPaired(t, m, first, second)
+	pos, ok = m.Position(target)
+	if !ok || pos.Position != 1 || pos.BucketSize != 1 || pos.EstimatedWait <= 0 {
+		t.Fatalf("after matching: %+v, %t", pos, ok)
+	}
+
+	newcomer := queueUser(t, m, hub, "go")
+	if pos, _ := m.Position(newcomer); pos.Position != 2 {
+		t.Fatalf("newcomer position %d", pos.Position)
+	}
+	m.tryMatch()
+	assertPaired(t, m, target, newcomer)
+	if _, ok := m.Position(target); ok {
+		t.Fatal("matched user still has a queue position")
+	}
+}
+
+// frameTypes drains c and returns the type of each JSON frame queued for it
+func frameTypes(t *testing.T, c *Connection) []string {
+	t.Helper()
+	var types []string
+	for {
+		select {
+		case f := <-c.Send:
+			var msg map[string]string
+			if err := json.Unmarshal(f.Data, &msg); err != nil {
+				t.Fatalf("frame %s: %v", f.Data, err)
+			}
+			types = append(types, msg["type"])
+		default:
+			return types
+		}
+	}
+}
+
+func TestEndingMatchRequeuesAutoRequeueUsers(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	m.RematchCooldown = 5 * time.Minute
+	auto := register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	manual := register(t, hub, uuid.Must(uuid.NewV4()), "device-1")
+	if err := m.Enqueue(context.Background(), auto.UserID, []string{"go", "rust"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Enqueue(context.Background(), manual.UserID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	m.tryMatch()
+	assertPaired(t, m, auto.UserID, manual.UserID)
+
+	if peer, ok := m.EndMatch(manual.UserID); !ok || peer != auto.UserID {
+		t.Fatalf("EndMatch = %s, %t", peer, ok)
+	}
+	if got := frameTypes(t, auto); len(got) != 2 || got[0] != "match_ended" || got[1] != "requeued" {
+		t.Fatalf("auto-requeue user got %v", got)
+	}
+	if got := frameTypes(t, manual); len(got) != 0 {
+		t.Fatalf("user who ended the match got %v", got)
+	}
+	if _, ok := m.Position(auto.UserID); !ok {
+		t.Fatal("auto-requeue user is not waiting")
+	}
+	if _, ok := m.Position(manual.UserID); ok {
+		t.Fatal("user without auto-requeue was put back in the queue")
+	}
+	if tags := m.waiting[auto.UserID].tags; len(tags) != 2 || tags[0] != "go" || tags[1] != "rust" {
+		t.Fatalf("requeued with tags %v", tags)
+	}
+
+	// The cooldown keeps the same two apart, but not anyone else
+	if err := m.Enqueue(context.Background(), manual.UserID, []string{"go"}, false); err != nil {
+		t.Fatal(err)
+	}
+	m.tryMatch()
+	if _, ok := m.GetPair(auto.UserID); ok {
+		t.Fatal("re-paired with the previous partner during the cooldown")
+	}
+	clock.Advance(5 * time.Minute)
+	m.tryMatch()
+	assertPaired(t, m, auto.UserID, manual.UserID)
+
+	// Auto-requeue carries over to the next match
+	m.EndMatch(auto.UserID)
+	if _, ok := m.Position(auto.UserID); !ok {
+		t.Fatal("auto-requeue lost after the first requeue")
+	}
+}
+
+func TestMinOverlapWithFallback(t *testing.T) {
+	m, hub, clock := newTestMatchmaker(t)
+	m.MinOverlap = 2
+	m.OverlapFallback = time.Minute
+	oneA := queueUser(t, m, hub, "music", "go")
+	oneB := queueUser(t, m, hub, "music", "rust")
+	clock.Advance(30 * time.Second)
+	twoA := queueUser(t, m, hub, "chess", "poker", "rust")
+	twoB := queueUser(t, m, hub, "chess", "poker")
+
+	// Two shared tags pair at once; one shared tag waits
+	m.tryMatch()
+	assertPaired(t, m, twoA, twoB)
+	if _, ok := m.GetPair(oneA); ok {
+		t.Fatal("paired on a single shared tag before the fallback")
+	}
+
+	clock.Advance(29 * time.Second)
+	m.tryMatch()
+	if _, ok := m.GetPair(oneA); ok {
+		t.Fatal("paired on a single shared tag before the fallback")
+	}
+	clock.Advance(time.Second)
+	m.tryMatch()
+	assertPaired(t, m, oneA, oneB)
+}
+
+func TestEnqueueWhileMatchedPolicies(t *testing.T) {
+	t.Run("end", func(t *testing.T) {
+		m, hub, _ := newTestMatchmaker(t)
+		m.WhileMatched = WhileMatchedEnd
+		a, b := pairUsers(t, m, hub)
+		if err := m.Enqueue(context.Background(), a.UserID, []string{"go"}, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []uuid.UUID{a.UserID, b.UserID} {
+			if _, ok := m.GetPair(id); ok {
+				t.Fatalf("%s still paired", id)
+			}
+		}
+		if _, ok := m.Position(a.UserID); !ok {
+			t.Fatal("enqueueing user is not waiting")
+		}
+		if _, ok := m.Position(b.UserID); ok {
+			t.Fatal("peer was queued too")
+		}
+		if got := frameTypes(t, b); len(got) != 1 || got[0] != "match_ended" {
+			t.Fatalf("peer got %v", got)
+		}
+		if got := frameTypes(t, a); len(got) != 0 {
+			t.Fatalf("enqueueing user got %v", got)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		m, hub, _ := newTestMatchmaker(t)
+		m.WhileMatched = WhileMatchedReject
+		a, b := pairUsers(t, m, hub)
+		if err := m.Enqueue(context.Background(), a.UserID, []string{"go"}, false); !errors.Is(err, ErrAlreadyMatched) {
+			t.Fatalf("Enqueue = %v, want ErrAlreadyMatched", err)
+		}
+		assertPaired(t, m, a.UserID, b.UserID)
+		assertPaired(t, m, b.UserID, a.UserID)
+		if _, ok := m.Position(a.UserID); ok {
+			t.Fatal("rejected user was queued")
+		}
+		if got := frameTypes(t, b); len(got) != 0 {
+			t.Fatalf("peer got %v", got)
+		}
+	})
+}
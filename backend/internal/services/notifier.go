@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/securechat/backend/internal/config"
+)
+
+// OTP delivery channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Notifier delivers one-time codes to users
+type Notifier interface {
+	SendOTP(ctx context.Context, identifier, channel, code string) error
+}
+
+// OTPChannel picks the delivery channel for an identifier: anything that
+// looks like an email address gets email, everything else SMS
+func OTPChannel(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return ChannelEmail
+	}
+	return ChannelSMS
+}
+
+// NewNotifier builds the notifier selected by OTP_DELIVERY
+func NewNotifier(cfg *config.Config) Notifier {
+	if cfg.OTPDelivery != "provider" {
+		return LogNotifier{}
+	}
+	return ChannelNotifier{
+		Email: &EmailNotifier{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword},
+		SMS:   &SMSNotifier{URL: cfg.SMSWebhookURL, Token: cfg.SMSWebhookToken, Client: &http.Client{Timeout: 10 * time.Second}},
+	}
+}
+
+// LogNotifier writes codes to the server log. It is meant for development,
+// where no provider is configured.
+type LogNotifier struct{}
+
+func (LogNotifier) SendOTP(ctx context.Context, identifier, channel, code string) error {
+	log.Printf("OTP for %s via %s: %s", identifier, channel, code)
+	return nil
+}
+
+// ChannelNotifier routes each code to the notifier for its channel
+type ChannelNotifier struct {
+	Email Notifier
+	SMS   Notifier
+}
+
+func (n ChannelNotifier) SendOTP(ctx context.Context, identifier, channel, code string) error {
+	switch channel {
+	case ChannelEmail:
+		return n.Email.SendOTP(ctx, identifier, channel, code)
+	case ChannelSMS:
+		return n.SMS.SendOTP(ctx, identifier, channel, code)
+	default:
+		return fmt.Errorf("unknown otp channel %q", channel)
+	}
+}
+
+// EmailNotifier sends codes over SMTP. Username may be empty for relays that
+// don't require authentication.
+type EmailNotifier struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (n *EmailNotifier) SendOTP(ctx context.Context, identifier, channel, code string) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Your verification code\r\n\r\nYour verification code is %s\r\n", n.From, identifier, code)
+	return smtp.SendMail(n.Addr, auth, n.From, []string{identifier}, []byte(msg))
+}
+
+// SMSNotifier posts codes to an HTTP gateway as {"to": ..., "message": ...}
+type SMSNotifier struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (n *SMSNotifier) SendOTP(ctx context.Context, identifier, channel, code string) error {
+	body, err := json.Marshal(map[string]string{
+		"to":      identifier,
+		"message": "Your verification code is " + code,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway returned %s", resp.Status)
+	}
+	return nil
+}
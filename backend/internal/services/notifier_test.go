@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/securechat/backend/internal/config"
+)
+
+func TestChannelNotifierRoutesByChannel(t *testing.T) {
+	email, sms := &recordingNotifier{}, &recordingNotifier{}
+	n := ChannelNotifier{Email: email, SMS: sms}
+	if err := n.SendOTP(context.Background(), "erin@example.com", ChannelEmail, "111111"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SendOTP(context.Background(), "+15550101", ChannelSMS, "222222"); err != nil {
+		t.Fatal(err)
+	}
+	if got := email.sent("erin@example.com"); len(got) != 1 || got[0] != "111111" || len(email.codes) != 1 {
+		t.Fatalf("email got %v", email.codes)
+	}
+	if got := sms.sent("+15550101"); len(got) != 1 || got[0] != "222222" || len(sms.codes) != 1 {
+		t.Fatalf("sms got %v", sms.codes)
+	}
+	if err := n.SendOTP(context.Background(), "x", "pigeon", "333333"); err == nil {
+		t.Fatal("unknown channel accepted")
+	}
+}
+
+func TestSMSNotifierPostsToGateway(t *testing.T) {
+	var got map[string]string
+	var auth string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	n := &SMSNotifier{URL: srv.URL, Token: "secret", Client: srv.Client()}
+	if err := n.SendOTP(context.Background(), "+15550102", ChannelSMS, "424242"); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer secret" || got["to"] != "+15550102" || got["message"] != "Your verification code is 424242" {
+		t.Fatalf("gateway got %v with auth %q", got, auth)
+	}
+
+	status = http.StatusBadGateway
+	if err := n.SendOTP(context.Background(), "+15550102", ChannelSMS, "424242"); err == nil {
+		t.Fatal("gateway error not reported")
+	}
+}
+
+func TestNewNotifierDefaultsToLog(t *testing.T) {
+	if _, ok := NewNotifier(&config.Config{}).(LogNotifier); !ok {
+		t.Fatal("expected LogNotifier without a provider")
+	}
+	if _, ok := NewNotifier(&config.Config{OTPDelivery: "provider"}).(ChannelNotifier); !ok {
+		t.Fatal("expected ChannelNotifier for OTP_DELIVERY=provider")
+	}
+}
@@ -1,9 +1,12 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
-	"encoding/base32"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -14,25 +17,102 @@ import (
 	"github.com/securechat/backend/internal/models"
 )
 
-func generateOTP(n int) (string, error) {
-	b := make([]byte, n)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+const (
+	otpAlphabetNumeric = "0123456789"
+	// Base32 alphabet: omits 0, 1, 8 and 9 (Base32 uses only 2–7), so 0, 1 and
+	// 8 can't be confused with O, I and B
+	otpAlphabetAlphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+func otpAlphabet(name string) string {
+	if name == "numeric" {
+		return otpAlphabetNumeric
+	}
+	return otpAlphabetAlphanumeric
+}
+
+// generateOTP returns n characters drawn uniformly from alphabet. Bytes that
+// would introduce modulo bias are rejected and redrawn.
+func generateOTP(n int, alphabet string) (string, error) {
+	limit := 256 - 256%len(alphabet)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			out = append(out, alphabet[int(b)%len(alphabet)])
+			if len(out) == n {
+				break
+			}
+		}
 	}
-	return base32.StdEncoding.EncodeToString(b)[:n], nil
+	return string(out), nil
+}
+
+// normalizeOTP maps user input onto the generator's alphabet
+func normalizeOTP(otp string) string {
+	return strings.ToUpper(strings.TrimSpace(otp))
 }
 
 type OTPService struct {
-	DB  *gorm.DB
-	Cfg *config.Config
+	DB       *gorm.DB
+	Cfg      *config.Config
+	Notifier Notifier
+	Clock    Clock
+}
+
+func NewOTPService(db *gorm.DB, cfg *config.Config, notifier Notifier) *OTPService {
+	return &OTPService{DB: db, Cfg: cfg, Notifier: notifier, Clock: RealClock{}}
 }
 
-func NewOTPService(db *gorm.DB, cfg *config.Config) *OTPService {
-	return &OTPService{DB: db, Cfg: cfg}
+// OTPThrottledError is returned when an identifier asks for codes too often
+type OTPThrottledError struct {
+	RetryAfter time.Duration
 }
 
-func (s *OTPService) CreateRegistrationSession(identifier string) (string, error) {
-	otp, err := generateOTP(6)
+func (e *OTPThrottledError) Error() string {
+	return fmt.Sprintf("otp throttled, retry after %s", e.RetryAfter)
+}
+
+// checkIssueLimits drops the identifier's expired sessions and refuses a new
+// code while the last one is younger than the resend interval or the active
+// cap is reached. Only the newest session can be verified, so older active
+// rows exist purely to count issuances until they expire.
+func (s *OTPService) checkIssueLimits(identifier string, now time.Time) error {
+	if err := s.DB.Where("identifier = ? AND expires_at <= ?", identifier, now).Delete(&models.RegistrationSession{}).Error; err != nil {
+		return err
+	}
+	var active []models.RegistrationSession
+	if err := s.DB.Select("created_at", "expires_at").Where("identifier = ?", identifier).Order("created_at asc").Find(&active).Error; err != nil {
+		return err
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	interval := time.Duration(s.Cfg.OTPResendIntervalSec) * time.Second
+	if wait := active[len(active)-1].CreatedAt.Add(interval).Sub(now); wait > 0 {
+		return &OTPThrottledError{RetryAfter: wait}
+	}
+	if s.Cfg.OTPMaxActiveSessions > 0 && len(active) >= s.Cfg.OTPMaxActiveSessions {
+		// A slot frees up when the oldest active code expires
+		return &OTPThrottledError{RetryAfter: active[len(active)-s.Cfg.OTPMaxActiveSessions].ExpiresAt.Sub(now)}
+	}
+	return nil
+}
+
+// CreateRegistrationSession issues a code for identifier and delivers it through
+// the notifier. The code is also returned so development builds can echo it.
+func (s *OTPService) CreateRegistrationSession(ctx context.Context, identifier string) (string, error) {
+	now := s.Clock.Now()
+	if err := s.checkIssueLimits(identifier, now); err != nil {
+		return "", err
+	}
+	otp, err := generateOTP(s.Cfg.OTPLength, otpAlphabet(s.Cfg.OTPAlphabet))
 	if err != nil {
 		return "", err
 	}
@@ -48,29 +128,100 @@ func (s *OTPService) CreateRegistrationSession(identifier string) (string, error
 		ID:         id,
 		Identifier: identifier,
 		OTPHash:    hashed,
-		ExpiresAt:  time.Now().Add(time.Duration(s.Cfg.OTPExpiryMinutes) * time.Minute),
+		ExpiresAt:  now.Add(time.Duration(s.Cfg.OTPExpiryMinutes) * time.Minute),
+		CreatedAt:  now,
 	}
 	if err := s.DB.Create(sess).Error; err != nil {
 		return "", err
 	}
 
-	// Verify insert worked
-	var count int64
-	s.DB.Model(&models.RegistrationSession{}).Where("identifier = ?", identifier).Count(&count)
-	log.Printf("DEBUG: Inserted session for %s, count in DB: %d", identifier, count)
-
-	// TODO: send OTP via SMS/Email provider in production
+	if err := s.Notifier.SendOTP(ctx, identifier, OTPChannel(identifier), otp); err != nil {
+		// An undelivered code must not count against the resend limits
+		s.DB.Delete(sess)
+		return "", fmt.Errorf("deliver otp: %w", err)
+	}
 	return otp, nil
 }
 
+// ErrOTPConsumed means the code was correct but a concurrent verification
+// consumed the session first
+var ErrOTPConsumed = errors.New("otp already used")
+
+// dummyOTPHash is compared against when no session exists so that unknown
+// identifiers cost the same bcrypt work as a wrong code
+var dummyOTPHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-otp"), bcrypt.DefaultCost)
+
+// VerifyRegistrationSession checks otp against the newest live session for
+// identifier. A missing session is reported exactly like a wrong code. The
+// session is consumed by a conditional delete, so of two concurrent
+// verifications only the one that deletes the row succeeds; the other gets
+// ErrOTPConsumed.
 func (s *OTPService) VerifyRegistrationSession(identifier, otp string) (bool, error) {
 	var sess models.RegistrationSession
-	if err := s.DB.Where("identifier = ? AND expires_at > ?", identifier, time.Now()).Order("created_at desc").First(&sess).Error; err != nil {
+	if err := s.DB.Where("identifier = ? AND expires_at > ?", identifier, s.Clock.Now()).Order("created_at desc").First(&sess).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			bcrypt.CompareHashAndPassword(dummyOTPHash, []byte(normalizeOTP(otp)))
+			return false, nil
+		}
 		return false, err
 	}
-	if err := bcrypt.CompareHashAndPassword(sess.OTPHash, []byte(otp)); err != nil {
+	if err := bcrypt.CompareHashAndPassword(sess.OTPHash, []byte(normalizeOTP(otp))); err != nil {
 		return false, nil
 	}
-	s.DB.Delete(&sess)
+	res := s.DB.Where("id = ?", sess.ID).Delete(&models.RegistrationSession{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, ErrOTPConsumed
+	}
 	return true, nil
 }
+
+// DeleteExpired removes every expired registration session and returns how
+// many were deleted. checkIssueLimits only prunes the identifier it is asked
+// about, so abandoned identifiers are left to this sweep.
+func (s *OTPService) DeleteExpired() (int64, error) {
+	res := s.DB.Where("expires_at <= ?", s.Clock.Now()).Delete(&models.RegistrationSession{})
+	return res.RowsAffected, res.Error
+}
+
+// RunCleanup periodically deletes expired registration sessions until ctx is
+// cancelled
+func (s *OTPService) RunCleanup(ctx context.Context) {
+	if s.Cfg.OTPCleanupIntervalSec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.Cfg.OTPCleanupIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.DeleteExpired()
+			if err != nil {
+				log.Printf("registration session cleanup error: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("removed %d expired registration sessions", n)
+			}
+		}
+	}
+}
+
+// PendingRegistrationSession reports whether a non-expired registration session
+// exists for identifier and how long the newest one remains valid.
+func (s *OTPService) PendingRegistrationSession(identifier string) (time.Duration, bool, error) {
+	var sess models.RegistrationSession
+	err := s.DB.Where("identifier = ? AND expires_at > ?", identifier, s.Clock.Now()).Order("expires_at desc").First(&sess).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return sess.ExpiresAt.Sub(s.Clock.Now()), true, nil
+}
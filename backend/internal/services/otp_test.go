@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+// recordingNotifier keeps the codes it is asked to deliver and the channel
+// each went to, or fails with err
+type recordingNotifier struct {
+	mu       sync.Mutex
+	codes    map[string][]string
+	channels map[string][]string
+	err      error
+}
+
+func (n *recordingNotifier) SendOTP(_ context.Context, identifier, channel, code string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	if n.codes == nil {
+		n.codes = make(map[string][]string)
+		n.channels = make(map[string][]string)
+	}
+	n.codes[identifier] = append(n.codes[identifier], code)
+	n.channels[identifier] = append(n.channels[identifier], channel)
+	return nil
+}
+
+func (n *recordingNotifier) sent(identifier string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.codes[identifier]
+}
+
+func newTestOTPService(t *testing.T) (*OTPService, *recordingNotifier, *ManualClock) {
+	t.Helper()
+	cfg := &config.Config{OTPExpiryMinutes: 10, OTPLength: 6, OTPAlphabet: "numeric", OTPResendIntervalSec: 30, OTPMaxActiveSessions: 3}
+	notifier := &recordingNotifier{}
+	s := NewOTPService(dbtest.New(t), cfg, notifier)
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.Clock = clock
+	return s, notifier, clock
+}
+
+func TestOTPExpiresOnClock(t *testing.T) {
+	s, notifier, clock := newTestOTPService(t)
+	code, err := s.CreateRegistrationSession(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(10*time.Minute + time.Second)
+	if ok, err := s.VerifyRegistrationSession("alice@example.com", code); ok || err != nil {
+		t.Fatalf("expired code: %t, %v", ok, err)
+	}
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Fatalf("DeleteExpired = %d, %v", n, err)
+	}
+
+	code, err = s.CreateRegistrationSession(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := notifier.sent("alice@example.com"); len(sent) != 2 || sent[1] != code {
+		t.Fatalf("sent = %v", sent)
+	}
+	clock.Advance(9 * time.Minute)
+	if ok, err := s.VerifyRegistrationSession("alice@example.com", code); !ok || err != nil {
+		t.Fatalf("live code: %t, %v", ok, err)
+	}
+}
+
+func TestOTPResendIntervalOnClock(t *testing.T) {
+	s, _, clock := newTestOTPService(t)
+	if _, err := s.CreateRegistrationSession(context.Background(), "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Second)
+	_, err := s.CreateRegistrationSession(context.Background(), "bob@example.com")
+	throttled, ok := err.(*OTPThrottledError)
+	if !ok || throttled.RetryAfter != 20*time.Second {
+		t.Fatalf("err = %v", err)
+	}
+	clock.Advance(20 * time.Second)
+	if _, err := s.CreateRegistrationSession(context.Background(), "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRapidRegistrationIsThrottledWithoutAccumulatingRows(t *testing.T) {
+	s, notifier, clock := newTestOTPService(t)
+	sessions := func() int64 {
+		var n int64
+		s.DB.Model(&models.RegistrationSession{}).Where("identifier = ?", "carol@example.com").Count(&n)
+		return n
+	}
+
+	for i := 0; i < 20; i++ {
+		_, err := s.CreateRegistrationSession(context.Background(), "carol@example.com")
+		if _, throttled := err.(*OTPThrottledError); i > 0 && !throttled {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if n := sessions(); n != 1 || len(notifier.sent("carol@example.com")) != 1 {
+		t.Fatalf("%d sessions, %d codes sent after a burst", n, len(notifier.sent("carol@example.com")))
+	}
+
+	// Spaced requests are capped at OTPMaxActiveSessions until the oldest expires
+	for i := 0; i < 2; i++ {
+		clock.Advance(30 * time.Second)
+		if _, err := s.CreateRegistrationSession(context.Background(), "carol@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(30 * time.Second)
+	_, err := s.CreateRegistrationSession(context.Background(), "carol@example.com")
+	throttled, ok := err.(*OTPThrottledError)
+	if !ok || throttled.RetryAfter != 10*time.Minute-90*time.Second {
+		t.Fatalf("over the cap: %v", err)
+	}
+	if n := sessions(); n != 3 {
+		t.Fatalf("%d sessions at the cap", n)
+	}
+
+	// Expired sessions are swept when the next code is issued
+	clock.Advance(throttled.RetryAfter)
+	if _, err := s.CreateRegistrationSession(context.Background(), "carol@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := sessions(); n != 3 {
+		t.Fatalf("%d sessions after the oldest expired", n)
+	}
+}
+
+func TestCreateRegistrationSessionDeliversOnIdentifierChannel(t *testing.T) {
+	s, notifier, _ := newTestOTPService(t)
+	for identifier, channel := range map[string]string{"carol@example.com": ChannelEmail, "+15550100": ChannelSMS} {
+		code, err := s.CreateRegistrationSession(context.Background(), identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 6 {
+			t.Fatalf("code %q", code)
+		}
+		notifier.mu.Lock()
+		codes, channels := notifier.codes[identifier], notifier.channels[identifier]
+		notifier.mu.Unlock()
+		if len(codes) != 1 || codes[0] != code || channels[0] != channel {
+			t.Fatalf("%s: delivered %v via %v, want %q via %s", identifier, codes, channels, code, channel)
+		}
+	}
+}
+
+func TestCreateRegistrationSessionUndeliveredLeavesNoSession(t *testing.T) {
+	s, notifier, _ := newTestOTPService(t)
+	notifier.err = errors.New("gateway down")
+	if _, err := s.CreateRegistrationSession(context.Background(), "dave@example.com"); !errors.Is(err, notifier.err) {
+		t.Fatalf("err = %v", err)
+	}
+	var n int64
+	s.DB.Model(&models.RegistrationSession{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d sessions left after a failed delivery", n)
+	}
+
+	// The failure doesn't count against the resend interval
+	notifier.err = nil
+	if _, err := s.CreateRegistrationSession(context.Background(), "dave@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// medianDuration runs f n times and returns the median run time
+func medianDuration(n int, f func()) time.Duration {
+	runs := make([]time.Duration, n)
+	for i := range runs {
+		start := time.Now()
+		f()
+		runs[i] = time.Since(start)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i] < runs[j] })
+	return runs[n/2]
+}
+
+func TestVerifyUnknownIdentifierCostsLikeWrongCode(t *testing.T) {
+	s, _, _ := newTestOTPService(t)
+	if _, err := s.CreateRegistrationSession(context.Background(), "erin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := medianDuration(5, func() {
+		if ok, err := s.VerifyRegistrationSession("erin@example.com", "000000x"); ok || err != nil {
+			t.Fatalf("wrong code: %t, %v", ok, err)
+		}
+	})
+	unknown := medianDuration(5, func() {
+		if ok, err := s.VerifyRegistrationSession("nobody@example.com", "000000x"); ok || err != nil {
+			t.Fatalf("unknown identifier: %t, %v", ok, err)
+		}
+	})
+	// Both pay for one bcrypt comparison; without the dummy comparison an
+	// unknown identifier returns after a single indexed lookup
+	if unknown < wrong/2 || unknown > wrong*2 {
+		t.Fatalf("unknown identifier took %v, wrong code %v", unknown, wrong)
+	}
+}
+
+func TestGenerateOTPLengthAndAlphabet(t *testing.T) {
+	for _, alphabet := range []string{otpAlphabetNumeric, otpAlphabetAlphanumeric} {
+		for n := 4; n <= 12; n++ {
+			code, err := generateOTP(n, alphabet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(code) != n || strings.Trim(code, alphabet) != "" {
+				t.Fatalf("generateOTP(%d, %q) = %q", n, alphabet, code)
+			}
+		}
+	}
+	if otpAlphabet("numeric") != otpAlphabetNumeric || otpAlphabet("alphanumeric") != otpAlphabetAlphanumeric {
+		t.Fatal("alphabet names map to the wrong alphabets")
+	}
+}
+
+func TestGenerateOTPIsUnbiased(t *testing.T) {
+	// 256 isn't a multiple of 10, so a plain modulo would favour 0-5 by 4%
+	const draws = 100000
+	counts := make(map[rune]int)
+	for i := 0; i < draws/10; i++ {
+		code, err := generateOTP(10, otpAlphabetNumeric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range code {
+			counts[r]++
+		}
+	}
+	// Chi-square with 9 degrees of freedom; 27.9 is the 0.1% critical value
+	expected := float64(draws) / 10
+	chi2 := 0.0
+	for _, r := range otpAlphabetNumeric {
+		d := float64(counts[r]) - expected
+		chi2 += d * d / expected
+	}
+	if chi2 > 27.9 {
+		t.Fatalf("digit counts %v look biased (chi-square %.1f)", counts, chi2)
+	}
+}
+
+func TestAlphanumericOTPVerifiesCaseInsensitively(t *testing.T) {
+	s, _, _ := newTestOTPService(t)
+	s.Cfg.OTPAlphabet = "alphanumeric"
+	s.Cfg.OTPLength = 8
+	code, err := s.CreateRegistrationSession(context.Background(), "frank@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 8 || strings.Trim(code, otpAlphabetAlphanumeric) != "" {
+		t.Fatalf("code %q", code)
+	}
+	if ok, err := s.VerifyRegistrationSession("frank@example.com", " "+strings.ToLower(code)+" "); !ok || err != nil {
+		t.Fatalf("lower-case code: %t, %v", ok, err)
+	}
+}
+
+func TestVerifyPicksNewestLiveSessionAmongMany(t *testing.T) {
+	s, _, clock := newTestOTPService(t)
+	now := clock.Now()
+	session := func(identifier, code string, created, expires time.Duration) models.RegistrationSession {
+		var hash []byte
+		if code != "" {
+			hash, _ = bcrypt.GenerateFromPassword([]byte(code), bcrypt.MinCost)
+		}
+		return models.RegistrationSession{ID: uuid.Must(uuid.NewV4()), Identifier: identifier, OTPHash: hash, CreatedAt: now.Add(created), ExpiresAt: now.Add(expires)}
+	}
+	var rows []models.RegistrationSession
+	for i := 0; i < 5000; i++ {
+		rows = append(rows, session(fmt.Sprintf("user%d@example.com", i), "", -time.Minute, 9*time.Minute))
+	}
+	rows = append(rows,
+		session("dave@example.com", "111111", -3*time.Minute, 7*time.Minute),
+		session("dave@example.com", "222222", -time.Minute, 9*time.Minute),
+		session("dave@example.com", "333333", 0, -time.Second), // newest, but expired
+	)
+	if err := s.DB.CreateInBatches(rows, 500).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := s.VerifyRegistrationSession("dave@example.com", "333333"); ok {
+		t.Fatal("expired session verified")
+	}
+	if ok, _ := s.VerifyRegistrationSession("dave@example.com", "111111"); ok {
+		t.Fatal("older session verified")
+	}
+	if ok, err := s.VerifyRegistrationSession("dave@example.com", "222222"); !ok || err != nil {
+		t.Fatalf("newest live session: %t, %v", ok, err)
+	}
+
+	// The lookup is served by the (identifier, expires_at) index rather than a scan
+	var plan []struct{ Detail string }
+	s.DB.Raw("EXPLAIN QUERY PLAN SELECT * FROM registration_sessions WHERE identifier = ? AND expires_at > ? ORDER BY created_at desc LIMIT 1", "dave@example.com", now).Scan(&plan)
+	if len(plan) == 0 || !strings.Contains(plan[0].Detail, "idx_registration_sessions_identifier_expires") {
+		t.Fatalf("query plan = %+v", plan)
+	}
+}
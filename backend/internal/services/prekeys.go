@@ -1,54 +1,124 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"github.com/securechat/backend/internal/config"
 	"github.com/securechat/backend/internal/models"
 )
 
 type PreKeyService struct {
-	DB *gorm.DB
+	DB    *gorm.DB
+	Cfg   *config.Config
+	Clock Clock
 }
 
-func NewPreKeyService(db *gorm.DB) *PreKeyService {
-	return &PreKeyService{DB: db}
+func NewPreKeyService(db *gorm.DB, cfg *config.Config) *PreKeyService {
+	return &PreKeyService{DB: db, Cfg: cfg, Clock: RealClock{}}
 }
 
-func (s *PreKeyService) StoreSignedPreKey(userID uuid.UUID, keyID string, prekey []byte, signature []byte, expires time.Time) error {
+// WithDB returns a copy of the service bound to db, e.g. an open transaction
+func (s *PreKeyService) WithDB(db *gorm.DB) *PreKeyService {
+	return &PreKeyService{DB: db, Cfg: s.Cfg, Clock: s.Clock}
+}
+
+func (s *PreKeyService) signedPreKeyTTL() time.Duration {
+	return time.Duration(s.Cfg.SignedPreKeyTTLDays) * 24 * time.Hour
+}
+
+func (s *PreKeyService) oneTimePreKeyTTL() time.Duration {
+	return time.Duration(s.Cfg.OneTimePreKeyTTLDays) * 24 * time.Hour
+}
+
+// StoreSignedPreKey stores a signed prekey for one of userID's devices.
+// Keys stored before per-device scoping have an empty device ID.
+func (s *PreKeyService) StoreSignedPreKey(userID uuid.UUID, deviceID, keyID string, prekey []byte, signature []byte) error {
 	pk := &models.PreKey{
 		ID:        uuid.Must(uuid.NewV4()),
 		UserID:    userID,
+		DeviceID:  deviceID,
 		KeyID:     keyID,
 		PreKey:    prekey,
 		Signature: signature,
-		ExpiresAt: expires,
+		ExpiresAt: s.Clock.Now().Add(s.signedPreKeyTTL()),
 	}
 	return s.DB.Create(pk).Error
 }
 
-func (s *PreKeyService) AddOneTimePreKeys(userID uuid.UUID, keys [][]byte) error {
-	for _, k := range keys {
-		otp := &models.OneTimePreKey{
-			ID:     uuid.Must(uuid.NewV4()),
-			UserID: userID,
-			PreKey: k,
-			Used:   false,
-		}
-		if err := s.DB.Create(otp).Error; err != nil {
-			return err
+// oneTimePreKeyBatchSize bounds the rows per INSERT statement
+const oneTimePreKeyBatchSize = 100
+
+// AddOneTimePreKeys stores keys with batched inserts in a single transaction,
+// so either every key is stored or none are. It returns the new keys' IDs in
+// the order given.
+func (s *PreKeyService) AddOneTimePreKeys(userID uuid.UUID, deviceID string, keys [][]byte) ([]uuid.UUID, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	expires := s.Clock.Now().Add(s.oneTimePreKeyTTL())
+	rows := make([]models.OneTimePreKey, len(keys))
+	ids := make([]uuid.UUID, len(keys))
+	for i, k := range keys {
+		ids[i] = uuid.Must(uuid.NewV4())
+		rows[i] = models.OneTimePreKey{
+			ID:        ids[i],
+			UserID:    userID,
+			DeviceID:  deviceID,
+			PreKey:    k,
+			Used:      false,
+			ExpiresAt: expires,
 		}
 	}
-	return nil
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(rows, oneTimePreKeyBatchSize).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// LatestSignedPreKey returns the newest signed prekey for a device, or for
+// the newest across all of the user's devices when deviceID is empty
+func (s *PreKeyService) LatestSignedPreKey(userID uuid.UUID, deviceID string) (*models.PreKey, error) {
+	var pk models.PreKey
+	q := s.DB.Where("user_id = ?", userID)
+	if deviceID != "" {
+		q = q.Where("device_id = ?", deviceID)
+	}
+	if err := q.Order("created_at desc").First(&pk).Error; err != nil {
+		return nil, err
+	}
+	return &pk, nil
 }
 
-func (s *PreKeyService) ConsumeOneTimePreKey(userID uuid.UUID) (*models.OneTimePreKey, error) {
+// availableOneTimePreKeys scopes a query to a device's unused, unexpired and
+// unreserved keys
+func availableOneTimePreKeys(db *gorm.DB, userID uuid.UUID, deviceID string, now time.Time) *gorm.DB {
+	return db.Where("user_id = ? AND device_id = ? AND used = false", userID, deviceID).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Where("reserved_until IS NULL OR reserved_until < ?", now)
+}
+
+// CountOneTimePreKeys returns how many one-time prekeys the device could
+// hand out right now
+func (s *PreKeyService) CountOneTimePreKeys(userID uuid.UUID, deviceID string) (int64, error) {
+	var n int64
+	err := availableOneTimePreKeys(s.DB.Model(&models.OneTimePreKey{}), userID, deviceID, s.Clock.Now()).Count(&n).Error
+	return n, err
+}
+
+func (s *PreKeyService) ConsumeOneTimePreKey(userID uuid.UUID, deviceID string) (*models.OneTimePreKey, error) {
 	var p models.OneTimePreKey
 	tx := s.DB.Begin()
-	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ? AND used = false", userID).Order("created_at asc").First(&p).Error; err != nil {
+	if err := availableOneTimePreKeys(tx.Clauses(clause.Locking{Strength: "UPDATE"}), userID, deviceID, s.Clock.Now()).Order("created_at asc").First(&p).Error; err != nil {
 		tx.Rollback()
 		return nil, err
 	}
@@ -60,3 +130,162 @@ func (s *PreKeyService) ConsumeOneTimePreKey(userID uuid.UUID) (*models.OneTimeP
 	tx.Commit()
 	return &p, nil
 }
+
+// ReserveOneTimePreKey holds one of the device's one-time prekeys for requester
+// without burning it. The key only becomes used once ConfirmOneTimePreKey is
+// called; otherwise it returns to the pool when the reservation lapses.
+func (s *PreKeyService) ReserveOneTimePreKey(userID uuid.UUID, deviceID string, requester uuid.UUID) (*models.OneTimePreKey, error) {
+	var p models.OneTimePreKey
+	now := s.Clock.Now()
+	tx := s.DB.Begin()
+	if err := availableOneTimePreKeys(tx.Clauses(clause.Locking{Strength: "UPDATE"}), userID, deviceID, now).Order("created_at asc").First(&p).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	until := now.Add(time.Duration(s.Cfg.PreKeyReservationSec) * time.Second)
+	p.ReservedBy = &requester
+	p.ReservedUntil = &until
+	if err := tx.Save(&p).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	tx.Commit()
+	return &p, nil
+}
+
+// ErrPreKeyConsumed is returned when revoking a one-time prekey that has
+// already been used
+var ErrPreKeyConsumed = errors.New("one-time prekey already used")
+
+// RevokeOneTimePreKey deletes one of userID's unused one-time prekeys so it
+// is never served again. A key that is only reserved is deleted too: its
+// holder's confirmation will then fail. It returns gorm.ErrRecordNotFound if
+// userID has no such key and ErrPreKeyConsumed if it was already used.
+func (s *PreKeyService) RevokeOneTimePreKey(userID, keyID uuid.UUID) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var p models.OneTimePreKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND user_id = ?", keyID, userID).First(&p).Error; err != nil {
+			return err
+		}
+		if p.Used {
+			return ErrPreKeyConsumed
+		}
+		return tx.Delete(&p).Error
+	})
+}
+
+// ConfirmOneTimePreKey permanently marks a key reserved by requester as used.
+// It returns gorm.ErrRecordNotFound if there is no live reservation.
+func (s *PreKeyService) ConfirmOneTimePreKey(keyID, requester uuid.UUID) error {
+	res := s.DB.Model(&models.OneTimePreKey{}).
+		Where("id = ? AND reserved_by = ? AND used = false AND reserved_until >= ?", keyID, requester, s.Clock.Now()).
+		Update("used", true)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// KeyHealth aggregates key-store state across all users for monitoring
+type KeyHealth struct {
+	UsersWithoutIdentityKey int64
+	// OneTimePreKeyBuckets counts users by how many unused, unexpired
+	// one-time prekeys they have across devices
+	OneTimePreKeyBuckets map[string]int64
+	// Devices whose newest signed prekey has expired, or expires within the
+	// window passed to Health
+	SignedPreKeysExpired      int64
+	SignedPreKeysExpiringSoon int64
+}
+
+// oneTimePreKeyBucket labels a user's one-time prekey count in SQL
+const oneTimePreKeyBucket = `CASE
+	WHEN COALESCE(k.n, 0) = 0 THEN '0'
+	WHEN k.n < 10 THEN '1-9'
+	WHEN k.n < 50 THEN '10-49'
+	WHEN k.n < 100 THEN '50-99'
+	ELSE '100+' END`
+
+// Health computes KeyHealth with aggregate queries; soon is how far ahead a
+// signed prekey expiry counts as expiring soon
+func (s *PreKeyService) Health(soon time.Duration) (KeyHealth, error) {
+	now := s.Clock.Now()
+	h := KeyHealth{OneTimePreKeyBuckets: map[string]int64{"0": 0, "1-9": 0, "10-49": 0, "50-99": 0, "100+": 0}}
+
+	if err := s.DB.Model(&models.User{}).
+		Where("identity_pub_key IS NULL OR length(identity_pub_key) = 0").
+		Count(&h.UsersWithoutIdentityKey).Error; err != nil {
+		return h, err
+	}
+
+	counts := s.DB.Model(&models.OneTimePreKey{}).
+		Select("user_id, COUNT(*) AS n").
+		Where("used = false AND (expires_at IS NULL OR expires_at > ?)", now).
+		Group("user_id")
+	labelled := s.DB.Model(&models.User{}).
+		Select(oneTimePreKeyBucket+" AS bucket").
+		Joins("LEFT JOIN (?) k ON k.user_id = users.id", counts)
+	var rows []struct {
+		Bucket string
+		Users  int64
+	}
+	if err := s.DB.Table("(?) AS b", labelled).Select("bucket, COUNT(*) AS users").Group("bucket").Scan(&rows).Error; err != nil {
+		return h, err
+	}
+	for _, r := range rows {
+		h.OneTimePreKeyBuckets[r.Bucket] = r.Users
+	}
+
+	newest := func(having string, args ...interface{}) (int64, error) {
+		devices := s.DB.Model(&models.PreKey{}).Select("user_id, device_id").Group("user_id, device_id").Having(having, args...)
+		var n int64
+		err := s.DB.Table("(?) AS d", devices).Count(&n).Error
+		return n, err
+	}
+	var err error
+	if h.SignedPreKeysExpired, err = newest("MAX(expires_at) <= ?", now); err != nil {
+		return h, err
+	}
+	h.SignedPreKeysExpiringSoon, err = newest("MAX(expires_at) > ? AND MAX(expires_at) <= ?", now, now.Add(soon))
+	return h, err
+}
+
+// DeleteExpired removes expired signed prekeys and one-time prekeys
+func (s *PreKeyService) DeleteExpired() (int64, error) {
+	now := s.Clock.Now()
+	res := s.DB.Where("expires_at < ?", now).Delete(&models.PreKey{})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	deleted := res.RowsAffected
+	res = s.DB.Where("expires_at < ?", now).Delete(&models.OneTimePreKey{})
+	if res.Error != nil {
+		return deleted, res.Error
+	}
+	return deleted + res.RowsAffected, nil
+}
+
+// RunCleanup periodically deletes expired prekeys until ctx is cancelled
+func (s *PreKeyService) RunCleanup(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.DeleteExpired()
+			if err != nil {
+				log.Printf("prekey cleanup error: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("removed %d expired prekeys", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/config"
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func newTestPreKeyService(t *testing.T) (*PreKeyService, *ManualClock) {
+	t.Helper()
+	cfg := &config.Config{SignedPreKeyTTLDays: 7, OneTimePreKeyTTLDays: 2, PreKeyReservationSec: 60}
+	s := NewPreKeyService(dbtest.New(t), cfg)
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	s.Clock = clock
+	return s, clock
+}
+
+func TestPreKeyTTLsComeFromConfig(t *testing.T) {
+	s, clock := newTestPreKeyService(t)
+	user := dbtest.SeedUser(t, s.DB, "alice")
+	start := clock.Now()
+	if err := s.StoreSignedPreKey(user.ID, "device-2", "spk-1", []byte{1}, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOneTimePreKeys(user.ID, "device-2", [][]byte{{3}, {4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	spk, err := s.LatestSignedPreKey(user.ID, "device-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spk.ExpiresAt.Equal(start.Add(7 * 24 * time.Hour)) {
+		t.Fatalf("signed prekey expires %v", spk.ExpiresAt)
+	}
+	var otks []models.OneTimePreKey
+	s.DB.Where("user_id = ?", user.ID).Find(&otks)
+	for _, k := range otks {
+		if !k.ExpiresAt.Equal(start.Add(2 * 24 * time.Hour)) {
+			t.Fatalf("one-time prekey expires %v", k.ExpiresAt)
+		}
+	}
+
+	// Expired one-time prekeys stop being served and are swept first
+	clock.Advance(3 * 24 * time.Hour)
+	if n, err := s.CountOneTimePreKeys(user.ID, "device-2"); n != 0 || err != nil {
+		t.Fatalf("available after expiry = %d, %v", n, err)
+	}
+	if n, err := s.DeleteExpired(); n != 2 || err != nil {
+		t.Fatalf("DeleteExpired = %d, %v", n, err)
+	}
+	clock.Advance(5 * 24 * time.Hour)
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Fatalf("DeleteExpired = %d, %v", n, err)
+	}
+}
+
+func TestReserveThenConfirmBurnsKey(t *testing.T) {
+	s, _ := newTestPreKeyService(t)
+	owner := dbtest.SeedUser(t, s.DB, "alice")
+	sender := dbtest.SeedUser(t, s.DB, "bob")
+	other := dbtest.SeedUser(t, s.DB, "carol")
+	if _, err := s.AddOneTimePreKeys(owner.ID, "device-1", [][]byte{{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := s.ReserveOneTimePreKey(owner.ID, "device-1", sender.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A held key isn't handed to anyone else
+	if n, _ := s.CountOneTimePreKeys(owner.ID, "device-1"); n != 0 {
+		t.Fatalf("%d keys available while reserved", n)
+	}
+	if _, err := s.ReserveOneTimePreKey(owner.ID, "device-1", other.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("second reservation: %v", err)
+	}
+	// Only the holder can confirm
+	if err := s.ConfirmOneTimePreKey(key.ID, other.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("confirm by another user: %v", err)
+	}
+	if err := s.ConfirmOneTimePreKey(key.ID, sender.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored models.OneTimePreKey
+	s.DB.First(&stored, "id = ?", key.ID)
+	if !stored.Used {
+		t.Fatal("confirmed key not marked used")
+	}
+	if err := s.ConfirmOneTimePreKey(key.ID, sender.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("second confirm: %v", err)
+	}
+}
+
+func TestLapsedReservationReturnsKeyToPool(t *testing.T) {
+	s, clock := newTestPreKeyService(t)
+	owner := dbtest.SeedUser(t, s.DB, "alice")
+	sender := dbtest.SeedUser(t, s.DB, "bob")
+	other := dbtest.SeedUser(t, s.DB, "carol")
+	if _, err := s.AddOneTimePreKeys(owner.ID, "device-1", [][]byte{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.ReserveOneTimePreKey(owner.ID, "device-1", sender.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(61 * time.Second)
+	if err := s.ConfirmOneTimePreKey(key.ID, sender.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("confirm after expiry: %v", err)
+	}
+	if n, _ := s.CountOneTimePreKeys(owner.ID, "device-1"); n != 1 {
+		t.Fatalf("%d keys available after the reservation lapsed, want 1", n)
+	}
+	again, err := s.ReserveOneTimePreKey(owner.ID, "device-1", other.ID)
+	if err != nil || again.ID != key.ID {
+		t.Fatalf("re-reserve = %v, %v", again, err)
+	}
+	if err := s.ConfirmOneTimePreKey(key.ID, other.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddOneTimePreKeysIsAtomic(t *testing.T) {
+	s, _ := newTestPreKeyService(t)
+	user := dbtest.SeedUser(t, s.DB, "alice")
+	// Fail the second batch, after the first was written inside the transaction
+	batches := 0
+	s.DB.Callback().Create().Before("gorm:create").Register("test:fail_second_batch", func(tx *gorm.DB) {
+		if tx.Statement.Table == "one_time_pre_keys" {
+			if batches++; batches == 2 {
+				tx.AddError(errors.New("simulated failure"))
+			}
+		}
+	})
+
+	keys := make([][]byte, oneTimePreKeyBatchSize+1)
+	for i := range keys {
+		keys[i] = []byte{byte(i)}
+	}
+	if ids, err := s.AddOneTimePreKeys(user.ID, "device-1", keys); err == nil || ids != nil {
+		t.Fatalf("AddOneTimePreKeys = %v, %v", ids, err)
+	}
+	if batches != 2 {
+		t.Fatalf("%d batches attempted, want 2", batches)
+	}
+	var n int64
+	s.DB.Model(&models.OneTimePreKey{}).Where("user_id = ?", user.ID).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d keys left behind by the failed upload", n)
+	}
+}
+
+func benchmarkKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, 32)
+	}
+	return keys
+}
+
+func BenchmarkAddOneTimePreKeysBatched(b *testing.B) {
+	s := NewPreKeyService(dbtest.New(b), &config.Config{})
+	user := dbtest.SeedUser(b, s.DB, "alice")
+	keys := benchmarkKeys(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.AddOneTimePreKeys(user.ID, "device-1", keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddOneTimePreKeysLooped is the one-INSERT-per-key approach the
+// batched upload replaced
+func BenchmarkAddOneTimePreKeysLooped(b *testing.B) {
+	s := NewPreKeyService(dbtest.New(b), &config.Config{})
+	user := dbtest.SeedUser(b, s.DB, "alice")
+	keys := benchmarkKeys(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, k := range keys {
+			row := models.OneTimePreKey{ID: uuid.Must(uuid.NewV4()), UserID: user.ID, DeviceID: "device-1", PreKey: k}
+			if err := s.DB.Create(&row).Error; err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPreKeysAreScopedPerDevice(t *testing.T) {
+	s, _ := newTestPreKeyService(t)
+	user := dbtest.SeedUser(t, s.DB, "alice")
+	if err := s.StoreSignedPreKey(user.ID, "device-a", "spk-a", []byte("spk-a"), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOneTimePreKeys(user.ID, "device-a", [][]byte{[]byte("otk-a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.LatestSignedPreKey(user.ID, "device-b"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("device-b signed prekey: %v", err)
+	}
+	if n, _ := s.CountOneTimePreKeys(user.ID, "device-b"); n != 0 {
+		t.Fatalf("device-b has %d one-time prekeys", n)
+	}
+	if _, err := s.ConsumeOneTimePreKey(user.ID, "device-b"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("consumed a one-time prekey for device-b: %v", err)
+	}
+
+	if err := s.StoreSignedPreKey(user.ID, "device-b", "spk-b", []byte("spk-b"), []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if spk, err := s.LatestSignedPreKey(user.ID, "device-a"); err != nil || string(spk.PreKey) != "spk-a" {
+		t.Fatalf("device-a signed prekey = %v, %v", spk, err)
+	}
+	otk, err := s.ConsumeOneTimePreKey(user.ID, "device-a")
+	if err != nil || string(otk.PreKey) != "otk-a" {
+		t.Fatalf("device-a one-time prekey = %v, %v", otk, err)
+	}
+}
+
+func TestKeyHealthAggregatesSeededKeys(t *testing.T) {
+	s, clock := newTestPreKeyService(t)
+	now := clock.Now()
+	day := 24 * time.Hour
+	users := map[string]models.User{}
+	for _, name := range []string{"keyless", "few", "dozen", "hundred", "none"} {
+		users[name] = dbtest.SeedUser(t, s.DB, name)
+	}
+	s.DB.Model(&models.User{}).Where("id = ?", users["keyless"].ID).Update("identity_pub_key", []byte{})
+
+	otks := func(name, device string, n int, used bool, expires time.Time) {
+		t.Helper()
+		keys := make([]models.OneTimePreKey, n)
+		for i := range keys {
+			keys[i] = models.OneTimePreKey{ID: uuid.Must(uuid.NewV4()), UserID: users[name].ID, DeviceID: device, PreKey: []byte{1}, Used: used, ExpiresAt: expires}
+		}
+		if err := s.DB.CreateInBatches(keys, 50).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	otks("few", "device-1", 3, false, now.Add(day))
+	otks("few", "device-1", 2, true, now.Add(day))
+	otks("few", "device-1", 1, false, now.Add(-time.Minute))
+	otks("dozen", "device-1", 6, false, now.Add(day))
+	otks("dozen", "device-2", 6, false, now.Add(day))
+	otks("hundred", "device-1", 100, false, now.Add(day))
+
+	// Only each device's newest signed prekey counts
+	spk := func(name, device string, expires time.Time) {
+		t.Helper()
+		k := models.PreKey{ID: uuid.Must(uuid.NewV4()), UserID: users[name].ID, DeviceID: device, KeyID: uuid.Must(uuid.NewV4()).String(), PreKey: []byte{1}, Signature: []byte{1}, ExpiresAt: expires}
+		if err := s.DB.Create(&k).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	spk("few", "device-1", now.Add(-day))
+	spk("few", "device-1", now.Add(30*day))
+	spk("dozen", "device-1", now.Add(-time.Hour))
+	spk("dozen", "device-2", now.Add(3*day))
+	spk("hundred", "device-1", now.Add(10*day))
+	spk("none", "device-1", now.Add(-2*day))
+	spk("none", "device-1", now.Add(-day))
+
+	queries := 0
+	count := func(*gorm.DB) { queries++ }
+	s.DB.Callback().Query().After("gorm:query").Register("test:count_queries", count)
+	s.DB.Callback().Row().After("gorm:row").Register("test:count_rows", count)
+
+	h, err := s.Health(7 * day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UsersWithoutIdentityKey != 1 {
+		t.Errorf("users without identity key = %d, want 1", h.UsersWithoutIdentityKey)
+	}
+	want := map[string]int64{"0": 2, "1-9": 1, "10-49": 1, "50-99": 0, "100+": 1}
+	for bucket, n := range want {
+		if h.OneTimePreKeyBuckets[bucket] != n {
+			t.Errorf("bucket %s = %d, want %d (all: %v)", bucket, h.OneTimePreKeyBuckets[bucket], n, h.OneTimePreKeyBuckets)
+		}
+	}
+	if h.SignedPreKeysExpired != 2 || h.SignedPreKeysExpiringSoon != 1 {
+		t.Errorf("signed prekeys expired %d, expiring soon %d, want 2 and 1", h.SignedPreKeysExpired, h.SignedPreKeysExpiringSoon)
+	}
+
+	// Aggregates, not a query per user: more users cost no more queries
+	perCall := queries
+	for i := 0; i < 5; i++ {
+		dbtest.SeedUser(t, s.DB, fmt.Sprintf("extra-%d", i))
+	}
+	queries = 0
+	if h, err = s.Health(7 * day); err != nil {
+		t.Fatal(err)
+	}
+	if perCall == 0 || queries != perCall || h.OneTimePreKeyBuckets["0"] != 7 {
+		t.Fatalf("%d queries for 10 users vs %d for 5; bucket 0 = %d", queries, perCall, h.OneTimePreKeyBuckets["0"])
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// PresenceReconciler copies hub presence into users.last_seen_at. The hub is
+// the only source of truth for who is online; the column survives restarts
+// and is what other instances can see, so it is only ever read as "last seen",
+// never as "online".
+type PresenceReconciler struct {
+	DB       *gorm.DB
+	Hub      *Hub
+	Interval time.Duration
+}
+
+func NewPresenceReconciler(db *gorm.DB, hub *Hub, interval time.Duration) *PresenceReconciler {
+	return &PresenceReconciler{DB: db, Hub: hub, Interval: interval}
+}
+
+// Flush writes the current presence of every connected user and returns how
+// many rows were updated. A stored value is never moved backwards.
+func (p *PresenceReconciler) Flush() (int64, error) {
+	var updated int64
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		for userID, seen := range p.Hub.LastSeen() {
+			res := tx.Model(&models.User{}).
+				Where("id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)", userID, seen).
+				UpdateColumn("last_seen_at", seen)
+			if res.Error != nil {
+				return res.Error
+			}
+			updated += res.RowsAffected
+		}
+		return nil
+	})
+	return updated, err
+}
+
+// Run flushes every Interval until ctx is cancelled, then once more so a
+// clean shutdown records everyone who was connected
+func (p *PresenceReconciler) Run(ctx context.Context) {
+	if p.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := p.Flush(); err != nil {
+				log.Printf("presence flush error: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if _, err := p.Flush(); err != nil {
+				log.Printf("presence flush error: %v", err)
+			}
+		}
+	}
+}
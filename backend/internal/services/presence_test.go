@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/securechat/backend/internal/db/dbtest"
+	"github.com/securechat/backend/internal/models"
+)
+
+func TestPresenceReconcilerFlushesOnInterval(t *testing.T) {
+	d := dbtest.New(t)
+	hub := NewHub()
+	alice := dbtest.SeedUser(t, d, "alice")
+	bob := dbtest.SeedUser(t, d, "bob")
+	carol := dbtest.SeedUser(t, d, "carol")
+	stale := time.Now().Add(-time.Hour).UTC()
+	ahead := time.Now().Add(time.Hour).UTC()
+	d.Model(&models.User{}).Where("id = ?", bob.ID).UpdateColumn("last_seen_at", stale)
+	d.Model(&models.User{}).Where("id = ?", carol.ID).UpdateColumn("last_seen_at", ahead)
+	aliceConn := register(t, hub, alice.ID, "phone")
+	aliceConn.Touch()
+	register(t, hub, carol.ID, "phone").Touch()
+
+	lastSeen := func(id uuid.UUID) time.Time {
+		var u models.User
+		d.Select("last_seen_at").First(&u, "id = ?", id)
+		if u.LastSeenAt == nil {
+			return time.Time{}
+		}
+		return *u.LastSeenAt
+	}
+	flushed := func(want time.Time) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !lastSeen(alice.ID).Equal(want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("last_seen_at = %v, want %v", lastSeen(alice.ID), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewPresenceReconciler(d, hub, 20*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+	seen, _ := hub.LastSeenOf(alice.ID)
+	flushed(seen)
+
+	// Later activity is picked up by a later tick
+	time.Sleep(5 * time.Millisecond)
+	aliceConn.Touch()
+	seen, _ = hub.LastSeenOf(alice.ID)
+	flushed(seen)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+	// Offline users keep their stored value, and nothing moves backwards
+	if got := lastSeen(bob.ID); !got.Equal(stale) {
+		t.Fatalf("offline user's last_seen_at changed to %v", got)
+	}
+	if got := lastSeen(carol.ID); !got.Equal(ahead) {
+		t.Fatalf("last_seen_at moved backwards to %v", got)
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// Push platforms a device token can belong to
+const (
+	PushPlatformAPNs = "apns"
+	PushPlatformFCM  = "fcm"
+)
+
+// PushNotification is a wake-up for a device with messages waiting. It
+// carries metadata only: never ciphertext, and not the sender.
+type PushNotification struct {
+	Token          string
+	Platform       string
+	ConversationID *uuid.UUID
+}
+
+// PushSender delivers push notifications to APNs, FCM or a relay
+type PushSender interface {
+	Send(ctx context.Context, n PushNotification) error
+}
+
+// LogPushSender logs instead of sending. It is meant for development, where
+// no push provider is configured.
+type LogPushSender struct{}
+
+func (LogPushSender) Send(ctx context.Context, n PushNotification) error {
+	log.Printf("push (%s): messages waiting", n.Platform)
+	return nil
+}
+
+// PushService wakes a user's devices when a message is queued for them
+type PushService struct {
+	DB     *gorm.DB
+	Sender PushSender
+	// Clock decides whether a mute has lapsed
+	Clock Clock
+}
+
+func NewPushService(db *gorm.DB, sender PushSender) *PushService {
+	return &PushService{DB: db, Sender: sender, Clock: RealClock{}}
+}
+
+// NotifyQueued sends a push to every device of userID that registered a
+// token, unless userID has muted convID. Failures are logged; the message
+// itself is already queued.
+func (s *PushService) NotifyQueued(userID uuid.UUID, convID *uuid.UUID) {
+	if convID != nil {
+		var member models.ConversationMember
+		err := s.DB.Where("conversation_id = ? AND user_id = ?", *convID, userID).First(&member).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			log.Printf("push mute lookup for %s: %v", userID, err)
+			return
+		}
+		if member.MutedAt(s.Clock.Now()) {
+			return
+		}
+	}
+	var devices []models.Device
+	if err := s.DB.Where("user_id = ? AND push_token <> ''", userID).Find(&devices).Error; err != nil {
+		log.Printf("push lookup for %s: %v", userID, err)
+		return
+	}
+	for _, d := range devices {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.Sender.Send(ctx, PushNotification{Token: d.PushToken, Platform: d.PushPlatform, ConversationID: convID})
+		cancel()
+		if err != nil {
+			log.Printf("push to %s device %s: %v", userID, d.DeviceID, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/securechat/backend/internal/models"
+)
+
+// SessionService records senders' reports that they established an
+// end-to-end session with a peer. The server never sees session keys; it only
+// finalizes the one-time prekey the session consumed and, when markers are
+// enabled, remembers that the pair has a session.
+type SessionService struct {
+	DB      *gorm.DB
+	PreKeys *PreKeyService
+	// Markers keeps a row per (user, peer) session; when false only the
+	// prekey is finalized, so the server holds no record of who talks to whom
+	Markers bool
+}
+
+func NewSessionService(db *gorm.DB, prekeys *PreKeyService, markers bool) *SessionService {
+	return &SessionService{DB: db, PreKeys: prekeys, Markers: markers}
+}
+
+// Establish finalizes the one-time prekey userID reserved from peer, if
+// keyID is set, and records the session marker, atomically. It returns
+// gorm.ErrRecordNotFound if the key is not peer's or has no live reservation
+// by userID.
+func (s *SessionService) Establish(userID, peer uuid.UUID, convID, keyID *uuid.UUID) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if keyID != nil {
+			var owned int64
+			if err := tx.Model(&models.OneTimePreKey{}).Where("id = ? AND user_id = ?", *keyID, peer).Count(&owned).Error; err != nil {
+				return err
+			}
+			if owned == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			if err := s.PreKeys.WithDB(tx).ConfirmOneTimePreKey(*keyID, userID); err != nil {
+				return err
+			}
+		}
+		if !s.Markers {
+			return nil
+		}
+		marker := models.SessionMarker{
+			UserID:         userID,
+			PeerID:         peer,
+			ConversationID: convID,
+			EstablishedAt:  s.PreKeys.Clock.Now(),
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "peer_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"conversation_id", "established_at"}),
+		}).Create(&marker).Error
+	})
+}
@@ -1,7 +1,10 @@
 package services
 
 import (
+	"context"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/websocket/v2"
@@ -12,56 +15,493 @@ type Connection struct {
 	UserID   uuid.UUID
 	DeviceID string
 	Conn     *websocket.Conn
-	Send     chan []byte
-	LastSeen time.Time
+	Send     chan Frame
+	// Binary is set when the client negotiated BinarySubprotocol
+	Binary bool
+	// LastSeen tracks presence (app messages and heartbeats); LastActive
+	// tracks app messages only and drives the idle timeout
+	LastSeen   time.Time
+	LastActive time.Time
+
+	mu sync.Mutex
+	// closeMu serializes CloseWith with Release, after which the socket
+	// belongs to the WebSocket library again
+	closeMu  sync.Mutex
+	released bool
+}
+
+// Touch records application-level activity on the connection. Keepalive
+// traffic (pings, heartbeats) must not call it so that idle connections can
+// be reclaimed.
+func (c *Connection) Touch() {
+	c.mu.Lock()
+	now := time.Now()
+	c.LastSeen = now
+	c.LastActive = now
+	c.mu.Unlock()
+}
+
+// Heartbeat refreshes presence without counting as application activity.
+// Heartbeats arriving less than interval apart are ignored and return false.
+func (c *Connection) Heartbeat(interval time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.LastSeen) < interval {
+		return false
+	}
+	c.LastSeen = now
+	return true
 }
 
+// IdleFor returns how long the connection has gone without application activity
+func (c *Connection) IdleFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.LastActive)
+}
+
+// What Register does when a device that is already connected opens another
+// socket. DuplicateReplace closes the old socket with CloseSuperseded, so a
+// client reconnecting before its old socket timed out takes over at once;
+// DuplicateReject keeps the old one and refuses the new.
+const (
+	DuplicateReplace = "replace"
+	DuplicateReject  = "reject"
+)
+
 type Hub struct {
-	mu          sync.RWMutex
-	connections map[uuid.UUID]*Connection
+	mu sync.RWMutex
+	// connections holds at most one connection per (user, device)
+	connections map[uuid.UUID]map[string]*Connection
+	// DuplicatePolicy is DuplicateReplace or DuplicateReject; empty means
+	// DuplicateReplace
+	DuplicatePolicy string
+	// draining is set by Drain; new sockets are refused while connected
+	// ones run on until shutdown closes them
+	draining atomic.Bool
+
+	// Set by EnableBus. remote maps users connected to other instances to
+	// each instance they were announced on and when; acks routes delivery
+	// acknowledgements back to the send waiting for them.
+	bus        Bus
+	instanceID string
+	remote     map[uuid.UUID]map[string]time.Time
+	acks       map[string]chan bool
 }
 
+const (
+	// busAnnounceInterval is how often each instance re-announces its
+	// connected users; entries not refreshed within busPresenceTTL are
+	// dropped so a crashed instance stops receiving frames
+	busAnnounceInterval = 30 * time.Second
+	busPresenceTTL      = 3 * busAnnounceInterval
+	// busAckTimeout bounds how long a relayed frame waits for the target
+	// instance to confirm delivery before the caller queues it instead
+	busAckTimeout = 2 * time.Second
+)
+
 func NewHub() *Hub {
 	return &Hub{
-		connections: make(map[uuid.UUID]*Connection),
+		connections: make(map[uuid.UUID]map[string]*Connection),
+		remote:      make(map[uuid.UUID]map[string]time.Time),
+		acks:        make(map[string]chan bool),
 	}
 }
 
-func (h *Hub) Register(c *Connection) {
+// Register adds c as its device's connection, applying DuplicatePolicy if
+// the device already has one. It returns false if c was rejected; the caller
+// then closes it with CloseDuplicate.
+func (h *Hub) Register(c *Connection) bool {
 	h.mu.Lock()
-	h.connections[c.UserID] = c
+	devices, ok := h.connections[c.UserID]
+	if !ok {
+		devices = make(map[string]*Connection)
+		h.connections[c.UserID] = devices
+	}
+	old := devices[c.DeviceID]
+	if old != nil && h.DuplicatePolicy == DuplicateReject {
+		h.mu.Unlock()
+		return false
+	}
+	devices[c.DeviceID] = c
 	h.mu.Unlock()
+
+	if old != nil {
+		// The old socket's read loop fails and its Unregister finds c in its
+		// place, so it removes nothing
+		go old.CloseWith(CloseSuperseded)
+	}
+	h.publish(BusMessage{Kind: busKindOnline, UserID: c.UserID})
+	return true
 }
 
-func (h *Hub) Unregister(uid uuid.UUID) {
+// Unregister removes c if it is still its device's registered connection. A
+// newer connection for the same device is left alone. Send is never closed:
+// the write pump exits on the handler's done channel, so late senders holding
+// c can't panic on a closed channel.
+func (h *Hub) Unregister(c *Connection) {
 	h.mu.Lock()
-	if c, ok := h.connections[uid]; ok {
-		close(c.Send)
-		delete(h.connections, uid)
+	offline := false
+	if devices, ok := h.connections[c.UserID]; ok && devices[c.DeviceID] == c {
+		delete(devices, c.DeviceID)
+		if len(devices) == 0 {
+			delete(h.connections, c.UserID)
+			offline = true
+		}
 	}
 	h.mu.Unlock()
+	if offline {
+		h.publish(BusMessage{Kind: busKindOffline, UserID: c.UserID})
+	}
+}
+
+// connectionsOf returns the user's local connections, one per device
+func (h *Hub) connectionsOf(userID uuid.UUID) []*Connection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns := make([]*Connection, 0, len(h.connections[userID]))
+	for _, c := range h.connections[userID] {
+		conns = append(conns, c)
+	}
+	return conns
 }
 
+// SendTo queues a JSON text frame for the user
 func (h *Hub) SendTo(userID uuid.UUID, payload []byte) bool {
+	return h.send(userID, func(*Connection) Frame { return TextFrame(payload) }, func() BusMessage {
+		return BusMessage{Text: payload}
+	})
+}
+
+// SendEnvelope queues a routed message, encoded for the recipient's protocol
+func (h *Hub) SendEnvelope(userID uuid.UUID, env *Envelope) bool {
+	return h.send(userID, func(c *Connection) Frame { return c.Encode(env) }, func() BusMessage {
+		return BusMessage{Envelope: env.MarshalBinary(), Queued: env.Queued}
+	})
+}
+
+// send delivers to each of the user's local device connections and relays
+// through the bus to every other instance they are connected to, so each of
+// their devices gets the frame. It reports whether any connection took it;
+// a relayed frame counts only once its instance acknowledges it. A nil relay
+// restricts delivery to local connections.
+func (h *Hub) send(userID uuid.UUID, encode func(*Connection) Frame, relay func() BusMessage) bool {
+	delivered := false
+	for _, c := range h.connectionsOf(userID) {
+		select {
+		case c.Send <- encode(c):
+			delivered = true
+		default:
+			// Slow consumer: evict so the client reconnects and resyncs
+			go c.CloseWith(CloseEvicted)
+		}
+	}
+	if relay == nil {
+		return delivered
+	}
+	instances := h.remoteInstances(userID)
+	if len(instances) == 0 {
+		return delivered
+	}
+	// Once a local device has the frame there is nothing to wait for
+	return h.relay(userID, instances, relay(), !delivered) || delivered
+}
+
+// relay publishes msg for userID to each instance. With wait set it blocks
+// until one of them acknowledges that a connection took the frame, all of
+// them report failure, or busAckTimeout passes. A failed publish, such as a
+// frame over the Postgres NOTIFY limit, counts as not delivered so the
+// caller falls back to the offline queue; an ack arriving after the timeout
+// means the recipient may get the frame twice.
+func (h *Hub) relay(userID uuid.UUID, instances []string, msg BusMessage, wait bool) bool {
+	msg.Kind = busKindDeliver
+	msg.UserID = userID
+	var acks chan bool
+	if wait {
+		msg.ID = uuid.Must(uuid.NewV4()).String()
+		acks = make(chan bool, len(instances))
+		h.mu.Lock()
+		h.acks[msg.ID] = acks
+		h.mu.Unlock()
+		defer func() {
+			h.mu.Lock()
+			delete(h.acks, msg.ID)
+			h.mu.Unlock()
+		}()
+	}
+
+	pending := 0
+	for _, instance := range instances {
+		msg.Target = instance
+		if err := h.publish(msg); err != nil {
+			log.Printf("hub bus: relay to %s: %v", instance, err)
+			continue
+		}
+		pending++
+	}
+	if !wait {
+		return false
+	}
+
+	timeout := time.NewTimer(busAckTimeout)
+	defer timeout.Stop()
+	for ; pending > 0; pending-- {
+		select {
+		case ok := <-acks:
+			if ok {
+				return true
+			}
+		case <-timeout.C:
+			return false
+		}
+	}
+	return false
+}
+
+// remoteInstances returns the other instances userID was announced on
+// within busPresenceTTL
+func (h *Hub) remoteInstances(userID uuid.UUID) []string {
 	h.mu.RLock()
-	c, ok := h.connections[userID]
+	defer h.mu.RUnlock()
+	var instances []string
+	for instance, seen := range h.remote[userID] {
+		if time.Since(seen) <= busPresenceTTL {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// Disconnect closes the user's connections with the given close code and
+// returns how many were closed
+func (h *Hub) Disconnect(userID uuid.UUID, code int) int {
+	conns := h.connectionsOf(userID)
+	for _, c := range conns {
+		c.CloseWith(code)
+	}
+	return len(conns)
+}
+
+// Drain marks the hub as draining ahead of a restart
+func (h *Hub) Drain() {
+	h.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// CloseAll closes every connection with the given close code, e.g. on shutdown
+func (h *Hub) CloseAll(code int) {
+	h.mu.RLock()
+	var conns []*Connection
+	for _, devices := range h.connections {
+		for _, c := range devices {
+			conns = append(conns, c)
+		}
+	}
 	h.mu.RUnlock()
-	if !ok {
-		return false
+
+	for _, c := range conns {
+		c.CloseWith(code)
 	}
-	select {
-	case c.Send <- payload:
-		return true
-	default:
-		go h.Unregister(userID)
-		return false
+}
+
+// LastSeen returns the last presence time of each connected user, the
+// latest across their devices
+func (h *Hub) LastSeen() map[uuid.UUID]time.Time {
+	h.mu.RLock()
+	var conns []*Connection
+	for _, devices := range h.connections {
+		for _, c := range devices {
+			conns = append(conns, c)
+		}
 	}
+	h.mu.RUnlock()
+
+	seen := make(map[uuid.UUID]time.Time, len(conns))
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.LastSeen.After(seen[c.UserID]) {
+			seen[c.UserID] = c.LastSeen
+		}
+		c.mu.Unlock()
+	}
+	return seen
+}
+
+// LastSeenOf returns userID's latest presence time across their devices if
+// they are connected
+func (h *Hub) LastSeenOf(userID uuid.UUID) (time.Time, bool) {
+	conns := h.connectionsOf(userID)
+	if len(conns) == 0 {
+		return time.Time{}, false
+	}
+	var seen time.Time
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.LastSeen.After(seen) {
+			seen = c.LastSeen
+		}
+		c.mu.Unlock()
+	}
+	return seen, true
 }
 
-// IsOnline checks if a user has an active WebSocket connection
+// IsOnline checks if a user has an active WebSocket connection on this or,
+// with a bus, any other instance
 func (h *Hub) IsOnline(userID uuid.UUID) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	_, ok := h.connections[userID]
-	return ok
+	if _, ok := h.connections[userID]; ok {
+		return true
+	}
+	for _, seen := range h.remote[userID] {
+		if time.Since(seen) <= busPresenceTTL {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableBus shares h with other instances over bus: frames for users
+// connected elsewhere are relayed, and presence is announced so the others
+// know where to relay. instanceID must be unique per running instance. The
+// subscription and periodic announcements stop when ctx is done.
+func (h *Hub) EnableBus(ctx context.Context, bus Bus, instanceID string) error {
+	h.mu.Lock()
+	h.bus = bus
+	h.instanceID = instanceID
+	h.mu.Unlock()
+
+	if err := bus.Subscribe(ctx, h.handleBus); err != nil {
+		return err
+	}
+	// Ask the other instances who is connected to them, and tell them who is
+	// connected here
+	h.publish(BusMessage{Kind: busKindSync})
+	h.announce()
+
+	go func() {
+		ticker := time.NewTicker(busAnnounceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.announce()
+				h.pruneRemote()
+			}
+		}
+	}()
+	return nil
+}
+
+// announce publishes an online message for every local connection
+func (h *Hub) announce() {
+	h.mu.RLock()
+	users := make([]uuid.UUID, 0, len(h.connections))
+	for id := range h.connections {
+		users = append(users, id)
+	}
+	h.mu.RUnlock()
+
+	for _, id := range users {
+		h.publish(BusMessage{Kind: busKindOnline, UserID: id})
+	}
+}
+
+// pruneRemote forgets remote connections whose instance stopped announcing
+// them, e.g. because it crashed without sending offline messages
+func (h *Hub) pruneRemote() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, instances := range h.remote {
+		for instance, seen := range instances {
+			if time.Since(seen) > busPresenceTTL {
+				delete(instances, instance)
+			}
+		}
+		if len(instances) == 0 {
+			delete(h.remote, userID)
+		}
+	}
+}
+
+// publish stamps msg with this instance's ID and sends it on the bus, if any
+func (h *Hub) publish(msg BusMessage) error {
+	h.mu.RLock()
+	bus, origin := h.bus, h.instanceID
+	h.mu.RUnlock()
+	if bus == nil {
+		return nil
+	}
+	msg.Origin = origin
+	err := bus.Publish(context.Background(), msg)
+	if err != nil && msg.Kind != busKindDeliver {
+		log.Printf("hub bus: publish %s: %v", msg.Kind, err)
+	}
+	return err
+}
+
+func (h *Hub) handleBus(msg BusMessage) {
+	if msg.Origin == h.instanceID {
+		return
+	}
+	switch msg.Kind {
+	case busKindOnline:
+		h.mu.Lock()
+		instances, ok := h.remote[msg.UserID]
+		if !ok {
+			instances = make(map[string]time.Time)
+			h.remote[msg.UserID] = instances
+		}
+		instances[msg.Origin] = time.Now()
+		h.mu.Unlock()
+	case busKindOffline:
+		h.mu.Lock()
+		if instances, ok := h.remote[msg.UserID]; ok {
+			delete(instances, msg.Origin)
+			if len(instances) == 0 {
+				delete(h.remote, msg.UserID)
+			}
+		}
+		h.mu.Unlock()
+	case busKindSync:
+		h.announce()
+	case busKindDeliver:
+		if msg.Target != h.instanceID {
+			return
+		}
+		delivered := false
+		if msg.Envelope != nil {
+			env, err := ParseEnvelope(msg.Envelope)
+			if err != nil {
+				log.Printf("hub bus: bad envelope: %v", err)
+			} else {
+				env.Queued = msg.Queued
+				delivered = h.send(msg.UserID, func(c *Connection) Frame { return c.Encode(env) }, nil)
+			}
+		} else {
+			text := msg.Text
+			delivered = h.send(msg.UserID, func(*Connection) Frame { return TextFrame(text) }, nil)
+		}
+		if msg.ID != "" {
+			h.publish(BusMessage{Kind: busKindAck, Target: msg.Origin, ID: msg.ID, Delivered: delivered})
+		}
+	case busKindAck:
+		if msg.Target != h.instanceID {
+			return
+		}
+		h.mu.RLock()
+		acks := h.acks[msg.ID]
+		h.mu.RUnlock()
+		if acks != nil {
+			// Buffered for one ack per target, so this never blocks
+			acks <- msg.Delivered
+		}
+	}
 }
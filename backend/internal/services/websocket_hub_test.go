@@ -0,0 +1,54 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestSendToDuringUnregisterDoesNotPanic(t *testing.T) {
+	h := NewHub()
+	userID := uuid.Must(uuid.NewV4())
+	const senders, sends, cycles = 8, 2000, 200
+	// Room for every send, so no connection is evicted as a slow consumer
+	newConn := func(i int) *Connection {
+		return &Connection{UserID: userID, DeviceID: fmt.Sprintf("device-%d", i%3), Send: make(chan Frame, senders*sends)}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				h.SendTo(userID, []byte(`{"type":"ping"}`))
+			}
+		}()
+	}
+	var conns []*Connection
+	for i := 0; i < cycles; i++ {
+		c := newConn(i)
+		if !h.Register(c) {
+			t.Fatal("register rejected")
+		}
+		conns = append(conns, c)
+		h.Unregister(c)
+	}
+	wg.Wait()
+
+	if h.IsOnline(userID) || len(h.connectionsOf(userID)) != 0 {
+		t.Fatal("connections left registered")
+	}
+	if h.SendTo(userID, []byte(`{"type":"ping"}`)) {
+		t.Fatal("send to an unregistered user reported delivery")
+	}
+	// Send channels stay open, so a sender still holding one can't panic
+	for _, c := range conns {
+		select {
+		case c.Send <- TextFrame(nil):
+		default:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// Application close codes (4000-4999 is reserved for private use by RFC 6455).
+// Each close frame carries a JSON reason telling the client whether and when
+// to reconnect, so a mass disconnect doesn't turn into a thundering herd.
+const (
+	CloseIdleTimeout    = 4000
+	CloseServerShutdown = 4001
+	CloseRateLimited    = 4002
+	CloseEvicted        = 4003
+	CloseAccountDeleted = 4004
+	CloseKicked         = 4005
+	CloseTokenExpired   = 4006
+	CloseAuthFailed     = 4007
+	CloseSuperseded     = 4008
+	CloseDuplicate      = 4009
+)
+
+type closePolicy struct {
+	reason    string
+	reconnect bool
+	minDelay  time.Duration
+	maxDelay  time.Duration
+}
+
+var closePolicies = map[int]closePolicy{
+	CloseIdleTimeout:    {reason: "idle_timeout", reconnect: true},
+	CloseServerShutdown: {reason: "server_shutdown", reconnect: true, minDelay: time.Second, maxDelay: 15 * time.Second},
+	CloseRateLimited:    {reason: "rate_limited", reconnect: true, minDelay: 30 * time.Second, maxDelay: 90 * time.Second},
+	CloseEvicted:        {reason: "evicted", reconnect: true, minDelay: time.Second, maxDelay: 5 * time.Second},
+	CloseAccountDeleted: {reason: "account_deleted", reconnect: false},
+	CloseKicked:         {reason: "kicked", reconnect: false},
+	CloseTokenExpired:   {reason: "token_expired", reconnect: true},
+	CloseAuthFailed:     {reason: "auth_failed", reconnect: false},
+	// The device connected again; reconnecting would only displace the new socket
+	CloseSuperseded: {reason: "superseded", reconnect: false},
+	CloseDuplicate:  {reason: "duplicate_connection", reconnect: true, minDelay: time.Second, maxDelay: 5 * time.Second},
+}
+
+// closeReason is the JSON body of a close frame. It must stay under the
+// 123-byte close reason limit.
+type closeReason struct {
+	Reason       string `json:"reason"`
+	Reconnect    bool   `json:"reconnect"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
+}
+
+// CloseMessage builds a close frame payload for code with a jittered
+// reconnect delay drawn from that code's policy.
+func CloseMessage(code int) []byte {
+	p, ok := closePolicies[code]
+	if !ok {
+		return websocket.FormatCloseMessage(code, "")
+	}
+	r := closeReason{Reason: p.reason, Reconnect: p.reconnect}
+	if p.reconnect && p.maxDelay > 0 {
+		delay := p.minDelay + time.Duration(rand.Int63n(int64(p.maxDelay-p.minDelay)+1))
+		r.RetryAfterMS = delay.Milliseconds()
+	}
+	b, _ := json.Marshal(r)
+	return websocket.FormatCloseMessage(code, string(b))
+}
+
+// CloseWith sends a structured close frame and closes the socket. The
+// connection's read loop then fails and unregisters it from the hub. It does
+// nothing once the connection has been released.
+func (c *Connection) CloseWith(code int) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.released {
+		return
+	}
+	c.Conn.WriteControl(websocket.CloseMessage, CloseMessage(code), time.Now().Add(time.Second))
+	c.Conn.Close()
+}
+
+// Release is called as the connection's handler returns, since the WebSocket
+// library then resets the socket for reuse. A CloseWith still running from
+// elsewhere, e.g. a superseding Register, finishes first; later ones are no-ops.
+func (c *Connection) Release() {
+	c.closeMu.Lock()
+	c.released = true
+	c.closeMu.Unlock()
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCloseMessagePerCode(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		reason    string
+		reconnect bool
+		min, max  time.Duration
+	}{
+		{CloseIdleTimeout, "idle_timeout", true, 0, 0},
+		{CloseServerShutdown, "server_shutdown", true, time.Second, 15 * time.Second},
+		{CloseRateLimited, "rate_limited", true, 30 * time.Second, 90 * time.Second},
+		{CloseEvicted, "evicted", true, time.Second, 5 * time.Second},
+		{CloseAccountDeleted, "account_deleted", false, 0, 0},
+		{CloseKicked, "kicked", false, 0, 0},
+		{CloseTokenExpired, "token_expired", true, 0, 0},
+		{CloseAuthFailed, "auth_failed", false, 0, 0},
+		{CloseSuperseded, "superseded", false, 0, 0},
+		{CloseDuplicate, "duplicate_connection", true, time.Second, 5 * time.Second},
+	} {
+		// Enough draws to see the jitter stay within the policy
+		for i := 0; i < 20; i++ {
+			msg := CloseMessage(tc.code)
+			if len(msg) > 125 {
+				t.Fatalf("%d: close payload is %d bytes", tc.code, len(msg))
+			}
+			if got := int(binary.BigEndian.Uint16(msg)); got != tc.code {
+				t.Fatalf("code %d, want %d", got, tc.code)
+			}
+			var r closeReason
+			if err := json.Unmarshal(msg[2:], &r); err != nil {
+				t.Fatalf("%d: %v", tc.code, err)
+			}
+			retry := time.Duration(r.RetryAfterMS) * time.Millisecond
+			if r.Reason != tc.reason || r.Reconnect != tc.reconnect || retry < tc.min || retry > tc.max {
+				t.Fatalf("%d: %+v", tc.code, r)
+			}
+		}
+	}
+
+	// Codes without a policy still close cleanly
+	if msg := CloseMessage(1000); len(msg) != 2 || binary.BigEndian.Uint16(msg) != 1000 {
+		t.Fatalf("plain close = %x", msg)
+	}
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid"
+)
+
+// BinarySubprotocol is negotiated by clients that want "message" frames as
+// binary envelopes instead of JSON. Control frames (errors, notices, pong)
+// stay JSON text either way.
+const BinarySubprotocol = "securechat.binary.v1"
+
+// Binary envelope layout, all integers big-endian:
+//
+//	[2] header length N (bytes that follow, before the payload)
+//	[1] version
+//	[1] frame type
+//	[16] peer ID: recipient on frames from clients, sender on frames to them
+//	[16] conversation ID, all zero for direct messages
+//	[8] unix timestamp in seconds, zero on frames from clients
+//	[1] flags (bit 0: delivered from the offline queue); absent when N is 42
+//	[N-43] reserved for future header fields
+//	[..] ciphertext
+//
+// A conversation message from a client carries one ciphertext per recipient,
+// so its ciphertext is a sequence of records:
+//
+//	[16] recipient ID
+//	[4] ciphertext length L
+//	[L] ciphertext
+const (
+	envelopeVersion     = 1
+	EnvelopeTypeMessage = 1
+	// envelopeMinHeaderLen is the header clients may send, without flags
+	envelopeMinHeaderLen = 1 + 1 + 16 + 16 + 8
+	envelopeHeaderLen    = envelopeMinHeaderLen + 1
+
+	envelopeFlagQueued = 1 << 0
+)
+
+var (
+	ErrBadEnvelope          = errors.New("malformed binary envelope")
+	ErrBadRecipientPayloads = errors.New("malformed recipient payloads")
+)
+
+// Frame is one queued WebSocket write
+type Frame struct {
+	Binary bool
+	Data   []byte
+	// Written, when set, is called by the write pump once Data has been
+	// written to the socket
+	Written func()
+}
+
+// TextFrame wraps a JSON message for the write pump
+func TextFrame(b []byte) Frame {
+	return Frame{Data: b}
+}
+
+// Envelope is a routed ciphertext message, independent of wire encoding
+type Envelope struct {
+	Type           byte
+	Peer           uuid.UUID
+	ConversationID uuid.UUID
+	Timestamp      int64
+	Queued         bool
+	Payload        []byte
+}
+
+// MarshalBinary encodes e in the binary envelope layout
+func (e *Envelope) MarshalBinary() []byte {
+	b := make([]byte, 2+envelopeHeaderLen+len(e.Payload))
+	binary.BigEndian.PutUint16(b[0:2], envelopeHeaderLen)
+	b[2] = envelopeVersion
+	b[3] = e.Type
+	copy(b[4:20], e.Peer.Bytes())
+	copy(b[20:36], e.ConversationID.Bytes())
+	binary.BigEndian.PutUint64(b[36:44], uint64(e.Timestamp))
+	if e.Queued {
+		b[44] |= envelopeFlagQueued
+	}
+	copy(b[45:], e.Payload)
+	return b
+}
+
+// ParseEnvelope decodes a binary envelope. The payload aliases b.
+func ParseEnvelope(b []byte) (*Envelope, error) {
+	if len(b) < 2 {
+		return nil, ErrBadEnvelope
+	}
+	n := int(binary.BigEndian.Uint16(b[0:2]))
+	if n < envelopeMinHeaderLen || len(b) < 2+n || b[2] != envelopeVersion {
+		return nil, ErrBadEnvelope
+	}
+	e := &Envelope{
+		Type:      b[3],
+		Timestamp: int64(binary.BigEndian.Uint64(b[36:44])),
+		Payload:   b[2+n:],
+	}
+	if n >= envelopeHeaderLen {
+		e.Queued = b[44]&envelopeFlagQueued != 0
+	}
+	e.Peer = uuid.FromBytesOrNil(b[4:20])
+	e.ConversationID = uuid.FromBytesOrNil(b[20:36])
+	return e, nil
+}
+
+// MarshalRecipientPayloads encodes per-recipient ciphertexts as a
+// conversation envelope's payload
+func MarshalRecipientPayloads(payloads map[uuid.UUID][]byte) []byte {
+	var b []byte
+	var n [4]byte
+	for id, ct := range payloads {
+		binary.BigEndian.PutUint32(n[:], uint32(len(ct)))
+		b = append(b, id.Bytes()...)
+		b = append(b, n[:]...)
+		b = append(b, ct...)
+	}
+	return b
+}
+
+// ParseRecipientPayloads decodes a conversation envelope's payload. The
+// ciphertexts alias b; a recipient listed twice is an error.
+func ParseRecipientPayloads(b []byte) (map[uuid.UUID][]byte, error) {
+	payloads := make(map[uuid.UUID][]byte)
+	for len(b) > 0 {
+		if len(b) < 20 {
+			return nil, ErrBadRecipientPayloads
+		}
+		id := uuid.FromBytesOrNil(b[:16])
+		n := binary.BigEndian.Uint32(b[16:20])
+		if uint64(len(b)-20) < uint64(n) {
+			return nil, ErrBadRecipientPayloads
+		}
+		if _, dup := payloads[id]; dup {
+			return nil, ErrBadRecipientPayloads
+		}
+		payloads[id] = b[20 : 20+n]
+		b = b[20+n:]
+	}
+	return payloads, nil
+}
+
+// MarshalJSON renders e as the text protocol's "message" frame, with the
+// peer as "from". Text clients send their payload as a string and get it back
+// unchanged; a payload that isn't valid UTF-8 (from a binary client) is sent
+// base64-encoded with payload_encoding set so it survives JSON.
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	frame := map[string]interface{}{
+		"type":      "message",
+		"from":      e.Peer.String(),
+		"timestamp": e.Timestamp,
+	}
+	if utf8.Valid(e.Payload) {
+		frame["payload"] = string(e.Payload)
+	} else {
+		frame["payload"] = base64.StdEncoding.EncodeToString(e.Payload)
+		frame["payload_encoding"] = "base64"
+	}
+	if e.ConversationID != uuid.Nil {
+		frame["conversation_id"] = e.ConversationID.String()
+	}
+	if e.Queued {
+		frame["queued"] = true
+	}
+	return json.Marshal(frame)
+}
+
+// Encode renders e for this connection's negotiated protocol
+func (c *Connection) Encode(e *Envelope) Frame {
+	if c.Binary {
+		return Frame{Binary: true, Data: e.MarshalBinary()}
+	}
+	b, _ := json.Marshal(e)
+	return TextFrame(b)
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestEnvelopeBinaryRoundTrip(t *testing.T) {
+	for _, queued := range []bool{false, true} {
+		in := &Envelope{
+			Type:           EnvelopeTypeMessage,
+			Peer:           uuid.Must(uuid.NewV4()),
+			ConversationID: uuid.Must(uuid.NewV4()),
+			Timestamp:      1700000000,
+			Queued:         queued,
+			Payload:        []byte{0, 1, 2, 0xff},
+		}
+		out, err := ParseEnvelope(in.MarshalBinary())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Peer != in.Peer || out.ConversationID != in.ConversationID || out.Timestamp != in.Timestamp ||
+			out.Queued != queued || !bytes.Equal(out.Payload, in.Payload) {
+			t.Fatalf("round trip: got %+v, want %+v", out, in)
+		}
+	}
+}
+
+func TestParseEnvelopeWithoutFlags(t *testing.T) {
+	// Clients written against the original layout send a 42-byte header
+	peer := uuid.Must(uuid.NewV4())
+	b := make([]byte, 2+envelopeMinHeaderLen+3)
+	binary.BigEndian.PutUint16(b, envelopeMinHeaderLen)
+	b[2] = envelopeVersion
+	b[3] = EnvelopeTypeMessage
+	copy(b[4:20], peer.Bytes())
+	copy(b[2+envelopeMinHeaderLen:], "abc")
+
+	e, err := ParseEnvelope(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Peer != peer || e.Queued || string(e.Payload) != "abc" {
+		t.Fatalf("got %+v", e)
+	}
+}
+
+func TestParseEnvelopeRejectsShortHeader(t *testing.T) {
+	b := make([]byte, 2+envelopeMinHeaderLen-1)
+	binary.BigEndian.PutUint16(b, envelopeMinHeaderLen-1)
+	b[2] = envelopeVersion
+	if _, err := ParseEnvelope(b); err != ErrBadEnvelope {
+		t.Fatalf("err = %v, want ErrBadEnvelope", err)
+	}
+}
+
+func TestEnvelopeJSONPassesTextPayloadThrough(t *testing.T) {
+	payload := `{"ciphertext":"abc","iv":"def"}`
+	b, err := json.Marshal(&Envelope{Peer: uuid.Must(uuid.NewV4()), Payload: []byte(payload), Queued: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame map[string]interface{}
+	if err := json.Unmarshal(b, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame["payload"] != payload || frame["queued"] != true {
+		t.Fatalf("frame = %v", frame)
+	}
+	if _, ok := frame["payload_encoding"]; ok {
+		t.Fatal("text payload marked as encoded")
+	}
+}
+
+func TestEnvelopeJSONEncodesBinaryPayload(t *testing.T) {
+	raw := []byte{0xff, 0xfe, 0x00}
+	b, _ := json.Marshal(&Envelope{Peer: uuid.Must(uuid.NewV4()), Payload: raw})
+	var frame map[string]interface{}
+	if err := json.Unmarshal(b, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame["payload_encoding"] != "base64" || frame["payload"] != base64.StdEncoding.EncodeToString(raw) {
+		t.Fatalf("frame = %v", frame)
+	}
+}
+
+func TestRecipientPayloadsRoundTrip(t *testing.T) {
+	bob, carol := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	in := map[uuid.UUID][]byte{bob: []byte("for bob"), carol: {}}
+	out, err := ParseRecipientPayloads(MarshalRecipientPayloads(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || string(out[bob]) != "for bob" || len(out[carol]) != 0 {
+		t.Fatalf("payloads = %q", out)
+	}
+}
+
+func TestParseRecipientPayloadsRejectsMalformed(t *testing.T) {
+	bob := uuid.Must(uuid.NewV4())
+	one := MarshalRecipientPayloads(map[uuid.UUID][]byte{bob: []byte("ct")})
+	for name, b := range map[string][]byte{
+		"short record":   one[:10],
+		"truncated":      one[:len(one)-1],
+		"duplicate":      append(append([]byte{}, one...), one...),
+		"trailing bytes": append(append([]byte{}, one...), 1, 2, 3),
+	} {
+		if _, err := ParseRecipientPayloads(b); err != ErrBadRecipientPayloads {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
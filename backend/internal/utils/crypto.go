@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"os"
@@ -26,10 +30,22 @@ func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
 	return key, err
 }
 
-// Decrypt envelope created with RSA-OAEP SHA256
+// ErrDecrypt is the only error RSADecrypt returns, so callers can't become a
+// padding oracle by distinguishing size, padding and key failures
+var ErrDecrypt = errors.New("decryption failed")
+
+// Decrypt envelope created with RSA-OAEP SHA256. Ciphertext must be exactly
+// the modulus size; the OAEP padding check itself is constant-time.
 func RSADecrypt(priv *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != priv.Size() {
+		return nil, ErrDecrypt
+	}
 	label := []byte("")
-	return rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, ciphertext, label)
+	pt, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, ciphertext, label)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return pt, nil
 }
 
 // Verify Ed25519 signature
@@ -42,3 +58,108 @@ func VerifyEd25519(pub []byte, message []byte, sig []byte) bool {
 	}
 	return ed25519.Verify(ed25519.PublicKey(pub), message, sig)
 }
+
+// Parse an RSA public key from PEM (PKIX/SPKI or PKCS#1)
+func ParseRSAPublicKey(b []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	if pub, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return pub, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return pub, nil
+}
+
+// SealedEnvelope is a hybrid-encrypted payload: a random AES-256-GCM key
+// wrapped with RSA-OAEP SHA256, plus the GCM nonce and ciphertext.
+type SealedEnvelope struct {
+	WrappedKey []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Encrypt plaintext to an RSA public key using RSA-OAEP SHA256 + AES-256-GCM
+func SealForRSAPublicKey(pub *rsa.PublicKey, plaintext []byte) (*SealedEnvelope, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(""))
+	if err != nil {
+		return nil, err
+	}
+	return &SealedEnvelope{
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// bundleDomain separates bundle signatures from any other use of the server key
+const bundleDomain = "securechat-bundle-v1"
+
+// BundleSigningMessage builds the byte string covered by a bundle signature:
+// the domain tag followed by each field as a 4-byte big-endian length and the
+// raw bytes. Length prefixes stop fields from being shifted between slots.
+func BundleSigningMessage(fields ...[]byte) []byte {
+	return lengthPrefixed(bundleDomain, fields...)
+}
+
+func lengthPrefixed(domain string, fields ...[]byte) []byte {
+	msg := []byte(domain)
+	var n [4]byte
+	for _, f := range fields {
+		binary.BigEndian.PutUint32(n[:], uint32(len(f)))
+		msg = append(msg, n[:]...)
+		msg = append(msg, f...)
+	}
+	return msg
+}
+
+// signedPreKeyDomain separates signed-prekey signatures from anything else
+// the client's signing key signs
+const signedPreKeyDomain = "securechat-spk-v1"
+
+// SignedPreKeyID is the key ID signed prekeys are stored and signed under
+// when the client doesn't choose one
+const SignedPreKeyID = "signed-prekey-v1"
+
+// SignedPreKeyMessage builds the byte string a client signs for a signed
+// prekey: "securechat-spk-v1" || len(keyID) || keyID || len(spk) || spk, with
+// 4-byte big-endian lengths. Signatures over the bare key are not accepted.
+func SignedPreKeyMessage(keyID string, spk []byte) []byte {
+	return lengthPrefixed(signedPreKeyDomain, []byte(keyID), spk)
+}
+
+// Sign bundle fields with RSA-PSS SHA256 (salt length = hash length, as Web Crypto expects)
+func SignBundle(priv *rsa.PrivateKey, fields ...[]byte) ([]byte, error) {
+	digest := sha256.Sum256(BundleSigningMessage(fields...))
+	return rsa.SignPSS(rand.Reader, priv, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+}
+
+// Verify a bundle signature produced by SignBundle
+func VerifyBundle(pub *rsa.PublicKey, sig []byte, fields ...[]byte) bool {
+	digest := sha256.Sum256(BundleSigningMessage(fields...))
+	return rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+}
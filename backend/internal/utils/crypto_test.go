@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testRSAKey is one key shared by every test, since generating one per test is slow
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return testKey
+}
+
+func TestBundleSignatureRoundTrip(t *testing.T) {
+	priv := testRSAKey(t)
+	fields := [][]byte{[]byte("user"), []byte("identity"), []byte("spk"), []byte("spk-sig"), []byte("otk")}
+	sig, err := SignBundle(priv, fields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyBundle(&priv.PublicKey, sig, fields...) {
+		t.Fatal("signature does not verify")
+	}
+
+	// Changing, dropping or shifting bytes between fields breaks it
+	for name, tampered := range map[string][][]byte{
+		"changed field":  {[]byte("user"), []byte("identitX"), []byte("spk"), []byte("spk-sig"), []byte("otk")},
+		"no one-time":    {[]byte("user"), []byte("identity"), []byte("spk"), []byte("spk-sig"), nil},
+		"shifted bytes":  {[]byte("user"), []byte("identitys"), []byte("pk"), []byte("spk-sig"), []byte("otk")},
+		"swapped fields": {[]byte("user"), []byte("spk"), []byte("identity"), []byte("spk-sig"), []byte("otk")},
+	} {
+		if VerifyBundle(&priv.PublicKey, sig, tampered...) {
+			t.Errorf("%s: signature still verifies", name)
+		}
+	}
+}
+
+func TestRSADecryptFailuresAreOpaque(t *testing.T) {
+	priv := testRSAKey(t)
+	valid, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, []byte("envelope"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := RSADecrypt(priv, valid); err != nil || string(pt) != "envelope" {
+		t.Fatalf("valid ciphertext: %q, %v", pt, err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, _ := rsa.EncryptOAEP(sha256.New(), rand.Reader, &other.PublicKey, []byte("envelope"), nil)
+	garbage := make([]byte, priv.Size())
+	rand.Read(garbage)
+	flipped := append([]byte(nil), valid...)
+	flipped[len(flipped)-1] ^= 1
+
+	for name, ct := range map[string][]byte{
+		"empty":     nil,
+		"short":     valid[:len(valid)-1],
+		"oversized": append(append([]byte(nil), valid...), 0),
+		"huge":      make([]byte, 1<<20),
+		"malformed": garbage,
+		"tampered":  flipped,
+		"wrong key": wrongKey,
+	} {
+		pt, err := RSADecrypt(priv, ct)
+		if err != ErrDecrypt || pt != nil {
+			t.Errorf("%s: %q, %v; want only ErrDecrypt", name, pt, err)
+		}
+	}
+}
+
+func TestSignedPreKeyMessageIsLengthPrefixed(t *testing.T) {
+	msg := SignedPreKeyMessage("id", []byte{0xaa, 0xbb})
+	want := append([]byte("securechat-spk-v1"), 0, 0, 0, 2, 'i', 'd', 0, 0, 0, 2, 0xaa, 0xbb)
+	if string(msg) != string(want) {
+		t.Fatalf("message = %x, want %x", msg, want)
+	}
+	// Moving bytes between the key ID and the key changes the message
+	if string(SignedPreKeyMessage("ab", []byte("c"))) == string(SignedPreKeyMessage("a", []byte("bc"))) {
+		t.Fatal("fields are ambiguous")
+	}
+}
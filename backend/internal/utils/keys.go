@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	mrand "math/rand"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Reasons ValidateX25519PublicKey rejects a key. The messages are safe to
+// return to clients.
+var (
+	ErrKeyLength       = errors.New("wrong_length")
+	ErrKeyNonCanonical = errors.New("non_canonical")
+	ErrKeyLowOrder     = errors.New("low_order")
+)
+
+// probeScalar is any fixed scalar; after clamping it is a multiple of the
+// cofactor, so multiplying a low-order point by it yields the identity
+var probeScalar = [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
+
+// ValidateX25519PublicKey rejects encodings that X25519 would silently
+// accept but that can't be an honest identity key: the unused top bit set, a
+// u-coordinate of p or above, and points of small order (including zero),
+// whose shared secrets are predictable.
+func ValidateX25519PublicKey(pub []byte) error {
+	if len(pub) != curve25519.PointSize {
+		return ErrKeyLength
+	}
+	if pub[31]&0x80 != 0 || !belowFieldPrime(pub) {
+		return ErrKeyNonCanonical
+	}
+	if _, err := curve25519.X25519(probeScalar[:], pub); err != nil {
+		return ErrKeyLowOrder
+	}
+	return nil
+}
+
+// belowFieldPrime reports whether the little-endian u is less than 2^255-19
+func belowFieldPrime(u []byte) bool {
+	if u[31] != 0x7f {
+		return true
+	}
+	for i := 30; i >= 1; i-- {
+		if u[i] != 0xff {
+			return true
+		}
+	}
+	return u[0] < 0xed
+}
+
+// MaxRegistrationID is the largest Signal registration ID (14 bits)
+const MaxRegistrationID = 16383
+
+// ValidRegistrationID reports whether id is a usable Signal registration ID.
+// Zero is reserved, and larger values don't fit the protocol's 14 bits.
+func ValidRegistrationID(id int) bool {
+	return id >= 1 && id <= MaxRegistrationID
+}
+
+// FreeRegistrationID picks a random registration ID not in used. It returns
+// false only when every ID is taken.
+func FreeRegistrationID(used map[int]bool) (int, bool) {
+	for i := 0; i < 16; i++ {
+		if id := 1 + mrand.Intn(MaxRegistrationID); !used[id] {
+			return id, true
+		}
+	}
+	for id := 1; id <= MaxRegistrationID; id++ {
+		if !used[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestValidateX25519PublicKey(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateX25519PublicKey(priv.PublicKey().Bytes()); err != nil {
+			t.Fatalf("generated key %x: %v", priv.PublicKey().Bytes(), err)
+		}
+	}
+
+	// Small-order points and out-of-range encodings, as listed by libsodium
+	for _, tc := range []struct {
+		name, hex string
+		want      error
+	}{
+		{"zero", "0000000000000000000000000000000000000000000000000000000000000000", ErrKeyLowOrder},
+		{"one", "0100000000000000000000000000000000000000000000000000000000000000", ErrKeyLowOrder},
+		{"order 8", "e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800", ErrKeyLowOrder},
+		{"order 8, other", "5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157", ErrKeyLowOrder},
+		{"p-1", "ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", ErrKeyLowOrder},
+		{"p", "edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", ErrKeyNonCanonical},
+		{"p+1", "eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", ErrKeyNonCanonical},
+		{"top bit set", "0900000000000000000000000000000000000000000000000000000000000080", ErrKeyNonCanonical},
+		{"short", "0900", ErrKeyLength},
+		{"long", "090000000000000000000000000000000000000000000000000000000000000000", ErrKeyLength},
+	} {
+		pub, err := hex.DecodeString(tc.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateX25519PublicKey(pub); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// The base point itself is a valid key
+	base, _ := hex.DecodeString("0900000000000000000000000000000000000000000000000000000000000000")
+	if err := ValidateX25519PublicKey(base); err != nil {
+		t.Fatalf("base point: %v", err)
+	}
+}
+
+func TestValidRegistrationID(t *testing.T) {
+	for id, want := range map[int]bool{-1: false, 0: false, 1: true, 8000: true, MaxRegistrationID: true, MaxRegistrationID + 1: false, 1 << 20: false} {
+		if got := ValidRegistrationID(id); got != want {
+			t.Errorf("ValidRegistrationID(%d) = %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestFreeRegistrationIDSkipsUsed(t *testing.T) {
+	used := make(map[int]bool, MaxRegistrationID)
+	for id := 1; id <= MaxRegistrationID; id++ {
+		used[id] = true
+	}
+	if id, ok := FreeRegistrationID(used); ok {
+		t.Fatalf("got %d with every ID taken", id)
+	}
+
+	// With one gap left the random picks almost always miss, so the scan finds it
+	delete(used, 4242)
+	if id, ok := FreeRegistrationID(used); !ok || id != 4242 {
+		t.Fatalf("got %d, %t, want the only free ID", id, ok)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SelfTest exercises the primitives the server depends on: the system RNG,
+// Ed25519 signing as checked by VerifyEd25519, and an RSA-OAEP round-trip
+// through priv. It is run at startup so a broken key or RNG fails loudly
+// before any traffic is served.
+func SelfTest(priv *rsa.PrivateKey) error {
+	if err := checkRandom(rand.Reader); err != nil {
+		return err
+	}
+
+	pub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("ed25519 keygen: %w", err)
+	}
+	msg := []byte("securechat-self-test")
+	sig := ed25519.Sign(edPriv, msg)
+	if !VerifyEd25519(pub, msg, sig) {
+		return errors.New("ed25519: valid signature rejected")
+	}
+	sig[0] ^= 0xff
+	if VerifyEd25519(pub, msg, sig) {
+		return errors.New("ed25519: tampered signature accepted")
+	}
+
+	if priv == nil {
+		return errors.New("rsa: no server key")
+	}
+	if err := priv.Validate(); err != nil {
+		return fmt.Errorf("rsa: invalid server key: %w", err)
+	}
+	ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, msg, []byte(""))
+	if err != nil {
+		return fmt.Errorf("rsa-oaep encrypt: %w", err)
+	}
+	pt, err := RSADecrypt(priv, ct)
+	if err != nil {
+		return fmt.Errorf("rsa-oaep decrypt: %w", err)
+	}
+	if !bytes.Equal(pt, msg) {
+		return errors.New("rsa-oaep: round-trip mismatch")
+	}
+	return nil
+}
+
+// checkRandom catches an RNG that errors or returns constant output
+func checkRandom(r io.Reader) error {
+	a := make([]byte, 32)
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(r, a); err != nil {
+		return fmt.Errorf("crypto/rand: %w", err)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("crypto/rand: %w", err)
+	}
+	if bytes.Equal(a, b) || bytes.Equal(a, make([]byte, 32)) {
+		return errors.New("crypto/rand: output is not random")
+	}
+	return nil
+}
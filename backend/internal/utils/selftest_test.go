@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestPassesWithGoodKey(t *testing.T) {
+	if err := SelfTest(testRSAKey(t)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfTestFailsWithBrokenKey(t *testing.T) {
+	good := testRSAKey(t)
+
+	// A private exponent that no longer matches the public key
+	broken := *good
+	broken.D = new(big.Int).Add(good.D, big.NewInt(2))
+	if err := SelfTest(&broken); err == nil || !strings.Contains(err.Error(), "rsa") {
+		t.Fatalf("broken exponent: err = %v", err)
+	}
+
+	// A public key swapped in from a different keypair
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := *good
+	mismatched.PublicKey = other.PublicKey
+	if err := SelfTest(&mismatched); err == nil || !strings.Contains(err.Error(), "rsa") {
+		t.Fatalf("mismatched public key: err = %v", err)
+	}
+
+	if err := SelfTest(nil); err == nil {
+		t.Fatal("nil key passed")
+	}
+}
+
+func TestCheckRandomRejectsBrokenReader(t *testing.T) {
+	if err := checkRandom(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRandom(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Fatal("constant output accepted")
+	}
+	if err := checkRandom(bytes.NewReader(make([]byte, 16))); err == nil {
+		t.Fatal("short read accepted")
+	}
+}
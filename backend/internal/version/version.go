@@ -0,0 +1,13 @@
+// Package version holds build metadata injected at link time, e.g.
+//
+//	go build -ldflags "-X github.com/securechat/backend/internal/version.Commit=$(git rev-parse --short HEAD)"
+package version
+
+import "runtime"
+
+var (
+	Commit    = "unknown"
+	BuildTime = "unknown"
+	// GoVersion defaults to the toolchain that built the binary
+	GoVersion = runtime.Version()
+)
@@ -1,6 +1,7 @@
 import * as nacl from 'tweetnacl'
 import { encodeBase64, decodeBase64 } from 'tweetnacl-util'
 import { db } from '../services/db'
+import { signedPreKeyMessage, SIGNED_PREKEY_ID } from './signedPrekey'
 
 /**
  * Simplified E2EE implementation using NaCl
@@ -117,9 +118,9 @@ export class CryptoEngine {
     const keyPair = nacl.box.keyPair()
     const keyId = `${this.deviceId}_signed`
     
-    // Sign the public key with signing private key
+    // Sign the domain-separated prekey message (see signedPrekey.ts)
     const signature = nacl.sign.detached(
-      keyPair.publicKey,
+      signedPreKeyMessage(SIGNED_PREKEY_ID, keyPair.publicKey),
       this.signingKeyPair.secretKey
     )
     
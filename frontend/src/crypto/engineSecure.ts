@@ -1,6 +1,7 @@
 import * as nacl from 'tweetnacl'
 import { encodeBase64, decodeBase64 } from 'tweetnacl-util'
 import { db } from '../services/db'
+import { signedPreKeyMessage, SIGNED_PREKEY_ID } from './signedPrekey'
 import {
     SessionState,
     createSessionState,
@@ -338,7 +339,7 @@ export class SecureCryptoEngine {
         const keyId = `${this.deviceId}_signed`
 
         const signature = nacl.sign.detached(
-            keyPair.publicKey,
+            signedPreKeyMessage(SIGNED_PREKEY_ID, keyPair.publicKey),
             this.signingKeyPair.secretKey
         )
 
@@ -0,0 +1,27 @@
+/**
+ * Signed prekey signatures cover a domain-separated message rather than the
+ * bare key, so the signing key can't be tricked into signing something that
+ * verifies as a prekey elsewhere. Must match SignedPreKeyMessage on the server:
+ * "securechat-spk-v1" || len(keyId) || keyId || len(key) || key, with 4-byte
+ * big-endian lengths.
+ */
+export const SIGNED_PREKEY_DOMAIN = 'securechat-spk-v1'
+export const SIGNED_PREKEY_ID = 'signed-prekey-v1'
+
+export function signedPreKeyMessage(keyId: string, publicKey: Uint8Array): Uint8Array {
+  const encoder = new TextEncoder()
+  const domain = encoder.encode(SIGNED_PREKEY_DOMAIN)
+  const id = encoder.encode(keyId)
+  const out = new Uint8Array(domain.length + 4 + id.length + 4 + publicKey.length)
+  const view = new DataView(out.buffer)
+  let offset = 0
+  out.set(domain, offset)
+  offset += domain.length
+  for (const field of [id, publicKey]) {
+    view.setUint32(offset, field.length)
+    offset += 4
+    out.set(field, offset)
+    offset += field.length
+  }
+  return out
+}
@@ -68,6 +68,15 @@ export const authService = {
     return response.data
   },
 
+  async rotateSignedPreKey(data: {
+    device_id?: string
+    signed_prekey: string
+    signed_prekey_signature: string
+  }): Promise<{ status: string; device_id: string }> {
+    const response = await api.post('/api/keys/signed-prekey', data)
+    return response.data
+  },
+
   async getKeyBundle(userId: string): Promise<KeyBundleResponse> {
     const response = await api.get(`/api/keys/bundle/${userId}`)
     return response.data